@@ -1,162 +1,236 @@
 package main
 
 import (
-	"bytes"
 	"crypto/sha256"
-	"crypto/tls"
 	"encoding/hex"
 	"errors"
-	"fmt"
+	"hash"
 	"io"
 	"log"
-	"mime"
-	"net/http"
+	"net"
+	"net/url"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/sankalpmukim/httpfromtcp/internal/client"
+	"github.com/sankalpmukim/httpfromtcp/internal/fileserver"
 	"github.com/sankalpmukim/httpfromtcp/internal/headers"
+	"github.com/sankalpmukim/httpfromtcp/internal/http2"
+	"github.com/sankalpmukim/httpfromtcp/internal/proxy"
 	"github.com/sankalpmukim/httpfromtcp/internal/request"
 	"github.com/sankalpmukim/httpfromtcp/internal/response"
 	"github.com/sankalpmukim/httpfromtcp/internal/server"
+	"github.com/sankalpmukim/httpfromtcp/internal/sse"
+	"github.com/sankalpmukim/httpfromtcp/internal/websocket"
 )
 
-const port = 42069
+const (
+	port    = 42069
+	tlsPort = 42443
+)
 
-func main() {
-	server.ShuttingDown.Store(false)
+// httpBinPool is where /httpbin goes. It has a single upstream, but its
+// state shows up at /admin/upstreams all the same.
+var httpBinPool = proxy.NewPool(proxy.RoundRobin, &proxy.Upstream{
+	URL:     &url.URL{Scheme: "https", Host: "httpbin.org"},
+	Breaker: &proxy.CircuitBreaker{FailureThreshold: 5, OpenDuration: 30 * time.Second},
+})
+
+// /httpbin/... is passed on to https://httpbin.org/...
+var httpBinProxy = &proxy.ReverseProxy{
+	Pool:           httpBinPool,
+	StripPrefix:    "/httpbin",
+	ModifyResponse: addChecksumTrailers,
+	// httpbin can be slow, don't let that hold requests up forever
+	Client: &client.Client{
+		DialTimeout:           5 * time.Second,
+		ResponseHeaderTimeout: 15 * time.Second,
+		Timeout:               time.Minute,
+	},
+	Retry: proxy.RetryPolicy{Max: 2, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second},
+}
+
+// /admin/upstreams reports the state of the proxy's pools, to clients on
+// this machine only.
+var upstreamsAdmin = proxy.AdminHandler(map[string]*proxy.Pool{"httpbin": httpBinPool})
+
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// staticFiles serves everything no other route takes from the
+// static-file-server directory, /about from about.html included. Setting
+// STATIC_LISTINGS lists the directories without an index.html.
+var staticFiles = &fileserver.FileServer{
+	Root:           os.DirFS("static-file-server"),
+	HTMLExtensions: true,
+	Listings:       os.Getenv("STATIC_LISTINGS") != "",
+}
+
+// sites picks the site by the Host header, or by the target for proxy
+// clients: static.localhost serves nothing but the static files, every
+// other host gets all the routes of handle.
+var sites = newSites()
+
+func newSites() *server.VirtualHosts {
+	vhosts := server.NewVirtualHosts()
+	if err := vhosts.Add("static.localhost", staticFiles.Handle); err != nil {
+		log.Fatalf("Error adding virtual host: %v", err)
+	}
+	vhosts.Default = handle
+	return vhosts
+}
+
+// forwardProxy serves requests from clients using us as a proxy, as in
+// curl -x localhost:42069. PROXY_ALLOW lists the destinations it may reach,
+// comma separated (httpbin.org by default), and PROXY_USER with
+// PROXY_PASSWORD turn on proxy authentication.
+var forwardProxy = newForwardProxy()
+
+func newForwardProxy() *proxy.ForwardProxy {
+	allow := os.Getenv("PROXY_ALLOW")
+	if allow == "" {
+		allow = "httpbin.org"
+	}
+	f := &proxy.ForwardProxy{Client: &client.Client{DialTimeout: 5 * time.Second, Timeout: time.Minute}}
+	for entry := range strings.SplitSeq(allow, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			f.Allowlist = append(f.Allowlist, entry)
+		}
+	}
+	if user := os.Getenv("PROXY_USER"); user != "" {
+		f.Authenticate = proxy.CheckPassword(user, os.Getenv("PROXY_PASSWORD"))
+	}
+	return f
+}
+
+// /ws/echo sends every WebSocket message back as it came, which is what the
+// Autobahn test suite runs against.
+var echoUpgrader = &websocket.Upgrader{
+	EnableCompression: true,
+	// Autobahn connects from its own origin
+	CheckOrigin: func(req *request.Request) bool { return true },
+}
 
-	srv, err := server.Serve(port, func(w *response.Writer, req *request.Request) {
-		switch req.RequestLine.RequestTarget {
-		case "/yourproblem":
-			w.WriteStatusLine(response.BadRequest)
-			h := response.GetDefaultHeaders(len(BadRequestTemplate))
-			h["content-type"] = "text/html"
-			w.WriteHeaders(h)
-			w.WriteBody([]byte(BadRequestTemplate))
-
-		case "/myproblem":
-			w.WriteStatusLine(response.InternalServerError)
-			h := response.GetDefaultHeaders(len(InternalServerErrorTemplate))
-			h["content-type"] = "text/html"
-			w.WriteHeaders(h)
-			w.WriteBody([]byte(InternalServerErrorTemplate))
-
-		default:
-			if after, ok := strings.CutPrefix(req.RequestLine.RequestTarget, "/httpbin"); ok {
-				httpBinTarget := fmt.Sprintf("https://httpbin.org%s", after)
-				var reqBody io.Reader = nil
-				if req.Headers.Get("content-length") != "" {
-					reqBody = bytes.NewReader(req.Body)
-				}
-				binRequest, _ := http.NewRequest(req.RequestLine.Method, httpBinTarget, reqBody)
-				for k, v := range req.Headers {
-					binRequest.Header.Set(k, v)
-				}
-				tr := &http.Transport{
-					TLSNextProto: make(map[string]func(string, *tls.Conn) http.RoundTripper), // Disable HTTP/2
-				}
-
-				// Create a custom Client using the custom Transport
-				client := &http.Client{Transport: tr}
-
-				resp, _ := client.Do(binRequest)
-				w.WriteStatusLine(response.StatusCode(resp.StatusCode))
-				toSendHeaders := (headers.ConvertInbuiltHeadersToOurHeaders(resp.Header))
-				toSendHeaders["Connection"] = "close"
-
-				if len(resp.TransferEncoding) != 0 {
-					toSendHeaders["Transfer-Encoding"] = "chunked"
-					toSendHeaders["Trailer"] = "X-Content-SHA256, X-Content-Length"
-					delete(toSendHeaders, "content-length")
-					w.WriteHeaders(toSendHeaders)
-					fmt.Println("chunked encoding mode")
-					hasher := sha256.New()
-					var totalLength int64
-
-					buf := make([]byte, 32*1024)
-
-					for {
-						n, err := resp.Body.Read(buf)
-						if n > 0 {
-							chunk := buf[:n]
-
-							hasher.Write(chunk)
-							totalLength += int64(n)
-
-							w.WriteChunkedBody(chunk)
-						}
-
-						if err == io.EOF {
-							break
-						}
-					}
-					trailers := headers.NewHeaders()
-					hashString := hex.EncodeToString(hasher.Sum(nil))
-
-					trailers["X-Content-SHA256"] = hashString
-					trailers["X-Content-Length"] = strconv.FormatInt(totalLength, 10)
-					w.WriteTrailers(trailers)
-				} else {
-					w.WriteHeaders(toSendHeaders)
-					fmt.Println("Not chunked encoding mode")
-					body, _ := io.ReadAll(resp.Body)
-					w.WriteBody(body)
-				}
-				fmt.Printf("Protocol: %s\n", resp.Proto)
-			} else if req.RequestLine.RequestTarget == "/video" {
-				videoFileContents, err := os.ReadFile("assets/vim.mp4")
-				if errors.Is(err, os.ErrNotExist) {
-					w.WriteStatusLine(response.NotFound)
-					w.WriteHeaders(response.GetDefaultHeaders(0))
-				}
-				h := response.GetDefaultHeaders(len(videoFileContents))
-				h["Content-Type"] = "video/mp4"
-				w.WriteStatusLine(response.OK)
-				w.WriteHeaders(h)
-				w.WriteBody(videoFileContents)
-			} else {
-				// 	w.WriteStatusLine(response.OK)
-				// 	h := response.GetDefaultHeaders(len(OkTemplate))
-				// 	h["content-type"] = "text/html"
-				// 	w.WriteHeaders(h)
-				// 	w.WriteBody([]byte(OkTemplate))
-				fileName := fmt.Sprintf("static-file-server%s", req.RequestLine.RequestTarget)
-				if strings.HasSuffix(fileName, "/") {
-					fileName += "index"
-				}
-				file, err := os.ReadFile(fileName)
-				ext := filepath.Ext(req.RequestLine.RequestTarget)
-				if errors.Is(err, os.ErrNotExist) {
-					// try for html file
-					file, err = os.ReadFile(fmt.Sprintf("%s.html", fileName))
-				}
-				if errors.Is(err, os.ErrNotExist) {
-					w.WriteStatusLine(response.NotFound)
-					w.WriteHeaders(response.GetDefaultHeaders(0))
-				} else {
-					if ext == "" {
-						ext = "html"
-					}
-					mimeType := mime.TypeByExtension(ext)
-					w.WriteStatusLine(response.OK)
-					h := response.GetDefaultHeaders(len(file))
-					h["Content-Type"] = mimeType
-					w.WriteHeaders(h)
-					w.WriteBody(file)
-				}
+func echoWebSocket(w *response.Writer, req *request.Request) {
+	conn, err := echoUpgrader.Upgrade(w, req)
+	if err != nil {
+		log.Println("Error upgrading to WebSocket:", err)
+		return
+	}
+	go func() {
+		for {
+			typ, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(typ, msg); err != nil {
+				return
 			}
 		}
-	})
+	}()
+}
+
+// clientAuthRoutes says which routes of the HTTPS server need a client
+// certificate: /whoami, to show who it says the client is.
+var clientAuthRoutes = newClientAuthRoutes()
+
+func newClientAuthRoutes() *server.ClientAuthRoutes {
+	routes := server.NewClientAuthRoutes()
+	routes.Add("/whoami", server.ClientAuth{Policy: server.ClientCertRequire})
+	return routes
+}
+
+// whoami answers with the identity of the client's certificate.
+func whoami(w *response.Writer, req *request.Request) {
+	if req.Identity == nil {
+		server.WriteError(w, server.HandleError{StatusCode: response.Forbidden, Message: "a client certificate is required"})
+		return
+	}
+	body := req.Identity.Name + "\n"
+	w.WriteStatusLine(response.OK)
+	h := response.GetDefaultHeaders(len(body))
+	h["content-type"] = "text/plain"
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
+
+// /events streams the server's clock as Server-Sent Events, one a second.
+var clockEvents = &sse.Broker{ReplaySize: 60}
+
+func publishClock() {
+	for now := range time.Tick(time.Second) {
+		clockEvents.Publish(sse.Event{Event: "time", Data: now.UTC().Format(time.RFC3339)})
+	}
+}
+
+// addChecksumTrailers makes chunked responses end with the SHA-256 and the
+// length of their body as trailers.
+func addChecksumTrailers(resp *client.Response) error {
+	if resp.Headers.Get("transfer-encoding") == "" {
+		return nil
+	}
+	resp.Headers["trailer"] = "X-Content-SHA256, X-Content-Length"
+	resp.BodyReader = &checksumReader{r: resp.BodyReader, hash: sha256.New(), trailers: resp.Trailers}
+	return nil
+}
+
+type checksumReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	length   int64
+	trailers headers.Headers
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	c.length += int64(n)
+	if errors.Is(err, io.EOF) {
+		c.trailers["X-Content-SHA256"] = hex.EncodeToString(c.hash.Sum(nil))
+		c.trailers["X-Content-Length"] = strconv.FormatInt(c.length, 10)
+	}
+	return n, err
+}
+
+// streamToHTTPBin leaves the bodies of requests for /httpbin on the
+// connection, so uploads are passed on as they come in rather than held.
+func streamToHTTPBin(req *request.Request) bool {
+	return strings.HasPrefix(request.OriginForm(req.RequestLine.RequestTarget), "/httpbin")
+}
+
+func main() {
+	server.ShuttingDown.Store(false)
+	go publishClock()
+
+	options := server.Options{Strict: true, HTTP2: &http2.Server{}, StreamBody: streamToHTTPBin}
+	srv, err := server.ServeWithOptions(port, options, sites.Handle)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
 	defer srv.Close()
 	log.Println("Server started on port", port)
 
+	if tlsOptions := tlsOptionsFromEnv(); tlsOptions != nil {
+		options.TLS = tlsOptions
+		tlsSrv, err := server.ServeWithOptions(tlsPort, options, clientAuthRoutes.Wrap(sites.Handle))
+		if err != nil {
+			log.Fatalf("Error starting HTTPS server: %v", err)
+		}
+		defer tlsSrv.Close()
+		log.Println("HTTPS server started on port", tlsPort)
+		go reloadOnSIGHUP(tlsSrv)
+	}
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
@@ -164,3 +238,114 @@ func main() {
 
 	log.Println("Server gracefully stopped")
 }
+
+// tlsOptionsFromEnv turns HTTPS on when TLS_CERT and TLS_KEY name a
+// certificate and its key (comma separated lists for several hostnames),
+// or with a self-signed certificate when TLS_DEV is set. TLS_CLIENT_CA
+// names the CA bundle client certificates are verified against.
+func tlsOptionsFromEnv() *server.TLSOptions {
+	certs, keys := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+	if certs == "" {
+		if os.Getenv("TLS_DEV") == "" {
+			return nil
+		}
+		return &server.TLSOptions{SelfSigned: true, ClientCAFile: os.Getenv("TLS_CLIENT_CA")}
+	}
+	certFiles, keyFiles := strings.Split(certs, ","), strings.Split(keys, ",")
+	if len(certFiles) != len(keyFiles) {
+		log.Fatalf("TLS_CERT lists %d files but TLS_KEY %d", len(certFiles), len(keyFiles))
+	}
+	options := &server.TLSOptions{ClientCAFile: os.Getenv("TLS_CLIENT_CA")}
+	for i := range certFiles {
+		options.Certificates = append(options.Certificates, server.CertificateFiles{
+			CertFile: strings.TrimSpace(certFiles[i]),
+			KeyFile:  strings.TrimSpace(keyFiles[i]),
+		})
+	}
+	return options
+}
+
+// reloadOnSIGHUP reloads the certificates whenever the process gets a
+// SIGHUP, so renewed ones are served without a restart.
+func reloadOnSIGHUP(srv *server.Server) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := srv.ReloadCertificates(); err != nil {
+			log.Println("Error reloading certificates:", err)
+			continue
+		}
+		log.Println("Certificates reloaded")
+	}
+}
+
+func handle(w *response.Writer, req *request.Request) {
+	if req.RequestLine.Method == request.MethodConnect || !strings.HasPrefix(req.RequestLine.RequestTarget, "/") {
+		forwardProxy.Handle(w, req)
+		return
+	}
+
+	switch req.RequestLine.RequestTarget {
+	case "/yourproblem":
+		w.WriteStatusLine(response.BadRequest)
+		h := response.GetDefaultHeaders(len(BadRequestTemplate))
+		h["content-type"] = "text/html"
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(BadRequestTemplate))
+
+	case "/events":
+		clockEvents.Handle(w, req)
+
+	case "/whoami":
+		whoami(w, req)
+
+	case "/admin/upstreams":
+		if !isLoopback(req.RemoteAddr) {
+			server.WriteError(w, server.HandleError{StatusCode: response.NotFound, Message: "not found"})
+			return
+		}
+		upstreamsAdmin(w, req)
+
+	case "/ws/echo":
+		echoWebSocket(w, req)
+
+	case "/myproblem":
+		w.WriteStatusLine(response.InternalServerError)
+		h := response.GetDefaultHeaders(len(InternalServerErrorTemplate))
+		h["content-type"] = "text/html"
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(InternalServerErrorTemplate))
+
+	default:
+		if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin") {
+			httpBinProxy.Handle(w, req)
+		} else if req.RequestLine.RequestTarget == "/video" {
+			serveFile(w, req, "assets/vim.mp4", headers.Headers{"content-type": "video/mp4"})
+		} else {
+			// 	w.WriteStatusLine(response.OK)
+			// 	h := response.GetDefaultHeaders(len(OkTemplate))
+			// 	h["content-type"] = "text/html"
+			// 	w.WriteHeaders(h)
+			// 	w.WriteBody([]byte(OkTemplate))
+			staticFiles.Handle(w, req)
+		}
+	}
+}
+
+// serveFile answers with the file at name, or the ranges of it asked for.
+func serveFile(w *response.Writer, req *request.Request, name string, h headers.Headers) {
+	file, err := os.Open(name)
+	if err != nil {
+		w.WriteStatusLine(response.NotFound)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		w.WriteStatusLine(response.NotFound)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		return
+	}
+	fileserver.ServeContent(w, req, name, info.ModTime(), file, h)
+}
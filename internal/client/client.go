@@ -0,0 +1,355 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/headers"
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+)
+
+// Client sends requests over TCP or TLS, writing them with
+// request.Request.WriteTo and reading the answers with response.ReadResponse.
+// It only speaks HTTP/1.1. Connections are kept alive and reused for later
+// requests to the same host. The zero value is ready to use.
+type Client struct {
+	// DialTimeout bounds connecting, TLS handshake included. Zero means
+	// only the context's deadline applies.
+	DialTimeout time.Duration
+	// ResponseHeaderTimeout bounds the time from starting to send the
+	// request to having the response's headers. Running into it fails with
+	// ErrResponseHeaderTimeout. Zero means no limit.
+	ResponseHeaderTimeout time.Duration
+	// Timeout bounds the whole exchange, up to the last byte of the
+	// response body. Zero means no limit.
+	Timeout time.Duration
+	// TLSConfig is used for https URLs. ServerName defaults to the URL's
+	// host.
+	TLSConfig *tls.Config
+
+	// DisableKeepAlives sends every request on a connection of its own,
+	// closed once the response is read.
+	DisableKeepAlives bool
+	// MaxIdleConns caps the idle connections kept across all hosts, and
+	// MaxIdleConnsPerHost those kept for a single host. Zero means 100 and
+	// 2 respectively.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost caps the connections to a single host, busy and idle
+	// ones alike. Requests past it wait for a connection to free up. Zero
+	// means no limit.
+	MaxConnsPerHost int
+	// IdleTimeout is how long an idle connection is kept before it's
+	// closed. Zero means 90 seconds.
+	IdleTimeout time.Duration
+
+	poolOnce sync.Once
+	pool     *pool
+}
+
+func (c *Client) maxIdleConns() int {
+	if c.MaxIdleConns > 0 {
+		return c.MaxIdleConns
+	}
+	return defaultMaxIdleConns
+}
+
+func (c *Client) maxIdleConnsPerHost() int {
+	if c.MaxIdleConnsPerHost > 0 {
+		return c.MaxIdleConnsPerHost
+	}
+	return defaultMaxIdleConnsPerHost
+}
+
+func (c *Client) idleTimeout() time.Duration {
+	if c.IdleTimeout > 0 {
+		return c.IdleTimeout
+	}
+	return defaultIdleTimeout
+}
+
+// CloseIdleConnections closes the connections sitting in the idle pool.
+// Connections in use are left alone.
+func (c *Client) CloseIdleConnections() {
+	c.getPool().closeIdle()
+}
+
+// ErrResponseHeaderTimeout is returned when the server took longer than
+// Client.ResponseHeaderTimeout to answer. It matches
+// context.DeadlineExceeded, like the other timeouts.
+var ErrResponseHeaderTimeout = fmt.Errorf("timeout awaiting response headers: %w", context.DeadlineExceeded)
+
+// Request is a request.Request plus where to send it.
+type Request struct {
+	*request.Request
+	URL *url.URL
+
+	// BodyReader, if set, is streamed to the server with chunked encoding
+	// in place of Request.Body.
+	BodyReader io.Reader
+}
+
+// NewRequest builds a request for an http or https URL. The request target
+// and Host header are taken from the URL.
+func NewRequest(method, rawURL string, body []byte) (*Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in %q", rawURL)
+	}
+
+	h := headers.NewHeaders()
+	h["host"] = u.Host
+	return &Request{
+		Request: &request.Request{
+			RequestLine: request.RequestLine{
+				Method:           method,
+				RequestTarget:    u.RequestURI(),
+				HttpVersion:      "1.1",
+				HttpVersionMajor: 1,
+				HttpVersionMinor: 1,
+			},
+			Headers:  h,
+			Body:     body,
+			Trailers: headers.NewHeaders(),
+		},
+		URL: u,
+	}, nil
+}
+
+// Response is a response whose body is still being streamed off the
+// connection. Close must be called once done with it, reading BodyReader to
+// the end does that as well.
+type Response struct {
+	*response.Response
+	body *body
+}
+
+func (r *Response) Close() error {
+	return r.body.Close()
+}
+
+// ReadBody reads the rest of the body into r.Body and closes the response.
+func (r *Response) ReadBody() error {
+	defer r.Close()
+	b, err := io.ReadAll(r.BodyReader)
+	r.Body = b
+	return err
+}
+
+// Do sends req and returns the response as soon as its headers are in.
+// Cancelling ctx, or running into Timeout, aborts the exchange at any
+// point, including while the body is being read.
+//
+// The connection goes back to the pool once the body has been read to the
+// end. If a pooled connection turns out to have been closed by the server
+// before any of the response came in, idempotent requests are retried once
+// on a fresh connection.
+func (c *Client) Do(ctx context.Context, req *Request) (*Response, error) {
+	var cancel context.CancelFunc
+	if c.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	p := c.getPool()
+	key := req.URL.Scheme + "://" + hostPort(req.URL)
+	dial := func(ctx context.Context) (net.Conn, error) { return c.dial(ctx, req.URL) }
+	for retried := false; ; retried = true {
+		pc, err := p.get(ctx, key, dial)
+		if err != nil {
+			err = contextError(ctx, err)
+			cancel()
+			return nil, err
+		}
+		// closing the connection is what unblocks any read or write in
+		// flight once the context is done
+		stop := context.AfterFunc(ctx, func() { pc.conn.Close() })
+
+		var headerTimer *time.Timer
+		if c.ResponseHeaderTimeout > 0 {
+			headerTimer = time.AfterFunc(c.ResponseHeaderTimeout, func() { pc.conn.Close() })
+		}
+		resp, err := c.roundTrip(pc, req)
+		if headerTimer != nil && !headerTimer.Stop() {
+			// the connection got closed under us, whatever we read is no good
+			err = ErrResponseHeaderTimeout
+		}
+		if err != nil {
+			stop()
+			p.discard(pc)
+			if !retried && pc.reused && ctx.Err() == nil && canRetry(req, err) {
+				continue
+			}
+			err = contextError(ctx, err)
+			cancel()
+			return nil, err
+		}
+
+		// a request that asked for the connection to be closed gets it closed
+		keepAlive := !c.DisableKeepAlives && !strings.EqualFold(req.Headers.Get("Connection"), "close") &&
+			req.RequestLine.ProtoAtLeast(1, 1)
+		b := &body{r: resp.BodyReader, ctx: ctx}
+		b.release = func(complete bool) {
+			// if stop reports the AfterFunc already ran, the connection is
+			// closed already
+			if stop() && complete && keepAlive && resp.ConnectionReusable() {
+				p.put(pc)
+			} else {
+				p.discard(pc)
+			}
+			cancel()
+		}
+		resp.BodyReader = b
+		return &Response{Response: resp, body: b}, nil
+	}
+}
+
+func (c *Client) roundTrip(pc *persistConn, req *Request) (*response.Response, error) {
+	// the headers we add only go on the wire, so the caller's request can
+	// be sent again as it is
+	wire := *req.Request
+	wire.Headers = maps.Clone(req.Headers)
+	if _, ok := wire.Headers["host"]; !ok {
+		wire.Headers["host"] = req.URL.Host
+	}
+	if c.DisableKeepAlives {
+		wire.Headers["connection"] = "close"
+	}
+
+	// both buffer what they write themselves, and a streamed body has
+	// every chunk flushed as it is read, which a bufio.Writer here would undo
+	var err error
+	if req.BodyReader != nil {
+		_, err = wire.WriteStreaming(pc.conn, req.BodyReader)
+	} else {
+		_, err = wire.WriteTo(pc.conn)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := response.ReadResponse(pc.br, req.RequestLine.Method)
+		if err != nil {
+			return nil, err
+		}
+		// interim responses have no body, just wait for the real one
+		code := resp.StatusLine.StatusCode
+		if code >= 100 && code < 200 && code != response.SwitchingProtocols {
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// canRetry reports whether req can safely be sent again after failing with
+// err on a reused connection: the request has to be idempotent and still
+// in memory, and the failure has to look like the server having closed the
+// connection while it sat idle, before it answered.
+func canRetry(req *Request, err error) bool {
+	if req.BodyReader != nil || !request.IsIdempotent(req.RequestLine.Method) {
+		return false
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+func (c *Client) dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	if c.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.DialTimeout)
+		defer cancel()
+	}
+
+	dialer := &net.Dialer{}
+	addr := hostPort(u)
+	if u.Scheme != "https" {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	config := &tls.Config{}
+	if c.TLSConfig != nil {
+		config = c.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = u.Hostname()
+	}
+	// we only speak HTTP/1.1, so don't let ALPN pick anything else
+	config.NextProtos = []string{"http/1.1"}
+	tlsDialer := &tls.Dialer{NetDialer: dialer, Config: config}
+	return tlsDialer.DialContext(ctx, "tcp", addr)
+}
+
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// contextError reports the context's error rather than whatever closing the
+// connection under a pending read or write produced.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("%w (%v)", ctxErr, err)
+	}
+	return err
+}
+
+// body hands out the response body and releases the connection once the
+// body is done with: back to the pool if it was read to the end, closed
+// otherwise.
+type body struct {
+	r       io.Reader
+	ctx     context.Context
+	once    sync.Once
+	release func(complete bool)
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil {
+		complete := errors.Is(err, io.EOF)
+		if !complete {
+			// before releasing, which cancels the context
+			err = contextError(b.ctx, err)
+		}
+		b.once.Do(func() { b.release(complete) })
+	}
+	return n, err
+}
+
+func (b *body) Close() error {
+	b.once.Do(func() { b.release(false) })
+	return nil
+}
+
+// Get is a shorthand for a GET request with c.
+func (c *Client) Get(ctx context.Context, rawURL string) (*Response, error) {
+	req, err := NewRequest(request.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(ctx, req)
+}
@@ -0,0 +1,171 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/sankalpmukim/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer runs one of our own servers on a free port.
+func startServer(t *testing.T, handler server.Handler) string {
+	t.Helper()
+	srv, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return fmt.Sprintf("http://127.0.0.1:%d", srv.Addr().(*net.TCPAddr).Port)
+}
+
+// startRawServer accepts connections and hands them to serve as is, for
+// upstreams that misbehave on purpose.
+func startRawServer(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return "http://" + listener.Addr().String()
+}
+
+func echoHandler(w *response.Writer, req *request.Request) {
+	body := fmt.Sprintf("%s %s %s", req.RequestLine.Method, req.RequestLine.RequestTarget, req.Body)
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+func TestClientDo(t *testing.T) {
+	base := startServer(t, echoHandler)
+	c := &Client{Timeout: 5 * time.Second}
+
+	// Test: Simple GET
+	resp, err := c.Get(context.Background(), base+"/coffee?size=medium")
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+	require.NoError(t, resp.ReadBody())
+	assert.Equal(t, "GET /coffee?size=medium ", string(resp.Body))
+
+	// Test: POST with a body in memory
+	req, err := NewRequest("POST", base+"/submit", []byte("hello"))
+	require.NoError(t, err)
+	resp, err = c.Do(context.Background(), req)
+	require.NoError(t, err)
+	require.NoError(t, resp.ReadBody())
+	assert.Equal(t, "POST /submit hello", string(resp.Body))
+
+	// Test: POST with a streamed body
+	req, err = NewRequest("POST", base+"/stream", nil)
+	require.NoError(t, err)
+	req.BodyReader = strings.NewReader(strings.Repeat("x", 100_000))
+	resp, err = c.Do(context.Background(), req)
+	require.NoError(t, err)
+	require.NoError(t, resp.ReadBody())
+	assert.Equal(t, "POST /stream "+strings.Repeat("x", 100_000), string(resp.Body))
+
+	// Test: The headers added on the wire stay off the caller's request,
+	// which can be sent again
+	req, err = NewRequest("GET", base+"/again", nil)
+	require.NoError(t, err)
+	delete(req.Headers, "host")
+	closing := &Client{Timeout: 5 * time.Second, DisableKeepAlives: true}
+	for range 2 {
+		resp, err = closing.Do(context.Background(), req)
+		require.NoError(t, err)
+		require.NoError(t, resp.ReadBody())
+		assert.Equal(t, "GET /again ", string(resp.Body))
+		assert.NotContains(t, req.Headers, "host")
+		assert.NotContains(t, req.Headers, "connection")
+	}
+
+	// Test: Streaming the response body
+	resp, err = c.Get(context.Background(), base+"/read")
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	n, err := io.ReadFull(resp.BodyReader, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "GET ", string(buf[:n]))
+	require.NoError(t, resp.Close())
+}
+
+func TestClientErrors(t *testing.T) {
+	// Test: Bad URLs
+	_, err := NewRequest("GET", "ftp://example.com/", nil)
+	require.Error(t, err)
+	_, err = NewRequest("GET", "/just/a/path", nil)
+	require.Error(t, err)
+
+	// Test: Upstream that never answers runs into the timeout
+	silent := startRawServer(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+	c := &Client{Timeout: 200 * time.Millisecond}
+	start := time.Now()
+	_, err = c.Get(context.Background(), silent+"/")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	// Test: Headers that take too long run into ResponseHeaderTimeout, the
+	// body after them doesn't
+	late := startRawServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		bufio.NewReader(conn).ReadString('\n')
+		time.Sleep(300 * time.Millisecond)
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\n"))
+		time.Sleep(300 * time.Millisecond)
+		conn.Write([]byte("ok"))
+	})
+	c = &Client{ResponseHeaderTimeout: 100 * time.Millisecond}
+	_, err = c.Get(context.Background(), late+"/")
+	require.ErrorIs(t, err, ErrResponseHeaderTimeout)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	c = &Client{ResponseHeaderTimeout: time.Second}
+	resp, err := c.Get(context.Background(), late+"/")
+	require.NoError(t, err)
+	require.NoError(t, resp.ReadBody())
+	assert.Equal(t, "ok", string(resp.Body))
+
+	// Test: Cancelling while the body is being read
+	slow := startRawServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nfirst bytes"))
+		time.Sleep(5 * time.Second)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err = (&Client{}).Get(ctx, slow+"/")
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	_, err = io.ReadAll(resp.BodyReader)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// Test: Nothing listening
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+	_, err = (&Client{DialTimeout: time.Second}).Get(context.Background(), "http://"+addr+"/")
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, context.DeadlineExceeded))
+}
@@ -0,0 +1,293 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaults for the pool settings on Client
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 2
+	defaultIdleTimeout         = 90 * time.Second
+)
+
+// persistConn is a connection that can outlive the exchange it was dialed
+// for. br stays with the connection, it may hold read ahead bytes.
+type persistConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	key  string
+
+	// reused is set when the connection came out of the idle pool, which
+	// makes it a candidate for having been closed by the server meanwhile
+	reused bool
+
+	idleSince time.Time
+	idleTimer *time.Timer
+}
+
+// hostConns is the pool state for one scheme://host:port.
+type hostConns struct {
+	// most recently used last
+	idle []*persistConn
+	// open connections, idle or busy
+	open int
+	// requests waiting for MaxConnsPerHost to allow them a connection. They
+	// are handed either an idle connection or nil, which means they may
+	// dial one.
+	waiting []chan *persistConn
+}
+
+// pool keeps idle connections per host and enforces the Client's limits.
+type pool struct {
+	client *Client
+
+	mu        sync.Mutex
+	hosts     map[string]*hostConns
+	idleCount int
+}
+
+func (c *Client) getPool() *pool {
+	c.poolOnce.Do(func() {
+		c.pool = &pool{client: c, hosts: make(map[string]*hostConns)}
+	})
+	return c.pool
+}
+
+func (p *pool) host(key string) *hostConns {
+	h, ok := p.hosts[key]
+	if !ok {
+		h = &hostConns{}
+		p.hosts[key] = h
+	}
+	return h
+}
+
+// get hands out an idle connection for key if there is a live one, and dials
+// a new one otherwise, waiting for a free slot first if the host is at
+// MaxConnsPerHost.
+func (p *pool) get(ctx context.Context, key string, dial func(context.Context) (net.Conn, error)) (*persistConn, error) {
+	for {
+		p.mu.Lock()
+		h := p.host(key)
+		if pc := p.popIdle(h); pc != nil {
+			p.mu.Unlock()
+			if pc.alive() {
+				return pc, nil
+			}
+			p.discard(pc)
+			continue
+		}
+
+		if limit := p.client.MaxConnsPerHost; limit > 0 && h.open >= limit {
+			wait := make(chan *persistConn, 1)
+			h.waiting = append(h.waiting, wait)
+			p.mu.Unlock()
+
+			select {
+			case pc := <-wait:
+				if pc == nil {
+					return p.dial(ctx, key, dial)
+				}
+				if pc.alive() {
+					return pc, nil
+				}
+				p.discard(pc)
+				continue
+			case <-ctx.Done():
+				p.mu.Lock()
+				h.waiting = removeWaiter(h.waiting, wait)
+				p.mu.Unlock()
+				// we may have been handed something just now, pass it on
+				select {
+				case pc := <-wait:
+					if pc == nil {
+						p.release(key)
+					} else {
+						p.put(pc)
+					}
+				default:
+				}
+				return nil, ctx.Err()
+			}
+		}
+
+		h.open++
+		p.mu.Unlock()
+		return p.dial(ctx, key, dial)
+	}
+}
+
+// dial opens a connection in a slot that has already been counted in open.
+func (p *pool) dial(ctx context.Context, key string, dial func(context.Context) (net.Conn, error)) (*persistConn, error) {
+	conn, err := dial(ctx)
+	if err != nil {
+		p.release(key)
+		return nil, err
+	}
+	return &persistConn{conn: conn, br: bufio.NewReader(conn), key: key}, nil
+}
+
+// popIdle takes the most recently used idle connection of h. p.mu is held.
+func (p *pool) popIdle(h *hostConns) *persistConn {
+	if len(h.idle) == 0 {
+		return nil
+	}
+	pc := h.idle[len(h.idle)-1]
+	h.idle = h.idle[:len(h.idle)-1]
+	p.idleCount--
+	pc.idleTimer.Stop()
+	pc.reused = true
+	return pc
+}
+
+// put returns a connection that is done with its exchange. It goes to a
+// waiting request if there is one, and to the idle list otherwise.
+func (p *pool) put(pc *persistConn) {
+	p.mu.Lock()
+	h := p.host(pc.key)
+	if len(h.waiting) > 0 {
+		wait := h.waiting[0]
+		h.waiting = h.waiting[1:]
+		p.mu.Unlock()
+		pc.reused = true
+		wait <- pc
+		return
+	}
+
+	var evict []*persistConn
+	if len(h.idle) >= p.client.maxIdleConnsPerHost() {
+		evict = append(evict, h.idle[0])
+		h.idle = h.idle[1:]
+		p.idleCount--
+	}
+	if p.idleCount >= p.client.maxIdleConns() {
+		if oldest := p.oldestIdle(); oldest != nil {
+			evict = append(evict, oldest)
+		}
+	}
+
+	pc.idleSince = time.Now()
+	pc.idleTimer = time.AfterFunc(p.client.idleTimeout(), func() { p.expire(pc) })
+	h.idle = append(h.idle, pc)
+	p.idleCount++
+	p.mu.Unlock()
+
+	for _, old := range evict {
+		old.idleTimer.Stop()
+		p.discard(old)
+	}
+}
+
+// oldestIdle removes and returns the connection idle the longest across all
+// hosts. p.mu is held.
+func (p *pool) oldestIdle() *persistConn {
+	var oldestHost *hostConns
+	for _, h := range p.hosts {
+		if len(h.idle) > 0 && (oldestHost == nil || h.idle[0].idleSince.Before(oldestHost.idle[0].idleSince)) {
+			oldestHost = h
+		}
+	}
+	if oldestHost == nil {
+		return nil
+	}
+	pc := oldestHost.idle[0]
+	oldestHost.idle = oldestHost.idle[1:]
+	p.idleCount--
+	return pc
+}
+
+// expire closes pc once it has been idle for IdleTimeout, unless it has
+// been picked up in the meantime.
+func (p *pool) expire(pc *persistConn) {
+	p.mu.Lock()
+	h := p.host(pc.key)
+	i := -1
+	for j, idle := range h.idle {
+		if idle == pc {
+			i = j
+			break
+		}
+	}
+	if i == -1 {
+		p.mu.Unlock()
+		return
+	}
+	h.idle = append(h.idle[:i], h.idle[i+1:]...)
+	p.idleCount--
+	p.mu.Unlock()
+	p.discard(pc)
+}
+
+// discard closes a connection that won't be used again and frees its slot.
+func (p *pool) discard(pc *persistConn) {
+	pc.conn.Close()
+	p.release(pc.key)
+}
+
+// release gives up a slot counted in open, letting a waiting request dial.
+func (p *pool) release(key string) {
+	p.mu.Lock()
+	h := p.host(key)
+	if len(h.waiting) > 0 {
+		wait := h.waiting[0]
+		h.waiting = h.waiting[1:]
+		p.mu.Unlock()
+		// the slot moves over to the waiter, open stays as it is
+		wait <- nil
+		return
+	}
+	h.open--
+	if h.open == 0 && len(h.idle) == 0 {
+		delete(p.hosts, key)
+	}
+	p.mu.Unlock()
+}
+
+// closeIdle closes every idle connection.
+func (p *pool) closeIdle() {
+	p.mu.Lock()
+	var idle []*persistConn
+	for _, h := range p.hosts {
+		idle = append(idle, h.idle...)
+		h.idle = nil
+	}
+	p.idleCount = 0
+	p.mu.Unlock()
+
+	for _, pc := range idle {
+		pc.idleTimer.Stop()
+		p.discard(pc)
+	}
+}
+
+func removeWaiter(waiting []chan *persistConn, wait chan *persistConn) []chan *persistConn {
+	for i, w := range waiting {
+		if w == wait {
+			return append(waiting[:i], waiting[i+1:]...)
+		}
+	}
+	return waiting
+}
+
+// alive checks, without blocking, that the server hasn't closed an idle
+// connection or sent anything on it. Both mean it can't be used: a
+// response nobody asked for leaves the connection out of step.
+func (pc *persistConn) alive() bool {
+	if pc.br.Buffered() > 0 {
+		return false
+	}
+	// a deadline in the past makes the read return at once, with a timeout
+	// if there's nothing to read
+	pc.conn.SetReadDeadline(time.Now())
+	_, err := pc.br.Peek(1)
+	pc.conn.SetReadDeadline(time.Time{})
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,213 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startKeepAliveServer answers requests on a connection until the client
+// closes it, or until requestsPerConn have been answered. The body says
+// which connection and which request on it this is. It returns the URL and
+// the number of connections accepted so far.
+func startKeepAliveServer(t *testing.T, requestsPerConn int) (string, *atomic.Int32) {
+	t.Helper()
+	var conns atomic.Int32
+	url := startRawServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		id := conns.Add(1)
+		for i := 1; requestsPerConn == 0 || i <= requestsPerConn; i++ {
+			req, err := request.RequestFromReader(conn)
+			if err != nil {
+				return
+			}
+			body := fmt.Sprintf("conn %d request %d %s", id, i, req.RequestLine.RequestTarget)
+			fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		}
+	})
+	return url, &conns
+}
+
+func get(t *testing.T, c *Client, url string) string {
+	t.Helper()
+	resp, err := c.Get(context.Background(), url)
+	require.NoError(t, err)
+	require.NoError(t, resp.ReadBody())
+	return string(resp.Body)
+}
+
+func TestConnectionReuse(t *testing.T) {
+	// Test: Requests in a row share one connection
+	base, conns := startKeepAliveServer(t, 0)
+	c := &Client{Timeout: 5 * time.Second}
+	assert.Equal(t, "conn 1 request 1 /a", get(t, c, base+"/a"))
+	assert.Equal(t, "conn 1 request 2 /b", get(t, c, base+"/b"))
+	assert.Equal(t, "conn 1 request 3 /c", get(t, c, base+"/c"))
+	assert.Equal(t, int32(1), conns.Load())
+
+	// Test: A body closed before its end takes the connection down with it
+	resp, err := c.Get(context.Background(), base+"/d")
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	assert.Equal(t, "conn 2 request 1 /e", get(t, c, base+"/e"))
+
+	// Test: DisableKeepAlives dials every time
+	base, conns = startKeepAliveServer(t, 0)
+	c = &Client{Timeout: 5 * time.Second, DisableKeepAlives: true}
+	get(t, c, base+"/a")
+	get(t, c, base+"/b")
+	assert.Equal(t, int32(2), conns.Load())
+
+	// Test: A response that asks for the connection to be closed isn't reused
+	var closed atomic.Int32
+	closing := startRawServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		closed.Add(1)
+		request.RequestFromReader(conn)
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 2\r\n\r\nok"))
+	})
+	c = &Client{Timeout: 5 * time.Second}
+	get(t, c, closing+"/a")
+	get(t, c, closing+"/b")
+	assert.Equal(t, int32(2), closed.Load())
+
+	// Test: A connection switched to another protocol, by a 101 or by a
+	// CONNECT tunnel, isn't reused
+	var switched atomic.Int32
+	switching := startRawServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		switched.Add(1)
+		for {
+			req, err := request.RequestFromReader(conn)
+			if err != nil {
+				return
+			}
+			if req.RequestLine.Method == request.MethodConnect {
+				conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+			} else {
+				conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+			}
+		}
+	})
+	c = &Client{Timeout: 5 * time.Second}
+	for _, method := range []string{"GET", "GET", request.MethodConnect, request.MethodConnect} {
+		req, err := NewRequest(method, switching+"/", nil)
+		require.NoError(t, err)
+		resp, err := c.Do(context.Background(), req)
+		require.NoError(t, err)
+		require.NoError(t, resp.ReadBody())
+	}
+	assert.Equal(t, int32(4), switched.Load())
+
+	// Test: Idle connections are closed after IdleTimeout
+	base, conns = startKeepAliveServer(t, 0)
+	c = &Client{Timeout: 5 * time.Second, IdleTimeout: 50 * time.Millisecond}
+	get(t, c, base+"/a")
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, "conn 2 request 1 /b", get(t, c, base+"/b"))
+
+	// Test: CloseIdleConnections empties the pool
+	assert.Equal(t, "conn 2 request 2 /c", get(t, c, base+"/c"))
+	c.CloseIdleConnections()
+	assert.Equal(t, "conn 3 request 1 /d", get(t, c, base+"/d"))
+}
+
+func TestStaleConnections(t *testing.T) {
+	// the server hangs up after every response without saying so
+	base, conns := startKeepAliveServer(t, 1)
+	c := &Client{Timeout: 5 * time.Second}
+
+	// Test: A closed idle connection is noticed before it's reused
+	assert.Equal(t, "conn 1 request 1 /a", get(t, c, base+"/a"))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "conn 2 request 1 /b", get(t, c, base+"/b"))
+	assert.Equal(t, int32(2), conns.Load())
+
+	// Test: Idempotent requests are retried when the server closes a
+	// reused connection without answering
+	var accepted atomic.Int32
+	drop := startRawServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		n := accepted.Add(1)
+		request.RequestFromReader(conn)
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+		if n == 1 {
+			// read the next request, then hang up on it
+			request.RequestFromReader(conn)
+			return
+		}
+	})
+	c = &Client{Timeout: 5 * time.Second}
+	assert.Equal(t, "ok", get(t, c, drop+"/a"))
+	assert.Equal(t, "ok", get(t, c, drop+"/b"))
+	assert.Equal(t, int32(2), accepted.Load())
+
+	// Test: POST isn't retried
+	accepted.Store(0)
+	c = &Client{Timeout: 5 * time.Second}
+	assert.Equal(t, "ok", get(t, c, drop+"/a"))
+	req, err := NewRequest("POST", drop+"/b", []byte("once"))
+	require.NoError(t, err)
+	_, err = c.Do(context.Background(), req)
+	require.Error(t, err)
+	assert.Equal(t, int32(1), accepted.Load())
+}
+
+func TestMaxConnsPerHost(t *testing.T) {
+	var open, peak atomic.Int32
+	release := make(chan struct{})
+	base := startRawServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		n := open.Add(1)
+		defer open.Add(-1)
+		for {
+			if p := peak.Load(); n > p {
+				peak.CompareAndSwap(p, n)
+			}
+			if _, err := request.RequestFromReader(conn); err != nil {
+				return
+			}
+			<-release
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+		}
+	})
+
+	// Test: Requests past the limit wait for a connection
+	c := &Client{Timeout: 5 * time.Second, MaxConnsPerHost: 2}
+	var wg sync.WaitGroup
+	for range 6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, "ok", get(t, c, base+"/"))
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.LessOrEqual(t, peak.Load(), int32(2))
+
+	// Test: Waiting gives up when the context is done
+	blocked := make(chan struct{})
+	t.Cleanup(func() { close(blocked) })
+	hold := startRawServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		request.RequestFromReader(conn)
+		<-blocked
+	})
+	c = &Client{MaxConnsPerHost: 1}
+	go c.Get(context.Background(), hold+"/")
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := c.Get(ctx, hold+"/")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
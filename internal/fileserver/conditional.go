@@ -0,0 +1,133 @@
+package fileserver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+)
+
+// ETag makes an entity tag for a file out of its modification time and
+// size, so it changes whenever the file is rewritten without reading it.
+// Files modified less than a second ago get a weak tag: another write
+// within the same tick of the file system's clock could keep the metadata,
+// and the tag, while changing the bytes.
+func ETag(modtime time.Time, size int64) string {
+	tag := fmt.Sprintf(`"%x-%x"`, modtime.UnixNano(), size)
+	if time.Since(modtime) < time.Second {
+		return "W/" + tag
+	}
+	return tag
+}
+
+// precondition is what the conditional headers of a request make of it.
+type precondition int
+
+const (
+	// preconditionPassed means the request goes ahead as if unconditional.
+	preconditionPassed precondition = iota
+	// preconditionNotModified is answered with 304, the client's copy is
+	// current.
+	preconditionNotModified
+	// preconditionFailed is answered with 412.
+	preconditionFailed
+)
+
+// checkPreconditions evaluates If-Match, If-Unmodified-Since,
+// If-None-Match and If-Modified-Since against the content's validators in
+// the order of RFC 9110 section 13.2.2. If-Range is left to the ranges.
+func checkPreconditions(req *request.Request, etag string, modtime time.Time) precondition {
+	// step 1 and 2: a client changing what it has seen
+	if ifMatch := req.Headers.Get("if-match"); ifMatch != "" {
+		if !matchETags(ifMatch, etag, true) {
+			return preconditionFailed
+		}
+	} else if t, ok := parseHTTPDate(req.Headers.Get("if-unmodified-since")); ok && !modtime.IsZero() {
+		if modtime.UTC().Truncate(time.Second).After(t) {
+			return preconditionFailed
+		}
+	}
+
+	// step 3 and 4: a client revalidating its cached copy
+	method := req.RequestLine.Method
+	if ifNoneMatch := req.Headers.Get("if-none-match"); ifNoneMatch != "" {
+		if matchETags(ifNoneMatch, etag, false) {
+			if method == request.MethodGet || method == request.MethodHead {
+				return preconditionNotModified
+			}
+			return preconditionFailed
+		}
+	} else if method == request.MethodGet || method == request.MethodHead {
+		if t, ok := parseHTTPDate(req.Headers.Get("if-modified-since")); ok && !modtime.IsZero() {
+			if !modtime.UTC().Truncate(time.Second).After(t) {
+				return preconditionNotModified
+			}
+		}
+	}
+	return preconditionPassed
+}
+
+// matchETags reports whether the If-Match or If-None-Match list has etag
+// in it, under the strong or weak comparison of RFC 9110 section 8.8.3.2.
+// "*" matches whenever there is a current representation.
+func matchETags(list, etag string, strong bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	if etag == "" || strong && strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	opaque := strings.TrimPrefix(etag, "W/")
+	for list != "" {
+		var tag string
+		tag, list = scanETag(list)
+		if tag == "" {
+			// garbage, nothing after it can be trusted to parse
+			return false
+		}
+		if strong && strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		if strings.TrimPrefix(tag, "W/") == opaque {
+			return true
+		}
+	}
+	return false
+}
+
+// scanETag takes the first entity tag off a comma separated list. The
+// quoted part can itself contain commas, so the list can't simply be split.
+func scanETag(list string) (tag, rest string) {
+	list = strings.TrimLeft(list, " \t,")
+	if list == "" {
+		return "", ""
+	}
+	start := 0
+	if strings.HasPrefix(list, "W/") {
+		start = 2
+	}
+	if len(list) <= start || list[start] != '"' {
+		return "", ""
+	}
+	end := strings.IndexByte(list[start+1:], '"')
+	if end < 0 {
+		return "", ""
+	}
+	end += start + 2
+	return list[:end], strings.TrimLeft(list[end:], " \t,")
+}
+
+// parseHTTPDate parses an HTTP-date in any of the three formats recipients
+// have to accept, RFC 9110 section 5.6.7.
+func parseHTTPDate(s string) (time.Time, bool) {
+	if s == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range []string{timeFormat, "Monday, 02-Jan-06 15:04:05 GMT", time.ANSIC} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
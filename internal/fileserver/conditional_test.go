@@ -0,0 +1,123 @@
+package fileserver
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/headers"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestETag(t *testing.T) {
+	// Test: Tags follow the metadata
+	tag := ETag(modtime, 26)
+	assert.Equal(t, `"17cb5d408ed1a7f4-1a"`, tag)
+	assert.NotEqual(t, tag, ETag(modtime, 27))
+	assert.NotEqual(t, tag, ETag(modtime.Add(time.Nanosecond), 26))
+
+	// Test: Files that just changed get weak tags
+	assert.True(t, strings.HasPrefix(ETag(time.Now(), 26), `W/"`))
+}
+
+func TestMatchETags(t *testing.T) {
+	for _, tc := range []struct {
+		list, etag   string
+		strong, weak bool
+	}{
+		{`"a"`, `"a"`, true, true},
+		{`"b", "a"`, `"a"`, true, true},
+		{`"x,y",  "a"`, `"a"`, true, true},
+		{`"x,y"`, `"y"`, false, false},
+		{`W/"a"`, `"a"`, false, true},
+		{`"a"`, `W/"a"`, false, true},
+		{`*`, `"a"`, true, true},
+		{`"b"`, `"a"`, false, false},
+		{`a`, `"a"`, false, false},
+		{`"a`, `"a"`, false, false},
+		{`"a"`, ``, false, false},
+	} {
+		assert.Equal(t, tc.strong, matchETags(tc.list, tc.etag, true), "strong %s %s", tc.list, tc.etag)
+		assert.Equal(t, tc.weak, matchETags(tc.list, tc.etag, false), "weak %s %s", tc.list, tc.etag)
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	etag := ETag(modtime, int64(len(alphabet)))
+	h := headers.Headers{"cache-control": "max-age=60"}
+	before := "Wed, 01 May 2024 12:30:14 GMT"
+	at := "Wed, 01 May 2024 12:30:15 GMT"
+
+	// Test: Responses carry the validators
+	resp := serve(t, "GET", h)
+	assert.Equal(t, etag, resp.Headers.Get("etag"))
+	assert.Equal(t, at, resp.Headers.Get("last-modified"))
+
+	// Test: Current copies get a 304 with the cache fields and no body
+	for _, line := range []string{
+		"If-None-Match: " + etag,
+		`If-None-Match: "other", W/` + etag,
+		"If-None-Match: *",
+		"If-Modified-Since: " + at,
+		"If-Modified-Since: Wednesday, 01-May-24 12:30:15 GMT",
+		"If-Modified-Since: Wed May  1 12:30:16 2024",
+	} {
+		for _, method := range []string{"GET", "HEAD"} {
+			resp := serve(t, method, h, line+"\r\n")
+			assert.Equal(t, response.NotModified, resp.StatusLine.StatusCode, line)
+			assert.Equal(t, etag, resp.Headers.Get("etag"), line)
+			assert.Equal(t, "max-age=60", resp.Headers.Get("cache-control"), line)
+			assert.Empty(t, resp.Headers.Get("content-type"), line)
+			assert.Empty(t, resp.Headers.Get("last-modified"), line)
+			assert.Empty(t, resp.Body, line)
+		}
+	}
+
+	// Test: Stale copies and conditions that don't parse get the content,
+	// and If-None-Match overrides If-Modified-Since
+	for _, lines := range [][]string{
+		{`If-None-Match: "other"`},
+		{"If-Modified-Since: " + before},
+		{"If-Modified-Since: yesterday"},
+		{`If-None-Match: "other"`, "If-Modified-Since: " + at},
+		{"If-Match: " + etag},
+		{"If-Match: *"},
+		{"If-Unmodified-Since: " + at},
+		{"If-Match: " + etag, "If-Unmodified-Since: " + before},
+	} {
+		resp := serve(t, "GET", h, strings.Join(lines, "\r\n")+"\r\n")
+		assert.Equal(t, response.OK, resp.StatusLine.StatusCode, lines)
+		assert.Equal(t, alphabet, string(resp.Body), lines)
+	}
+
+	// Test: Failed preconditions are a 412, If-Match first
+	for _, tc := range []struct {
+		method string
+		lines  []string
+	}{
+		{"GET", []string{`If-Match: "other"`}},
+		{"GET", []string{"If-Match: W/" + etag}},
+		{"GET", []string{"If-Unmodified-Since: " + before}},
+		{"GET", []string{`If-Match: "other"`, "If-None-Match: " + etag}},
+		{"POST", []string{"If-None-Match: " + etag}},
+		{"POST", []string{"If-None-Match: *"}},
+	} {
+		resp := serve(t, tc.method, h, strings.Join(tc.lines, "\r\n")+"\r\n")
+		assert.Equal(t, response.PreconditionFailed, resp.StatusLine.StatusCode, tc.lines)
+		assert.Empty(t, resp.Body, tc.lines)
+	}
+
+	// Test: If-Modified-Since only applies to GET and HEAD
+	resp = serve(t, "POST", h, "If-Modified-Since: "+at+"\r\n")
+	assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+
+	// Test: A 304 comes before the ranges
+	resp = serve(t, "GET", h, "Range: bytes=0-1\r\n", "If-None-Match: "+etag+"\r\n")
+	assert.Equal(t, response.NotModified, resp.StatusLine.StatusCode)
+
+	// Test: Without an ETag the 304 says when the content changed
+	resp = serve(t, "GET", headers.Headers{"etag": ""}, "If-Modified-Since: "+at+"\r\n")
+	assert.Equal(t, response.NotModified, resp.StatusLine.StatusCode)
+	assert.Equal(t, at, resp.Headers.Get("last-modified"))
+}
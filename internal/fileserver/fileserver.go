@@ -0,0 +1,297 @@
+// Package fileserver serves files and other seekable content, answering
+// range requests so clients can seek in media and resume downloads, and
+// conditional requests so caches can revalidate without downloading again.
+package fileserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/headers"
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/sankalpmukim/httpfromtcp/internal/server"
+)
+
+// timeFormat is the IMF-fixdate format of HTTP dates, RFC 9110 section
+// 5.6.7.
+const timeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// maxRanges is how many ranges a request can ask for before it gets the
+// whole content instead. Many small ranges cost far more to serve than
+// they save.
+const maxRanges = 64
+
+// ServeContent answers req with content, or the ranges of it asked for.
+//
+// h holds headers to send along, ETag and Cache-Control for instance, and
+// can be nil. The Content-Type is guessed from the extension of name when
+// h doesn't have one. modtime, unless zero, is sent as Last-Modified, and
+// makes the ETag when h doesn't have one, see ETag. An empty h["etag"]
+// sends none.
+//
+// If-Match, If-Unmodified-Since, If-None-Match and If-Modified-Since are
+// evaluated against those validators first, as RFC 9110 section 13.2.2
+// orders them. Clients whose copy is current get a 304 Not Modified and
+// failed preconditions a 412, both without a body.
+//
+// GET requests with a Range header get a 206 Partial Content, as
+// multipart/byteranges when they ask for more than one range, or a 416
+// when none of the ranges overlaps the content. If-Range makes the
+// ranges apply only while the content still has the entity tag in
+// h["etag"] or the modification time asked for; otherwise the whole
+// content is sent.
+//
+// The content is streamed rather than read into memory, and an *os.File
+// goes out with sendfile on plain TCP connections, see
+// response.Writer.ReadFrom.
+func ServeContent(w *response.Writer, req *request.Request, name string, modtime time.Time, content io.ReadSeeker, h headers.Headers) {
+	size, err := content.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = content.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		server.WriteError(w, server.HandleError{
+			StatusCode: response.InternalServerError,
+			Message:    fmt.Sprintf("can't read %s", name),
+		})
+		return
+	}
+
+	out := response.GetDefaultHeaders(0)
+	delete(out, "content-type")
+	for k, v := range h {
+		out[strings.ToLower(k)] = v
+	}
+	if _, ok := out["content-type"]; !ok {
+		out["content-type"] = contentType(name, content)
+	}
+	out["accept-ranges"] = "bytes"
+	if !modtime.IsZero() {
+		out["last-modified"] = modtime.UTC().Format(timeFormat)
+		if _, ok := out["etag"]; !ok {
+			out["etag"] = ETag(modtime, size)
+		}
+	}
+	if out["etag"] == "" {
+		delete(out, "etag")
+	}
+
+	switch checkPreconditions(req, out["etag"], modtime) {
+	case preconditionNotModified:
+		w.WriteStatusLine(response.NotModified)
+		w.WriteHeaders(notModifiedHeaders(out))
+		return
+	case preconditionFailed:
+		w.WriteStatusLine(response.PreconditionFailed)
+		w.WriteHeaders(headers.Headers{"content-length": "0", "connection": "close"})
+		return
+	}
+
+	ranges, err := requestedRanges(req, size, out["etag"], modtime)
+	switch {
+	case errors.Is(err, errNoOverlap):
+		message := fmt.Sprintf("An error occurred: no range asked for is within the %d bytes of %s", size, name)
+		w.WriteStatusLine(response.RangeNotSatisfiable)
+		out["content-range"] = fmt.Sprintf("bytes */%d", size)
+		out["content-type"] = "text/plain; charset=utf-8"
+		out["content-length"] = strconv.Itoa(len(message))
+		w.WriteHeaders(out)
+		w.WriteBody([]byte(message))
+
+	case len(ranges) == 1:
+		r := ranges[0]
+		out["content-range"] = r.contentRange(size)
+		out["content-length"] = strconv.FormatInt(r.length, 10)
+		w.WriteStatusLine(response.PartialContent)
+		w.WriteHeaders(out)
+		if _, err := content.Seek(r.start, io.SeekStart); err == nil {
+			io.CopyN(w, content, r.length)
+		}
+
+	case len(ranges) > 1:
+		writeMultipart(w, out, content, ranges, size)
+
+	default:
+		out["content-length"] = strconv.FormatInt(size, 10)
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(out)
+		if req.RequestLine.Method != request.MethodHead {
+			io.CopyN(w, content, size)
+		}
+	}
+}
+
+// notModifiedHeaders picks what a 304 carries out of the headers of the
+// 200 it stands for, RFC 9110 section 15.4.5: the fields caches update
+// their copy with, and Last-Modified only when there is no ETag.
+func notModifiedHeaders(out headers.Headers) headers.Headers {
+	h := headers.Headers{"connection": "close"}
+	for _, name := range []string{"cache-control", "content-location", "date", "etag", "expires", "vary"} {
+		if v, ok := out[name]; ok {
+			h[name] = v
+		}
+	}
+	if _, ok := h["etag"]; !ok && out["last-modified"] != "" {
+		h["last-modified"] = out["last-modified"]
+	}
+	return h
+}
+
+// requestedRanges returns the ranges req asks for, nil when it should get
+// the whole content.
+func requestedRanges(req *request.Request, size int64, etag string, modtime time.Time) ([]byteRange, error) {
+	value := req.Headers.Get("range")
+	// range requests are only defined for GET, RFC 9110 section 14.2
+	if value == "" || req.RequestLine.Method != request.MethodGet || size == 0 {
+		return nil, nil
+	}
+	if ifRange := req.Headers.Get("if-range"); ifRange != "" && !ifRangeMatches(ifRange, etag, modtime) {
+		return nil, nil
+	}
+	ranges, err := parseRange(value, size)
+	if errors.Is(err, errInvalidRange) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// ranges adding up to more than the content are overlapping, and
+	// cheaper sent as the whole thing
+	var total int64
+	for _, r := range ranges {
+		total += r.length
+	}
+	if len(ranges) > maxRanges || total > size {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// writeMultipart sends ranges as a multipart/byteranges body, RFC 9110
+// section 14.6, each part with the content type of the whole.
+func writeMultipart(w *response.Writer, out headers.Headers, content io.ReadSeeker, ranges []byteRange, size int64) {
+	boundary := randomBoundary()
+	partType := out["content-type"]
+
+	// the part headers are worked out first, for the Content-Length
+	parts := make([]string, len(ranges))
+	length := int64(0)
+	for i, r := range ranges {
+		delimiter := "--" + boundary
+		if i > 0 {
+			delimiter = "\r\n" + delimiter
+		}
+		parts[i] = fmt.Sprintf("%s\r\ncontent-type: %s\r\ncontent-range: %s\r\n\r\n", delimiter, partType, r.contentRange(size))
+		length += int64(len(parts[i])) + r.length
+	}
+	closing := "\r\n--" + boundary + "--\r\n"
+	length += int64(len(closing))
+
+	out["content-type"] = "multipart/byteranges; boundary=" + boundary
+	out["content-length"] = strconv.FormatInt(length, 10)
+	w.WriteStatusLine(response.PartialContent)
+	w.WriteHeaders(out)
+	for i, r := range ranges {
+		if _, err := io.WriteString(w, parts[i]); err != nil {
+			return
+		}
+		if _, err := content.Seek(r.start, io.SeekStart); err != nil {
+			return
+		}
+		if _, err := io.CopyN(w, content, r.length); err != nil {
+			return
+		}
+	}
+	io.WriteString(w, closing)
+}
+
+func randomBoundary() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// contentType guesses the media type of content from the extension of
+// its name, or from its first bytes when the extension says nothing.
+func contentType(name string, content io.ReadSeeker) string {
+	ext := strings.ToLower(path.Ext(name))
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	if t, ok := extraTypes[ext]; ok {
+		return t
+	}
+
+	var buf [sniffLen]byte
+	n, _ := io.ReadFull(content, buf[:])
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "application/octet-stream"
+	}
+	return sniff(buf[:n])
+}
+
+// extraTypes covers common extensions missing from the mime package's
+// built-in table, for systems without a mime.types file.
+var extraTypes = map[string]string{
+	".txt":   "text/plain; charset=utf-8",
+	".md":    "text/markdown; charset=utf-8",
+	".csv":   "text/csv; charset=utf-8",
+	".ico":   "image/x-icon",
+	".mp4":   "video/mp4",
+	".webm":  "video/webm",
+	".mp3":   "audio/mpeg",
+	".ogg":   "audio/ogg",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".ttf":   "font/ttf",
+	".zip":   "application/zip",
+	".gz":    "application/gzip",
+}
+
+// sniffLen is how much of the content sniff looks at.
+const sniffLen = 512
+
+// sniff tells HTML, other text and binary content apart, which is as
+// much as can safely be told from the bytes of a file without a type.
+func sniff(b []byte) string {
+	trimmed := strings.ToLower(strings.TrimLeft(string(b), " \t\r\n"))
+	for _, prefix := range []string{"<!doctype html", "<html", "<head", "<body"} {
+		if strings.HasPrefix(trimmed, prefix) {
+			return "text/html; charset=utf-8"
+		}
+	}
+	if !utf8.Valid(trimTruncatedRune(b)) {
+		return "application/octet-stream"
+	}
+	for _, c := range b {
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' && c != '\f' {
+			return "application/octet-stream"
+		}
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// trimTruncatedRune drops a rune cut off at the end of b, where sniffLen
+// may have split it.
+func trimTruncatedRune(b []byte) []byte {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return b[:i]
+			}
+			break
+		}
+	}
+	return b
+}
@@ -0,0 +1,162 @@
+package fileserver
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/headers"
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const alphabet = "abcdefghijklmnopqrstuvwxyz"
+
+var modtime = time.Date(2024, 5, 1, 12, 30, 15, 500, time.UTC)
+
+// serve runs ServeContent over alphabet for a request with the given
+// method and header lines, and parses what it wrote.
+func serve(t *testing.T, method string, h headers.Headers, lines ...string) *response.Response {
+	t.Helper()
+	raw := method + " /letters.txt HTTP/1.1\r\nHost: localhost\r\n" + strings.Join(lines, "") + "\r\n"
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	w := response.NewResponseWriter(&buf)
+	ServeContent(&w, req, "letters.txt", modtime, strings.NewReader(alphabet), h)
+	resp, err := response.ResponseFromReader(&buf, method)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestParseRange(t *testing.T) {
+	for value, want := range map[string][]byteRange{
+		"bytes=0-4":          {{0, 5}},
+		"bytes=5-":           {{5, 21}},
+		"bytes=-3":           {{23, 3}},
+		"bytes=-100":         {{0, 26}},
+		"bytes=20-100":       {{20, 6}},
+		"Bytes = 1-1, 3-3":   {{1, 1}, {3, 1}},
+		"bytes=0-0,,-1":      {{0, 1}, {25, 1}},
+		"bytes=30-40, 0-1":   {{0, 2}},
+		"bytes=25-25":        {{25, 1}},
+		"bytes=0-9999999999": {{0, 26}},
+	} {
+		ranges, err := parseRange(value, int64(len(alphabet)))
+		require.NoError(t, err, value)
+		assert.Equal(t, want, ranges, value)
+	}
+
+	for _, value := range []string{"bytes=", "bytes=a-b", "bytes=5-1", "bytes=-", "items=0-1", "bytes=+1-2", "bytes=1 -2", "0-1"} {
+		_, err := parseRange(value, int64(len(alphabet)))
+		assert.ErrorIs(t, err, errInvalidRange, value)
+	}
+	for _, value := range []string{"bytes=26-", "bytes=100-200", "bytes=-0"} {
+		_, err := parseRange(value, int64(len(alphabet)))
+		assert.ErrorIs(t, err, errNoOverlap, value)
+	}
+}
+
+func TestServeContent(t *testing.T) {
+	// Test: Without a range the whole content goes out, saying ranges are
+	// welcome
+	resp := serve(t, "GET", nil)
+	assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+	assert.Equal(t, alphabet, string(resp.Body))
+	assert.Equal(t, "bytes", resp.Headers.Get("accept-ranges"))
+	assert.Equal(t, "Wed, 01 May 2024 12:30:15 GMT", resp.Headers.Get("last-modified"))
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Headers.Get("content-type"))
+
+	// Test: One range is a 206 with Content-Range
+	resp = serve(t, "GET", nil, "Range: bytes=3-5\r\n")
+	assert.Equal(t, response.PartialContent, resp.StatusLine.StatusCode)
+	assert.Equal(t, "def", string(resp.Body))
+	assert.Equal(t, "bytes 3-5/26", resp.Headers.Get("content-range"))
+	assert.Equal(t, "3", resp.Headers.Get("content-length"))
+
+	// Test: Ranges past the end are a 416 saying how long the content is
+	resp = serve(t, "GET", nil, "Range: bytes=26-30\r\n")
+	assert.Equal(t, response.RangeNotSatisfiable, resp.StatusLine.StatusCode)
+	assert.Equal(t, "bytes */26", resp.Headers.Get("content-range"))
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Headers.Get("content-type"))
+
+	// Test: Ranges that don't parse, aren't for GET, overlap or are for
+	// other units are ignored
+	for _, tc := range []struct{ method, line string }{
+		{"GET", "Range: bytes=z-\r\n"},
+		{"GET", "Range: bytes=0-20,5-25\r\n"},
+		{"GET", "Range: lines=1-2\r\n"},
+		{"POST", "Range: bytes=0-1\r\n"},
+	} {
+		resp = serve(t, tc.method, nil, tc.line)
+		assert.Equal(t, response.OK, resp.StatusLine.StatusCode, tc.line)
+		assert.Equal(t, alphabet, string(resp.Body), tc.line)
+	}
+
+	// Test: HEAD gets the headers of a GET
+	resp = serve(t, "HEAD", nil)
+	assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "26", resp.Headers.Get("content-length"))
+	assert.Empty(t, resp.Body)
+
+	// Test: Headers given are sent along
+	resp = serve(t, "GET", headers.Headers{"Content-Type": "text/x-letters", "cache-control": "no-cache"})
+	assert.Equal(t, "text/x-letters", resp.Headers.Get("content-type"))
+	assert.Equal(t, "no-cache", resp.Headers.Get("cache-control"))
+}
+
+func TestServeContentMultipart(t *testing.T) {
+	// Test: Several ranges come as multipart/byteranges
+	resp := serve(t, "GET", nil, "Range: bytes=0-1, 10-12, -2\r\n")
+	assert.Equal(t, response.PartialContent, resp.StatusLine.StatusCode)
+	assert.Empty(t, resp.Headers.Get("content-range"))
+	mediaType, params, err := mime.ParseMediaType(resp.Headers.Get("content-type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+
+	reader := multipart.NewReader(bytes.NewReader(resp.Body), params["boundary"])
+	want := []struct{ contentRange, body string }{
+		{"bytes 0-1/26", "ab"},
+		{"bytes 10-12/26", "klm"},
+		{"bytes 24-25/26", "yz"},
+	}
+	for _, w := range want {
+		part, err := reader.NextPart()
+		require.NoError(t, err)
+		assert.Equal(t, w.contentRange, part.Header.Get("Content-Range"))
+		assert.Equal(t, "text/plain; charset=utf-8", part.Header.Get("Content-Type"))
+		body, err := io.ReadAll(part)
+		require.NoError(t, err)
+		assert.Equal(t, w.body, string(body))
+	}
+	_, err = reader.NextPart()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestIfRange(t *testing.T) {
+	etag := headers.Headers{"etag": `"v1"`}
+
+	// Test: Ranges apply while the entity tag or date still match
+	for _, value := range []string{`"v1"`, "Wed, 01 May 2024 12:30:15 GMT"} {
+		resp := serve(t, "GET", etag, "Range: bytes=0-0\r\n", "If-Range: "+value+"\r\n")
+		assert.Equal(t, response.PartialContent, resp.StatusLine.StatusCode, value)
+		assert.Equal(t, "a", string(resp.Body), value)
+	}
+
+	// Test: Otherwise the whole content is sent, as are weak tags, which
+	// never match
+	for _, value := range []string{`"v0"`, `W/"v1"`, "Wed, 01 May 2024 12:30:14 GMT", "yesterday"} {
+		resp := serve(t, "GET", etag, "Range: bytes=0-0\r\n", "If-Range: "+value+"\r\n")
+		assert.Equal(t, response.OK, resp.StatusLine.StatusCode, value)
+		assert.Equal(t, alphabet, string(resp.Body), value)
+	}
+	resp := serve(t, "GET", headers.Headers{"etag": `W/"v1"`}, "Range: bytes=0-0\r\n", "If-Range: W/\"v1\"\r\n")
+	assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+}
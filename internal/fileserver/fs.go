@@ -0,0 +1,240 @@
+package fileserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/sankalpmukim/httpfromtcp/internal/server"
+)
+
+// FileServer serves the files under Root, with ServeContent.
+//
+//	files := &fileserver.FileServer{Root: os.DirFS("public")}
+//	server.Serve(port, files.Handle)
+//
+// Request paths are percent-decoded and cleaned before they go anywhere
+// near Root, so "/../../etc/passwd" is "/etc/passwd" under Root. Symbolic
+// links are followed while they stay within Root; those leading out of it
+// are treated as missing, for file systems that can read links
+// (fs.ReadLinkFS, as os.DirFS does). Files and directories whose name
+// starts with a dot are hidden unless AllowDotfiles is set.
+//
+// Directories are served by their index.html, or listed if Listings is
+// set. Requests for a directory without the trailing slash are redirected
+// to it, so relative links in the page work.
+type FileServer struct {
+	Root fs.FS
+
+	// AllowDotfiles serves .env, .git/config and the like. Keep it off
+	// unless Root holds nothing but what is meant to be public.
+	AllowDotfiles bool
+
+	// Listings lists the directories without an index.html, as JSON for
+	// clients that accept application/json and as HTML otherwise.
+	// Directories are a 404 without it.
+	Listings bool
+
+	// HTMLExtensions serves /about from about.html when there is no file
+	// named about.
+	HTMLExtensions bool
+}
+
+// maxSymlinks is how many symbolic links are followed resolving one path,
+// as ELOOP does it on Linux.
+const maxSymlinks = 40
+
+var (
+	errHidden  = errors.New("hidden file")
+	errOutside = errors.New("symbolic link leads out of the root")
+	errLoop    = errors.New("too many symbolic links")
+)
+
+// Handle is a Handler serving GET and HEAD requests from Root.
+func (f *FileServer) Handle(w *response.Writer, req *request.Request) {
+	method := req.RequestLine.Method
+	if method != request.MethodGet && method != request.MethodHead {
+		w.WriteStatusLine(response.MethodNotAllowed)
+		h := response.GetDefaultHeaders(0)
+		h["allow"] = "GET, HEAD"
+		w.WriteHeaders(h)
+		return
+	}
+
+	urlPath, query, _ := strings.Cut(request.OriginForm(req.RequestLine.RequestTarget), "?")
+	decoded, err := url.PathUnescape(urlPath)
+	if err != nil || !strings.HasPrefix(decoded, "/") || strings.ContainsRune(decoded, 0) {
+		server.WriteError(w, server.HandleError{StatusCode: response.BadRequest, Message: "invalid path"})
+		return
+	}
+	clean := path.Clean(decoded)
+
+	name, info, err := f.lookup(strings.TrimPrefix(clean, "/"))
+	if err == nil && info.IsDir() && !strings.HasSuffix(decoded, "/") {
+		// the slash makes relative links in the page resolve inside the
+		// directory
+		location := (&url.URL{Path: strings.TrimSuffix(clean, "/") + "/"}).EscapedPath()
+		if query != "" {
+			location += "?" + query
+		}
+		w.WriteStatusLine(response.MovedPermanently)
+		h := response.GetDefaultHeaders(0)
+		h["location"] = location
+		w.WriteHeaders(h)
+		return
+	}
+	if err == nil && !info.IsDir() && strings.HasSuffix(decoded, "/") {
+		err = syscall.ENOTDIR
+	}
+	if err == nil && info.IsDir() {
+		dir := name
+		name, info, err = f.lookup(path.Join(dir, "index.html"))
+		if errors.Is(err, fs.ErrNotExist) && f.Listings {
+			f.serveListing(w, req, dir, clean)
+			return
+		}
+		if err == nil && info.IsDir() {
+			err = fs.ErrNotExist
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) && f.HTMLExtensions && path.Ext(clean) == "" && clean != "/" {
+		name, info, err = f.lookup(strings.TrimPrefix(clean, "/") + ".html")
+	}
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+	f.serveFile(w, req, name, info)
+}
+
+// lookup finds name in Root, following symbolic links, and returns the
+// name it really has there.
+func (f *FileServer) lookup(name string) (string, fs.FileInfo, error) {
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		return "", nil, fs.ErrNotExist
+	}
+	if !f.AllowDotfiles && hasDotfile(name) {
+		return "", nil, errHidden
+	}
+	resolved, err := resolve(f.Root, name)
+	if err != nil {
+		return "", nil, err
+	}
+	// a link can lead to a dotfile under another name
+	if !f.AllowDotfiles && hasDotfile(resolved) {
+		return "", nil, errHidden
+	}
+	info, err := fs.Stat(f.Root, resolved)
+	if err != nil {
+		return "", nil, err
+	}
+	return resolved, info, nil
+}
+
+func (f *FileServer) serveFile(w *response.Writer, req *request.Request, name string, info fs.FileInfo) {
+	file, err := f.Root.Open(name)
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+	defer file.Close()
+
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		// file systems that can't seek get their files read whole, for
+		// ranges and sniffing
+		b, err := io.ReadAll(file)
+		if err != nil {
+			writeFSError(w, err)
+			return
+		}
+		content = bytes.NewReader(b)
+	}
+	ServeContent(w, req, info.Name(), info.ModTime(), content, nil)
+}
+
+// hasDotfile reports whether any element of the slash separated name
+// starts with a dot. "." alone is the root.
+func hasDotfile(name string) bool {
+	for elem := range strings.SplitSeq(name, "/") {
+		if strings.HasPrefix(elem, ".") && elem != "." {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve follows the symbolic links along name one element at a time,
+// and returns the path it leads to within fsys, which has none left. Links
+// leading out of fsys, by an absolute target or too many "..", fail with
+// errOutside. File systems without links have name returned as it is.
+func resolve(fsys fs.FS, name string) (string, error) {
+	links, ok := fsys.(fs.ReadLinkFS)
+	if !ok || name == "." {
+		return name, nil
+	}
+
+	resolved := "."
+	rest := strings.Split(name, "/")
+	followed := 0
+	for len(rest) > 0 {
+		next := path.Join(resolved, rest[0])
+		rest = rest[1:]
+		info, err := links.Lstat(next)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if followed++; followed > maxSymlinks {
+			return "", fmt.Errorf("%s: %w", name, errLoop)
+		}
+		target, err := links.ReadLink(next)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			return "", errOutside
+		}
+		// the target is relative to the directory holding the link, which
+		// has no links in it, and may have links of its own
+		target = path.Join(resolved, target)
+		if target == ".." || strings.HasPrefix(target, "../") {
+			return "", errOutside
+		}
+		resolved = "."
+		if target != "." {
+			rest = append(strings.Split(target, "/"), rest...)
+		}
+	}
+	return resolved, nil
+}
+
+// writeFSError answers for a file that couldn't be served. Hidden files
+// and links out of the root or in a loop look missing, so as not to give
+// away that they exist.
+func writeFSError(w *response.Writer, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, syscall.ENOTDIR),
+		errors.Is(err, errHidden), errors.Is(err, errOutside), errors.Is(err, errLoop):
+		server.WriteError(w, server.HandleError{StatusCode: response.NotFound, Message: "file not found"})
+	case errors.Is(err, fs.ErrPermission):
+		server.WriteError(w, server.HandleError{StatusCode: response.Forbidden, Message: "permission denied"})
+	default:
+		server.WriteError(w, server.HandleError{StatusCode: response.InternalServerError, Message: "can't read file"})
+	}
+}
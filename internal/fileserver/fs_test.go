@@ -0,0 +1,210 @@
+package fileserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSite lays out a site to serve, next to a secret it mustn't give away,
+// and returns its root.
+func newSite(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	root := filepath.Join(dir, "site")
+	for name, content := range map[string]string{
+		"hello.txt":       "hello",
+		"a file.txt":      "spaced",
+		"<b>.txt":         "bold",
+		"about.html":      "<p>about</p>",
+		"page":            "<!DOCTYPE html><p>page</p>",
+		"blob":            "\x00\x01\x02",
+		".env":            "SECRET=1",
+		".git/config":     "[core]",
+		"docs/index.html": "<p>docs</p>",
+		"docs/style.css":  "p {}",
+		"empty/.keep":     "",
+	} {
+		name = filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(name), 0o755))
+		require.NoError(t, os.WriteFile(name, []byte(content), 0o644))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("outside"), 0o644))
+	for link, target := range map[string]string{
+		"greeting":     "hello.txt",
+		"manual":       "docs",
+		"docs/up":      "../hello.txt",
+		"escape":       "../secret.txt",
+		"deep-escape":  "docs/../../secret.txt",
+		"absolute":     filepath.Join(dir, "secret.txt"),
+		"env":          ".env",
+		"loop":         "loop",
+		"docs/escaper": "../../secret.txt",
+	} {
+		require.NoError(t, os.Symlink(target, filepath.Join(root, link)))
+	}
+	return root
+}
+
+// get has f handle a request, and parses what it wrote.
+func get(t *testing.T, f *FileServer, method, target string, lines ...string) *response.Response {
+	t.Helper()
+	raw := method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n" + strings.Join(lines, "") + "\r\n"
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	w := response.NewResponseWriter(&buf)
+	f.Handle(&w, req)
+	resp, err := response.ResponseFromReader(&buf, method)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestFileServer(t *testing.T) {
+	f := &FileServer{Root: os.DirFS(newSite(t))}
+
+	// Test: Files are served with their type
+	for target, want := range map[string]struct{ body, contentType string }{
+		"/hello.txt":      {"hello", "text/plain; charset=utf-8"},
+		"/a%20file.txt":   {"spaced", "text/plain; charset=utf-8"},
+		"/docs/style.css": {"p {}", "text/css; charset=utf-8"},
+		"/page":           {"<!DOCTYPE html><p>page</p>", "text/html; charset=utf-8"},
+		"/blob":           {"\x00\x01\x02", "application/octet-stream"},
+		"/docs/":          {"<p>docs</p>", "text/html; charset=utf-8"},
+		"/hello.txt?x=1":  {"hello", "text/plain; charset=utf-8"},
+		// absolute-form, as proxy clients send it
+		"http://static.localhost/hello.txt": {"hello", "text/plain; charset=utf-8"},
+		"http://static.localhost/docs/":     {"<p>docs</p>", "text/html; charset=utf-8"},
+	} {
+		resp := get(t, f, "GET", target)
+		assert.Equal(t, response.OK, resp.StatusLine.StatusCode, target)
+		assert.Equal(t, want.body, string(resp.Body), target)
+		assert.Equal(t, want.contentType, resp.Headers.Get("content-type"), target)
+		assert.NotEmpty(t, resp.Headers.Get("etag"), target)
+	}
+
+	// Test: Links within the root are followed
+	for target, want := range map[string]string{"/greeting": "hello", "/manual/style.css": "p {}", "/docs/up": "hello"} {
+		resp := get(t, f, "GET", target)
+		assert.Equal(t, response.OK, resp.StatusLine.StatusCode, target)
+		assert.Equal(t, want, string(resp.Body), target)
+	}
+
+	// Test: Nothing outside the root, hidden or missing is served
+	for _, target := range []string{
+		"/../secret.txt", "/..%2fsecret.txt", "/%2e%2e/secret.txt", "/docs/../../secret.txt",
+		"/escape", "/deep-escape", "/absolute", "/docs/escaper", "/loop",
+		"/.env", "/%2eenv", "/.git/config", "/docs/../.env", "/env",
+		"/missing", "/hello.txt/", "/hello.txt/x", "/empty/",
+	} {
+		resp := get(t, f, "GET", target)
+		assert.Equal(t, response.NotFound, resp.StatusLine.StatusCode, target)
+		assert.NotContains(t, string(resp.Body), "outside", target)
+		assert.NotContains(t, string(resp.Body), "SECRET", target)
+	}
+
+	// Test: Directories without their slash are redirected to it
+	for target, want := range map[string]string{"/docs": "/docs/", "/docs?v=2": "/docs/?v=2", "/manual": "/manual/", "/docs/.": "/docs/", "/.": "/"} {
+		resp := get(t, f, "GET", target)
+		assert.Equal(t, response.MovedPermanently, resp.StatusLine.StatusCode, target)
+		assert.Equal(t, want, resp.Headers.Get("location"), target)
+	}
+
+	// Test: Only GET and HEAD, and paths have to decode
+	resp := get(t, f, "POST", "/hello.txt")
+	assert.Equal(t, response.MethodNotAllowed, resp.StatusLine.StatusCode)
+	assert.Equal(t, "GET, HEAD", resp.Headers.Get("allow"))
+	resp = get(t, f, "HEAD", "/hello.txt")
+	assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "5", resp.Headers.Get("content-length"))
+	for _, target := range []string{"/%zz", "/a%00b"} {
+		resp = get(t, f, "GET", target)
+		assert.Equal(t, response.BadRequest, resp.StatusLine.StatusCode, target)
+	}
+}
+
+func TestFileServerOptions(t *testing.T) {
+	root := newSite(t)
+
+	// Test: Dotfiles can be allowed, links out still can't
+	f := &FileServer{Root: os.DirFS(root), AllowDotfiles: true}
+	resp := get(t, f, "GET", "/.env")
+	assert.Equal(t, "SECRET=1", string(resp.Body))
+	resp = get(t, f, "GET", "/escape")
+	assert.Equal(t, response.NotFound, resp.StatusLine.StatusCode)
+
+	// Test: Clean URLs find their .html
+	f = &FileServer{Root: os.DirFS(root), HTMLExtensions: true}
+	resp = get(t, f, "GET", "/about")
+	assert.Equal(t, "<p>about</p>", string(resp.Body))
+	assert.Equal(t, "text/html; charset=utf-8", resp.Headers.Get("content-type"))
+	resp = get(t, (&FileServer{Root: os.DirFS(root)}), "GET", "/about")
+	assert.Equal(t, response.NotFound, resp.StatusLine.StatusCode)
+
+	// Test: Listings come as HTML, escaped, without hidden files
+	f = &FileServer{Root: os.DirFS(root), Listings: true}
+	resp = get(t, f, "GET", "/")
+	assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Headers.Get("content-type"))
+	body := string(resp.Body)
+	assert.Contains(t, body, `<a href="./hello.txt">hello.txt</a>`)
+	assert.Contains(t, body, `<a href="./a%20file.txt">a file.txt</a>`)
+	assert.Contains(t, body, `<a href="./docs/">docs/</a>`)
+	assert.Contains(t, body, `<a href="./manual/">manual/</a>`)
+	assert.Contains(t, body, `&lt;b&gt;.txt`)
+	assert.NotContains(t, body, "<b>")
+	assert.NotContains(t, body, ".env")
+	assert.NotContains(t, body, `href="../"`)
+
+	// Test: Or as JSON, for clients asking for it
+	resp = get(t, f, "GET", "/empty/", "Accept: application/json\r\n")
+	assert.Equal(t, "application/json", resp.Headers.Get("content-type"))
+	var entries []listingEntry
+	require.NoError(t, json.Unmarshal(resp.Body, &entries))
+	assert.Empty(t, entries)
+	resp = get(t, f, "GET", "/", "Accept: application/json\r\n")
+	require.NoError(t, json.Unmarshal(resp.Body, &entries))
+	names := map[string]bool{}
+	for _, e := range entries {
+		names[e.Name] = e.Dir
+	}
+	assert.Equal(t, true, names["docs"])
+	assert.Equal(t, false, names["hello.txt"])
+	assert.NotContains(t, names, ".git")
+
+	// Test: Links are listed as what they lead to, those leading out of
+	// the root not at all
+	assert.Equal(t, true, names["manual"])
+	assert.Equal(t, false, names["greeting"])
+	for _, name := range []string{"escape", "deep-escape", "absolute", "env", "loop"} {
+		assert.NotContains(t, names, name)
+	}
+
+	// Test: Directories with an index.html aren't listed
+	resp = get(t, f, "GET", "/docs/")
+	assert.Equal(t, "<p>docs</p>", string(resp.Body))
+}
+
+func TestFileServerFS(t *testing.T) {
+	// Test: Any fs.FS can be served
+	f := &FileServer{Root: fstest.MapFS{
+		"data.json":    {Data: []byte(`{"a":1}`)},
+		"sub/notes.md": {Data: []byte("# notes")},
+	}}
+	resp := get(t, f, "GET", "/data.json")
+	assert.Equal(t, `{"a":1}`, string(resp.Body))
+	assert.Equal(t, "application/json", resp.Headers.Get("content-type"))
+	resp = get(t, f, "GET", "/sub/notes.md", "Range: bytes=2-\r\n")
+	assert.Equal(t, response.PartialContent, resp.StatusLine.StatusCode)
+	assert.Equal(t, "notes", string(resp.Body))
+}
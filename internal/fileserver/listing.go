@@ -0,0 +1,100 @@
+package fileserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io/fs"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/headers"
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+)
+
+// listingEntry is a file of a directory listing, as its JSON has it.
+type listingEntry struct {
+	Name    string    `json:"name"`
+	Dir     bool      `json:"dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// Href links to the entry from the directory's page. "./" keeps names
+// with a colon from reading as a URL scheme.
+func (e listingEntry) Href() string {
+	href := "./" + url.PathEscape(e.Name)
+	if e.Dir {
+		href += "/"
+	}
+	return href
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<ul>
+{{- if ne .Path "/"}}
+<li><a href="../">../</a></li>
+{{- end}}
+{{- range .Entries}}
+<li><a href="{{.Href}}">{{.Name}}{{if .Dir}}/{{end}}</a></li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+// serveListing lists dir, which the client asked for as urlPath. Hidden
+// files are left out unless they are allowed.
+func (f *FileServer) serveListing(w *response.Writer, req *request.Request, dir, urlPath string) {
+	dirEntries, err := fs.ReadDir(f.Root, dir)
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+	entries := []listingEntry{}
+	for _, d := range dirEntries {
+		if !f.AllowDotfiles && strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		// links are listed as what they lead to, and left out like a
+		// request for them would be turned away
+		_, info, err := f.lookup(path.Join(dir, d.Name()))
+		if err != nil {
+			// gone since it was listed, or a link out of the root
+			continue
+		}
+		entries = append(entries, listingEntry{
+			Name:    d.Name(),
+			Dir:     info.IsDir(),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UTC(),
+		})
+	}
+
+	var buf bytes.Buffer
+	contentType := "text/html; charset=utf-8"
+	if strings.Contains(req.Headers.Get("accept"), "application/json") {
+		contentType = "application/json"
+		err = json.NewEncoder(&buf).Encode(entries)
+	} else {
+		err = listingTemplate.Execute(&buf, struct {
+			Path    string
+			Entries []listingEntry
+		}{strings.TrimSuffix(urlPath, "/") + "/", entries})
+	}
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+	// listings change whenever the directory does, so caches are told to
+	// check first, and the two forms don't share a cache entry
+	h := headers.Headers{"content-type": contentType, "cache-control": "no-cache", "vary": "Accept"}
+	ServeContent(w, req, dir, time.Time{}, bytes.NewReader(buf.Bytes()), h)
+}
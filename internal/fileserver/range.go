@@ -0,0 +1,120 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// byteRange is a part of the content, already cut to fit it.
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+var (
+	// errInvalidRange is a Range header that doesn't parse, which is
+	// ignored.
+	errInvalidRange = errors.New("invalid range")
+	// errNoOverlap is a Range header whose ranges all lie past the end of
+	// the content, which is answered with 416.
+	errNoOverlap = errors.New("no range overlaps the content")
+)
+
+// parseRange parses a Range header value, RFC 9110 section 14.1.2, for
+// content that is size bytes long. Ranges starting past the end are
+// dropped, and those running past it are cut short.
+func parseRange(s string, size int64) ([]byteRange, error) {
+	unit, set, ok := strings.Cut(s, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, errInvalidRange
+	}
+	var ranges []byteRange
+	specs := 0
+	for spec := range strings.SplitSeq(set, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		specs++
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+
+		// "-n" is the last n bytes
+		if first == "" {
+			n, err := parseDigits(last)
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			ranges = append(ranges, byteRange{start: size - n, length: n})
+			continue
+		}
+
+		start, err := parseDigits(first)
+		if err != nil {
+			return nil, err
+		}
+		end := size - 1
+		if last != "" {
+			if end, err = parseDigits(last); err != nil {
+				return nil, err
+			}
+			if end < start {
+				return nil, errInvalidRange
+			}
+		}
+		if start >= size {
+			continue
+		}
+		end = min(end, size-1)
+		ranges = append(ranges, byteRange{start: start, length: end - start + 1})
+	}
+	if specs == 0 {
+		return nil, errInvalidRange
+	}
+	if len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+// parseDigits parses a non-negative decimal, without the signs and spaces
+// strconv would let through.
+func parseDigits(s string) (int64, error) {
+	if s == "" {
+		return 0, errInvalidRange
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, errInvalidRange
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errInvalidRange
+	}
+	return n, nil
+}
+
+// ifRangeMatches reports whether an If-Range value still describes the
+// content, RFC 9110 section 13.1.5: an entity tag equal to etag under the
+// strong comparison, or the date it was last modified.
+func ifRangeMatches(value, etag string, modtime time.Time) bool {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "W/") {
+		return value == etag && !strings.HasPrefix(etag, "W/")
+	}
+	t, ok := parseHTTPDate(value)
+	return ok && !modtime.IsZero() && t.Equal(modtime.UTC().Truncate(time.Second))
+}
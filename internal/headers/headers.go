@@ -1,13 +1,19 @@
 package headers
 
 import (
+	"bytes"
 	"errors"
-	"fmt"
 	"strings"
 )
 
 type Headers map[string]string
 
+var (
+	ErrBareLineEnding      = errors.New("bare CR or LF in field line")
+	ErrObsoleteLineFolding = errors.New("obsolete line folding is not allowed")
+	ErrInvalidFieldLine    = errors.New("invalid field line")
+)
+
 func (h Headers) Get(key string) string {
 	v, ok := h[strings.ToLower(key)]
 	if !ok {
@@ -20,42 +26,100 @@ func (h Headers) Get(key string) string {
 // if data does not contain CRLF, it returns early as
 // it does not have enough data yet
 func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+	return h.parse(data, false)
+}
+
+// ParseStrict works like Parse, but rejects every field line that RFC 9112
+// considers ambiguous instead of trying to make sense of it: bare CR or LF,
+// obsolete line folding, whitespace around the field name and control
+// characters inside the value.
+func (h Headers) ParseStrict(data []byte) (n int, done bool, err error) {
+	return h.parse(data, true)
+}
 
-	allContent := string(data)
-	idx := strings.Index(allContent, "\r\n")
+func (h Headers) parse(data []byte, strict bool) (n int, done bool, err error) {
+	idx := bytes.Index(data, crlf)
 	if idx == -1 {
+		if strict && bytes.IndexByte(data, '\n') != -1 {
+			return 0, false, ErrBareLineEnding
+		}
 		return 0, false, nil
 	}
 
-	lineContent := strings.TrimSpace(allContent[:idx])
-	bytesConsumed := idx + 2
-
-	// TODO: Flimsyish logic, need to review still
-	if len(lineContent) == 0 && strings.Count(allContent, "\r\n") == 1 {
+	key, value, done, err := ParseFieldLine(data[:idx], strict)
+	if err != nil {
+		return 0, false, err
+	}
+	if done {
 		return 2, true, nil
 	}
+	h.Add(key, value)
+	return idx + 2, false, nil
+}
+
+var crlf = []byte("\r\n")
+
+// ParseFieldLine parses a single field line, without its CRLF, and hands
+// back the lowercased name and the value without storing them anywhere.
+// done is set for the empty line that ends a field section. Only the name
+// and value are copied out of line.
+func ParseFieldLine(line []byte, strict bool) (name, value string, done bool, err error) {
+	if strict {
+		if bytes.IndexByte(line, '\r') != -1 || bytes.IndexByte(line, '\n') != -1 {
+			return "", "", false, ErrBareLineEnding
+		}
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			return "", "", false, ErrObsoleteLineFolding
+		}
+	}
 
-	idxColon := strings.Index(lineContent, ":")
+	lineContent := bytes.TrimSpace(line)
+	if len(lineContent) == 0 {
+		if strict && len(line) != 0 {
+			return "", "", false, ErrInvalidFieldLine
+		}
+		return "", "", true, nil
+	}
+
+	idxColon := bytes.IndexByte(lineContent, ':')
 
 	if idxColon <= 0 || lineContent[idxColon-1] == ' ' {
-		return 0, false, errors.ErrUnsupported
+		return "", "", false, errors.ErrUnsupported
 	}
 
-	key := strings.ToLower(strings.TrimSpace(lineContent[:idxColon]))
-	value := strings.TrimSpace(lineContent[idxColon+2:])
+	key := bytes.TrimSpace(lineContent[:idxColon])
+	rawValue := bytes.TrimSpace(lineContent[idxColon+1:])
 
-	if !isValidHeaderChars(key) {
-		return 0, false, errors.ErrUnsupported
+	if strict {
+		// no leading whitespace at this point, so the colon is where it was
+		// in line and anything between the name and it is an error
+		key = line[:idxColon]
+		if !isValidHeaderBytes(key) {
+			return "", "", false, ErrInvalidFieldLine
+		}
+		rawValue = bytes.Trim(line[idxColon+1:], " \t")
+		if !isValidFieldValue(rawValue) {
+			return "", "", false, ErrInvalidFieldLine
+		}
 	}
 
-	_, ok := h[key]
+	if !isValidHeaderBytes(key) {
+		return "", "", false, errors.ErrUnsupported
+	}
+
+	return lowerName(key), string(rawValue), false, nil
+}
+
+// Add appends value to key, joining repeated fields with ", " the way
+// RFC 9110 section 5.3 allows.
+func (h Headers) Add(key, value string) {
+	key = strings.ToLower(key)
+	existing, ok := h[key]
 	if ok {
-		h[key] += fmt.Sprintf(", %s", value)
+		h[key] = existing + ", " + value
 	} else {
 		h[key] = value
 	}
-
-	return bytesConsumed, false, nil
 }
 
 func NewHeaders() Headers {
@@ -84,5 +84,47 @@ func TestHeaders(t *testing.T) {
 	n, done, err = headers.Parse(data[n+o+p:])
 	assert.True(t, done)
 	assert.Equal(t, "lane-loves-go, prime-loves-zig, tj-loves-ocaml", headers["set-person"])
+}
+
+func TestHeadersStrict(t *testing.T) {
+	// Test: Valid single header
+	headers := NewHeaders()
+	data := []byte("Host: localhost:42069\r\n\r\n")
+	n, done, err := headers.ParseStrict(data)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, 23, n)
+	assert.False(t, done)
+
+	// Test: Leading whitespace is obsolete line folding
+	headers = NewHeaders()
+	data = []byte("       Host: localhost:42069       \r\n\r\n")
+	n, done, err = headers.ParseStrict(data)
+	require.ErrorIs(t, err, ErrObsoleteLineFolding)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
 
+	// Test: Tab before the colon
+	headers = NewHeaders()
+	data = []byte("Host\t: localhost:42069\r\n\r\n")
+	_, _, err = headers.ParseStrict(data)
+	require.ErrorIs(t, err, ErrInvalidFieldLine)
+
+	// Test: Bare LF
+	headers = NewHeaders()
+	data = []byte("Host: localhost:42069\nX-Other: 1\r\n\r\n")
+	_, _, err = headers.ParseStrict(data)
+	require.ErrorIs(t, err, ErrBareLineEnding)
+
+	// Test: Control character in the value
+	headers = NewHeaders()
+	data = []byte("Host: local\x00host\r\n\r\n")
+	_, _, err = headers.ParseStrict(data)
+	require.ErrorIs(t, err, ErrInvalidFieldLine)
+
+	// Test: Whitespace only line is not the end of the headers
+	headers = NewHeaders()
+	data = []byte("  \r\n")
+	_, _, err = headers.ParseStrict(data)
+	require.Error(t, err)
 }
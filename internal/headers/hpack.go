@@ -0,0 +1,491 @@
+package headers
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// HPACK, the header compression of HTTP/2 (RFC 7541).
+
+// ErrInvalidHPACK is what decoding a malformed header block fails with. To
+// HTTP/2 it is a COMPRESSION_ERROR, fatal to the connection, as the decoder's
+// table can no longer be trusted to match the encoder's.
+var ErrInvalidHPACK = errors.New("hpack: invalid header block")
+
+// HeaderField is a name and value as HPACK sees them: names are lowercase,
+// pseudo-header fields (":method", ":status", ...) included, and fields
+// keep their order.
+type HeaderField struct {
+	Name, Value string
+	// Sensitive fields are never put in a compression table, by us or by
+	// any intermediary, so their values can't be guessed at by watching
+	// the compressed size of later requests. Decoded fields have it set
+	// when the sender asked for that.
+	Sensitive bool
+}
+
+// size is what an entry costs in a dynamic table, RFC 7541 section 4.1.
+func (f HeaderField) size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + 32)
+}
+
+// DefaultTableSize is the dynamic table size both ends start with.
+const DefaultTableSize = 4096
+
+// staticTable is RFC 7541 Appendix A. HPACK indexes are 1-based.
+var staticTable = [...]HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// for the encoder: the index of each static name, and of each static name
+// and value pair
+var (
+	staticNameIndex  = make(map[string]uint64)
+	staticFieldIndex = make(map[HeaderField]uint64)
+)
+
+func init() {
+	for i, f := range staticTable {
+		if _, ok := staticNameIndex[f.Name]; !ok {
+			staticNameIndex[f.Name] = uint64(i + 1)
+		}
+		staticFieldIndex[f] = uint64(i + 1)
+	}
+}
+
+// dynamicTable is the table both ends build up as fields are sent with
+// incremental indexing. New entries go in at index 62 and push older ones
+// up; the oldest are evicted to stay within maxSize.
+type dynamicTable struct {
+	entries []HeaderField // oldest first
+	size    uint32
+	maxSize uint32
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	f.Sensitive = false
+	t.entries = append(t.entries, f)
+	t.size += f.size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(n uint32) {
+	t.maxSize = n
+	t.evict()
+}
+
+func (t *dynamicTable) evict() {
+	n := 0
+	for t.size > t.maxSize {
+		t.size -= t.entries[n].size()
+		n++
+	}
+	if n > 0 {
+		t.entries = slices.Delete(t.entries, 0, n)
+	}
+}
+
+// get looks up an index of the combined static and dynamic index space.
+func (t *dynamicTable) get(i uint64) (HeaderField, bool) {
+	switch {
+	case i == 0:
+		return HeaderField{}, false
+	case i <= uint64(len(staticTable)):
+		return staticTable[i-1], true
+	}
+	i -= uint64(len(staticTable)) + 1
+	if i >= uint64(len(t.entries)) {
+		return HeaderField{}, false
+	}
+	return t.entries[len(t.entries)-1-int(i)], true
+}
+
+// search finds f in the static and dynamic tables. An index with exact
+// false only matched the name.
+func (t *dynamicTable) search(f HeaderField) (index uint64, exact bool) {
+	if i, ok := staticFieldIndex[HeaderField{Name: f.Name, Value: f.Value}]; ok {
+		return i, true
+	}
+	index = staticNameIndex[f.Name]
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		e := t.entries[i]
+		if e.Name != f.Name {
+			continue
+		}
+		dynamicIndex := uint64(len(staticTable) + len(t.entries) - i)
+		if e.Value == f.Value {
+			return dynamicIndex, true
+		}
+		if index == 0 {
+			index = dynamicIndex
+		}
+	}
+	return index, false
+}
+
+// Decoder decodes the header blocks of one direction of a connection. The
+// blocks have to be decoded in the order they were sent, since each can
+// change the table the next one refers to.
+type Decoder struct {
+	table dynamicTable
+	// the most the encoder may grow the table to, as we told it
+	maxTableSize uint32
+	// whether anything but a table size update has been seen in the
+	// current block
+	pastSizeUpdates bool
+}
+
+// NewDecoder returns a decoder that allows the encoder a table of
+// maxTableSize bytes, SETTINGS_HEADER_TABLE_SIZE in HTTP/2.
+func NewDecoder(maxTableSize uint32) *Decoder {
+	return &Decoder{table: dynamicTable{maxSize: maxTableSize}, maxTableSize: maxTableSize}
+}
+
+// Decode decodes a complete header block, all HEADERS and CONTINUATION
+// fragments put together.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	d.pastSizeUpdates = false
+	for len(block) > 0 {
+		var f HeaderField
+		var ok bool
+		var err error
+		f, ok, block, err = d.decodeField(block)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			fields = append(fields, f)
+		}
+	}
+	return fields, nil
+}
+
+// decodeField decodes one representation off the front of b. ok is false
+// for a table size update, which carries no field.
+func (d *Decoder) decodeField(b []byte) (f HeaderField, ok bool, rest []byte, err error) {
+	switch {
+	case b[0]&0x80 != 0:
+		// indexed field, section 6.1
+		d.pastSizeUpdates = true
+		i, rest, err := readInt(b, 7)
+		if err != nil {
+			return f, false, nil, err
+		}
+		f, found := d.table.get(i)
+		if !found {
+			return f, false, nil, fmt.Errorf("%w: index %d out of range", ErrInvalidHPACK, i)
+		}
+		return f, true, rest, nil
+
+	case b[0]&0xC0 == 0x40:
+		// literal with incremental indexing, section 6.2.1
+		f, rest, err = d.decodeLiteral(b, 6)
+		if err != nil {
+			return f, false, nil, err
+		}
+		d.table.add(f)
+		return f, true, rest, nil
+
+	case b[0]&0xE0 == 0x20:
+		// dynamic table size update, section 6.3
+		if d.pastSizeUpdates {
+			return f, false, nil, fmt.Errorf("%w: table size update after the first field", ErrInvalidHPACK)
+		}
+		size, rest, err := readInt(b, 5)
+		if err != nil {
+			return f, false, nil, err
+		}
+		if size > uint64(d.maxTableSize) {
+			return f, false, nil, fmt.Errorf("%w: table size %d over the limit of %d", ErrInvalidHPACK, size, d.maxTableSize)
+		}
+		d.table.setMaxSize(uint32(size))
+		return f, false, rest, nil
+
+	default:
+		// literal without indexing (0000) or never indexed (0001),
+		// sections 6.2.2 and 6.2.3
+		f, rest, err = d.decodeLiteral(b, 4)
+		f.Sensitive = b[0]&0x10 != 0
+		return f, err == nil, rest, err
+	}
+}
+
+// decodeLiteral decodes a literal field whose name index has an n-bit
+// prefix, index 0 meaning the name follows as a string.
+func (d *Decoder) decodeLiteral(b []byte, n int) (HeaderField, []byte, error) {
+	d.pastSizeUpdates = true
+	var f HeaderField
+	i, b, err := readInt(b, n)
+	if err != nil {
+		return f, nil, err
+	}
+	if i == 0 {
+		if f.Name, b, err = readString(b); err != nil {
+			return f, nil, err
+		}
+	} else {
+		named, ok := d.table.get(i)
+		if !ok {
+			return f, nil, fmt.Errorf("%w: index %d out of range", ErrInvalidHPACK, i)
+		}
+		f.Name = named.Name
+	}
+	f.Value, b, err = readString(b)
+	return f, b, err
+}
+
+// SetMaxTableSize changes the limit the encoder's table size updates are
+// held to, when our SETTINGS_HEADER_TABLE_SIZE changes.
+func (d *Decoder) SetMaxTableSize(n uint32) {
+	d.maxTableSize = n
+	if d.table.maxSize > n {
+		d.table.setMaxSize(n)
+	}
+}
+
+// Encoder encodes the header blocks of one direction of a connection.
+type Encoder struct {
+	table dynamicTable
+
+	// a table size change that has to be signalled at the start of the next
+	// block, and the smallest size the table went down to before it
+	sizeUpdate bool
+	minSize    uint32
+}
+
+// NewEncoder returns an encoder using a table of DefaultTableSize, which
+// every decoder starts out allowing.
+func NewEncoder() *Encoder {
+	return &Encoder{table: dynamicTable{maxSize: DefaultTableSize}}
+}
+
+// Encode appends the header block for fields to dst.
+func (e *Encoder) Encode(dst []byte, fields []HeaderField) []byte {
+	if e.sizeUpdate {
+		if e.minSize < e.table.maxSize {
+			dst = appendInt(dst, 5, 0x20, uint64(e.minSize))
+		}
+		dst = appendInt(dst, 5, 0x20, uint64(e.table.maxSize))
+		e.sizeUpdate = false
+	}
+	for _, f := range fields {
+		dst = e.encodeField(dst, f)
+	}
+	return dst
+}
+
+// SetMaxTableSize applies the peer's SETTINGS_HEADER_TABLE_SIZE. The table
+// never grows past DefaultTableSize, and the change is announced at the
+// start of the next block.
+func (e *Encoder) SetMaxTableSize(n uint32) {
+	n = min(n, DefaultTableSize)
+	if n == e.table.maxSize && !e.sizeUpdate {
+		return
+	}
+	if !e.sizeUpdate || n < e.minSize {
+		e.minSize = n
+	}
+	e.sizeUpdate = true
+	e.table.setMaxSize(n)
+}
+
+func (e *Encoder) encodeField(dst []byte, f HeaderField) []byte {
+	index, exact := e.table.search(f)
+	switch {
+	case f.Sensitive:
+		// never indexed, section 6.2.3. Only the name may come from a
+		// table, the value always goes out as it is.
+		return appendLiteral(dst, 4, 0x10, index, f)
+	case exact:
+		return appendInt(dst, 7, 0x80, index)
+	case f.size() > e.table.maxSize:
+		// it wouldn't fit, and adding it would only empty the table.
+		// Literal without indexing, section 6.2.2.
+		return appendLiteral(dst, 4, 0, index, f)
+	}
+	// literal with incremental indexing, so the next one is a single byte
+	e.table.add(f)
+	return appendLiteral(dst, 6, 0x40, index, f)
+}
+
+// appendLiteral appends a literal field representation, with the name
+// taken from index if it isn't 0.
+func appendLiteral(dst []byte, n int, flags byte, index uint64, f HeaderField) []byte {
+	dst = appendInt(dst, n, flags, index)
+	if index == 0 {
+		dst = appendString(dst, f.Name)
+	}
+	return appendString(dst, f.Value)
+}
+
+// appendInt appends i as an HPACK integer with an n-bit prefix, section
+// 5.1. flags fills the bits of the first byte above the prefix.
+func appendInt(dst []byte, n int, flags byte, i uint64) []byte {
+	limit := uint64(1)<<n - 1
+	if i < limit {
+		return append(dst, flags|byte(i))
+	}
+	dst = append(dst, flags|byte(limit))
+	i -= limit
+	for i >= 0x80 {
+		dst = append(dst, byte(i)|0x80)
+		i >>= 7
+	}
+	return append(dst, byte(i))
+}
+
+// readInt reads an HPACK integer with an n-bit prefix off the front of b.
+func readInt(b []byte, n int) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, fmt.Errorf("%w: truncated integer", ErrInvalidHPACK)
+	}
+	limit := uint64(1)<<n - 1
+	i := uint64(b[0]) & limit
+	if i < limit {
+		return i, b[1:], nil
+	}
+	for j, shift := 1, 0; j < len(b); j, shift = j+1, shift+7 {
+		// anything that needs more than 63 bits is an attack rather than
+		// a header
+		if shift > 56 {
+			return 0, nil, fmt.Errorf("%w: integer overflow", ErrInvalidHPACK)
+		}
+		i += uint64(b[j]&0x7F) << shift
+		if b[j]&0x80 == 0 {
+			return i, b[j+1:], nil
+		}
+	}
+	return 0, nil, fmt.Errorf("%w: truncated integer", ErrInvalidHPACK)
+}
+
+// appendString appends s as a string literal, section 5.2, Huffman coded
+// unless that makes it longer. Ties go to Huffman, as in the RFC's
+// examples.
+func appendString(dst []byte, s string) []byte {
+	if n := huffmanEncodedLen(s); n <= len(s) && len(s) > 0 {
+		dst = appendInt(dst, 7, 0x80, uint64(n))
+		return appendHuffman(dst, s)
+	}
+	dst = appendInt(dst, 7, 0, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// readString reads a string literal off the front of b, Huffman coded or
+// not.
+func readString(b []byte) (string, []byte, error) {
+	if len(b) == 0 {
+		return "", nil, fmt.Errorf("%w: truncated string", ErrInvalidHPACK)
+	}
+	huffman := b[0]&0x80 != 0
+	length, b, err := readInt(b, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if length > uint64(len(b)) {
+		return "", nil, fmt.Errorf("%w: truncated string", ErrInvalidHPACK)
+	}
+	raw, rest := b[:length], b[length:]
+	if !huffman {
+		return string(raw), rest, nil
+	}
+	s, err := huffmanDecode(raw)
+	if err != nil {
+		return "", nil, err
+	}
+	return s, rest, nil
+}
+
+// Fields lists h as HPACK header fields, lowercased and in name order so
+// the same headers always compress the same. Credentials, and cookies short
+// enough to be guessed one at a time, are marked Sensitive, as RFC 7541
+// section 7.1.3 suggests.
+func (h Headers) Fields() []HeaderField {
+	fields := make([]HeaderField, 0, len(h))
+	for name, value := range h {
+		name = strings.ToLower(name)
+		sensitive := name == "authorization" || name == "proxy-authorization" ||
+			name == "cookie" && len(value) < 20
+		fields = append(fields, HeaderField{Name: name, Value: value, Sensitive: sensitive})
+	}
+	slices.SortFunc(fields, func(a, b HeaderField) int { return strings.Compare(a.Name, b.Name) })
+	return fields
+}
+
+// HeadersFromFields collects decoded header fields into Headers. Repeated
+// fields are joined the way Add does, except cookies, which are joined with
+// "; " (RFC 9113 section 8.2.3). Pseudo-header fields are kept under their
+// names, ":method" and the like.
+func HeadersFromFields(fields []HeaderField) Headers {
+	h := NewHeaders()
+	for _, f := range fields {
+		if cookie, ok := h["cookie"]; ok && f.Name == "cookie" {
+			h["cookie"] = cookie + "; " + f.Value
+			continue
+		}
+		h.Add(f.Name, f.Value)
+	}
+	return h
+}
@@ -0,0 +1,303 @@
+package headers
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+func fields(pairs ...string) []HeaderField {
+	var f []HeaderField
+	for i := 0; i < len(pairs); i += 2 {
+		f = append(f, HeaderField{Name: pairs[i], Value: pairs[i+1]})
+	}
+	return f
+}
+
+// the request examples of RFC 7541 Appendix C.3 and C.4, the same three
+// requests on one connection, without and with Huffman coding
+var (
+	exampleRequests = [][]HeaderField{
+		fields(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com"),
+		fields(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com", "cache-control", "no-cache"),
+		fields(":method", "GET", ":scheme", "https", ":path", "/index.html", ":authority", "www.example.com", "custom-key", "custom-value"),
+	}
+	exampleRequestsPlain = []string{
+		"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+		"8286 84be 5808 6e6f 2d63 6163 6865",
+		"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+	}
+	exampleRequestsHuffman = []string{
+		"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+		"8286 84be 5886 a8eb 1064 9cbf",
+		"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+	}
+)
+
+func TestHPACKDecode(t *testing.T) {
+	// Test: RFC 7541 C.3 and C.4, requests
+	for _, blocks := range [][]string{exampleRequestsPlain, exampleRequestsHuffman} {
+		d := NewDecoder(DefaultTableSize)
+		for i, block := range blocks {
+			got, err := d.Decode(unhex(t, block))
+			require.NoError(t, err)
+			assert.Equal(t, exampleRequests[i], got)
+		}
+		assert.Equal(t, uint32(164), d.table.size)
+	}
+
+	// Test: RFC 7541 C.5, responses with a 256 byte table, evicting
+	d := NewDecoder(256)
+	for _, tc := range []struct {
+		block string
+		want  []HeaderField
+		size  uint32
+	}{
+		{
+			"4803 3330 3258 0770 7269 7661 7465 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3120 474d 546e 1768 7474 7073 3a2f 2f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+			fields(":status", "302", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT", "location", "https://www.example.com"),
+			222,
+		},
+		{
+			"4803 3330 37c1 c0bf",
+			fields(":status", "307", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT", "location", "https://www.example.com"),
+			222,
+		},
+		{
+			"88c1 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3220 474d 54c0 5a04 677a 6970 7738 666f 6f3d 4153 444a 4b48 514b 425a 584f 5157 454f 5049 5541 5851 5745 4f49 553b 206d 6178 2d61 6765 3d33 3630 303b 2076 6572 7369 6f6e 3d31",
+			fields(":status", "200", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:22 GMT", "location", "https://www.example.com",
+				"content-encoding", "gzip", "set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"),
+			215,
+		},
+	} {
+		got, err := d.Decode(unhex(t, tc.block))
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, got)
+		assert.Equal(t, tc.size, d.table.size)
+	}
+
+	// Test: RFC 7541 C.2.2 and C.2.3, literals that stay out of the table
+	d = NewDecoder(DefaultTableSize)
+	got, err := d.Decode(unhex(t, "040c 2f73 616d 706c 652f 7061 7468"))
+	require.NoError(t, err)
+	assert.Equal(t, fields(":path", "/sample/path"), got)
+	got, err = d.Decode(unhex(t, "1008 7061 7373 776f 7264 0673 6563 7265 74"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{{Name: "password", Value: "secret", Sensitive: true}}, got)
+	assert.Empty(t, d.table.entries)
+
+	// Test: Table size updates, only at the start of a block
+	d = NewDecoder(DefaultTableSize)
+	_, err = d.Decode(unhex(t, "3f e1 1f 82"))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(4096), d.table.maxSize)
+	_, err = d.Decode(unhex(t, "20 82"))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), d.table.maxSize)
+
+	// Test: Malformed blocks
+	for name, block := range map[string]string{
+		"index 0":                   "80",
+		"index past the tables":     "be",
+		"truncated integer":         "ff",
+		"integer overflow":          "ff ff ff ff ff ff ff ff ff ff ff",
+		"truncated string":          "40 0a 6375 7374",
+		"size update too big":       "3f e2 1f",
+		"size update after a field": "82 20",
+		"huffman EOS":               "40 84 ff ff ff ff 00",
+		"huffman padding of zeros":  "00 81 00 81 00",
+		"huffman padding too long":  "00 82 1f ff 00",
+	} {
+		_, err := NewDecoder(DefaultTableSize).Decode(unhex(t, block))
+		assert.ErrorIs(t, err, ErrInvalidHPACK, name)
+	}
+}
+
+func TestHPACKEncode(t *testing.T) {
+	// Test: Our encoder produces RFC 7541 C.4 byte for byte, Huffman coding
+	// every string it shortens
+	e := NewEncoder()
+	for i, request := range exampleRequests {
+		assert.Equal(t, exampleRequestsHuffman[i], spacedHex(e.Encode(nil, request)))
+	}
+
+	// Test: And C.6, with its 256 byte table and evictions
+	e = NewEncoder()
+	e.table.maxSize = 256
+	for _, tc := range readStory(t, "testdata/hpack/rfc7541_c6.json").Cases {
+		assert.Equal(t, tc.Wire, hex.EncodeToString(e.Encode(nil, tc.fields())))
+	}
+
+	// Test: What it encodes decodes to the same
+	e, d := NewEncoder(), NewDecoder(DefaultTableSize)
+	for range 3 {
+		block := fields(":status", "200", "content-type", "text/html", "x-long", strings.Repeat("v", 5000), "x-request", "one")
+		got, err := d.Decode(e.Encode(nil, block))
+		require.NoError(t, err)
+		assert.Equal(t, block, got)
+	}
+
+	// Test: A smaller table asked for by the peer is announced first, the
+	// smallest size before the final one
+	e, d = NewEncoder(), NewDecoder(DefaultTableSize)
+	e.Encode(nil, fields("x-a", "1"))
+	e.SetMaxTableSize(0)
+	e.SetMaxTableSize(100)
+	block := e.Encode(nil, fields("x-a", "1"))
+	assert.Equal(t, "203f 45", spacedHex(block[:3]))
+	assert.Len(t, e.table.entries, 1)
+	_, err := d.Decode(block)
+	require.NoError(t, err)
+
+	// Test: Nothing is announced when the size stays the same
+	e.SetMaxTableSize(100)
+	assert.Equal(t, "be", spacedHex(e.Encode(nil, fields("x-a", "1"))))
+
+	// Test: Sensitive fields are never indexed, by name from the table or
+	// literally
+	e, d = NewEncoder(), NewDecoder(DefaultTableSize)
+	secret := []HeaderField{{Name: "authorization", Value: "secret", Sensitive: true}, {Name: "x-token", Value: "abc", Sensitive: true}}
+	block = e.Encode(nil, secret)
+	assert.Equal(t, byte(0x1f), block[0])
+	assert.Equal(t, byte(0x08), block[1], "authorization is static entry 23")
+	assert.Empty(t, e.table.entries)
+	got, err := d.Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, secret, got)
+
+	// Test: Fields too big for the table don't empty it
+	e = NewEncoder()
+	e.Encode(nil, fields("x-a", "1"))
+	e.Encode(nil, fields("x-big", strings.Repeat("b", DefaultTableSize)))
+	assert.Len(t, e.table.entries, 1)
+}
+
+func TestHuffman(t *testing.T) {
+	// Test: Every byte value survives a round trip, whatever the padding
+	var all strings.Builder
+	for c := range 256 {
+		all.WriteByte(byte(c))
+	}
+	for n := range all.Len() {
+		s := all.String()[n:]
+		encoded := appendHuffman(nil, s)
+		assert.Len(t, encoded, huffmanEncodedLen(s))
+		got, err := huffmanDecode(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, s, got)
+	}
+
+	// Test: RFC 7541 C.4.1
+	assert.Equal(t, "f1e3 c2e5 f23a 6ba0 ab90 f4ff", spacedHex(appendHuffman(nil, "www.example.com")))
+}
+
+func TestHeadersFields(t *testing.T) {
+	h := Headers{"Content-Type": "text/html", "authorization": "Bearer x", "cookie": "a=1", "accept": "*/*"}
+
+	// Test: Sorted, lowercased, with credentials marked
+	assert.Equal(t, []HeaderField{
+		{Name: "accept", Value: "*/*"},
+		{Name: "authorization", Value: "Bearer x", Sensitive: true},
+		{Name: "content-type", Value: "text/html"},
+		{Name: "cookie", Value: "a=1", Sensitive: true},
+	}, h.Fields())
+
+	// Test: Back to Headers, cookies joined with semicolons
+	assert.Equal(t, Headers{":method": "GET", "accept": "a, b", "cookie": "a=1; b=2"}, HeadersFromFields(
+		fields(":method", "GET", "accept", "a", "cookie", "a=1", "accept", "b", "cookie", "b=2")))
+}
+
+// story is a file in the format of the hpack-test-case corpus
+// (https://github.com/http2jp/hpack-test-case): the header blocks sent on
+// one connection, in order.
+type story struct {
+	Description string      `json:"description"`
+	Cases       []storyCase `json:"cases"`
+}
+
+type storyCase struct {
+	Seqno           int     `json:"seqno"`
+	HeaderTableSize *uint32 `json:"header_table_size"`
+	Wire            string  `json:"wire"`
+	// one field per map, to keep them in order
+	Headers []map[string]string `json:"headers"`
+}
+
+func readStory(t *testing.T, path string) story {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var s story
+	require.NoError(t, json.Unmarshal(data, &s))
+	return s
+}
+
+func (c *storyCase) fields() []HeaderField {
+	var f []HeaderField
+	for _, h := range c.Headers {
+		for name, value := range h {
+			f = append(f, HeaderField{Name: name, Value: value})
+		}
+	}
+	return f
+}
+
+// TestHPACKStories decodes the stories in testdata/hpack, the RFC 7541
+// Appendix C examples, then encodes their headers again and checks they
+// come back the same.
+func TestHPACKStories(t *testing.T) {
+	paths, err := filepath.Glob("testdata/hpack/*.json")
+	require.NoError(t, err)
+	require.NotEmpty(t, paths)
+
+	for _, path := range paths {
+		s := readStory(t, path)
+		t.Run(path, func(t *testing.T) {
+			d := NewDecoder(DefaultTableSize)
+			for _, tc := range s.Cases {
+				if tc.HeaderTableSize != nil {
+					d.SetMaxTableSize(*tc.HeaderTableSize)
+				}
+				wire, err := hex.DecodeString(tc.Wire)
+				require.NoError(t, err)
+				got, err := d.Decode(wire)
+				require.NoError(t, err, "case %d", tc.Seqno)
+				for i := range got {
+					got[i].Sensitive = false
+				}
+				assert.Equal(t, tc.fields(), got, "case %d", tc.Seqno)
+			}
+
+			e, d := NewEncoder(), NewDecoder(DefaultTableSize)
+			for _, tc := range s.Cases {
+				got, err := d.Decode(e.Encode(nil, tc.fields()))
+				require.NoError(t, err)
+				assert.Equal(t, tc.fields(), got, "case %d", tc.Seqno)
+			}
+		})
+	}
+}
+
+// spacedHex formats b the way RFC 7541 prints its examples.
+func spacedHex(b []byte) string {
+	s := hex.EncodeToString(b)
+	var out []string
+	for len(s) > 4 {
+		out = append(out, s[:4])
+		s = s[4:]
+	}
+	return strings.Join(append(out, s), " ")
+}
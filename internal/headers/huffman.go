@@ -0,0 +1,97 @@
+package headers
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// huffmanNode is a node of the decoding tree. Leaves have no children and
+// a symbol.
+type huffmanNode struct {
+	children [2]*huffmanNode
+	symbol   byte
+}
+
+var (
+	huffmanTree     *huffmanNode
+	huffmanTreeOnce sync.Once
+)
+
+func buildHuffmanTree() {
+	huffmanTree = &huffmanNode{}
+	for symbol, c := range huffmanCodes {
+		n := huffmanTree
+		for bit := int(c.bits) - 1; bit >= 0; bit-- {
+			b := c.code >> bit & 1
+			if n.children[b] == nil {
+				n.children[b] = &huffmanNode{}
+			}
+			n = n.children[b]
+		}
+		n.symbol = byte(symbol)
+	}
+}
+
+// huffmanDecode decodes a Huffman coded string, RFC 7541 section 5.2. The
+// last symbol may be followed by at most 7 bits of padding, all ones.
+func huffmanDecode(b []byte) (string, error) {
+	huffmanTreeOnce.Do(buildHuffmanTree)
+	var s strings.Builder
+	s.Grow(len(b) * 8 / 5)
+	n := huffmanTree
+	// bits read since the last symbol, and whether they were all ones
+	pending, allOnes := 0, true
+	for _, c := range b {
+		for bit := 7; bit >= 0; bit-- {
+			b := c >> bit & 1
+			n = n.children[b]
+			if n == nil {
+				// only EOS, 30 ones, leads off the tree
+				return "", fmt.Errorf("%w: EOS in Huffman string", ErrInvalidHPACK)
+			}
+			pending++
+			allOnes = allOnes && b == 1
+			if n.children[0] == nil && n.children[1] == nil {
+				s.WriteByte(n.symbol)
+				n = huffmanTree
+				pending, allOnes = 0, true
+			}
+		}
+	}
+	if pending > 7 || !allOnes {
+		return "", fmt.Errorf("%w: bad Huffman padding", ErrInvalidHPACK)
+	}
+	return s.String(), nil
+}
+
+// huffmanEncodedLen is how many bytes s takes Huffman coded.
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodes[s[i]].bits)
+	}
+	return (bits + 7) / 8
+}
+
+// appendHuffman appends s Huffman coded, padded to a whole byte with the
+// start of EOS.
+func appendHuffman(dst []byte, s string) []byte {
+	// bits not yet appended sit at the bottom of acc, n of them. Codes are
+	// at most 30 bits, so with fewer than 8 pending nothing falls off.
+	var acc uint64
+	n := 0
+	for i := 0; i < len(s); i++ {
+		c := huffmanCodes[s[i]]
+		acc = acc<<c.bits | uint64(c.code)
+		n += int(c.bits)
+		for n >= 8 {
+			n -= 8
+			dst = append(dst, byte(acc>>n))
+		}
+	}
+	if n > 0 {
+		dst = append(dst, byte(acc<<(8-n))|0xFF>>n)
+	}
+	return dst
+}
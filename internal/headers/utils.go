@@ -1,29 +1,100 @@
 package headers
 
-import "net/http"
+import "strings"
 
 func isValidHeaderChars(s string) bool {
 	for i := 0; i < len(s); i++ {
-		c := s[i]
-		if !((c >= 'a' && c <= 'z') ||
-			(c >= 'A' && c <= 'Z') ||
-			(c >= '0' && c <= '9') ||
-			c == '!' || c == '#' || c == '$' || c == '%' ||
-			c == '&' || c == '\'' || c == '*' || c == '+' ||
-			c == '-' || c == '.' || c == '^' || c == '_' ||
-			c == '`' || c == '|' || c == '~') {
+		if !isTokenChar[s[i]] {
 			return false
 		}
 	}
 	return len(s) > 0 // token = 1*tchar
 }
 
-// utility to convert map[string]string[] to map[string]string
-// to only take the last value in case of multiple.
-func ConvertInbuiltHeadersToOurHeaders(from http.Header) Headers {
-	to := NewHeaders()
-	for k, v := range from {
-		to[k] = v[0]
+func isValidHeaderBytes(b []byte) bool {
+	for _, c := range b {
+		if !isTokenChar[c] {
+			return false
+		}
+	}
+	return len(b) > 0
+}
+
+// tchar lookup table, a single load per byte beats the chain of
+// comparisons on the hot path.
+var isTokenChar = func() (table [256]bool) {
+	for c := 'a'; c <= 'z'; c++ {
+		table[c] = true
+	}
+	for c := 'A'; c <= 'Z'; c++ {
+		table[c] = true
+	}
+	for c := '0'; c <= '9'; c++ {
+		table[c] = true
+	}
+	for _, c := range "!#$%&'*+-.^_`|~" {
+		table[c] = true
+	}
+	return table
+}()
+
+// IsToken reports whether s is an RFC 9110 token, the grammar shared by
+// field names, methods and transfer codings.
+func IsToken(s string) bool {
+	return isValidHeaderChars(s)
+}
+
+// IsFieldValue reports whether s can be sent as a field value as is,
+// without letting anything like a CRLF sneak into the message.
+func IsFieldValue(s string) bool {
+	return isValidFieldValue([]byte(s))
+}
+
+// field-value = *( VCHAR / obs-text / SP / HTAB ), so anything below 0x20
+// other than HTAB, and DEL, is rejected.
+func isValidFieldValue(b []byte) bool {
+	for _, c := range b {
+		if (c < 0x20 && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// lowerName lowercases a field name, returning a shared string for the
+// common ones so they don't cost an allocation per request.
+func lowerName(b []byte) string {
+	var buf [32]byte
+	if len(b) > len(buf) {
+		return strings.ToLower(string(b))
+	}
+	lower := buf[:len(b)]
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower[i] = c
 	}
-	return to
+	if name, ok := commonNames[string(lower)]; ok {
+		return name
+	}
+	return string(lower)
 }
+
+var commonNames = func() map[string]string {
+	names := map[string]string{}
+	for _, name := range []string{
+		"accept", "accept-encoding", "accept-language", "authorization",
+		"cache-control", "connection", "content-encoding", "content-length",
+		"content-type", "cookie", "date", "etag", "expect", "forwarded",
+		"host", "if-match", "if-modified-since", "if-none-match", "if-range",
+		"if-unmodified-since", "last-modified", "origin", "pragma", "range",
+		"referer", "sec-fetch-dest", "sec-fetch-mode", "sec-fetch-site",
+		"te", "trailer", "transfer-encoding", "upgrade",
+		"upgrade-insecure-requests", "user-agent", "x-forwarded-for",
+		"x-forwarded-host", "x-forwarded-proto", "x-request-id",
+	} {
+		names[name] = name
+	}
+	return names
+}()
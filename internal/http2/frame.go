@@ -0,0 +1,166 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// frame types, RFC 9113 section 6
+type frameType uint8
+
+const (
+	frameData         frameType = 0x0
+	frameHeaders      frameType = 0x1
+	framePriority     frameType = 0x2
+	frameRSTStream    frameType = 0x3
+	frameSettings     frameType = 0x4
+	framePushPromise  frameType = 0x5
+	framePing         frameType = 0x6
+	frameGoAway       frameType = 0x7
+	frameWindowUpdate frameType = 0x8
+	frameContinuation frameType = 0x9
+)
+
+func (t frameType) String() string {
+	switch t {
+	case frameData:
+		return "DATA"
+	case frameHeaders:
+		return "HEADERS"
+	case framePriority:
+		return "PRIORITY"
+	case frameRSTStream:
+		return "RST_STREAM"
+	case frameSettings:
+		return "SETTINGS"
+	case framePushPromise:
+		return "PUSH_PROMISE"
+	case framePing:
+		return "PING"
+	case frameGoAway:
+		return "GOAWAY"
+	case frameWindowUpdate:
+		return "WINDOW_UPDATE"
+	case frameContinuation:
+		return "CONTINUATION"
+	}
+	return fmt.Sprintf("UNKNOWN_FRAME_TYPE_%d", uint8(t))
+}
+
+// frame flags. The same bit means different things for different types.
+const (
+	flagEndStream  = 0x1 // DATA, HEADERS
+	flagAck        = 0x1 // SETTINGS, PING
+	flagEndHeaders = 0x4 // HEADERS, CONTINUATION
+	flagPadded     = 0x8 // DATA, HEADERS
+	flagPriority   = 0x20
+)
+
+const frameHeaderLen = 9
+
+// the frame size both ends start with, and the most that can be allowed
+const (
+	defaultMaxFrameSize = 1 << 14
+	maxMaxFrameSize     = 1<<24 - 1
+)
+
+type frame struct {
+	typ      frameType
+	flags    uint8
+	streamID uint32
+	payload  []byte
+}
+
+func (f *frame) has(flag uint8) bool {
+	return f.flags&flag != 0
+}
+
+// readFrame reads the next frame, reusing buf for its payload. Frames over
+// maxSize are a connection error.
+func readFrame(r io.Reader, maxSize uint32, buf []byte) (frame, []byte, error) {
+	var h [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return frame{}, buf, err
+	}
+	length := uint32(h[0])<<16 | uint32(h[1])<<8 | uint32(h[2])
+	f := frame{
+		typ:      frameType(h[3]),
+		flags:    h[4],
+		streamID: binary.BigEndian.Uint32(h[5:]) & 0x7FFFFFFF,
+	}
+	if length > maxSize {
+		return f, buf, connError(ErrCodeFrameSize, "%v frame of %d bytes, over the limit of %d", f.typ, length, maxSize)
+	}
+	if uint32(cap(buf)) < length {
+		buf = make([]byte, length)
+	}
+	f.payload = buf[:length]
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return f, buf, err
+	}
+	return f, buf, nil
+}
+
+func appendFrameHeader(b []byte, typ frameType, flags uint8, streamID uint32, length int) []byte {
+	b = append(b, byte(length>>16), byte(length>>8), byte(length), byte(typ), flags)
+	return binary.BigEndian.AppendUint32(b, streamID&0x7FFFFFFF)
+}
+
+// stripPadding returns the payload of a PADDED DATA or HEADERS frame
+// without its padding.
+func stripPadding(f frame) ([]byte, error) {
+	if !f.has(flagPadded) {
+		return f.payload, nil
+	}
+	if len(f.payload) == 0 {
+		return nil, connError(ErrCodeProtocol, "padded %v frame without a pad length", f.typ)
+	}
+	padLength := int(f.payload[0])
+	if padLength >= len(f.payload) {
+		return nil, connError(ErrCodeProtocol, "%v frame padding longer than its payload", f.typ)
+	}
+	return f.payload[1 : len(f.payload)-padLength], nil
+}
+
+// settings, section 6.5.2
+type settingID uint16
+
+const (
+	settingHeaderTableSize      settingID = 0x1
+	settingEnablePush           settingID = 0x2
+	settingMaxConcurrentStreams settingID = 0x3
+	settingInitialWindowSize    settingID = 0x4
+	settingMaxFrameSize         settingID = 0x5
+	settingMaxHeaderListSize    settingID = 0x6
+)
+
+type setting struct {
+	id    settingID
+	value uint32
+}
+
+func appendSettings(b []byte, settings ...setting) []byte {
+	for _, s := range settings {
+		b = binary.BigEndian.AppendUint16(b, uint16(s.id))
+		b = binary.BigEndian.AppendUint32(b, s.value)
+	}
+	return b
+}
+
+func parseSettings(payload []byte) ([]setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, connError(ErrCodeFrameSize, "SETTINGS payload of %d bytes", len(payload))
+	}
+	settings := make([]setting, 0, len(payload)/6)
+	for i := 0; i < len(payload); i += 6 {
+		settings = append(settings, setting{
+			id:    settingID(binary.BigEndian.Uint16(payload[i:])),
+			value: binary.BigEndian.Uint32(payload[i+2:]),
+		})
+	}
+	return settings, nil
+}
@@ -0,0 +1,111 @@
+// Package http2 serves HTTP/2 (RFC 9113) on connections the server hands
+// over: after the client's connection preface when it speaks h2c with prior
+// knowledge, after a 101 answering "Upgrade: h2c", or straight away when
+// TLS negotiated "h2" with ALPN.
+//
+// Every stream is handed to an ordinary server.Handler. The handler writes
+// its response through a response.Writer as it would for HTTP/1.1, and the
+// bytes are parsed back and sent out as HEADERS and DATA frames, within the
+// flow control windows the client grants. Request bodies are collected
+// before the handler runs, within windows of our own and Server.MaxBodyBytes.
+// Hijacking is not available on HTTP/2 streams, and ClientGone fires once
+// the stream is reset or the connection goes away.
+package http2
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+)
+
+// ClientPreface is what every HTTP/2 client sends first, section 3.4.
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// ErrCode is the error code of RST_STREAM and GOAWAY frames, section 7.
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+var errCodeNames = map[ErrCode]string{
+	ErrCodeNo:                 "NO_ERROR",
+	ErrCodeProtocol:           "PROTOCOL_ERROR",
+	ErrCodeInternal:           "INTERNAL_ERROR",
+	ErrCodeFlowControl:        "FLOW_CONTROL_ERROR",
+	ErrCodeSettingsTimeout:    "SETTINGS_TIMEOUT",
+	ErrCodeStreamClosed:       "STREAM_CLOSED",
+	ErrCodeFrameSize:          "FRAME_SIZE_ERROR",
+	ErrCodeRefusedStream:      "REFUSED_STREAM",
+	ErrCodeCancel:             "CANCEL",
+	ErrCodeCompression:        "COMPRESSION_ERROR",
+	ErrCodeConnect:            "CONNECT_ERROR",
+	ErrCodeEnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	ErrCodeInadequateSecurity: "INADEQUATE_SECURITY",
+	ErrCodeHTTP11Required:     "HTTP_1_1_REQUIRED",
+}
+
+func (c ErrCode) String() string {
+	if name, ok := errCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown error code 0x%x", uint32(c))
+}
+
+// ConnError is a connection error, section 5.4.1. The connection is closed
+// with a GOAWAY carrying Code.
+type ConnError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e *ConnError) Error() string {
+	return fmt.Sprintf("http2: connection error %v: %s", e.Code, e.Reason)
+}
+
+func connError(code ErrCode, format string, args ...any) error {
+	return &ConnError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+// StreamError is a stream error, section 5.4.2. Only the stream is reset,
+// with an RST_STREAM carrying Code.
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+	Reason   string
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %v: %s", e.StreamID, e.Code, e.Reason)
+}
+
+func streamError(id uint32, code ErrCode, format string, args ...any) error {
+	return &StreamError{StreamID: id, Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+// NextProtoH2 is the ALPN protocol ID of HTTP/2 over TLS.
+const NextProtoH2 = "h2"
+
+// ConfigureTLS offers "h2" over ALPN ahead of HTTP/1.1, so clients that
+// speak it get their connection handed to the HTTP/2 server.
+func ConfigureTLS(config *tls.Config) {
+	if !slices.Contains(config.NextProtos, NextProtoH2) {
+		config.NextProtos = append([]string{NextProtoH2}, config.NextProtos...)
+	}
+	if !slices.Contains(config.NextProtos, "http/1.1") {
+		config.NextProtos = append(config.NextProtos, "http/1.1")
+	}
+}
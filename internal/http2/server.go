@@ -0,0 +1,948 @@
+package http2
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/headers"
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/sankalpmukim/httpfromtcp/internal/server"
+)
+
+// Server holds the limits HTTP/2 connections are served with. The zero
+// value is ready to use, and it is what server.Options.HTTP2 takes.
+type Server struct {
+	// MaxConcurrentStreams is how many streams a client may have open at
+	// once, more are refused. Zero means 100.
+	MaxConcurrentStreams uint32
+
+	// MaxHeaderBytes limits the header section of a request, compressed
+	// and decoded alike. Zero means 1 MiB.
+	MaxHeaderBytes int
+
+	// MaxBodyBytes limits the body of a request, which is held in memory
+	// until the handler runs. Streams sending more are reset with
+	// ENHANCE_YOUR_CALM. Zero means 10 MiB.
+	MaxBodyBytes int64
+}
+
+const (
+	defaultMaxConcurrentStreams = 100
+	defaultMaxHeaderBytes       = 1 << 20
+	defaultMaxBodyBytes         = 10 << 20
+
+	// both ends start with this much room to send, on every stream and on
+	// the connection as a whole
+	initialWindowSize = 65535
+	maxWindowSize     = 1<<31 - 1
+)
+
+// errStreamClosed is what a handler's writes fail with once its stream is
+// gone, reset by the client or by us.
+var errStreamClosed = errors.New("http2: stream closed")
+
+// ServeConn speaks HTTP/2 on conn until the client goes away or breaks the
+// protocol, and closes it. upgrade is the request that asked to switch with
+// "Upgrade: h2c", which was answered with 101 already; it becomes stream 1.
+// It is nil for connections that start with the client preface.
+func (s *Server) ServeConn(conn net.Conn, handler server.Handler, upgrade *request.Request) {
+	sc := &serverConn{
+		conn:           conn,
+		handler:        handler,
+		br:             bufio.NewReader(conn),
+		bw:             bufio.NewWriter(conn),
+		decoder:        headers.NewDecoder(headers.DefaultTableSize),
+		encoder:        headers.NewEncoder(),
+		maxStreams:     s.MaxConcurrentStreams,
+		maxHeaderBytes: s.MaxHeaderBytes,
+		maxBodyBytes:   s.MaxBodyBytes,
+		streams:        make(map[uint32]*stream),
+		sendWindow:     initialWindowSize,
+		recvWindow:     initialWindowSize,
+		peerWindow:     initialWindowSize,
+		peerFrameSize:  defaultMaxFrameSize,
+	}
+	if sc.maxStreams == 0 {
+		sc.maxStreams = defaultMaxConcurrentStreams
+	}
+	if sc.maxHeaderBytes == 0 {
+		sc.maxHeaderBytes = defaultMaxHeaderBytes
+	}
+	if sc.maxBodyBytes == 0 {
+		sc.maxBodyBytes = defaultMaxBodyBytes
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	sc.serve(upgrade)
+}
+
+type serverConn struct {
+	conn    net.Conn
+	handler server.Handler
+
+	// owned by the read loop
+	br             *bufio.Reader
+	readBuf        []byte
+	decoder        *headers.Decoder
+	maxStreams     uint32
+	maxHeaderBytes int
+	maxBodyBytes   int64
+	lastStreamID   uint32
+	// what the client may still send on the connection as a whole
+	recvWindow int64
+
+	// mu guards the streams and the send side of flow control. cond is
+	// signalled whenever a window grows or a stream goes away.
+	mu            sync.Mutex
+	cond          *sync.Cond
+	streams       map[uint32]*stream
+	sendWindow    int64
+	peerWindow    int64 // SETTINGS_INITIAL_WINDOW_SIZE of the client
+	peerFrameSize uint32
+	closed        bool
+
+	// writeMu makes frames go out whole, and keeps the encoder's blocks in
+	// the order they are sent
+	writeMu sync.Mutex
+	bw      *bufio.Writer
+	encoder *headers.Encoder
+}
+
+type stream struct {
+	id uint32
+
+	// owned by the read loop until the request is handed to the handler
+	req           *request.Request
+	contentLength int64 // -1 if not given
+	remoteClosed  bool  // END_STREAM received
+	recvWindow    int64 // what the client may still send on the stream
+
+	// guarded by serverConn.mu
+	sendWindow int64
+	closed     bool
+	// what the handler writes to comes out of here
+	pipe *io.PipeReader
+	// closed along with the stream, it is the handler's ClientGone
+	gone chan struct{}
+}
+
+func (sc *serverConn) serve(upgrade *request.Request) {
+	defer sc.close()
+
+	if upgrade != nil {
+		// HTTP2-Settings is the payload of a SETTINGS frame in base64url,
+		// section 3.2.1 of RFC 7540
+		payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(upgrade.Headers.Get("http2-settings"), "="))
+		if err != nil {
+			return
+		}
+		settings, err := parseSettings(payload)
+		if err == nil {
+			err = sc.applySettings(settings)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	// the server's preface is a SETTINGS frame, which can go out before
+	// the client's has arrived
+	ours := appendSettings(nil,
+		setting{settingMaxConcurrentStreams, sc.maxStreams},
+		setting{settingMaxHeaderListSize, uint32(sc.maxHeaderBytes)},
+	)
+	if err := sc.writeFrame(frameSettings, 0, 0, ours); err != nil {
+		return
+	}
+
+	if upgrade != nil {
+		st := sc.newStream(1)
+		st.remoteClosed = true
+		sc.lastStreamID = 1
+		upgrade.RequestLine.HttpVersion = "2.0"
+		upgrade.RequestLine.HttpVersionMajor, upgrade.RequestLine.HttpVersionMinor = 2, 0
+		sc.startHandler(st, upgrade)
+	}
+
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.br, preface); err != nil || string(preface) != ClientPreface {
+		sc.goAway(ErrCodeProtocol)
+		return
+	}
+
+	var connErr *ConnError
+	if err := sc.readFrames(); errors.As(err, &connErr) {
+		sc.goAway(connErr.Code)
+	}
+}
+
+// close tears down every stream that is still open and the connection.
+func (sc *serverConn) close() {
+	sc.mu.Lock()
+	sc.closed = true
+	for _, st := range sc.streams {
+		sc.closeStreamLocked(st)
+	}
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	sc.conn.Close()
+}
+
+func (sc *serverConn) goAway(code ErrCode) {
+	payload := binary.BigEndian.AppendUint32(nil, sc.lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	sc.writeFrame(frameGoAway, 0, 0, payload)
+}
+
+func (sc *serverConn) readFrames() error {
+	first := true
+	for {
+		f, buf, err := readFrame(sc.br, defaultMaxFrameSize, sc.readBuf)
+		sc.readBuf = buf
+		if err != nil {
+			return err
+		}
+		// the rest of the client's preface, section 3.4
+		if first && (f.typ != frameSettings || f.has(flagAck)) {
+			return connError(ErrCodeProtocol, "expected SETTINGS, got %v", f.typ)
+		}
+		first = false
+
+		err = sc.processFrame(f)
+		var streamErr *StreamError
+		if errors.As(err, &streamErr) {
+			sc.resetStream(streamErr.StreamID, streamErr.Code)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (sc *serverConn) processFrame(f frame) error {
+	switch f.typ {
+	case frameData:
+		return sc.processData(f)
+	case frameHeaders:
+		return sc.processHeaders(f)
+	case framePriority:
+		if f.streamID == 0 {
+			return connError(ErrCodeProtocol, "PRIORITY on stream 0")
+		}
+		if len(f.payload) != 5 {
+			return streamError(f.streamID, ErrCodeFrameSize, "PRIORITY payload of %d bytes", len(f.payload))
+		}
+		// priorities are only advice, and we don't take it
+		return nil
+	case frameRSTStream:
+		return sc.processRSTStream(f)
+	case frameSettings:
+		return sc.processSettings(f)
+	case framePushPromise:
+		return connError(ErrCodeProtocol, "clients can't push")
+	case framePing:
+		if f.streamID != 0 {
+			return connError(ErrCodeProtocol, "PING on stream %d", f.streamID)
+		}
+		if len(f.payload) != 8 {
+			return connError(ErrCodeFrameSize, "PING payload of %d bytes", len(f.payload))
+		}
+		if f.has(flagAck) {
+			return nil
+		}
+		return sc.writeFrame(framePing, flagAck, 0, f.payload)
+	case frameGoAway:
+		if f.streamID != 0 {
+			return connError(ErrCodeProtocol, "GOAWAY on stream %d", f.streamID)
+		}
+		// the client is done opening streams. Let those it has finish,
+		// it closes the connection once it has their responses.
+		return nil
+	case frameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	case frameContinuation:
+		return connError(ErrCodeProtocol, "CONTINUATION without HEADERS")
+	}
+	// unknown frame types are ignored, section 5.5
+	return nil
+}
+
+// checkStream returns the open stream a DATA or HEADERS frame is for.
+// Frames for streams that were never opened are a connection error, those
+// for streams that have come and gone a stream error.
+func (sc *serverConn) checkStream(f frame) (*stream, error) {
+	sc.mu.Lock()
+	st := sc.streams[f.streamID]
+	sc.mu.Unlock()
+	if st == nil {
+		if f.streamID > sc.lastStreamID {
+			return nil, connError(ErrCodeProtocol, "%v on idle stream %d", f.typ, f.streamID)
+		}
+		return nil, streamError(f.streamID, ErrCodeStreamClosed, "%v on closed stream", f.typ)
+	}
+	if st.remoteClosed {
+		return nil, streamError(f.streamID, ErrCodeStreamClosed, "%v after END_STREAM", f.typ)
+	}
+	return st, nil
+}
+
+func (sc *serverConn) processData(f frame) error {
+	if f.streamID == 0 {
+		return connError(ErrCodeProtocol, "DATA on stream 0")
+	}
+	data, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+
+	// The whole frame counts against the windows, padding included,
+	// section 6.9.1
+	length := int64(len(f.payload))
+	if length > sc.recvWindow {
+		return connError(ErrCodeFlowControl, "DATA of %d bytes with a connection window of %d", length, sc.recvWindow)
+	}
+	sc.recvWindow -= length
+
+	// the data is either dropped or held by its stream, whose own window
+	// and MaxBodyBytes bound what it holds, so the connection's window can
+	// be given back right away. That keeps one stream that stops reading
+	// from holding up the others.
+	if err := sc.refillConnWindow(); err != nil {
+		return err
+	}
+
+	st, err := sc.checkStream(f)
+	if err != nil {
+		return err
+	}
+	if length > st.recvWindow {
+		return streamError(st.id, ErrCodeFlowControl, "DATA of %d bytes with a stream window of %d", length, st.recvWindow)
+	}
+	st.recvWindow -= length
+
+	size := int64(len(st.req.Body) + len(data))
+	if st.contentLength >= 0 && size > st.contentLength {
+		return streamError(st.id, ErrCodeProtocol, "body over its content-length of %d", st.contentLength)
+	}
+	if size > sc.maxBodyBytes {
+		return streamError(st.id, ErrCodeEnhanceYourCalm, "body over %d bytes", sc.maxBodyBytes)
+	}
+	st.req.Body = append(st.req.Body, data...)
+	if f.has(flagEndStream) {
+		return sc.endOfRequest(st)
+	}
+
+	// handlers only get the body once it is complete, so the stream's
+	// window is opened again as long as the body stays under the limit
+	if st.recvWindow <= initialWindowSize/2 && size < sc.maxBodyBytes {
+		increment := initialWindowSize - st.recvWindow
+		st.recvWindow = initialWindowSize
+		return sc.writeWindowUpdate(st.id, uint32(increment))
+	}
+	return nil
+}
+
+// refillConnWindow opens the connection's window again once half of it has
+// been used, rather than after every frame.
+func (sc *serverConn) refillConnWindow() error {
+	if sc.recvWindow > initialWindowSize/2 {
+		return nil
+	}
+	increment := initialWindowSize - sc.recvWindow
+	sc.recvWindow = initialWindowSize
+	return sc.writeWindowUpdate(0, uint32(increment))
+}
+
+func (sc *serverConn) processHeaders(f frame) error {
+	id := f.streamID
+	if id == 0 {
+		return connError(ErrCodeProtocol, "HEADERS on stream 0")
+	}
+	fragment, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	selfDependent := false
+	if f.has(flagPriority) {
+		if len(fragment) < 5 {
+			return connError(ErrCodeFrameSize, "HEADERS too short for its priority")
+		}
+		selfDependent = binary.BigEndian.Uint32(fragment)&0x7FFFFFFF == id
+		fragment = fragment[5:]
+	}
+
+	// the block has to be decoded whatever becomes of the stream, or the
+	// decoder's table gets out of step with the client's
+	block, err := sc.readHeaderBlock(f, fragment)
+	if err != nil {
+		return err
+	}
+	fields, err := sc.decoder.Decode(block)
+	if err != nil {
+		return connError(ErrCodeCompression, "%v", err)
+	}
+	size := 0
+	for _, field := range fields {
+		size += len(field.Name) + len(field.Value) + 32
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[id]
+	sc.mu.Unlock()
+	if st != nil {
+		// trailers
+		if st.remoteClosed {
+			return streamError(id, ErrCodeStreamClosed, "HEADERS after END_STREAM")
+		}
+		if !f.has(flagEndStream) {
+			return streamError(id, ErrCodeProtocol, "trailers without END_STREAM")
+		}
+		if size > sc.maxHeaderBytes {
+			return streamError(id, ErrCodeProtocol, "trailer section of %d bytes", size)
+		}
+		for _, field := range fields {
+			if err := checkField(field); err != nil {
+				return streamError(id, ErrCodeProtocol, "trailer %v", err)
+			}
+			st.req.Trailers.Add(field.Name, field.Value)
+		}
+		return sc.endOfRequest(st)
+	}
+
+	if id <= sc.lastStreamID {
+		return connError(ErrCodeStreamClosed, "HEADERS on closed stream %d", id)
+	}
+	if id%2 == 0 {
+		return connError(ErrCodeProtocol, "client opened even stream %d", id)
+	}
+	sc.lastStreamID = id
+	if selfDependent {
+		return streamError(id, ErrCodeProtocol, "stream depends on itself")
+	}
+	if size > sc.maxHeaderBytes {
+		return streamError(id, ErrCodeProtocol, "header section of %d bytes", size)
+	}
+	sc.mu.Lock()
+	open := len(sc.streams)
+	sc.mu.Unlock()
+	if open >= int(sc.maxStreams) {
+		return streamError(id, ErrCodeRefusedStream, "over %d concurrent streams", sc.maxStreams)
+	}
+
+	req, err := sc.newRequest(fields)
+	if err != nil {
+		return streamError(id, ErrCodeProtocol, "%v", err)
+	}
+	st = sc.newStream(id)
+	st.req = req
+	if cl, ok := req.Headers["content-length"]; ok {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || n < 0 {
+			return streamError(id, ErrCodeProtocol, "invalid content-length %q", cl)
+		}
+		st.contentLength = n
+	}
+	if f.has(flagEndStream) {
+		return sc.endOfRequest(st)
+	}
+	return nil
+}
+
+// readHeaderBlock puts a header block back together from the fragment of
+// its HEADERS frame and the CONTINUATION frames that have to follow right
+// after, section 6.10.
+func (sc *serverConn) readHeaderBlock(f frame, fragment []byte) ([]byte, error) {
+	// the read buffer is reused for the next frame
+	block := slices.Clone(fragment)
+	endHeaders := f.has(flagEndHeaders)
+	for !endHeaders {
+		if len(block) > sc.maxHeaderBytes {
+			return nil, connError(ErrCodeEnhanceYourCalm, "header block over %d bytes", sc.maxHeaderBytes)
+		}
+		next, buf, err := readFrame(sc.br, defaultMaxFrameSize, sc.readBuf)
+		sc.readBuf = buf
+		if err != nil {
+			return nil, err
+		}
+		if next.typ != frameContinuation || next.streamID != f.streamID {
+			return nil, connError(ErrCodeProtocol, "%v on stream %d in the middle of a header block", next.typ, next.streamID)
+		}
+		block = append(block, next.payload...)
+		endHeaders = next.has(flagEndHeaders)
+	}
+	return block, nil
+}
+
+// endOfRequest runs the handler once END_STREAM has come in.
+func (sc *serverConn) endOfRequest(st *stream) error {
+	st.remoteClosed = true
+	if st.contentLength >= 0 && st.contentLength != int64(len(st.req.Body)) {
+		return streamError(st.id, ErrCodeProtocol, "content-length %d with a body of %d bytes", st.contentLength, len(st.req.Body))
+	}
+	sc.startHandler(st, st.req)
+	return nil
+}
+
+func (sc *serverConn) processRSTStream(f frame) error {
+	if f.streamID == 0 {
+		return connError(ErrCodeProtocol, "RST_STREAM on stream 0")
+	}
+	if len(f.payload) != 4 {
+		return connError(ErrCodeFrameSize, "RST_STREAM payload of %d bytes", len(f.payload))
+	}
+	if f.streamID > sc.lastStreamID {
+		return connError(ErrCodeProtocol, "RST_STREAM on idle stream %d", f.streamID)
+	}
+	sc.mu.Lock()
+	if st := sc.streams[f.streamID]; st != nil {
+		sc.closeStreamLocked(st)
+	}
+	sc.mu.Unlock()
+	return nil
+}
+
+func (sc *serverConn) processSettings(f frame) error {
+	if f.streamID != 0 {
+		return connError(ErrCodeProtocol, "SETTINGS on stream %d", f.streamID)
+	}
+	if f.has(flagAck) {
+		if len(f.payload) != 0 {
+			return connError(ErrCodeFrameSize, "SETTINGS ACK with a payload")
+		}
+		return nil
+	}
+	settings, err := parseSettings(f.payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	return sc.writeFrame(frameSettings, flagAck, 0, nil)
+}
+
+// applySettings takes on the client's settings, section 6.5.2.
+func (sc *serverConn) applySettings(settings []setting) error {
+	for _, s := range settings {
+		switch s.id {
+		case settingHeaderTableSize:
+			sc.writeMu.Lock()
+			sc.encoder.SetMaxTableSize(s.value)
+			sc.writeMu.Unlock()
+		case settingEnablePush:
+			if s.value > 1 {
+				return connError(ErrCodeProtocol, "SETTINGS_ENABLE_PUSH of %d", s.value)
+			}
+		case settingInitialWindowSize:
+			if s.value > maxWindowSize {
+				return connError(ErrCodeFlowControl, "SETTINGS_INITIAL_WINDOW_SIZE of %d", s.value)
+			}
+			// the change applies to the windows of open streams too,
+			// section 6.9.2
+			sc.mu.Lock()
+			delta := int64(s.value) - sc.peerWindow
+			sc.peerWindow = int64(s.value)
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					sc.mu.Unlock()
+					return connError(ErrCodeFlowControl, "SETTINGS_INITIAL_WINDOW_SIZE overflows stream %d", st.id)
+				}
+			}
+			sc.cond.Broadcast()
+			sc.mu.Unlock()
+		case settingMaxFrameSize:
+			if s.value < defaultMaxFrameSize || s.value > maxMaxFrameSize {
+				return connError(ErrCodeProtocol, "SETTINGS_MAX_FRAME_SIZE of %d", s.value)
+			}
+			sc.mu.Lock()
+			sc.peerFrameSize = s.value
+			sc.mu.Unlock()
+		}
+		// the rest are about what we may push or send in requests, and
+		// unknown settings are ignored
+	}
+	return nil
+}
+
+func (sc *serverConn) processWindowUpdate(f frame) error {
+	if len(f.payload) != 4 {
+		return connError(ErrCodeFrameSize, "WINDOW_UPDATE payload of %d bytes", len(f.payload))
+	}
+	increment := int64(binary.BigEndian.Uint32(f.payload) & 0x7FFFFFFF)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.streamID == 0 {
+		if increment == 0 {
+			return connError(ErrCodeProtocol, "WINDOW_UPDATE of 0")
+		}
+		sc.sendWindow += increment
+		if sc.sendWindow > maxWindowSize {
+			return connError(ErrCodeFlowControl, "connection window over 2^31-1")
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	if f.streamID > sc.lastStreamID {
+		return connError(ErrCodeProtocol, "WINDOW_UPDATE on idle stream %d", f.streamID)
+	}
+	st := sc.streams[f.streamID]
+	if increment == 0 {
+		return streamError(f.streamID, ErrCodeProtocol, "WINDOW_UPDATE of 0")
+	}
+	if st == nil {
+		// the stream has finished, the update crossed our last frame
+		return nil
+	}
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return streamError(f.streamID, ErrCodeFlowControl, "stream window over 2^31-1")
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) newStream(id uint32) *stream {
+	st := &stream{id: id, contentLength: -1, recvWindow: initialWindowSize, gone: make(chan struct{})}
+	sc.mu.Lock()
+	st.sendWindow = sc.peerWindow
+	sc.streams[id] = st
+	sc.mu.Unlock()
+	return st
+}
+
+func (sc *serverConn) closeStream(st *stream) {
+	sc.mu.Lock()
+	sc.closeStreamLocked(st)
+	sc.mu.Unlock()
+}
+
+// closeStreamLocked forgets about a stream. Its handler, if it is still
+// writing, gets errStreamClosed.
+func (sc *serverConn) closeStreamLocked(st *stream) {
+	if st.closed {
+		return
+	}
+	st.closed = true
+	close(st.gone)
+	delete(sc.streams, st.id)
+	if st.pipe != nil {
+		st.pipe.CloseWithError(errStreamClosed)
+	}
+	sc.cond.Broadcast()
+}
+
+// resetStream ends a stream with an RST_STREAM.
+func (sc *serverConn) resetStream(id uint32, code ErrCode) {
+	sc.mu.Lock()
+	if st := sc.streams[id]; st != nil {
+		sc.closeStreamLocked(st)
+	}
+	sc.mu.Unlock()
+	sc.writeFrame(frameRSTStream, 0, id, binary.BigEndian.AppendUint32(nil, uint32(code)))
+}
+
+// newRequest turns the header section of a new stream into a request,
+// checking it is well formed the way section 8.3 wants.
+func (sc *serverConn) newRequest(fields []headers.HeaderField) (*request.Request, error) {
+	req := &request.Request{
+		Headers:    headers.NewHeaders(),
+		Trailers:   headers.NewHeaders(),
+		RemoteAddr: sc.conn.RemoteAddr().String(),
+		RequestLine: request.RequestLine{
+			HttpVersion:      "2.0",
+			HttpVersionMajor: 2,
+		},
+	}
+	if tlsConn, ok := sc.conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+
+	pseudo := map[string]string{}
+	regular := false
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			if regular {
+				return nil, fmt.Errorf("pseudo-header %s after regular fields", f.Name)
+			}
+			switch f.Name {
+			case ":method", ":scheme", ":path", ":authority":
+			default:
+				return nil, fmt.Errorf("pseudo-header %s in a request", f.Name)
+			}
+			if _, dup := pseudo[f.Name]; dup {
+				return nil, fmt.Errorf("repeated %s", f.Name)
+			}
+			pseudo[f.Name] = f.Value
+			continue
+		}
+		regular = true
+		if err := checkField(f); err != nil {
+			return nil, err
+		}
+		// cookies may come split up for better compression, and are
+		// put back together with "; ", section 8.2.3
+		if cookie, ok := req.Headers["cookie"]; ok && f.Name == "cookie" {
+			req.Headers["cookie"] = cookie + "; " + f.Value
+			continue
+		}
+		req.Headers.Add(f.Name, f.Value)
+	}
+
+	method, ok := pseudo[":method"]
+	if !ok || !headers.IsToken(method) {
+		return nil, fmt.Errorf("missing or invalid :method")
+	}
+	req.RequestLine.Method = method
+	authority, hasAuthority := pseudo[":authority"]
+	if hasAuthority {
+		// it stands in for Host, which should agree with it if present
+		if host, ok := req.Headers["host"]; ok && host != authority {
+			return nil, fmt.Errorf(":authority %q and host %q differ", authority, host)
+		}
+		req.Headers["host"] = authority
+	}
+
+	if method == request.MethodConnect {
+		_, hasScheme := pseudo[":scheme"]
+		_, hasPath := pseudo[":path"]
+		if !hasAuthority || hasScheme || hasPath {
+			return nil, fmt.Errorf("CONNECT takes :authority only")
+		}
+		req.RequestLine.RequestTarget = authority
+		return req, nil
+	}
+
+	if _, ok := pseudo[":scheme"]; !ok {
+		return nil, fmt.Errorf("missing :scheme")
+	}
+	path := pseudo[":path"]
+	if !strings.HasPrefix(path, "/") && !(path == "*" && method == request.MethodOptions) {
+		return nil, fmt.Errorf("invalid :path %q", path)
+	}
+	req.RequestLine.RequestTarget = path
+	return req, nil
+}
+
+// connection specific fields have no place in HTTP/2, section 8.2.2
+var connectionFields = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// checkField rejects regular fields an HTTP/2 request mustn't carry,
+// sections 8.2.1 and 8.2.2.
+func checkField(f headers.HeaderField) error {
+	if !headers.IsToken(f.Name) || strings.ToLower(f.Name) != f.Name {
+		return fmt.Errorf("invalid field name %q", f.Name)
+	}
+	if !headers.IsFieldValue(f.Value) || strings.TrimSpace(f.Value) != f.Value {
+		return fmt.Errorf("invalid value for %s", f.Name)
+	}
+	if connectionFields[f.Name] {
+		return fmt.Errorf("connection specific field %s", f.Name)
+	}
+	if f.Name == "te" && f.Value != "trailers" {
+		return fmt.Errorf("te other than trailers")
+	}
+	return nil
+}
+
+// startHandler runs the handler for a stream whose request is complete.
+// The handler writes an HTTP/1.1 response, which is parsed back and sent
+// out in frames as it comes.
+func (sc *serverConn) startHandler(st *stream, req *request.Request) {
+	pr, pw := io.Pipe()
+	sc.mu.Lock()
+	if st.closed {
+		sc.mu.Unlock()
+		return
+	}
+	st.pipe = pr
+	sc.mu.Unlock()
+
+	go func() {
+		w := response.NewStreamResponseWriter(pw, st.gone)
+		sc.handler(&w, req)
+		pw.Close()
+	}()
+	go sc.writeResponse(st, pr, req.RequestLine.Method)
+}
+
+// writeResponse sends the response the handler writes into pr.
+func (sc *serverConn) writeResponse(st *stream, pr *io.PipeReader, method string) {
+	br := bufio.NewReader(pr)
+	resp, err := response.ReadResponse(br, method)
+	// interim responses go out as HEADERS of their own, section 8.1
+	for err == nil && resp.StatusLine.StatusCode >= 100 && resp.StatusLine.StatusCode < 200 &&
+		resp.StatusLine.StatusCode != response.SwitchingProtocols {
+		if err = sc.writeHeaders(st, responseFields(resp.StatusLine.StatusCode, resp.Headers), false); err == nil {
+			resp, err = response.ReadResponse(br, method)
+		}
+	}
+	if err != nil || resp.StatusLine.StatusCode == response.SwitchingProtocols {
+		// the handler wrote nothing we can send, or asked to switch
+		// protocols, which HTTP/2 can't
+		sc.resetStream(st.id, ErrCodeInternal)
+		return
+	}
+
+	code := resp.StatusLine.StatusCode
+	bodyless := method == request.MethodHead || code == response.NoContent || code == response.NotModified
+	if err := sc.writeHeaders(st, responseFields(code, resp.Headers), bodyless); err != nil {
+		return
+	}
+	if bodyless {
+		sc.closeStream(st)
+		return
+	}
+
+	buf := make([]byte, defaultMaxFrameSize)
+	for {
+		n, err := resp.BodyReader.Read(buf)
+		if n > 0 {
+			if err := sc.writeData(st, buf[:n], false); err != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			sc.resetStream(st.id, ErrCodeInternal)
+			return
+		}
+	}
+	if len(resp.Trailers) > 0 {
+		err = sc.writeHeaders(st, resp.Trailers.Fields(), true)
+	} else {
+		err = sc.writeData(st, nil, true)
+	}
+	if err == nil {
+		sc.closeStream(st)
+	}
+}
+
+// responseFields turns the status and headers of an HTTP/1.1 response into
+// an HTTP/2 header section.
+func responseFields(code response.StatusCode, h headers.Headers) []headers.HeaderField {
+	fields := []headers.HeaderField{{Name: ":status", Value: strconv.Itoa(int(code))}}
+	for _, f := range h.Fields() {
+		if !connectionFields[f.Name] {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// writeHeaders sends a header section as HEADERS and as many CONTINUATION
+// frames as it takes.
+func (sc *serverConn) writeHeaders(st *stream, fields []headers.HeaderField, endStream bool) error {
+	sc.mu.Lock()
+	closed, frameSize := st.closed || sc.closed, int(sc.peerFrameSize)
+	sc.mu.Unlock()
+	if closed {
+		return errStreamClosed
+	}
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	block := sc.encoder.Encode(nil, fields)
+	typ, flags := frameHeaders, uint8(0)
+	if endStream {
+		flags |= flagEndStream
+	}
+	for first := true; first || len(block) > 0; first = false {
+		n := min(len(block), frameSize)
+		if n == len(block) {
+			flags |= flagEndHeaders
+		}
+		if err := sc.writeFrameLocked(typ, flags, st.id, block[:n]); err != nil {
+			return err
+		}
+		block = block[n:]
+		typ, flags = frameContinuation, 0
+	}
+	return sc.bw.Flush()
+}
+
+// writeData sends p in DATA frames as the flow control windows allow,
+// waiting for the client to open them when they are used up.
+func (sc *serverConn) writeData(st *stream, p []byte, endStream bool) error {
+	for {
+		n, err := sc.reserve(st, len(p))
+		if err != nil {
+			return err
+		}
+		flags := uint8(0)
+		if endStream && n == len(p) {
+			flags = flagEndStream
+		}
+		if err := sc.writeFrame(frameData, flags, st.id, p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+		if len(p) == 0 {
+			return nil
+		}
+	}
+}
+
+// reserve takes up to want bytes out of the stream's and the connection's
+// windows, as many as fit in a frame, waiting until there is at least one.
+func (sc *serverConn) reserve(st *stream, want int) (int, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for {
+		if st.closed || sc.closed {
+			return 0, errStreamClosed
+		}
+		if want == 0 {
+			return 0, nil
+		}
+		n := min(int64(want), st.sendWindow, sc.sendWindow, int64(sc.peerFrameSize))
+		if n > 0 {
+			st.sendWindow -= n
+			sc.sendWindow -= n
+			return int(n), nil
+		}
+		sc.cond.Wait()
+	}
+}
+
+func (sc *serverConn) writeWindowUpdate(streamID uint32, increment uint32) error {
+	return sc.writeFrame(frameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, increment))
+}
+
+func (sc *serverConn) writeFrame(typ frameType, flags uint8, streamID uint32, payload []byte) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	if err := sc.writeFrameLocked(typ, flags, streamID, payload); err != nil {
+		return err
+	}
+	return sc.bw.Flush()
+}
+
+func (sc *serverConn) writeFrameLocked(typ frameType, flags uint8, streamID uint32, payload []byte) error {
+	var h [frameHeaderLen]byte
+	sc.bw.Write(appendFrameHeader(h[:0], typ, flags, streamID, len(payload)))
+	_, err := sc.bw.Write(payload)
+	return err
+}
@@ -0,0 +1,635 @@
+package http2
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/headers"
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/sankalpmukim/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer serves handler over HTTP/1.1 and h2c.
+func startServer(t *testing.T, h2 *Server, handler server.Handler) string {
+	t.Helper()
+	srv, err := server.ServeWithOptions(0, server.Options{HTTP2: h2}, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return srv.Addr().String()
+}
+
+// echoHandler answers with the method, target and body of the request.
+func echoHandler(w *response.Writer, req *request.Request) {
+	body := req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + string(req.Body)
+	w.WriteStatusLine(response.OK)
+	h := response.GetDefaultHeaders(len(body))
+	h["x-proto"] = req.RequestLine.HttpVersion
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
+
+// testClient speaks raw frames, with HPACK for the header blocks.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+	enc  *headers.Encoder
+	dec  *headers.Decoder
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testClient{t: t, conn: conn, br: bufio.NewReader(conn), enc: headers.NewEncoder(), dec: headers.NewDecoder(headers.DefaultTableSize)}
+}
+
+// connect dials and goes through the prefaces, the client sending settings.
+func connect(t *testing.T, addr string, settings ...setting) *testClient {
+	t.Helper()
+	c := dial(t, addr)
+	c.write([]byte(ClientPreface))
+	c.handshake(settings...)
+	return c
+}
+
+func (c *testClient) handshake(settings ...setting) {
+	c.t.Helper()
+	c.writeFrame(frameSettings, 0, 0, appendSettings(nil, settings...))
+	f := c.readFrame()
+	require.Equal(c.t, frameSettings, f.typ)
+	require.False(c.t, f.has(flagAck))
+	c.writeFrame(frameSettings, flagAck, 0, nil)
+	f = c.readFrame()
+	require.Equal(c.t, frameSettings, f.typ)
+	require.True(c.t, f.has(flagAck))
+}
+
+func (c *testClient) write(b []byte) {
+	c.t.Helper()
+	_, err := c.conn.Write(b)
+	require.NoError(c.t, err)
+}
+
+func (c *testClient) writeFrame(typ frameType, flags uint8, streamID uint32, payload []byte) {
+	c.t.Helper()
+	c.write(append(appendFrameHeader(nil, typ, flags, streamID, len(payload)), payload...))
+}
+
+func (c *testClient) readFrame() frame {
+	c.t.Helper()
+	f, _, err := readFrame(c.br, maxMaxFrameSize, nil)
+	require.NoError(c.t, err)
+	return f
+}
+
+// request opens a stream with a GET (or whatever method extra has) to
+// path, followed by extra fields.
+func (c *testClient) request(id uint32, path string, endStream bool, extra ...string) {
+	c.t.Helper()
+	fields := []headers.HeaderField{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: path}, {Name: ":authority", Value: "localhost"}}
+	for i := 0; i < len(extra); i += 2 {
+		if extra[i] == ":method" {
+			fields[0].Value = extra[i+1]
+			continue
+		}
+		fields = append(fields, headers.HeaderField{Name: extra[i], Value: extra[i+1]})
+	}
+	flags := uint8(flagEndHeaders)
+	if endStream {
+		flags |= flagEndStream
+	}
+	c.writeFrame(frameHeaders, flags, id, c.enc.Encode(nil, fields))
+}
+
+type testResponse struct {
+	headers  map[string]string
+	body     string
+	trailers map[string]string
+}
+
+// readResponse reads frames until stream id ends, answering PINGs and
+// skipping anything unrelated.
+func (c *testClient) readResponse(id uint32) testResponse {
+	c.t.Helper()
+	var resp testResponse
+	for {
+		f := c.readFrame()
+		if f.streamID != id {
+			continue
+		}
+		switch f.typ {
+		case frameHeaders:
+			require.True(c.t, f.has(flagEndHeaders))
+			fields, err := c.dec.Decode(f.payload)
+			require.NoError(c.t, err)
+			h := map[string]string{}
+			for _, field := range fields {
+				h[field.Name] = field.Value
+			}
+			if resp.headers == nil {
+				resp.headers = h
+			} else {
+				resp.trailers = h
+			}
+		case frameData:
+			resp.body += string(f.payload)
+		case frameRSTStream:
+			c.t.Fatalf("stream %d reset with %v", id, ErrCode(binary.BigEndian.Uint32(f.payload)))
+		}
+		if f.has(flagEndStream) {
+			return resp
+		}
+	}
+}
+
+// expectFrame reads frames until one of type typ, which it returns.
+func (c *testClient) expectFrame(typ frameType) frame {
+	c.t.Helper()
+	for {
+		if f := c.readFrame(); f.typ == typ {
+			return f
+		}
+	}
+}
+
+func (c *testClient) expectGoAway(code ErrCode) {
+	c.t.Helper()
+	f := c.expectFrame(frameGoAway)
+	assert.Equal(c.t, code, ErrCode(binary.BigEndian.Uint32(f.payload[4:])))
+	// EOF, or a reset if the close left some of what we sent unread
+	_, err := c.br.ReadByte()
+	assert.Error(c.t, err, "connection should be closed")
+}
+
+func (c *testClient) expectReset(id uint32, code ErrCode) {
+	c.t.Helper()
+	f := c.expectFrame(frameRSTStream)
+	assert.Equal(c.t, id, f.streamID)
+	assert.Equal(c.t, code, ErrCode(binary.BigEndian.Uint32(f.payload)))
+}
+
+func TestPriorKnowledge(t *testing.T) {
+	addr := startServer(t, &Server{}, echoHandler)
+
+	// Test: A GET over h2c, with the HTTP/1.1 framing headers left out
+	c := connect(t, addr)
+	c.request(1, "/hello", true)
+	resp := c.readResponse(1)
+	assert.Equal(t, "200", resp.headers[":status"])
+	assert.Equal(t, "2.0", resp.headers["x-proto"])
+	assert.Equal(t, "11", resp.headers["content-length"])
+	assert.NotContains(t, resp.headers, "connection")
+	assert.Equal(t, "GET /hello ", resp.body)
+
+	// Test: A body spread over DATA frames, on the same connection
+	c.request(3, "/upload", false, ":method", "POST", "content-length", "11")
+	c.writeFrame(frameData, 0, 3, []byte("hello "))
+	c.writeFrame(frameData, flagEndStream|flagPadded, 3, append([]byte{3}, "world\x00\x00\x00"...))
+	resp = c.readResponse(3)
+	assert.Equal(t, "POST /upload hello world", resp.body)
+
+	// Test: HEAD gets the headers only
+	c.request(5, "/hello", true, ":method", "HEAD")
+	resp = c.readResponse(5)
+	assert.Equal(t, "200", resp.headers[":status"])
+	assert.Empty(t, resp.body)
+
+	// Test: PING is answered with the same payload
+	c.writeFrame(framePing, 0, 0, []byte("12345678"))
+	f := c.expectFrame(framePing)
+	assert.True(t, f.has(flagAck))
+	assert.Equal(t, "12345678", string(f.payload))
+
+	// Test: Plain HTTP/1.1 still works next to h2c
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "PUT /old HTTP/1.1\r\nHost: localhost\r\nContent-Length: 2\r\n\r\nhi")
+	require.NoError(t, err)
+	resp1, err := response.ResponseFromReader(conn, "PUT")
+	require.NoError(t, err)
+	assert.Equal(t, "PUT /old hi", string(resp1.Body))
+}
+
+func TestUpgrade(t *testing.T) {
+	addr := startServer(t, &Server{}, echoHandler)
+	c := dial(t, addr)
+
+	// Test: "Upgrade: h2c" gets a 101, and the response on stream 1
+	settings := base64.RawURLEncoding.EncodeToString(appendSettings(nil, setting{settingInitialWindowSize, 1 << 20}))
+	c.write([]byte("POST /up HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n" +
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: " + settings + "\r\n\r\nbody"))
+	resp, err := response.ReadResponse(c.br, "POST")
+	require.NoError(t, err)
+	assert.Equal(t, response.SwitchingProtocols, resp.StatusLine.StatusCode)
+	assert.Equal(t, "h2c", resp.Headers.Get("upgrade"))
+
+	// the response may come before the server's SETTINGS are answered
+	c.write([]byte(ClientPreface))
+	c.writeFrame(frameSettings, 0, 0, nil)
+	got := c.readResponse(1)
+	assert.Equal(t, "POST /up body", got.body)
+
+	// Test: The next stream is 3
+	c.request(3, "/next", true)
+	assert.Equal(t, "GET /next ", c.readResponse(3).body)
+
+	// Test: Without HTTP2-Settings it stays HTTP/1.1
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET /stay HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	require.NoError(t, err)
+	resp1, err := response.ResponseFromReader(conn, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, resp1.StatusLine.StatusCode)
+}
+
+func TestMultiplexing(t *testing.T) {
+	release := make(chan struct{})
+	addr := startServer(t, &Server{}, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			<-release
+		}
+		echoHandler(w, req)
+	})
+	c := connect(t, addr)
+
+	// Test: A slow stream doesn't hold up the one opened after it
+	c.request(1, "/slow", true)
+	c.request(3, "/fast", true)
+	assert.Equal(t, "GET /fast ", c.readResponse(3).body)
+	close(release)
+	assert.Equal(t, "GET /slow ", c.readResponse(1).body)
+}
+
+func TestConcurrentStreamLimit(t *testing.T) {
+	release := make(chan struct{})
+	addr := startServer(t, &Server{MaxConcurrentStreams: 1}, func(w *response.Writer, req *request.Request) {
+		<-release
+		echoHandler(w, req)
+	})
+	c := connect(t, addr)
+
+	// Test: Streams past the limit are refused
+	c.request(1, "/one", true)
+	c.request(3, "/two", true)
+	c.expectReset(3, ErrCodeRefusedStream)
+	close(release)
+	assert.Equal(t, "GET /one ", c.readResponse(1).body)
+}
+
+func TestFlowControl(t *testing.T) {
+	body := strings.Repeat("0123456789", 10000)
+	addr := startServer(t, &Server{}, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	})
+
+	// Test: The server sends no more than the client's window allows
+	c := connect(t, addr, setting{settingInitialWindowSize, 10})
+	c.request(1, "/", true)
+	c.expectFrame(frameHeaders)
+	f := c.expectFrame(frameData)
+	assert.Equal(t, body[:10], string(f.payload))
+	c.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := c.br.Peek(1)
+	require.Error(t, err, "nothing past the window")
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: And carries on as the window opens, within the connection's
+	c.writeFrame(frameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 1<<20))
+	got := body[:10]
+	for len(got) < initialWindowSize {
+		f := c.expectFrame(frameData)
+		assert.LessOrEqual(t, len(f.payload), defaultMaxFrameSize)
+		got += string(f.payload)
+	}
+	assert.Equal(t, initialWindowSize, len(got))
+	c.writeFrame(frameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, 1<<20))
+	resp := c.readResponse(1)
+	assert.Equal(t, body, got+resp.body)
+
+	// Test: A window pushed past 2^31-1 resets the stream
+	c.request(3, "/", true)
+	c.expectFrame(frameHeaders)
+	c.writeFrame(frameWindowUpdate, 0, 3, binary.BigEndian.AppendUint32(nil, maxWindowSize))
+	c.writeFrame(frameWindowUpdate, 0, 3, binary.BigEndian.AppendUint32(nil, maxWindowSize))
+	c.expectReset(3, ErrCodeFlowControl)
+}
+
+func TestRequestBodyLimits(t *testing.T) {
+	addr := startServer(t, &Server{MaxBodyBytes: 100000}, func(w *response.Writer, req *request.Request) {
+		size := strconv.Itoa(len(req.Body))
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(size)))
+		w.WriteBody([]byte(size))
+	})
+
+	// Test: A body bigger than the windows gets through as they are opened
+	// again, in batches rather than after every frame
+	body := strings.Repeat("x", 99000)
+	c := connect(t, addr)
+	c.request(1, "/", false, ":method", "POST")
+	frames := 0
+	for rest := body; rest != ""; frames++ {
+		n := min(len(rest), defaultMaxFrameSize)
+		flags := uint8(0)
+		if n == len(rest) {
+			flags = flagEndStream
+		}
+		c.writeFrame(frameData, flags, 1, []byte(rest[:n]))
+		rest = rest[n:]
+	}
+	updates := 0
+	got := ""
+	for {
+		f := c.readFrame()
+		if f.typ == frameWindowUpdate {
+			updates++
+		}
+		if f.typ == frameData {
+			got += string(f.payload)
+		}
+		if f.has(flagEndStream) {
+			break
+		}
+	}
+	assert.Less(t, updates, frames)
+	assert.Equal(t, strconv.Itoa(len(body)), got)
+
+	// Test: A body over MaxBodyBytes is reset before it is complete
+	c = connect(t, addr)
+	c.request(1, "/", false, ":method", "POST")
+	for range 7 {
+		c.writeFrame(frameData, 0, 1, make([]byte, defaultMaxFrameSize))
+	}
+	c.expectReset(1, ErrCodeEnhanceYourCalm)
+
+	// Test: So is a body over its content-length, without waiting for
+	// END_STREAM
+	c = connect(t, addr)
+	c.request(1, "/", false, ":method", "POST", "content-length", "3")
+	c.writeFrame(frameData, 0, 1, []byte("hello"))
+	c.expectReset(1, ErrCodeProtocol)
+
+	// Test: The connection carries on
+	c.request(3, "/", true)
+	assert.Equal(t, "0", c.readResponse(3).body)
+}
+
+func TestTrailers(t *testing.T) {
+	addr := startServer(t, &Server{}, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(map[string]string{"transfer-encoding": "chunked", "trailer": "x-sum"})
+		w.WriteChunkedBody([]byte("some "))
+		w.WriteChunkedBody([]byte("data"))
+		w.WriteTrailers(map[string]string{"x-sum": "9", "x-request-trailer": req.Trailers.Get("x-client")})
+	})
+	c := connect(t, addr)
+
+	// Test: Request trailers come in, response trailers go out as HEADERS
+	c.request(1, "/", false, ":method", "POST")
+	c.writeFrame(frameData, 0, 1, []byte("x"))
+	c.writeFrame(frameHeaders, flagEndHeaders|flagEndStream, 1, c.enc.Encode(nil, []headers.HeaderField{{Name: "x-client", Value: "yes"}}))
+	resp := c.readResponse(1)
+	assert.NotContains(t, resp.headers, "transfer-encoding")
+	assert.Equal(t, "some data", resp.body)
+	assert.Equal(t, map[string]string{"x-sum": "9", "x-request-trailer": "yes"}, resp.trailers)
+}
+
+func TestHandlerWritesNothing(t *testing.T) {
+	addr := startServer(t, &Server{}, func(w *response.Writer, req *request.Request) {})
+	c := connect(t, addr)
+
+	// Test: A stream without a response is reset
+	c.request(1, "/", true)
+	c.expectReset(1, ErrCodeInternal)
+}
+
+func TestClientReset(t *testing.T) {
+	writeErr := make(chan error, 1)
+	addr := startServer(t, &Server{}, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(map[string]string{"transfer-encoding": "chunked"})
+		for {
+			if _, err := w.WriteChunkedBody(make([]byte, 1024)); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+	})
+	c := connect(t, addr)
+
+	// Test: RST_STREAM stops the handler's writes
+	c.request(1, "/", true)
+	c.expectFrame(frameData)
+	c.writeFrame(frameRSTStream, 0, 1, binary.BigEndian.AppendUint32(nil, uint32(ErrCodeCancel)))
+	select {
+	case err := <-writeErr:
+		assert.ErrorIs(t, err, errStreamClosed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler kept writing")
+	}
+
+	// Test: The connection carries on
+	c.writeFrame(framePing, 0, 0, []byte("still up"))
+	assert.Equal(t, "still up", string(c.expectFrame(framePing).payload))
+}
+
+func TestClientGone(t *testing.T) {
+	noticed := make(chan string, 2)
+	addr := startServer(t, &Server{}, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(map[string]string{"transfer-encoding": "chunked"})
+		w.WriteChunkedBody([]byte("waiting"))
+		select {
+		case <-w.ClientGone():
+			noticed <- req.RequestLine.RequestTarget
+		case <-time.After(5 * time.Second):
+		}
+	})
+	wait := func(path string) {
+		t.Helper()
+		select {
+		case got := <-noticed:
+			assert.Equal(t, path, got)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: handler didn't notice the client going", path)
+		}
+	}
+
+	// Test: RST_STREAM closes ClientGone without anything being written
+	c := connect(t, addr)
+	c.request(1, "/reset", true)
+	c.expectFrame(frameData)
+	c.writeFrame(frameRSTStream, 0, 1, binary.BigEndian.AppendUint32(nil, uint32(ErrCodeCancel)))
+	wait("/reset")
+
+	// Test: So does the connection closing
+	c.request(3, "/close", true)
+	c.expectFrame(frameData)
+	c.conn.Close()
+	wait("/close")
+}
+
+func TestMalformedRequests(t *testing.T) {
+	addr := startServer(t, &Server{}, echoHandler)
+
+	// Test: Requests breaking section 8 get their stream reset
+	for name, extra := range map[string][]string{
+		"uppercase name":      {"X-Upper", "1"},
+		"connection header":   {"connection", "keep-alive"},
+		"te other than trail": {"te", "gzip"},
+		"unknown pseudo":      {":protocol", "websocket"},
+		"response pseudo":     {":status", "200"},
+		"bad content-length":  {"content-length", "abc"},
+		"host and authority":  {"host", "other"},
+	} {
+		c := connect(t, addr)
+		c.request(1, "/", true, extra...)
+		f := c.expectFrame(frameRSTStream)
+		assert.Equal(t, ErrCodeProtocol, ErrCode(binary.BigEndian.Uint32(f.payload)), name)
+	}
+
+	// Test: A body that doesn't match content-length
+	c := connect(t, addr)
+	c.request(1, "/", false, ":method", "POST", "content-length", "10")
+	c.writeFrame(frameData, flagEndStream, 1, []byte("short"))
+	c.expectReset(1, ErrCodeProtocol)
+
+	// Test: Missing pseudo-headers
+	c = connect(t, addr)
+	c.writeFrame(frameHeaders, flagEndHeaders|flagEndStream, 1, c.enc.Encode(nil, []headers.HeaderField{{Name: ":method", Value: "GET"}}))
+	c.expectReset(1, ErrCodeProtocol)
+
+	// Test: A host the server doesn't take is answered like in HTTP/1.1
+	c = connect(t, addr)
+	c.writeFrame(frameHeaders, flagEndHeaders|flagEndStream, 1, c.enc.Encode(nil, []headers.HeaderField{
+		{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: ":authority", Value: "bad host"},
+	}))
+	assert.Equal(t, "400", c.readResponse(1).headers[":status"])
+
+	// Test: So are unknown methods
+	c = connect(t, addr)
+	c.request(1, "/", true, ":method", "BREW")
+	assert.Equal(t, "501", c.readResponse(1).headers[":status"])
+}
+
+func TestConnectionErrors(t *testing.T) {
+	addr := startServer(t, &Server{}, echoHandler)
+
+	for name, tc := range map[string]struct {
+		send func(c *testClient)
+		code ErrCode
+	}{
+		"DATA on stream 0":       {func(c *testClient) { c.writeFrame(frameData, 0, 0, []byte("x")) }, ErrCodeProtocol},
+		"even stream":            {func(c *testClient) { c.request(2, "/", true) }, ErrCodeProtocol},
+		"DATA on an idle stream": {func(c *testClient) { c.writeFrame(frameData, 0, 5, []byte("x")) }, ErrCodeProtocol},
+		"bad HPACK":              {func(c *testClient) { c.writeFrame(frameHeaders, flagEndHeaders, 1, []byte{0x80}) }, ErrCodeCompression},
+		"frame too big":          {func(c *testClient) { c.writeFrame(frameData, 0, 1, make([]byte, defaultMaxFrameSize+1)) }, ErrCodeFrameSize},
+		"WINDOW_UPDATE of 0":     {func(c *testClient) { c.writeFrame(frameWindowUpdate, 0, 0, make([]byte, 4)) }, ErrCodeProtocol},
+		"PUSH_PROMISE":           {func(c *testClient) { c.writeFrame(framePushPromise, flagEndHeaders, 1, make([]byte, 4)) }, ErrCodeProtocol},
+		"bad SETTINGS length":    {func(c *testClient) { c.writeFrame(frameSettings, 0, 0, make([]byte, 5)) }, ErrCodeFrameSize},
+		"bad SETTINGS_ENABLE_PUSH": {func(c *testClient) {
+			c.writeFrame(frameSettings, 0, 0, appendSettings(nil, setting{settingEnablePush, 2}))
+		}, ErrCodeProtocol},
+		"interrupted header block": {func(c *testClient) {
+			c.writeFrame(frameHeaders, 0, 1, c.enc.Encode(nil, []headers.HeaderField{{Name: ":method", Value: "GET"}}))
+			c.writeFrame(framePing, 0, 0, make([]byte, 8))
+		}, ErrCodeProtocol},
+		"stream reused": {func(c *testClient) {
+			c.request(1, "/", true)
+			c.readResponse(1)
+			c.request(1, "/", true)
+		}, ErrCodeStreamClosed},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Test: Each is answered with GOAWAY and the connection closed
+			c := connect(t, addr)
+			tc.send(c)
+			c.expectGoAway(tc.code)
+		})
+	}
+
+	// Test: A connection that doesn't open with SETTINGS
+	c := dial(t, addr)
+	c.write([]byte(ClientPreface))
+	c.writeFrame(framePing, 0, 0, make([]byte, 8))
+	c.expectGoAway(ErrCodeProtocol)
+}
+
+func TestLargeHeaders(t *testing.T) {
+	addr := startServer(t, &Server{}, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		h := response.GetDefaultHeaders(0)
+		h["x-big"] = req.Headers.Get("x-big")
+		w.WriteHeaders(h)
+	})
+	c := connect(t, addr)
+
+	// Test: Header blocks bigger than a frame come in CONTINUATION frames
+	big := strings.Repeat("b", 3*defaultMaxFrameSize)
+	block := c.enc.Encode(nil, []headers.HeaderField{
+		{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "localhost"}, {Name: "x-big", Value: big},
+	})
+	c.writeFrame(frameHeaders, flagEndStream, 1, block[:10])
+	for block = block[10:]; len(block) > defaultMaxFrameSize; block = block[defaultMaxFrameSize:] {
+		c.writeFrame(frameContinuation, 0, 1, block[:defaultMaxFrameSize])
+	}
+	c.writeFrame(frameContinuation, flagEndHeaders, 1, block)
+
+	// and go out the same way
+	f := c.expectFrame(frameHeaders)
+	require.False(t, f.has(flagEndHeaders))
+	got := f.payload
+	for !f.has(flagEndHeaders) {
+		f = c.expectFrame(frameContinuation)
+		got = append(got, f.payload...)
+	}
+	fields, err := c.dec.Decode(got)
+	require.NoError(t, err)
+	assert.Contains(t, fields, headers.HeaderField{Name: "x-big", Value: big})
+	assert.Contains(t, fields, headers.HeaderField{Name: "content-length", Value: strconv.Itoa(0)})
+}
+
+func TestALPN(t *testing.T) {
+	srv, err := server.ServeWithOptions(0, server.Options{HTTP2: &Server{}, TLS: &server.TLSOptions{SelfSigned: true}},
+		func(w *response.Writer, req *request.Request) {
+			body := req.TLS.NegotiatedProtocol + " " + req.TLS.ServerName
+			w.WriteStatusLine(response.OK)
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody([]byte(body))
+		})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: Clients negotiating h2 over TLS speak HTTP/2 from the start,
+	// with the TLS state on their requests
+	conn, err := tls.Dial("tcp", srv.Addr().String(), &tls.Config{ServerName: "localhost", InsecureSkipVerify: true, NextProtos: []string{NextProtoH2}})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, NextProtoH2, conn.ConnectionState().NegotiatedProtocol)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &testClient{t: t, conn: conn, br: bufio.NewReader(conn), enc: headers.NewEncoder(), dec: headers.NewDecoder(headers.DefaultTableSize)}
+	c.write([]byte(ClientPreface))
+	c.handshake()
+	c.request(1, "/", true)
+	assert.Equal(t, "h2 localhost", c.readResponse(1).body)
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"encoding/json"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/sankalpmukim/httpfromtcp/internal/server"
+)
+
+type poolStatus struct {
+	Strategy  string           `json:"strategy"`
+	Upstreams []UpstreamStatus `json:"upstreams"`
+}
+
+// AdminHandler returns a server.Handler that reports the state of pools,
+// keyed by name, as JSON. It shouldn't be reachable from outside.
+func AdminHandler(pools map[string]*Pool) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		status := make(map[string]poolStatus, len(pools))
+		for name, pool := range pools {
+			status[name] = poolStatus{Strategy: pool.Strategy.String(), Upstreams: pool.Status()}
+		}
+		body, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			server.WriteError(w, server.HandleError{StatusCode: response.InternalServerError, Message: err.Error()})
+			return
+		}
+		body = append(body, '\n')
+		h := response.GetDefaultHeaders(len(body))
+		h["content-type"] = "application/json"
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteBody(body)
+	}
+}
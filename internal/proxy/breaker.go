@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is what a request gets while the circuit breaker of its
+// upstream is open. It is answered with 503 without trying the upstream.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerState is the state of a CircuitBreaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets every request through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails every request right away.
+	BreakerOpen
+	// BreakerHalfOpen lets a few trial requests through to see whether
+	// the upstream is back.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreaker stops sending requests to an upstream that keeps failing.
+// After FailureThreshold failures in a row it opens, and requests fail fast
+// for OpenDuration. Then it lets HalfOpenRequests trial requests through:
+// if they all succeed it closes again, if one fails it reopens.
+//
+// The zero value is ready to use.
+type CircuitBreaker struct {
+	// Zero means 5.
+	FailureThreshold int
+	// Zero means 30 seconds.
+	OpenDuration time.Duration
+	// Zero means 1.
+	HalfOpenRequests int
+
+	mu        sync.Mutex
+	state     BreakerState
+	failures  int
+	openUntil time.Time
+	// trial requests let through, and how many of them succeeded
+	trials    int
+	successes int
+}
+
+func (b *CircuitBreaker) failureThreshold() int {
+	if b.FailureThreshold > 0 {
+		return b.FailureThreshold
+	}
+	return 5
+}
+
+func (b *CircuitBreaker) openDuration() time.Duration {
+	if b.OpenDuration > 0 {
+		return b.OpenDuration
+	}
+	return 30 * time.Second
+}
+
+func (b *CircuitBreaker) halfOpenRequests() int {
+	if b.HalfOpenRequests > 0 {
+		return b.HalfOpenRequests
+	}
+	return 1
+}
+
+// State reports the breaker's state. An open breaker whose OpenDuration is
+// over reports half-open.
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(time.Now())
+	return b.state
+}
+
+// advance moves an open breaker to half-open once its time is up. b.mu is
+// held.
+func (b *CircuitBreaker) advance(now time.Time) {
+	if b.state == BreakerOpen && !now.Before(b.openUntil) {
+		b.state = BreakerHalfOpen
+		b.trials = 0
+		b.successes = 0
+	}
+}
+
+// Allow reports whether a request may go ahead. Every allowed request has
+// to be followed by a Record of how it went.
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(time.Now())
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.trials >= b.halfOpenRequests() {
+			return false
+		}
+		b.trials++
+	}
+	return true
+}
+
+// Record reports the outcome of a request that Allow let through.
+func (b *CircuitBreaker) Record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerClosed:
+		if success {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.failureThreshold() {
+			b.open()
+		}
+	case BreakerHalfOpen:
+		if !success {
+			b.open()
+			return
+		}
+		b.successes++
+		if b.successes >= b.halfOpenRequests() {
+			b.state = BreakerClosed
+			b.failures = 0
+		}
+	}
+	// requests let through before the breaker opened don't change anything
+}
+
+// open is called with b.mu held.
+func (b *CircuitBreaker) open() {
+	b.state = BreakerOpen
+	b.openUntil = time.Now().Add(b.openDuration())
+	b.failures = 0
+}
+
+// RetryPolicy says how often a failed request is tried again. Only
+// idempotent requests are retried, and only when the upstream couldn't be
+// reached, timed out or answered 502, 503 or 504. With a Pool every attempt
+// picks its upstream anew.
+type RetryPolicy struct {
+	// Max is the number of retries after the first attempt.
+	Max int
+	// The wait before retry n is random, between zero and BaseDelay*2^n
+	// capped at MaxDelay. Zero means 50 milliseconds and 1 second.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// backoff is the wait before retry number attempt, counting from 0, with
+// full jitter so that clients failing together don't retry together.
+func (r RetryPolicy) backoff(attempt int) time.Duration {
+	base, maxDelay := r.BaseDelay, r.MaxDelay
+	if base <= 0 {
+		base = 50 * time.Millisecond
+	}
+	if maxDelay <= 0 {
+		maxDelay = time.Second
+	}
+	delay := maxDelay
+	if attempt < 30 && base<<attempt > 0 && base<<attempt < maxDelay {
+		delay = base << attempt
+	}
+	return rand.N(delay + 1)
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/client"
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &CircuitBreaker{FailureThreshold: 3, OpenDuration: 50 * time.Millisecond, HalfOpenRequests: 2}
+
+	// Test: Failures in a row open it, a success in between resets the count
+	for _, success := range []bool{false, false, true, false, false} {
+		require.True(t, b.Allow())
+		b.Record(success)
+	}
+	assert.Equal(t, BreakerClosed, b.State())
+	require.True(t, b.Allow())
+	b.Record(false)
+	assert.Equal(t, BreakerOpen, b.State())
+	assert.False(t, b.Allow())
+
+	// Test: After OpenDuration a limited number of trials go through
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, BreakerHalfOpen, b.State())
+	assert.True(t, b.Allow())
+	assert.True(t, b.Allow())
+	assert.False(t, b.Allow())
+
+	// Test: A failed trial opens it again
+	b.Record(true)
+	b.Record(false)
+	assert.Equal(t, BreakerOpen, b.State())
+
+	// Test: Successful trials close it
+	time.Sleep(60 * time.Millisecond)
+	for range 2 {
+		require.True(t, b.Allow())
+		b.Record(true)
+	}
+	assert.Equal(t, BreakerClosed, b.State())
+	assert.True(t, b.Allow())
+}
+
+func TestRetryBackoff(t *testing.T) {
+	r := RetryPolicy{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	for attempt, limit := range []time.Duration{10, 20, 40, 50, 50} {
+		for range 100 {
+			assert.LessOrEqual(t, r.backoff(attempt), limit*time.Millisecond)
+		}
+	}
+	assert.LessOrEqual(t, r.backoff(100), 50*time.Millisecond)
+}
+
+// flakyServer fails the first failures requests with 503 and answers the
+// rest with 200, counting them all.
+func flakyServer(t *testing.T, failures int32) (*url.URL, *atomic.Int32) {
+	t.Helper()
+	var count atomic.Int32
+	u := startServer(t, func(w *response.Writer, req *request.Request) {
+		code := response.OK
+		if count.Add(1) <= failures {
+			code = response.ServiceUnavailable
+		}
+		w.WriteStatusLine(code)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+	return u, &count
+}
+
+func TestReverseProxyRetries(t *testing.T) {
+	retry := RetryPolicy{Max: 2, BaseDelay: time.Millisecond}
+
+	// Test: Idempotent requests are retried until they succeed
+	upstream, count := flakyServer(t, 2)
+	front := startServer(t, (&ReverseProxy{Upstream: upstream, Retry: retry}).Handle)
+	resp := do(t, "GET", front.String()+"/", nil, nil)
+	assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+	assert.Equal(t, int32(3), count.Load())
+
+	// Test: but only Max times
+	upstream, count = flakyServer(t, 10)
+	front = startServer(t, (&ReverseProxy{Upstream: upstream, Retry: retry}).Handle)
+	resp = do(t, "GET", front.String()+"/", nil, nil)
+	assert.Equal(t, response.ServiceUnavailable, resp.StatusLine.StatusCode)
+	assert.Equal(t, int32(3), count.Load())
+
+	// Test: POST is never retried
+	upstream, count = flakyServer(t, 1)
+	front = startServer(t, (&ReverseProxy{Upstream: upstream, Retry: retry}).Handle)
+	resp = do(t, "POST", front.String()+"/", []byte("once"), nil)
+	assert.Equal(t, response.ServiceUnavailable, resp.StatusLine.StatusCode)
+	assert.Equal(t, int32(1), count.Load())
+
+	// Test: Retries in a pool move on to the next upstream
+	bad, badCount := flakyServer(t, 100)
+	good, goodCount := flakyServer(t, 0)
+	pool := NewPool(RoundRobin, &Upstream{URL: bad}, &Upstream{URL: good})
+	front = startServer(t, (&ReverseProxy{Pool: pool, Retry: retry}).Handle)
+	for range 4 {
+		resp = do(t, "GET", front.String()+"/", nil, nil)
+		assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+	}
+	assert.Equal(t, int32(4), badCount.Load())
+	assert.Equal(t, int32(4), goodCount.Load())
+}
+
+func TestReverseProxyTimeoutsAndBreaker(t *testing.T) {
+	slow := startRawServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		request.RequestFromReader(conn)
+		time.Sleep(2 * time.Second)
+	})
+
+	// Test: Per upstream timeouts, and the breaker failing fast after them
+	breaker := &CircuitBreaker{FailureThreshold: 2, OpenDuration: time.Minute}
+	upstream := &Upstream{
+		URL:     slow,
+		Client:  &client.Client{ResponseHeaderTimeout: 50 * time.Millisecond},
+		Breaker: breaker,
+	}
+	pool := NewPool(RoundRobin, upstream)
+	front := startServer(t, (&ReverseProxy{Pool: pool}).Handle)
+	for range 2 {
+		resp := do(t, "GET", front.String()+"/", nil, nil)
+		assert.Equal(t, response.GatewayTimeout, resp.StatusLine.StatusCode)
+	}
+	assert.Equal(t, BreakerOpen, breaker.State())
+	start := time.Now()
+	resp := do(t, "GET", front.String()+"/", nil, nil)
+	assert.Equal(t, response.ServiceUnavailable, resp.StatusLine.StatusCode)
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, "open", pool.Status()[0].Breaker)
+
+	// Test: The breaker works for a single Upstream as well
+	breaker = &CircuitBreaker{FailureThreshold: 1, OpenDuration: time.Minute}
+	front = startServer(t, (&ReverseProxy{
+		Upstream: slow,
+		Client:   &client.Client{Timeout: 50 * time.Millisecond},
+		Breaker:  breaker,
+	}).Handle)
+	resp = do(t, "GET", front.String()+"/", nil, nil)
+	assert.Equal(t, response.GatewayTimeout, resp.StatusLine.StatusCode)
+	resp = do(t, "GET", front.String()+"/", nil, nil)
+	assert.Equal(t, response.ServiceUnavailable, resp.StatusLine.StatusCode)
+	assert.Contains(t, string(resp.Body), ErrCircuitOpen.Error())
+}
+
+func TestReverseProxyPassesOverHalfOpenBreakers(t *testing.T) {
+	named := func(name string) *url.URL {
+		return startServer(t, func(w *response.Writer, req *request.Request) {
+			w.WriteStatusLine(response.OK)
+			w.WriteHeaders(response.GetDefaultHeaders(len(name)))
+			w.WriteBody([]byte(name))
+		})
+	}
+	// halfOpen returns a breaker that is half open with its one trial
+	// request taken already
+	halfOpen := func() *CircuitBreaker {
+		b := &CircuitBreaker{FailureThreshold: 1, OpenDuration: 10 * time.Millisecond, HalfOpenRequests: 1}
+		require.True(t, b.Allow())
+		b.Record(false)
+		time.Sleep(20 * time.Millisecond)
+		require.Equal(t, BreakerHalfOpen, b.State())
+		require.True(t, b.Allow())
+		return b
+	}
+
+	// Test: Requests go to the other upstreams while a breaker holds back
+	a := &Upstream{URL: named("a"), Breaker: halfOpen()}
+	b := &Upstream{URL: named("b")}
+	front := startServer(t, (&ReverseProxy{Pool: NewPool(RoundRobin, a, b)}).Handle)
+	for range 3 {
+		resp := do(t, "GET", front.String()+"/", nil, nil)
+		assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+		assert.Equal(t, "b", string(resp.Body))
+	}
+
+	// Test: 503 once every upstream is held back
+	a = &Upstream{URL: a.URL, Breaker: halfOpen()}
+	b = &Upstream{URL: b.URL, Breaker: halfOpen()}
+	front = startServer(t, (&ReverseProxy{Pool: NewPool(RoundRobin, a, b)}).Handle)
+	resp := do(t, "GET", front.String()+"/", nil, nil)
+	assert.Equal(t, response.ServiceUnavailable, resp.StatusLine.StatusCode)
+	assert.Contains(t, string(resp.Body), ErrCircuitOpen.Error())
+}
@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/client"
+	"github.com/sankalpmukim/httpfromtcp/internal/headers"
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/sankalpmukim/httpfromtcp/internal/server"
+)
+
+// ForwardProxy is a server.Handler for clients that use us as their proxy,
+// curl -x for instance. Requests with an absolute-form target
+// ("GET http://host/path HTTP/1.1") are sent on to the origin they name,
+// and CONNECT requests ("CONNECT host:443 HTTP/1.1") get a raw TCP tunnel
+// to the destination, which is how HTTPS goes through a proxy.
+//
+// Requests with an ordinary target go to Next.
+type ForwardProxy struct {
+	// Allowlist restricts the destinations that can be reached. Entries
+	// are "host" or "host:port", where host may be "*.example.com" to
+	// match every subdomain of example.com, and IPv6 addresses are
+	// bracketed when a port follows. An empty Allowlist allows
+	// everything, which makes an open proxy: don't expose that.
+	Allowlist []string
+
+	// Authenticate, if set, checks the Basic credentials in
+	// Proxy-Authorization. Requests without valid ones get a 407.
+	// CheckPassword makes one for a single user.
+	Authenticate func(user, password string) bool
+
+	// Client sends absolute-form requests on. nil means a client of its
+	// own, with default settings.
+	Client *client.Client
+	// DialTimeout bounds connecting a CONNECT tunnel. Zero means 10
+	// seconds.
+	DialTimeout time.Duration
+
+	// Next handles requests that aren't meant for a proxy. nil answers them
+	// with 400.
+	Next server.Handler
+
+	// ErrorLog gets the errors met while proxying. nil means the log
+	// package's standard logger.
+	ErrorLog *log.Logger
+
+	defaultClient client.Client
+}
+
+// CheckPassword returns an Authenticate function that accepts one user.
+func CheckPassword(user, password string) func(string, string) bool {
+	return func(u, p string) bool {
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+		return userOK && passwordOK
+	}
+}
+
+// Handle is the server.Handler of the proxy.
+func (f *ForwardProxy) Handle(w *response.Writer, req *request.Request) {
+	target := req.RequestLine.RequestTarget
+	isConnect := req.RequestLine.Method == request.MethodConnect
+	if !isConnect && !strings.Contains(target, "://") {
+		if f.Next != nil {
+			f.Next(w, req)
+			return
+		}
+		server.WriteError(w, server.HandleError{StatusCode: response.BadRequest, Message: "not a proxy request"})
+		return
+	}
+
+	if !f.authenticated(req) {
+		msg := "proxy authentication required"
+		h := response.GetDefaultHeaders(len(msg))
+		h["proxy-authenticate"] = `Basic realm="proxy"`
+		w.WriteStatusLine(response.ProxyAuthenticationRequired)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(msg))
+		return
+	}
+
+	if isConnect {
+		f.connect(w, req)
+		return
+	}
+	f.forward(w, req)
+}
+
+func (f *ForwardProxy) authenticated(req *request.Request) bool {
+	if f.Authenticate == nil {
+		return true
+	}
+	scheme, credentials, ok := strings.Cut(req.Headers.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	return ok && f.Authenticate(user, password)
+}
+
+// allowed reports whether host:port may be reached. host is normalised
+// already.
+func (f *ForwardProxy) allowed(host, port string) bool {
+	if len(f.Allowlist) == 0 {
+		return true
+	}
+	for _, entry := range f.Allowlist {
+		entryHost, entryPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			// no port
+			entryHost, entryPort = strings.Trim(entry, "[]"), ""
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		entryHost = strings.ToLower(entryHost)
+		if suffix, ok := strings.CutPrefix(entryHost, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if host == entryHost {
+			return true
+		}
+	}
+	return false
+}
+
+// connect answers a CONNECT request by opening a tunnel to its target.
+func (f *ForwardProxy) connect(w *response.Writer, req *request.Request) {
+	host, port, err := request.ParseHost(req.RequestLine.RequestTarget)
+	if err != nil || port == "" {
+		server.WriteError(w, server.HandleError{StatusCode: response.BadRequest, Message: "CONNECT needs a host:port target"})
+		return
+	}
+	if !f.allowed(host, port) {
+		server.WriteError(w, server.HandleError{StatusCode: response.Forbidden, Message: "destination not allowed"})
+		return
+	}
+	// the tunnel needs the connection to itself, which an HTTP/2 stream
+	// can't give
+	if !w.CanHijack() {
+		server.WriteError(w, server.HandleError{StatusCode: response.NotImplemented, Message: "CONNECT is only supported over HTTP/1"})
+		return
+	}
+
+	dialTimeout := f.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = 10 * time.Second
+	}
+	upstream, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), dialTimeout)
+	if err != nil {
+		logf(f.ErrorLog, "Error opening tunnel: %v", err)
+		server.WriteError(w, server.HandleError{StatusCode: upstreamErrorStatus(err), Message: "can't reach destination"})
+		return
+	}
+
+	// a 2xx answer to CONNECT has no body, the tunnel starts right after
+	// the empty line
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(headers.NewHeaders())
+	conn, rw, err := w.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	// a client that didn't wait for our answer may have sent some of the
+	// tunnel's data along with the request
+	if n := rw.Reader.Buffered(); n > 0 {
+		early, _ := rw.Reader.Peek(n)
+		if _, err := upstream.Write(early); err != nil {
+			conn.Close()
+			upstream.Close()
+			return
+		}
+	}
+	tunnel(conn, upstream)
+}
+
+// tunnel copies between a and b in both directions until both are done,
+// then closes them.
+func tunnel(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		copyAndCloseWrite(a, b)
+		close(done)
+	}()
+	copyAndCloseWrite(b, a)
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// copyAndCloseWrite copies src to dst, then passes the end of src on to
+// dst, so each direction of the tunnel can finish by itself.
+func copyAndCloseWrite(dst, src net.Conn) {
+	io.Copy(dst, src)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+// forward sends an absolute-form request on to the origin it names.
+func (f *ForwardProxy) forward(w *response.Writer, req *request.Request) {
+	u, err := url.Parse(req.RequestLine.RequestTarget)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		server.WriteError(w, server.HandleError{StatusCode: response.BadRequest, Message: "only http:// targets can be proxied, use CONNECT for https"})
+		return
+	}
+	host, port, err := request.ParseHost(u.Host)
+	if err != nil {
+		server.WriteError(w, server.HandleError{StatusCode: response.BadRequest, Message: err.Error()})
+		return
+	}
+	if port == "" {
+		port = "80"
+	}
+	if !f.allowed(host, port) {
+		server.WriteError(w, server.HandleError{StatusCode: response.Forbidden, Message: "destination not allowed"})
+		return
+	}
+
+	out, err := client.NewRequest(req.RequestLine.Method, u.String(), req.Body)
+	if err != nil {
+		server.WriteError(w, server.HandleError{StatusCode: response.BadRequest, Message: err.Error()})
+		return
+	}
+	for name, value := range req.Headers {
+		out.Headers[name] = value
+	}
+	removeHopHeaders(out.Headers)
+	delete(out.Headers, "content-length")
+	// the target wins over whatever Host the client sent, RFC 9112
+	// section 3.2.2
+	out.Headers["host"] = u.Host
+	for name, value := range req.Trailers {
+		out.Trailers[name] = value
+	}
+
+	c := f.Client
+	if c == nil {
+		c = &f.defaultClient
+	}
+	resp, err := c.Do(context.Background(), out)
+	if err != nil {
+		logf(f.ErrorLog, "Error forwarding request: %v", err)
+		server.WriteError(w, server.HandleError{StatusCode: upstreamErrorStatus(err), Message: "upstream request failed"})
+		return
+	}
+	defer resp.Close()
+	if err := writeResponse(w, req, resp); err != nil {
+		logf(f.ErrorLog, "Error streaming upstream response: %v", err)
+	}
+}
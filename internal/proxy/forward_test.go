@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sendRaw writes raw to the server at u and reads back one response. The
+// connection stays open for tunnels.
+func sendRaw(t *testing.T, u *url.URL, raw string) (*response.Response, net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, raw)
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := response.ReadResponse(br, "")
+	require.NoError(t, err)
+	return resp, conn, br
+}
+
+func readBody(t *testing.T, resp *response.Response) string {
+	t.Helper()
+	body, err := io.ReadAll(resp.BodyReader)
+	require.NoError(t, err)
+	return string(body)
+}
+
+// startEchoServer echoes back whatever it gets over plain TCP.
+func startEchoServer(t *testing.T) *url.URL {
+	return startRawServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+	})
+}
+
+func basicAuth(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func TestForwardProxy(t *testing.T) {
+	origin := startServer(t, dumpHandler)
+	echo := startEchoServer(t)
+	var errorLog logBuffer
+	front := startServer(t, (&ForwardProxy{
+		ErrorLog: log.New(&errorLog, "", 0),
+		Next: func(w *response.Writer, req *request.Request) {
+			w.WriteStatusLine(response.OK)
+			w.WriteHeaders(response.GetDefaultHeaders(len("local")))
+			w.WriteBody([]byte("local"))
+		},
+	}).Handle)
+
+	// Test: Absolute-form requests go to the origin they name
+	resp, _, _ := sendRaw(t, front, fmt.Sprintf(
+		"GET http://%s/some/path?q=1 HTTP/1.1\r\nHost: ignored.example\r\nProxy-Connection: keep-alive\r\nX-Custom: yes\r\n\r\n",
+		origin.Host))
+	assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+	body := readBody(t, resp)
+	assert.Contains(t, body, "GET /some/path?q=1\n")
+	assert.Contains(t, body, "host: "+origin.Host+"\n")
+	assert.Contains(t, body, "x-custom: yes\n")
+
+	// Test: CONNECT opens a tunnel
+	resp, conn, br := sendRaw(t, front, fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo.Host, echo.Host))
+	assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+	for _, msg := range []string{"hello through the tunnel\n", "and again\n"} {
+		_, err := io.WriteString(conn, msg)
+		require.NoError(t, err)
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, msg, line)
+	}
+
+	// Test: Tunnel data sent right behind the CONNECT request isn't lost
+	_, early, earlyBr := sendRaw(t, front, fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nclient hello\n", echo.Host, echo.Host))
+	line, err := earlyBr.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "client hello\n", line)
+	early.Close()
+
+	// Test: Closing our side ends the tunnel
+	conn.(*net.TCPConn).CloseWrite()
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+
+	// Test: Ordinary requests go to Next
+	resp, _, _ = sendRaw(t, front, "GET /local HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "local", readBody(t, resp))
+
+	// Test: https targets need CONNECT
+	resp, _, _ = sendRaw(t, front, "GET https://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, response.BadRequest, resp.StatusLine.StatusCode)
+
+	// Test: Unreachable destinations are a 502
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	down := listener.Addr().String()
+	listener.Close()
+	resp, _, _ = sendRaw(t, front, fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", down, down))
+	assert.Equal(t, response.BadGateway, resp.StatusLine.StatusCode)
+	assert.Contains(t, errorLog.String(), "Error opening tunnel: ")
+
+	// Test: Writers that can't be hijacked, as on HTTP/2, get a 501 before
+	// anything is dialled
+	var dialled atomic.Bool
+	target := startRawServer(t, func(conn net.Conn) {
+		dialled.Store(true)
+		conn.Close()
+	})
+	req, err := request.RequestFromReader(strings.NewReader(fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target.Host, target.Host)))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := response.NewResponseWriter(&buf)
+	(&ForwardProxy{}).Handle(&w, req)
+	resp, err = response.ResponseFromReader(&buf, "CONNECT")
+	require.NoError(t, err)
+	assert.Equal(t, response.NotImplemented, resp.StatusLine.StatusCode)
+	assert.False(t, dialled.Load())
+}
+
+func TestForwardProxyAccessControl(t *testing.T) {
+	echo := startEchoServer(t)
+	_, echoPort, _ := net.SplitHostPort(echo.Host)
+	front := startServer(t, (&ForwardProxy{
+		Allowlist:    []string{"127.0.0.1:" + echoPort, "*.example.com:443"},
+		Authenticate: CheckPassword("alice", "secret"),
+	}).Handle)
+	connect := func(target, auth string) response.StatusCode {
+		raw := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+		if auth != "" {
+			raw += "Proxy-Authorization: " + auth + "\r\n"
+		}
+		resp, _, _ := sendRaw(t, front, raw+"\r\n")
+		return resp.StatusLine.StatusCode
+	}
+
+	// Test: No or wrong credentials get a 407 with a challenge
+	resp, _, _ := sendRaw(t, front, fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo.Host, echo.Host))
+	assert.Equal(t, response.ProxyAuthenticationRequired, resp.StatusLine.StatusCode)
+	assert.Equal(t, `Basic realm="proxy"`, resp.Headers.Get("Proxy-Authenticate"))
+	assert.Equal(t, response.ProxyAuthenticationRequired, connect(echo.Host, basicAuth("alice", "wrong")))
+	assert.Equal(t, response.ProxyAuthenticationRequired, connect(echo.Host, "Bearer token"))
+
+	// Test: Allowed destinations
+	assert.Equal(t, response.OK, connect(echo.Host, basicAuth("alice", "secret")))
+
+	// Test: Everything else is a 403
+	assert.Equal(t, response.Forbidden, connect("127.0.0.1:1", basicAuth("alice", "secret")))
+	assert.Equal(t, response.Forbidden, connect("example.com:443", basicAuth("alice", "secret")))
+	assert.Equal(t, response.Forbidden, connect("www.example.com:80", basicAuth("alice", "secret")))
+	resp, _, _ = sendRaw(t, front, "GET http://localhost:1/ HTTP/1.1\r\nHost: localhost\r\nProxy-Authorization: "+
+		basicAuth("alice", "secret")+"\r\n\r\n")
+	assert.Equal(t, response.Forbidden, resp.StatusLine.StatusCode)
+
+	// Test: Allowlist matching
+	f := &ForwardProxy{Allowlist: []string{"example.org", "*.example.com:443", "[::1]:8080"}}
+	assert.True(t, f.allowed("example.org", "80"))
+	assert.True(t, f.allowed("example.org", "8443"))
+	assert.False(t, f.allowed("www.example.org", "80"))
+	assert.True(t, f.allowed("a.b.example.com", "443"))
+	assert.False(t, f.allowed("example.com", "443"))
+	assert.False(t, f.allowed("evilexample.com", "443"))
+	assert.True(t, f.allowed("::1", "8080"))
+	assert.False(t, f.allowed("::1", "80"))
+}
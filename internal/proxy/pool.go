@@ -0,0 +1,434 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"hash/fnv"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/client"
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+)
+
+// ErrNoUpstream is returned by Pool.Pick when every upstream is down or
+// ejected.
+var ErrNoUpstream = errors.New("no upstream available")
+
+// Strategy is how a Pool spreads requests over its upstreams.
+type Strategy int
+
+const (
+	// RoundRobin takes the upstreams in turn.
+	RoundRobin Strategy = iota
+	// LeastConnections takes the upstream with the fewest requests in
+	// flight, in turn among those tied.
+	LeastConnections
+	// Weighted takes the upstreams in turn, each as often as its Weight
+	// says, spread out evenly rather than in bursts.
+	Weighted
+	// ConsistentHash sends requests with the same key to the same
+	// upstream, and only moves the keys of an upstream that goes away.
+	// The key is the client IP, or Pool.HashHeader when that is set.
+	ConsistentHash
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case RoundRobin:
+		return "round-robin"
+	case LeastConnections:
+		return "least-connections"
+	case Weighted:
+		return "weighted"
+	case ConsistentHash:
+		return "consistent-hash"
+	}
+	return "strategy(" + strconv.Itoa(int(s)) + ")"
+}
+
+// Upstream is one server in a Pool.
+type Upstream struct {
+	URL *url.URL
+	// Weight is used by Weighted and ConsistentHash. Zero means 1.
+	Weight int
+	// Client, if set, is used for this upstream instead of the proxy's,
+	// which is how it gets timeouts of its own.
+	Client *client.Client
+	// Breaker, if set, stops requests to the upstream while it keeps
+	// failing. Pick passes over upstreams whose breaker is open.
+	Breaker *CircuitBreaker
+
+	active   atomic.Int64
+	requests atomic.Int64
+
+	// the rest is guarded by the pool's mutex
+	healthy      bool
+	checkStreak  int // consecutive health check results agreeing with each other
+	lastCheckOK  bool
+	failures     int // consecutive failed requests
+	ejectedUntil time.Time
+	current      int // smooth weighted round robin state
+}
+
+func (u *Upstream) weight() int {
+	if u.Weight > 0 {
+		return u.Weight
+	}
+	return 1
+}
+
+// HealthCheck configures active health checks: every Interval each
+// upstream gets a GET for Path, and answers other than 2xx or 3xx, as well
+// as no answer within Timeout, count as failures.
+type HealthCheck struct {
+	Path string
+	// Interval defaults to 10 seconds.
+	Interval time.Duration
+	// Timeout defaults to Interval.
+	Timeout time.Duration
+	// how many checks in a row it takes to mark an upstream up or down.
+	// Zero means 1 and 2.
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+const defaultCheckInterval = 10 * time.Second
+
+// Pool is a set of upstreams that a ReverseProxy balances requests over.
+// Upstreams that fail MaxFails requests in a row are ejected for
+// EjectDuration; with a HealthCheck configured, upstreams are also taken
+// out and put back according to the check's results.
+type Pool struct {
+	Strategy Strategy
+	// HashHeader is the header ConsistentHash hashes on. Empty means the
+	// client IP.
+	HashHeader string
+
+	// MaxFails consecutive failed requests eject an upstream. Zero means
+	// passive ejection is off.
+	MaxFails int
+	// EjectDuration is how long an ejected upstream gets no requests.
+	// Zero means 30 seconds.
+	EjectDuration time.Duration
+
+	mu        sync.Mutex
+	upstreams []*Upstream
+	next      int
+	ring      []ringPoint
+
+	stopChecks context.CancelFunc
+}
+
+// how many points each unit of weight gets on the hash ring
+const ringReplicas = 100
+
+type ringPoint struct {
+	hash     uint32
+	upstream *Upstream
+}
+
+// NewPool returns a pool over upstreams, all of them considered healthy to
+// begin with.
+func NewPool(strategy Strategy, upstreams ...*Upstream) *Pool {
+	p := &Pool{Strategy: strategy, upstreams: upstreams}
+	for _, u := range upstreams {
+		u.healthy = true
+	}
+	p.buildRing()
+	return p
+}
+
+func (p *Pool) buildRing() {
+	p.ring = p.ring[:0]
+	for _, u := range p.upstreams {
+		for i := range u.weight() * ringReplicas {
+			p.ring = append(p.ring, ringPoint{hash: hashKey(u.URL.Host + "#" + strconv.Itoa(i)), upstream: u})
+		}
+	}
+	slices.SortFunc(p.ring, func(a, b ringPoint) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+}
+
+// hashKey is FNV-1a followed by murmur3's finalizer. FNV alone leaves
+// keys that only differ at the end, like our ring points, bunched up.
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// available reports whether u may get requests. p.mu is held.
+func (u *Upstream) available(now time.Time) bool {
+	return u.healthy && !now.Before(u.ejectedUntil) && (u.Breaker == nil || u.Breaker.State() != BreakerOpen)
+}
+
+// Pick chooses the upstream for req.
+func (p *Pool) Pick(req *request.Request) (*Upstream, error) {
+	return p.pick(req, nil)
+}
+
+// pick is Pick passing over the upstreams in skip as well.
+func (p *Pool) pick(req *request.Request, skip map[*Upstream]bool) (*Upstream, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	usable := func(u *Upstream) bool {
+		return u.available(now) && !skip[u]
+	}
+
+	var picked *Upstream
+	switch p.Strategy {
+	case LeastConnections:
+		for i := range p.upstreams {
+			u := p.upstreams[(p.next+i)%len(p.upstreams)]
+			if usable(u) && (picked == nil || u.active.Load() < picked.active.Load()) {
+				picked = u
+			}
+		}
+		p.next++
+	case Weighted:
+		// smooth weighted round robin, as in nginx
+		total := 0
+		for _, u := range p.upstreams {
+			if !usable(u) {
+				continue
+			}
+			u.current += u.weight()
+			total += u.weight()
+			if picked == nil || u.current > picked.current {
+				picked = u
+			}
+		}
+		if picked != nil {
+			picked.current -= total
+		}
+	case ConsistentHash:
+		picked = p.pickHashed(p.hashKeyFor(req), usable)
+	default:
+		for range p.upstreams {
+			u := p.upstreams[p.next%len(p.upstreams)]
+			p.next++
+			if usable(u) {
+				picked = u
+				break
+			}
+		}
+	}
+
+	if picked == nil {
+		return nil, ErrNoUpstream
+	}
+	return picked, nil
+}
+
+func (p *Pool) hashKeyFor(req *request.Request) string {
+	if p.HashHeader != "" {
+		return req.Headers.Get(p.HashHeader)
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// pickHashed walks the ring clockwise from key's point to the first
+// usable upstream. p.mu is held.
+func (p *Pool) pickHashed(key string, usable func(*Upstream) bool) *Upstream {
+	if len(p.ring) == 0 {
+		return nil
+	}
+	h := hashKey(key)
+	start, _ := slices.BinarySearchFunc(p.ring, h, func(point ringPoint, h uint32) int {
+		return cmp.Compare(point.hash, h)
+	})
+	for i := range p.ring {
+		point := p.ring[(start+i)%len(p.ring)]
+		if usable(point.upstream) {
+			return point.upstream
+		}
+	}
+	return nil
+}
+
+// begin and end bracket a request to u. failed says whether the upstream
+// let it down, which counts towards ejecting it.
+func (p *Pool) begin(u *Upstream) {
+	u.active.Add(1)
+	u.requests.Add(1)
+}
+
+func (p *Pool) end(u *Upstream, failed bool) {
+	u.active.Add(-1)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !failed {
+		u.failures = 0
+		return
+	}
+	u.failures++
+	if p.MaxFails > 0 && u.failures >= p.MaxFails {
+		u.failures = 0
+		u.ejectedUntil = time.Now().Add(p.ejectDuration())
+	}
+}
+
+func (p *Pool) ejectDuration() time.Duration {
+	if p.EjectDuration > 0 {
+		return p.EjectDuration
+	}
+	return 30 * time.Second
+}
+
+// StartHealthChecks checks every upstream as configured by check until
+// StopHealthChecks is called.
+func (p *Pool) StartHealthChecks(check HealthCheck) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.mu.Lock()
+	if p.stopChecks != nil {
+		p.stopChecks()
+	}
+	p.stopChecks = cancel
+	upstreams := slices.Clone(p.upstreams)
+	p.mu.Unlock()
+
+	if check.Interval <= 0 {
+		check.Interval = defaultCheckInterval
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = check.Interval
+	}
+	if check.HealthyThreshold <= 0 {
+		check.HealthyThreshold = 1
+	}
+	if check.UnhealthyThreshold <= 0 {
+		check.UnhealthyThreshold = 2
+	}
+	c := &client.Client{Timeout: check.Timeout, DisableKeepAlives: true}
+
+	go func() {
+		ticker := time.NewTicker(check.Interval)
+		defer ticker.Stop()
+		for {
+			var wg sync.WaitGroup
+			for _, u := range upstreams {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					p.recordCheck(u, check, probe(ctx, c, u, check.Path))
+				}()
+			}
+			wg.Wait()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// StopHealthChecks stops the checks started by StartHealthChecks.
+func (p *Pool) StopHealthChecks() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopChecks != nil {
+		p.stopChecks()
+		p.stopChecks = nil
+	}
+}
+
+func probe(ctx context.Context, c *client.Client, u *Upstream, path string) bool {
+	target := *u.URL
+	target.Path = path
+	target.RawQuery = ""
+	resp, err := c.Get(ctx, target.String())
+	if err != nil {
+		return false
+	}
+	resp.Close()
+	code := resp.StatusLine.StatusCode
+	return code >= 200 && code < 400
+}
+
+func (p *Pool) recordCheck(u *Upstream, check HealthCheck, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ok != u.lastCheckOK {
+		u.checkStreak = 0
+	}
+	u.lastCheckOK = ok
+	u.checkStreak++
+	switch {
+	case ok && !u.healthy && u.checkStreak >= check.HealthyThreshold:
+		u.healthy = true
+		// passed the check, so give it its chance again
+		u.ejectedUntil = time.Time{}
+		u.failures = 0
+	case !ok && u.healthy && u.checkStreak >= check.UnhealthyThreshold:
+		u.healthy = false
+	}
+}
+
+// UpstreamStatus is a snapshot of an upstream, as shown by the admin
+// endpoint.
+type UpstreamStatus struct {
+	URL          string    `json:"url"`
+	Weight       int       `json:"weight"`
+	Healthy      bool      `json:"healthy"`
+	Ejected      bool      `json:"ejected"`
+	EjectedUntil time.Time `json:"ejected_until,omitzero"`
+	Active       int64     `json:"active"`
+	Requests     int64     `json:"requests"`
+	Failures     int       `json:"consecutive_failures"`
+	Breaker      string    `json:"breaker,omitempty"`
+}
+
+// Status reports the state of every upstream in the pool.
+func (p *Pool) Status() []UpstreamStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	status := make([]UpstreamStatus, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		s := UpstreamStatus{
+			URL:      u.URL.String(),
+			Weight:   u.weight(),
+			Healthy:  u.healthy,
+			Ejected:  now.Before(u.ejectedUntil),
+			Active:   u.active.Load(),
+			Requests: u.requests.Load(),
+			Failures: u.failures,
+		}
+		if s.Ejected {
+			s.EjectedUntil = u.ejectedUntil
+		}
+		if u.Breaker != nil {
+			s.Breaker = u.Breaker.State().String()
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+// isUpstreamFailure reports whether a response means the upstream itself is
+// in trouble, as opposed to the request being one it can't serve.
+func isUpstreamFailure(code response.StatusCode) bool {
+	return code == response.BadGateway || code == response.ServiceUnavailable || code == response.GatewayTimeout
+}
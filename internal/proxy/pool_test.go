@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/headers"
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testUpstreams(n int) []*Upstream {
+	upstreams := make([]*Upstream, n)
+	for i := range upstreams {
+		upstreams[i] = &Upstream{URL: &url.URL{Scheme: "http", Host: fmt.Sprintf("10.0.0.%d:80", i+1)}}
+	}
+	return upstreams
+}
+
+func requestFrom(remoteAddr string) *request.Request {
+	return &request.Request{Headers: headers.NewHeaders(), RemoteAddr: remoteAddr}
+}
+
+// picks returns the hosts picked for n requests from the same client.
+func picks(t *testing.T, p *Pool, n int) []string {
+	t.Helper()
+	var hosts []string
+	for range n {
+		u, err := p.Pick(requestFrom("192.0.2.1:5000"))
+		require.NoError(t, err)
+		hosts = append(hosts, u.URL.Host)
+	}
+	return hosts
+}
+
+func TestPoolStrategies(t *testing.T) {
+	// Test: Round robin takes turns
+	upstreams := testUpstreams(3)
+	p := NewPool(RoundRobin, upstreams...)
+	assert.Equal(t, []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.1:80"}, picks(t, p, 4))
+
+	// Test: Unavailable upstreams are skipped
+	upstreams[1].healthy = false
+	assert.Equal(t, []string{"10.0.0.3:80", "10.0.0.1:80", "10.0.0.3:80"}, picks(t, p, 3))
+	upstreams[0].ejectedUntil = time.Now().Add(time.Minute)
+	upstreams[2].healthy = false
+	_, err := p.Pick(requestFrom("192.0.2.1:5000"))
+	require.ErrorIs(t, err, ErrNoUpstream)
+
+	// Test: Least connections avoids busy upstreams
+	upstreams = testUpstreams(3)
+	p = NewPool(LeastConnections, upstreams...)
+	upstreams[0].active.Store(5)
+	upstreams[1].active.Store(1)
+	upstreams[2].active.Store(3)
+	assert.Equal(t, []string{"10.0.0.2:80"}, picks(t, p, 1))
+	upstreams[1].active.Store(3)
+	assert.ElementsMatch(t, []string{"10.0.0.2:80", "10.0.0.3:80"}, picks(t, p, 2))
+
+	// Test: Weighted spreads requests by weight, interleaved
+	upstreams = testUpstreams(3)
+	upstreams[0].Weight = 5
+	p = NewPool(Weighted, upstreams...)
+	assert.Equal(t, []string{
+		"10.0.0.1:80", "10.0.0.1:80", "10.0.0.2:80", "10.0.0.1:80", "10.0.0.3:80", "10.0.0.1:80", "10.0.0.1:80",
+	}, picks(t, p, 7))
+
+	// Test: Consistent hashing sticks to one upstream per client
+	upstreams = testUpstreams(5)
+	p = NewPool(ConsistentHash, upstreams...)
+	assignment := make(map[string]*Upstream)
+	counts := make(map[*Upstream]int)
+	for i := range 1000 {
+		addr := fmt.Sprintf("198.51.%d.%d:1234", i/256, i%256)
+		u, err := p.Pick(requestFrom(addr))
+		require.NoError(t, err)
+		again, _ := p.Pick(requestFrom(addr))
+		assert.Same(t, u, again)
+		assignment[addr] = u
+		counts[u]++
+	}
+	for _, u := range upstreams {
+		assert.Greater(t, counts[u], 100, u.URL.Host)
+	}
+
+	// Test: Taking one out only moves its own clients
+	upstreams[2].healthy = false
+	for addr, before := range assignment {
+		after, err := p.Pick(requestFrom(addr))
+		require.NoError(t, err)
+		if before != upstreams[2] {
+			assert.Same(t, before, after)
+		} else {
+			assert.NotSame(t, before, after)
+		}
+	}
+
+	// Test: Hashing on a header
+	p = NewPool(ConsistentHash, testUpstreams(5)...)
+	p.HashHeader = "X-User"
+	seen := make(map[string]bool)
+	for i := range 20 {
+		req := requestFrom(fmt.Sprintf("192.0.2.%d:1", i))
+		req.Headers["x-user"] = "alice"
+		u, err := p.Pick(req)
+		require.NoError(t, err)
+		seen[u.URL.Host] = true
+	}
+	assert.Len(t, seen, 1)
+}
+
+// upstreamServer runs a server whose /health answers 200 while healthy is
+// set and 500 otherwise, and that says which upstream it is on every other
+// path.
+func upstreamServer(t *testing.T, name string, healthy *atomic.Bool) *Upstream {
+	t.Helper()
+	u := startServer(t, func(w *response.Writer, req *request.Request) {
+		code, body := response.OK, name
+		if req.RequestLine.RequestTarget == "/health" && !healthy.Load() {
+			code = response.InternalServerError
+		}
+		w.WriteStatusLine(code)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	})
+	return &Upstream{URL: u}
+}
+
+func TestPoolHealth(t *testing.T) {
+	var aHealthy, bHealthy atomic.Bool
+	aHealthy.Store(true)
+	bHealthy.Store(true)
+	a := upstreamServer(t, "a", &aHealthy)
+	b := upstreamServer(t, "b", &bHealthy)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead := &Upstream{URL: &url.URL{Scheme: "http", Host: listener.Addr().String()}}
+	listener.Close()
+
+	pool := NewPool(RoundRobin, a, b, dead)
+	pool.MaxFails = 2
+	pool.EjectDuration = time.Minute
+	front := startServer(t, (&ReverseProxy{Pool: pool}).Handle)
+
+	// Test: Consecutive failures eject an upstream
+	bodies := make(map[string]int)
+	for range 9 {
+		resp := do(t, "GET", front.String()+"/", nil, nil)
+		bodies[string(resp.Body)]++
+	}
+	assert.Equal(t, 2, bodies["An error occurred: upstream request failed"])
+	assert.Equal(t, 4, bodies["a"])
+	assert.Equal(t, 3, bodies["b"])
+	status := pool.Status()
+	assert.True(t, status[2].Ejected)
+	assert.False(t, status[0].Ejected)
+	assert.Equal(t, int64(4), status[0].Requests)
+
+	// Test: A zero Interval falls back to the default
+	pool.StartHealthChecks(HealthCheck{Path: "/health"})
+	pool.StopHealthChecks()
+
+	// Test: Failing health checks take an upstream out, passing ones bring
+	// it back
+	pool.StartHealthChecks(HealthCheck{Path: "/health", Interval: 20 * time.Millisecond, UnhealthyThreshold: 2})
+	defer pool.StopHealthChecks()
+	bHealthy.Store(false)
+	require.Eventually(t, func() bool { return !pool.Status()[1].Healthy }, 2*time.Second, 10*time.Millisecond)
+	for range 3 {
+		assert.Equal(t, "a", string(do(t, "GET", front.String()+"/", nil, nil).Body))
+	}
+	bHealthy.Store(true)
+	require.Eventually(t, func() bool { return pool.Status()[1].Healthy }, 2*time.Second, 10*time.Millisecond)
+
+	// Test: With nothing left the proxy answers 503
+	aHealthy.Store(false)
+	bHealthy.Store(false)
+	require.Eventually(t, func() bool { return !pool.Status()[0].Healthy && !pool.Status()[1].Healthy },
+		2*time.Second, 10*time.Millisecond)
+	resp := do(t, "GET", front.String()+"/", nil, nil)
+	assert.Equal(t, response.ServiceUnavailable, resp.StatusLine.StatusCode)
+
+	// Test: The admin endpoint shows it all
+	admin := startServer(t, AdminHandler(map[string]*Pool{"backend": pool}))
+	resp = do(t, "GET", admin.String()+"/", nil, nil)
+	assert.Equal(t, "application/json", resp.Headers.Get("content-type"))
+	var report map[string]struct {
+		Strategy  string           `json:"strategy"`
+		Upstreams []UpstreamStatus `json:"upstreams"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body, &report))
+	require.Len(t, report["backend"].Upstreams, 3)
+	assert.Equal(t, "round-robin", report["backend"].Strategy)
+	assert.Equal(t, a.URL.String(), report["backend"].Upstreams[0].URL)
+	assert.False(t, report["backend"].Upstreams[0].Healthy)
+	assert.True(t, report["backend"].Upstreams[2].Ejected)
+}
@@ -0,0 +1,437 @@
+// Package proxy forwards requests received by our server to other HTTP
+// servers.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/client"
+	"github.com/sankalpmukim/httpfromtcp/internal/headers"
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/sankalpmukim/httpfromtcp/internal/server"
+)
+
+// ReverseProxy is a server.Handler that passes requests on to an upstream
+// server and streams its answers back.
+//
+//	p := &proxy.ReverseProxy{Upstream: upstream, StripPrefix: "/api"}
+//	server.Serve(port, p.Handle)
+//
+// A request for /api/users?page=2 then goes to the upstream as
+// <upstream path>/users?page=2. Hop-by-hop headers are dropped in both
+// directions and the upstream learns about the client through
+// X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host and Forwarded.
+//
+// Responses are streamed. So are request bodies the server left on the
+// connection (see server.Options.StreamBody), along with their trailers;
+// other bodies go upstream from memory.
+//
+// Upstream failures are answered with 502 Bad Gateway, or 504 Gateway
+// Timeout when the client's timeout ran out. With a Pool, requests are
+// balanced over several upstreams instead of going to Upstream. Failed
+// idempotent requests can be retried, and circuit breakers keep requests
+// away from upstreams that keep failing.
+type ReverseProxy struct {
+	// Upstream is the scheme and host requests are sent to. Its path is
+	// put in front of the request's path, and its query in front of the
+	// request's query.
+	Upstream *url.URL
+	// Pool, if set, is used instead of Upstream to pick where each request
+	// goes. With no upstream available the request gets a 503.
+	Pool *Pool
+
+	// StripPrefix is cut off the request's path before it's forwarded.
+	StripPrefix string
+
+	// PreserveHost sends the client's Host header upstream instead of the
+	// upstream's own.
+	PreserveHost bool
+
+	// Rewrite, if set, is called last on the outgoing request and can
+	// change anything about it.
+	Rewrite func(out *client.Request, in *request.Request)
+
+	// ModifyResponse, if set, is called with the upstream response before
+	// anything of it is sent on. It may replace BodyReader and add
+	// trailers, which are sent once the body is done. An error answers the
+	// request with 502.
+	ModifyResponse func(resp *client.Response) error
+
+	// Client sends the requests upstream. nil means a client of its own,
+	// with default settings. Its DialTimeout, ResponseHeaderTimeout and
+	// Timeout are the connect, response header and total timeouts.
+	Client *client.Client
+
+	// Breaker, if set, fails requests to Upstream fast with 503 while it
+	// keeps failing. Pools have a breaker per upstream instead.
+	Breaker *CircuitBreaker
+
+	// Retry says how often idempotent requests are tried again when the
+	// upstream fails them. The zero value doesn't retry.
+	Retry RetryPolicy
+
+	// ErrorLog gets the errors met while proxying. nil means the log
+	// package's standard logger.
+	ErrorLog *log.Logger
+
+	defaultClient client.Client
+}
+
+// hopHeaders are meaningful for a single connection only, RFC 9110
+// section 7.6.1, and are never forwarded.
+var hopHeaders = []string{
+	"connection",
+	"proxy-connection",
+	"keep-alive",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+// target is where one attempt at a request goes.
+type target struct {
+	url      *url.URL
+	client   *client.Client
+	breaker  *CircuitBreaker
+	upstream *Upstream // nil without a Pool
+}
+
+// Handle is the server.Handler of the proxy.
+func (p *ReverseProxy) Handle(w *response.Writer, req *request.Request) {
+	retries := 0
+	// a streamed body can only be sent once
+	if request.IsIdempotent(req.RequestLine.Method) && req.BodyReader == nil {
+		retries = p.Retry.Max
+	}
+
+	for attempt := 0; ; attempt++ {
+		t, err := p.pick(req)
+		if err != nil {
+			server.WriteError(w, server.HandleError{StatusCode: response.ServiceUnavailable, Message: err.Error()})
+			return
+		}
+
+		out, err := p.outgoingRequest(req, t.url)
+		if err != nil {
+			p.finish(t, false)
+			server.WriteError(w, server.HandleError{StatusCode: response.BadGateway, Message: err.Error()})
+			return
+		}
+		resp, err := t.client.Do(context.Background(), out)
+
+		failed := err != nil || isUpstreamFailure(resp.StatusLine.StatusCode)
+		if failed && attempt < retries {
+			if err != nil {
+				logf(p.ErrorLog, "Error proxying request, retrying: %v", err)
+			} else {
+				resp.Close()
+			}
+			p.finish(t, true)
+			time.Sleep(p.Retry.backoff(attempt))
+			continue
+		}
+
+		p.finish(t, p.respond(w, req, resp, err))
+		return
+	}
+}
+
+// pick decides where the next attempt at req goes, and counts it as begun.
+func (p *ReverseProxy) pick(req *request.Request) (*target, error) {
+	t := &target{url: p.Upstream, client: p.Client, breaker: p.Breaker}
+	if p.Pool != nil {
+		// a half-open breaker lets only so many trial requests through, the
+		// pool's other upstreams can take the rest
+		var skip map[*Upstream]bool
+		for {
+			upstream, err := p.Pool.pick(req, skip)
+			if err != nil {
+				if skip != nil {
+					return nil, ErrCircuitOpen
+				}
+				return nil, err
+			}
+			if upstream.Breaker == nil || upstream.Breaker.Allow() {
+				t = &target{url: upstream.URL, client: upstream.Client, upstream: upstream, breaker: upstream.Breaker}
+				break
+			}
+			if skip == nil {
+				skip = make(map[*Upstream]bool)
+			}
+			skip[upstream] = true
+		}
+	} else if t.breaker != nil && !t.breaker.Allow() {
+		return nil, ErrCircuitOpen
+	}
+	if t.client == nil {
+		t.client = p.Client
+	}
+	if t.client == nil {
+		t.client = &p.defaultClient
+	}
+
+	if t.upstream != nil {
+		p.Pool.begin(t.upstream)
+	}
+	return t, nil
+}
+
+// finish records how an attempt started by pick went.
+func (p *ReverseProxy) finish(t *target, failed bool) {
+	if t.breaker != nil {
+		t.breaker.Record(!failed)
+	}
+	if t.upstream != nil {
+		p.Pool.end(t.upstream, failed)
+	}
+}
+
+// respond sends the outcome of the last attempt to the client. It reports
+// whether the upstream let the request down.
+func (p *ReverseProxy) respond(w *response.Writer, req *request.Request, resp *client.Response, err error) (failed bool) {
+	if err != nil {
+		logf(p.ErrorLog, "Error proxying request: %v", err)
+		status, message := upstreamErrorStatus(err), "upstream request failed"
+		if status == response.ContentTooLarge {
+			message = request.ErrBodyTooLarge.Error()
+		}
+		server.WriteError(w, server.HandleError{StatusCode: status, Message: message})
+		return status != response.ContentTooLarge
+	}
+	defer resp.Close()
+
+	if p.ModifyResponse != nil {
+		if err := p.ModifyResponse(resp); err != nil {
+			server.WriteError(w, server.HandleError{StatusCode: response.BadGateway, Message: err.Error()})
+			return false
+		}
+	}
+
+	if err := writeResponse(w, req, resp); err != nil {
+		// the status line is out already, all we can do is not finish the
+		// body so the client can tell something went wrong
+		logf(p.ErrorLog, "Error streaming upstream response: %v", err)
+		return true
+	}
+	return isUpstreamFailure(resp.StatusLine.StatusCode)
+}
+
+// logf writes to l, or to the standard logger when l is nil.
+func logf(l *log.Logger, format string, args ...any) {
+	if l == nil {
+		l = log.Default()
+	}
+	l.Printf(format, args...)
+}
+
+func upstreamErrorStatus(err error) response.StatusCode {
+	if errors.Is(err, request.ErrBodyTooLarge) {
+		// the client's fault, not the upstream's
+		return response.ContentTooLarge
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return response.GatewayTimeout
+	}
+	return response.BadGateway
+}
+
+// outgoingRequest builds the request to send upstream from the one we got.
+func (p *ReverseProxy) outgoingRequest(in *request.Request, upstream *url.URL) (*client.Request, error) {
+	target, err := p.rewriteTarget(in.RequestLine.RequestTarget, upstream)
+	if err != nil {
+		return nil, err
+	}
+	out, err := client.NewRequest(in.RequestLine.Method, target, in.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, value := range in.Headers {
+		out.Headers[name] = value
+	}
+	removeHopHeaders(out.Headers)
+	// the client frames the body itself
+	delete(out.Headers, "content-length")
+	if !p.PreserveHost {
+		out.Headers["host"] = out.URL.Host
+	}
+	if in.BodyReader != nil {
+		// the trailers arrive at the end of the body, sharing the map
+		// gets them upstream once it has been read
+		out.BodyReader = in.BodyReader
+		out.Trailers = in.Trailers
+	} else {
+		for name, value := range in.Trailers {
+			out.Trailers[name] = value
+		}
+	}
+	addForwardedHeaders(out.Headers, in)
+
+	if p.Rewrite != nil {
+		p.Rewrite(out, in)
+	}
+	return out, nil
+}
+
+// rewriteTarget turns the origin-form target we got into the absolute URL
+// to send upstream.
+func (p *ReverseProxy) rewriteTarget(target string, upstream *url.URL) (string, error) {
+	if !strings.HasPrefix(target, "/") {
+		return "", fmt.Errorf("can't proxy request target %q", target)
+	}
+	path, query, _ := strings.Cut(target, "?")
+	path = strings.TrimPrefix(path, p.StripPrefix)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	u := *upstream
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = ""
+	switch {
+	case u.RawQuery == "":
+		u.RawQuery = query
+	case query != "":
+		u.RawQuery += "&" + query
+	}
+	return u.String(), nil
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from h, including any
+// that the Connection header names.
+func removeHopHeaders(h headers.Headers) {
+	for name := range strings.SplitSeq(h.Get("Connection"), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			delete(h, name)
+		}
+	}
+	for _, name := range hopHeaders {
+		delete(h, name)
+	}
+}
+
+// addForwardedHeaders tells the upstream who the request came from, adding
+// to what earlier proxies said.
+func addForwardedHeaders(h headers.Headers, in *request.Request) {
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	clientIP := in.RemoteAddr
+	if host, _, err := net.SplitHostPort(in.RemoteAddr); err == nil {
+		clientIP = host
+	}
+	host := in.Headers.Get("Host")
+
+	if clientIP != "" {
+		h.Add("x-forwarded-for", clientIP)
+	}
+	h["x-forwarded-proto"] = proto
+	if host != "" {
+		h["x-forwarded-host"] = host
+	}
+
+	// RFC 7239: IPv6 addresses are bracketed, and anything that isn't a
+	// token has to be quoted
+	var forwarded []string
+	if clientIP != "" {
+		node := clientIP
+		if strings.Contains(node, ":") {
+			node = "[" + node + "]"
+		}
+		forwarded = append(forwarded, "for="+quoteIfNeeded(node))
+	}
+	if host != "" {
+		forwarded = append(forwarded, "host="+quoteIfNeeded(host))
+	}
+	forwarded = append(forwarded, "proto="+proto)
+	h.Add("forwarded", strings.Join(forwarded, ";"))
+}
+
+func quoteIfNeeded(s string) string {
+	if headers.IsToken(s) {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// writeResponse streams resp back to the client. Bodies with a length are
+// copied as they are, everything else goes out chunked, trailers included.
+func writeResponse(w *response.Writer, req *request.Request, resp *client.Response) error {
+	h := headers.NewHeaders()
+	for name, value := range resp.Headers {
+		h[name] = value
+	}
+	removeHopHeaders(h)
+	// we close the client connection after every response
+	h["connection"] = "close"
+
+	if err := w.WriteStatusLine(resp.StatusLine.StatusCode); err != nil {
+		return err
+	}
+
+	code := resp.StatusLine.StatusCode
+	noBody := req.RequestLine.Method == request.MethodHead ||
+		code == response.NoContent || code == response.NotModified || code >= 100 && code < 200
+	_, hasLength := h["content-length"]
+	if noBody || hasLength {
+		if err := w.WriteHeaders(h); err != nil {
+			return err
+		}
+		if noBody {
+			return nil
+		}
+		_, err := io.Copy(bodyWriter{w}, resp.BodyReader)
+		return err
+	}
+
+	h["transfer-encoding"] = "chunked"
+	if trailer := resp.Headers.Get("Trailer"); trailer != "" {
+		h["trailer"] = trailer
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.BodyReader.Read(buf)
+		if n > 0 {
+			if _, err := w.WriteChunkedBody(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(resp.Trailers) > 0 {
+		return w.WriteTrailers(resp.Trailers)
+	}
+	_, err := w.WriteChunkedBodyDone()
+	return err
+}
+
+// bodyWriter lets io.Copy write a body through Writer.WriteBody.
+type bodyWriter struct {
+	w *response.Writer
+}
+
+func (b bodyWriter) Write(p []byte) (int, error) {
+	return b.w.WriteBody(p)
+}
@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/client"
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/sankalpmukim/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer runs one of our own servers on a free port and returns its
+// base URL.
+func startServer(t *testing.T, handler server.Handler) *url.URL {
+	t.Helper()
+	return startServerWithOptions(t, server.Options{}, handler)
+}
+
+func startServerWithOptions(t *testing.T, options server.Options, handler server.Handler) *url.URL {
+	t.Helper()
+	srv, err := server.ServeWithOptions(0, options, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	u, err := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", srv.Addr().(*net.TCPAddr).Port))
+	require.NoError(t, err)
+	return u
+}
+
+// logBuffer collects what a log.Logger writes from the server's goroutines.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// startRawServer hands every connection to serve, for upstreams that need
+// to say exactly what they say.
+func startRawServer(t *testing.T, serve func(conn net.Conn)) *url.URL {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return &url.URL{Scheme: "http", Host: listener.Addr().String()}
+}
+
+// dumpHandler answers with the request it got, one line per header.
+func dumpHandler(w *response.Writer, req *request.Request) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s\n", req.RequestLine.Method, req.RequestLine.RequestTarget)
+	for _, name := range []string{"host", "x-forwarded-for", "x-forwarded-proto", "x-forwarded-host", "forwarded",
+		"connection", "x-secret", "keep-alive", "x-custom"} {
+		fmt.Fprintf(&b, "%s: %s\n", name, req.Headers.Get(name))
+	}
+	b.Write(req.Body)
+	h := response.GetDefaultHeaders(b.Len())
+	h["keep-alive"] = "timeout=5"
+	h["x-upstream"] = "yes"
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(b.String()))
+}
+
+func do(t *testing.T, method, url string, body []byte, extra map[string]string) *client.Response {
+	t.Helper()
+	req, err := client.NewRequest(method, url, body)
+	require.NoError(t, err)
+	for k, v := range extra {
+		req.Headers[k] = v
+	}
+	resp, err := (&client.Client{Timeout: 5 * time.Second}).Do(context.Background(), req)
+	require.NoError(t, err)
+	require.NoError(t, resp.ReadBody())
+	return resp
+}
+
+func TestReverseProxy(t *testing.T) {
+	upstream := startServer(t, dumpHandler)
+	upstream.Path = "/base"
+	upstream.RawQuery = "key=1"
+	front := startServer(t, (&ReverseProxy{Upstream: upstream, StripPrefix: "/api"}).Handle)
+
+	// Test: Path and query are rewritten, headers are forwarded
+	resp := do(t, "POST", front.String()+"/api/users?page=2", []byte("payload"), map[string]string{
+		"x-custom":        "kept",
+		"connection":      "close, x-secret",
+		"x-secret":        "hop",
+		"keep-alive":      "timeout=1",
+		"x-forwarded-for": "203.0.113.9",
+	})
+	assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+	body := string(resp.Body)
+	assert.Contains(t, body, "POST /base/users?key=1&page=2\n")
+	assert.Contains(t, body, "host: "+upstream.Host+"\n")
+	assert.Contains(t, body, "x-forwarded-for: 203.0.113.9, 127.0.0.1\n")
+	assert.Contains(t, body, "x-forwarded-proto: http\n")
+	assert.Contains(t, body, "x-forwarded-host: "+front.Host+"\n")
+	assert.Contains(t, body, `forwarded: for=127.0.0.1;host="`+front.Host+`";proto=http`+"\n")
+	assert.Contains(t, body, "x-custom: kept\n")
+	assert.Contains(t, body, "payload")
+
+	// Test: Hop-by-hop headers don't get through, in either direction
+	assert.Contains(t, body, "x-secret: \n")
+	assert.Contains(t, body, "keep-alive: \n")
+	assert.Contains(t, body, "connection: \n")
+	assert.Equal(t, "", resp.Headers.Get("keep-alive"))
+	assert.Equal(t, "yes", resp.Headers.Get("x-upstream"))
+
+	// Test: PreserveHost keeps the client's Host
+	front = startServer(t, (&ReverseProxy{Upstream: upstream, PreserveHost: true}).Handle)
+	resp = do(t, "GET", front.String()+"/", nil, nil)
+	assert.Contains(t, string(resp.Body), "host: "+front.Host+"\n")
+
+	// Test: Rewrite has the last word
+	front = startServer(t, (&ReverseProxy{
+		Upstream: upstream,
+		Rewrite: func(out *client.Request, in *request.Request) {
+			out.Headers["x-custom"] = "rewritten"
+		},
+	}).Handle)
+	resp = do(t, "GET", front.String()+"/", nil, nil)
+	assert.Contains(t, string(resp.Body), "x-custom: rewritten\n")
+}
+
+func TestReverseProxyForwardedProto(t *testing.T) {
+	upstream := startServer(t, dumpHandler)
+	srv, err := server.ServeWithOptions(0, server.Options{TLS: &server.TLSOptions{SelfSigned: true}}, (&ReverseProxy{Upstream: upstream}).Handle)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	front := fmt.Sprintf("https://localhost:%d", srv.Addr().(*net.TCPAddr).Port)
+
+	// Test: Requests that came in over TLS are forwarded as https
+	req, err := client.NewRequest("GET", front+"/", nil)
+	require.NoError(t, err)
+	c := &client.Client{Timeout: 5 * time.Second, TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	resp, err := c.Do(context.Background(), req)
+	require.NoError(t, err)
+	require.NoError(t, resp.ReadBody())
+	body := string(resp.Body)
+	assert.Contains(t, body, "x-forwarded-proto: https\n")
+	assert.Contains(t, body, ";proto=https\n")
+}
+
+func TestReverseProxyStreaming(t *testing.T) {
+	upstream := startRawServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		request.RequestFromReader(conn)
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n"))
+		for _, chunk := range []string{"hello ", "streaming ", "world"} {
+			fmt.Fprintf(conn, "%x\r\n%s\r\n", len(chunk), chunk)
+			time.Sleep(10 * time.Millisecond)
+		}
+		conn.Write([]byte("0\r\nX-Sum: 42\r\n\r\n"))
+	})
+	front := startServer(t, (&ReverseProxy{Upstream: upstream}).Handle)
+
+	// Test: Chunked bodies and their trailers are passed on
+	resp := do(t, "GET", front.String()+"/", nil, nil)
+	assert.Equal(t, "hello streaming world", string(resp.Body))
+	assert.Equal(t, "chunked", resp.Headers.Get("transfer-encoding"))
+	assert.Equal(t, "42", resp.Trailers.Get("x-sum"))
+
+	// Test: ModifyResponse can add trailers of its own
+	front = startServer(t, (&ReverseProxy{
+		Upstream: upstream,
+		ModifyResponse: func(resp *client.Response) error {
+			resp.Trailers["x-extra"] = "added"
+			return nil
+		},
+	}).Handle)
+	resp = do(t, "GET", front.String()+"/", nil, nil)
+	assert.Equal(t, "added", resp.Trailers.Get("x-extra"))
+
+	// Test: HEAD responses keep their Content-Length but have no body
+	head := startRawServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		request.RequestFromReader(conn)
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 1234\r\n\r\n"))
+	})
+	front = startServer(t, (&ReverseProxy{Upstream: head}).Handle)
+	resp = do(t, "HEAD", front.String()+"/", nil, nil)
+	assert.Equal(t, "1234", resp.Headers.Get("content-length"))
+	assert.Empty(t, resp.Body)
+}
+
+func TestReverseProxyErrors(t *testing.T) {
+	// Test: Nothing listening upstream is a 502
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	down := &url.URL{Scheme: "http", Host: listener.Addr().String()}
+	listener.Close()
+	var errorLog logBuffer
+	front := startServer(t, (&ReverseProxy{Upstream: down, ErrorLog: log.New(&errorLog, "", 0)}).Handle)
+	resp := do(t, "GET", front.String()+"/", nil, nil)
+	assert.Equal(t, response.BadGateway, resp.StatusLine.StatusCode)
+	assert.Contains(t, errorLog.String(), "Error proxying request: ")
+
+	// Test: Garbage from upstream is a 502
+	garbage := startRawServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte("not http at all\r\n\r\n"))
+	})
+	front = startServer(t, (&ReverseProxy{Upstream: garbage}).Handle)
+	resp = do(t, "GET", front.String()+"/", nil, nil)
+	assert.Equal(t, response.BadGateway, resp.StatusLine.StatusCode)
+
+	// Test: An upstream that takes too long is a 504
+	slow := startRawServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		bufio.NewReader(conn).ReadString('\n')
+		time.Sleep(2 * time.Second)
+	})
+	front = startServer(t, (&ReverseProxy{Upstream: slow, Client: &client.Client{Timeout: 100 * time.Millisecond}}).Handle)
+	resp = do(t, "GET", front.String()+"/", nil, nil)
+	assert.Equal(t, response.GatewayTimeout, resp.StatusLine.StatusCode)
+}
+
+func TestReverseProxyStreamingRequestBody(t *testing.T) {
+	streamAll := server.Options{StreamBody: func(*request.Request) bool { return true }}
+	firstPart := make(chan string, 1)
+	upstream := startServerWithOptions(t, streamAll, func(w *response.Writer, req *request.Request) {
+		buf := make([]byte, 6)
+		_, err := io.ReadFull(req.BodyReader, buf)
+		assert.NoError(t, err)
+		firstPart <- string(buf)
+		rest, err := io.ReadAll(req.BodyReader)
+		assert.NoError(t, err)
+		body := string(buf) + string(rest) + " " + req.Trailers.Get("x-sum")
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	})
+	front := startServerWithOptions(t, streamAll, (&ReverseProxy{Upstream: upstream}).Handle)
+
+	// Test: The request body reaches upstream before the client has sent all of it
+	pr, pw := io.Pipe()
+	req, err := client.NewRequest("POST", front.String()+"/", nil)
+	require.NoError(t, err)
+	req.BodyReader = pr
+	go func() {
+		pw.Write([]byte("hello "))
+		select {
+		case got := <-firstPart:
+			assert.Equal(t, "hello ", got)
+		case <-time.After(5 * time.Second):
+			t.Error("the first part never reached upstream")
+		}
+		// Test: The rest of the body and the trailers follow
+		req.Trailers["x-sum"] = "42"
+		pw.Write([]byte("world"))
+		pw.Close()
+	}()
+	resp, err := (&client.Client{Timeout: 5 * time.Second}).Do(context.Background(), req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "hello world 42", string(body))
+}
@@ -0,0 +1,106 @@
+package request
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// a few requests as they show up in practice: a browser page load, an API
+// call from curl with a JSON body, and a chunked upload.
+var benchCorpus = map[string]string{
+	"browser": "GET /static/app.js?v=3 HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Connection: keep-alive\r\n" +
+		"sec-ch-ua: \"Chromium\";v=\"124\", \"Not-A.Brand\";v=\"99\"\r\n" +
+		"sec-ch-ua-mobile: ?0\r\n" +
+		"User-Agent: Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36\r\n" +
+		"sec-ch-ua-platform: \"Linux\"\r\n" +
+		"Accept: */*\r\n" +
+		"Sec-Fetch-Site: same-origin\r\n" +
+		"Sec-Fetch-Mode: no-cors\r\n" +
+		"Sec-Fetch-Dest: script\r\n" +
+		"Referer: http://localhost:42069/\r\n" +
+		"Accept-Encoding: gzip, deflate, br, zstd\r\n" +
+		"Accept-Language: en-GB,en-US;q=0.9,en;q=0.8\r\n" +
+		"Cookie: session=3f9a1c0e5b7d4e2a9c8b6f1d0e3a5b7c; theme=dark\r\n" +
+		"If-None-Match: \"5e1f-18c0a7b2d40\"\r\n" +
+		"\r\n",
+	"curl-json": "POST /coffee HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"User-Agent: curl/8.5.0\r\n" +
+		"Accept: */*\r\n" +
+		"Content-Type: application/json\r\n" +
+		"Content-Length: 39\r\n" +
+		"\r\n" +
+		"{\"type\": \"dark mode\", \"size\": \"medium\"}",
+	"chunked-upload": "POST /upload HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"User-Agent: curl/8.5.0\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"400\r\n" + string(bytes.Repeat([]byte("a"), 0x400)) + "\r\n" +
+		"400\r\n" + string(bytes.Repeat([]byte("b"), 0x400)) + "\r\n" +
+		"10\r\n" + string(bytes.Repeat([]byte("c"), 0x10)) + "\r\n" +
+		"0\r\n\r\n",
+}
+
+func BenchmarkRequestFromReader(b *testing.B) {
+	for name, data := range benchCorpus {
+		b.Run(name, func(b *testing.B) {
+			reader := bytes.NewReader([]byte(data))
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for b.Loop() {
+				reader.Reset([]byte(data))
+				if _, err := RequestFromReader(reader); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkParserFeed(b *testing.B) {
+	for name, data := range benchCorpus {
+		b.Run(name, func(b *testing.B) {
+			raw := []byte(data)
+			p := NewParser()
+			b.SetBytes(int64(len(raw)))
+			b.ReportAllocs()
+			for b.Loop() {
+				p.Reset()
+				if _, _, err := p.Feed(raw); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkNetHTTP is the baseline: the standard library's parser reading
+// the same requests, body included.
+func BenchmarkNetHTTP(b *testing.B) {
+	for name, data := range benchCorpus {
+		b.Run(name, func(b *testing.B) {
+			reader := bytes.NewReader([]byte(data))
+			br := bufio.NewReader(reader)
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for b.Loop() {
+				reader.Reset([]byte(data))
+				br.Reset(reader)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadAll(req.Body); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidHost = errors.New("invalid Host header")
+
+// ValidateHost checks the Host header the way RFC 9112 section 3.2 wants it:
+// HTTP/1.1 requests carry exactly one, and it has to be a valid
+// uri-host [ ":" port ]. On success the normalised host (lowercase, no
+// trailing dot, no IPv6 brackets) and port end up in r.Host and r.Port.
+// For an absolute-form target they come from the target's authority
+// instead, as section 3.2.2 says.
+func (r *Request) ValidateHost() error {
+	value, ok := r.Headers["host"]
+	if !ok && r.RequestLine.ProtoAtLeast(1, 1) {
+		return fmt.Errorf("%w: missing", ErrInvalidHost)
+	}
+	if ok {
+		// repeated headers get joined with commas, and a comma is never
+		// part of a valid host, so this catches duplicates too
+		if strings.Contains(value, ",") {
+			return fmt.Errorf("%w: more than one Host", ErrInvalidHost)
+		}
+		host, port, err := ParseHost(value)
+		if err != nil {
+			return err
+		}
+		r.Host = host
+		r.Port = port
+	}
+
+	if authority, ok := absoluteAuthority(r.RequestLine.RequestTarget); ok {
+		host, port, err := ParseHost(authority)
+		if err != nil {
+			return err
+		}
+		r.Host = host
+		r.Port = port
+	}
+	return nil
+}
+
+// absoluteAuthority returns the authority of an absolute-form target, the
+// part between "scheme://" and the path, query or fragment.
+func absoluteAuthority(target string) (string, bool) {
+	scheme, rest, ok := strings.Cut(target, "://")
+	if !ok || !isScheme(scheme) {
+		return "", false
+	}
+	if end := strings.IndexAny(rest, "/?#"); end != -1 {
+		rest = rest[:end]
+	}
+	return rest, true
+}
+
+// OriginForm turns an absolute-form target into the path and query it
+// names, so handlers can treat it like any other. Other targets come back
+// as they are.
+func OriginForm(target string) string {
+	authority, ok := absoluteAuthority(target)
+	if !ok {
+		return target
+	}
+	_, rest, _ := strings.Cut(target, "://")
+	rest = rest[len(authority):]
+	rest, _, _ = strings.Cut(rest, "#")
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	return rest
+}
+
+// scheme = ALPHA *( ALPHA / DIGIT / "+" / "-" / "." )
+func isScheme(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case i > 0 && (c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
+
+// ParseHost splits a Host header value into a normalised host and port. The
+// port is empty when the value doesn't carry one.
+func ParseHost(value string) (host, port string, err error) {
+	if value == "" {
+		return "", "", fmt.Errorf("%w: empty", ErrInvalidHost)
+	}
+
+	if strings.HasPrefix(value, "[") {
+		// IP-literal
+		end := strings.IndexByte(value, ']')
+		if end == -1 {
+			return "", "", fmt.Errorf("%w: %q", ErrInvalidHost, value)
+		}
+		host = value[1:end]
+		rest := value[end+1:]
+		if rest != "" {
+			if rest[0] != ':' {
+				return "", "", fmt.Errorf("%w: %q", ErrInvalidHost, value)
+			}
+			port = rest[1:]
+		}
+		if !isIPv6Literal(host) {
+			return "", "", fmt.Errorf("%w: %q", ErrInvalidHost, value)
+		}
+	} else {
+		host = value
+		if idx := strings.LastIndexByte(value, ':'); idx != -1 {
+			host = value[:idx]
+			port = value[idx+1:]
+		}
+		host = strings.TrimSuffix(host, ".")
+		if host == "" || !isRegName(host) {
+			return "", "", fmt.Errorf("%w: %q", ErrInvalidHost, value)
+		}
+	}
+
+	// port = *DIGIT, so "host:" is allowed, but it still has to fit in 16 bits
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || !isDigits(port) || n > 65535 {
+			return "", "", fmt.Errorf("%w: bad port in %q", ErrInvalidHost, value)
+		}
+	}
+
+	return strings.ToLower(host), port, nil
+}
+
+// reg-name = *( unreserved / pct-encoded / sub-delims ), which also covers
+// IPv4 addresses.
+func isRegName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("-._~", c) != -1: // unreserved
+		case strings.IndexByte("!$&'()*+;=", c) != -1: // sub-delims, minus ","
+		case c == '%':
+			if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+				return false
+			}
+			i += 2
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func isIPv6Literal(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !isHex(c) && c != ':' && c != '.' {
+			return false
+		}
+	}
+	return strings.Contains(s, ":")
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
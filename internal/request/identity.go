@@ -0,0 +1,50 @@
+package request
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+)
+
+// Identity is who a client proved to be with a TLS certificate the server
+// verified, as found in the certificate's subject and subject alternative
+// names.
+type Identity struct {
+	// Name identifies the client, see IdentityFromCertificate. Servers
+	// can map certificates to names of their own instead.
+	Name string
+
+	Subject        pkix.Name
+	DNSNames       []string
+	URIs           []string
+	EmailAddresses []string
+
+	// Certificate is the client's leaf certificate.
+	Certificate *x509.Certificate
+}
+
+// IdentityFromCertificate describes the client holding cert. Its Name is
+// the first of the certificate's URI SANs (SPIFFE IDs look like
+// spiffe://trust-domain/workload), DNS names and email addresses, or the
+// subject's common name for certificates without any.
+func IdentityFromCertificate(cert *x509.Certificate) *Identity {
+	id := &Identity{
+		Subject:        cert.Subject,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		Certificate:    cert,
+	}
+	for _, u := range cert.URIs {
+		id.URIs = append(id.URIs, u.String())
+	}
+	switch {
+	case len(id.URIs) > 0:
+		id.Name = id.URIs[0]
+	case len(id.DNSNames) > 0:
+		id.Name = id.DNSNames[0]
+	case len(id.EmailAddresses) > 0:
+		id.Name = id.EmailAddresses[0]
+	default:
+		id.Name = cert.Subject.CommonName
+	}
+	return id
+}
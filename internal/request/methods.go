@@ -0,0 +1,94 @@
+package request
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/headers"
+)
+
+const (
+	MethodGet     = "GET"
+	MethodHead    = "HEAD"
+	MethodPost    = "POST"
+	MethodPut     = "PUT"
+	MethodDelete  = "DELETE"
+	MethodConnect = "CONNECT"
+	MethodOptions = "OPTIONS"
+	MethodTrace   = "TRACE"
+	MethodPatch   = "PATCH"
+)
+
+// the methods every server knows about out of the box.
+var StandardMethods = []string{
+	MethodGet, MethodHead, MethodPost, MethodPut, MethodDelete,
+	MethodConnect, MethodOptions, MethodTrace, MethodPatch,
+}
+
+// IsIdempotent reports whether sending a request with method twice has the
+// same effect as sending it once (RFC 9110 section 9.2.2), which is what
+// makes retrying it safe.
+func IsIdempotent(method string) bool {
+	switch method {
+	case MethodGet, MethodHead, MethodOptions, MethodTrace, MethodPut, MethodDelete:
+		return true
+	}
+	return false
+}
+
+// WebDAVMethods (RFC 4918) are not registered by default, but can be added
+// with MethodRegistry.Register when a handler speaks WebDAV.
+var WebDAVMethods = []string{
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+}
+
+// MethodRegistry keeps track of the methods a server is willing to hand to
+// its handler. Anything else gets a 501 Not Implemented.
+type MethodRegistry struct {
+	mu      sync.RWMutex
+	methods map[string]bool
+	order   []string
+}
+
+// NewMethodRegistry returns a registry holding StandardMethods plus extra.
+func NewMethodRegistry(extra ...string) (*MethodRegistry, error) {
+	m := &MethodRegistry{methods: make(map[string]bool)}
+	if err := m.Register(StandardMethods...); err != nil {
+		return nil, err
+	}
+	if err := m.Register(extra...); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Register adds methods to the registry. Methods are case-sensitive, so
+// "get" and "GET" are different methods.
+func (m *MethodRegistry) Register(methods ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, method := range methods {
+		if !headers.IsToken(method) {
+			return fmt.Errorf("invalid method %q", method)
+		}
+		if m.methods[method] {
+			continue
+		}
+		m.methods[method] = true
+		m.order = append(m.order, method)
+	}
+	return nil
+}
+
+func (m *MethodRegistry) Known(method string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.methods[method]
+}
+
+// List returns the registered methods in registration order.
+func (m *MethodRegistry) List() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]string(nil), m.order...)
+}
@@ -0,0 +1,489 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/headers"
+)
+
+type RequestState int
+
+const (
+	requestStateInitialized RequestState = iota
+	requestStateParsingHeaders
+	requestStateParsingBody
+	requestStateParsingChunkSize
+	requestStateParsingChunkData
+	requestStateParsingChunkDataEnd
+	requestStateParsingTrailers
+	requestStateDone
+)
+
+// the largest chunk size we accept, in hex digits. keeps the value well
+// inside an int so a huge size can never wrap around.
+const maxChunkSizeDigits = 15
+
+// the longest chunk size line we wait for, extensions included, so a line
+// that never ends can't be buffered forever
+const maxChunkLineLength = 4096
+
+type EventType int
+
+const (
+	EventRequestLine EventType = iota
+	EventHeader
+	EventHeadersComplete
+	EventBodyChunk
+	EventTrailer
+	EventMessageComplete
+)
+
+// Event is one step of progress through a request. Which fields are set
+// depends on Type:
+//
+//	EventRequestLine      RequestLine
+//	EventHeader           Name, Value (Name is lowercased)
+//	EventHeadersComplete  Headers, with every field the framing settled on
+//	EventBodyChunk        Data, the decoded body bytes
+//	EventTrailer          Name, Value
+//	EventMessageComplete  nothing
+type Event struct {
+	Type        EventType
+	RequestLine RequestLine
+	Name        string
+	Value       string
+	Headers     headers.Headers
+	// Data points into the slice given to Feed, copy it if it has to
+	// outlive that buffer.
+	Data []byte
+}
+
+// Parser is a push based request parser. The caller owns the reading and
+// hands over bytes as they arrive, which makes it usable from event loops
+// and fuzzers alike:
+//
+//	p := request.NewParser()
+//	consumed, events, err := p.Feed(buf)
+//
+// Feed consumes as much of data as it can make sense of and reports what it
+// found. Bytes past consumed have to be fed again, at the start of the next
+// call and followed by whatever arrives next. Once EventMessageComplete has been emitted the parser stops
+// consuming; Reset gets it ready for the next request on the connection.
+type Parser struct {
+	state  RequestState
+	strict bool
+
+	requestLine    RequestLine
+	headers        headers.Headers
+	trailers       headers.Headers
+	bodyRemaining  int
+	chunkRemaining int
+
+	// limits set by SetLimits, zero means none
+	maxHeaderBytes int
+	maxBodyBytes   int
+	// what the current field section (headers, then trailers) and the
+	// body have taken so far
+	sectionBytes int
+	bodyBytes    int
+
+	events []Event
+
+	// how much of the pending data is known not to hold the end of the
+	// current line, so a line trickling in isn't scanned from the start
+	// on every Feed
+	scanned int
+}
+
+func NewParser() *Parser {
+	p := &Parser{}
+	p.Reset()
+	return p
+}
+
+// NewStrictParser returns a Parser that rejects ambiguous framing, see
+// RequestFromReaderStrict.
+func NewStrictParser() *Parser {
+	p := NewParser()
+	p.strict = true
+	return p
+}
+
+// SetLimits caps the request line and headers at maxHeaderBytes, the
+// trailers at maxHeaderBytes too, and the decoded body at maxBodyBytes.
+// Feed fails with ErrHeaderTooLarge or ErrBodyTooLarge once a request goes
+// past them, before all of it has to be held. Zero means no limit.
+func (p *Parser) SetLimits(maxHeaderBytes, maxBodyBytes int) {
+	p.maxHeaderBytes = maxHeaderBytes
+	p.maxBodyBytes = maxBodyBytes
+}
+
+// Reset forgets the current message, keeping the strictness and limits.
+func (p *Parser) Reset() {
+	*p = Parser{
+		state:          requestStateInitialized,
+		strict:         p.strict,
+		maxHeaderBytes: p.maxHeaderBytes,
+		maxBodyBytes:   p.maxBodyBytes,
+		// sized for a typical browser request so the map doesn't keep
+		// growing while the headers come in
+		headers:  make(headers.Headers, 16),
+		trailers: headers.NewHeaders(),
+		events:   p.events[:0],
+	}
+}
+
+// Done reports whether a whole message has been parsed.
+func (p *Parser) Done() bool {
+	return p.state == requestStateDone
+}
+
+// Feed parses as much of data as possible. The returned events are only
+// valid until the next call to Feed or Reset.
+func (p *Parser) Feed(data []byte) (consumed int, events []Event, err error) {
+	if p.state == requestStateDone {
+		return 0, nil, errors.New("error: trying to read data in a done state")
+	}
+	p.events = p.events[:0]
+	for p.state != requestStateDone {
+		before := len(p.events)
+		n, err := p.step(data[consumed:])
+		if err != nil {
+			return consumed, p.events, err
+		}
+		if n == 0 && len(p.events) == before {
+			break
+		}
+		consumed += n
+	}
+	return consumed, p.events, nil
+}
+
+func (p *Parser) emit(ev Event) {
+	p.events = append(p.events, ev)
+}
+
+// step makes at most one state transition.
+func (p *Parser) step(data []byte) (int, error) {
+	switch p.state {
+	case requestStateInitialized:
+		line, bytesRead, bareLF := p.nextLine(data)
+		if bareLF {
+			return 0, errors.New("bare LF in request line")
+		}
+		if err := p.countSection(bytesRead, data); err != nil {
+			return 0, err
+		}
+		if bytesRead == 0 {
+			return 0, nil // need more data
+		}
+		requestLine, err := parseRequestLine(line, p.strict)
+		if err != nil {
+			return 0, err
+		}
+		p.requestLine = requestLine
+		p.state = requestStateParsingHeaders
+		p.emit(Event{Type: EventRequestLine, RequestLine: requestLine})
+		return bytesRead, nil
+
+	case requestStateParsingHeaders:
+		line, bytesRead, bareLF := p.nextLine(data)
+		if bareLF {
+			return 0, headers.ErrBareLineEnding
+		}
+		if err := p.countSection(bytesRead, data); err != nil {
+			return 0, err
+		}
+		if bytesRead == 0 {
+			return 0, nil
+		}
+		name, value, headersDone, err := headers.ParseFieldLine(line, p.strict)
+		if err != nil {
+			return 0, err
+		}
+		if !headersDone {
+			p.headers.Add(name, value)
+			p.emit(Event{Type: EventHeader, Name: name, Value: value})
+			return bytesRead, nil
+		}
+		if err := p.determineFraming(); err != nil {
+			return 0, err
+		}
+		p.emit(Event{Type: EventHeadersComplete, Headers: p.headers})
+		if p.state == requestStateDone {
+			p.emit(Event{Type: EventMessageComplete})
+		}
+		return bytesRead, nil
+
+	case requestStateParsingBody:
+		toRead := min(len(data), p.bodyRemaining)
+		if toRead == 0 {
+			return 0, nil
+		}
+		p.bodyRemaining -= toRead
+		p.emit(Event{Type: EventBodyChunk, Data: data[:toRead]})
+		if p.bodyRemaining == 0 {
+			p.state = requestStateDone
+			p.emit(Event{Type: EventMessageComplete})
+		}
+		return toRead, nil
+
+	case requestStateParsingChunkSize:
+		line, bytesRead, bareLF := p.nextLine(data)
+		if bareLF {
+			return 0, fmt.Errorf("%w: bare LF in chunk size line", ErrBadFraming)
+		}
+		if bytesRead == 0 {
+			if len(data) > maxChunkLineLength {
+				return 0, fmt.Errorf("%w: chunk size line too long", ErrBadFraming)
+			}
+			return 0, nil
+		}
+		size, err := parseChunkSize(line, p.strict)
+		if err != nil {
+			return 0, err
+		}
+		if err := p.countBody(size); err != nil {
+			return 0, err
+		}
+		if size == 0 {
+			p.state = requestStateParsingTrailers
+			p.sectionBytes = 0
+		} else {
+			p.chunkRemaining = size
+			p.state = requestStateParsingChunkData
+		}
+		return bytesRead, nil
+
+	case requestStateParsingChunkData:
+		toRead := min(len(data), p.chunkRemaining)
+		if toRead == 0 {
+			return 0, nil
+		}
+		p.chunkRemaining -= toRead
+		if p.chunkRemaining == 0 {
+			p.state = requestStateParsingChunkDataEnd
+		}
+		p.emit(Event{Type: EventBodyChunk, Data: data[:toRead]})
+		return toRead, nil
+
+	case requestStateParsingChunkDataEnd:
+		if len(data) < 2 {
+			return 0, nil
+		}
+		if data[0] != '\r' || data[1] != '\n' {
+			return 0, fmt.Errorf("%w: chunk data not followed by CRLF", ErrBadFraming)
+		}
+		p.state = requestStateParsingChunkSize
+		return 2, nil
+
+	case requestStateParsingTrailers:
+		line, bytesRead, bareLF := p.nextLine(data)
+		if bareLF {
+			return 0, headers.ErrBareLineEnding
+		}
+		if err := p.countSection(bytesRead, data); err != nil {
+			return 0, err
+		}
+		if bytesRead == 0 {
+			return 0, nil
+		}
+		name, value, trailersDone, err := headers.ParseFieldLine(line, p.strict)
+		if err != nil {
+			return 0, err
+		}
+		if !trailersDone {
+			if p.strict && (name == "content-length" || name == "transfer-encoding" || name == "host") {
+				return 0, fmt.Errorf("%w: %s is not allowed in trailers", ErrBadFraming, name)
+			}
+			p.trailers.Add(name, value)
+			p.emit(Event{Type: EventTrailer, Name: name, Value: value})
+			return bytesRead, nil
+		}
+		p.state = requestStateDone
+		p.emit(Event{Type: EventMessageComplete})
+		return bytesRead, nil
+
+	default:
+		return 0, errors.New("error: unknown state")
+	}
+}
+
+// nextLine finds the CRLF terminated line at the front of data and returns
+// it without the CRLF, along with the number of bytes it takes up (0 if the
+// line isn't complete yet). The search picks up where the previous call gave
+// up. In strict mode a LF without a CR in front of it is reported as bareLF,
+// otherwise it's left in the line for the line parser to deal with.
+func (p *Parser) nextLine(data []byte) (line []byte, n int, bareLF bool) {
+	for {
+		idx := bytes.IndexByte(data[p.scanned:], '\n')
+		if idx == -1 {
+			p.scanned = len(data)
+			return nil, 0, false
+		}
+		idx += p.scanned
+		if idx > 0 && data[idx-1] == '\r' {
+			p.scanned = 0
+			return data[:idx-1], idx + 1, false
+		}
+		if p.strict {
+			return nil, 0, true
+		}
+		p.scanned = idx + 1
+	}
+}
+
+// countSection checks the field section being read against maxHeaderBytes.
+// n is the length of the line just read off data, or 0 while the line is
+// incomplete, and then all of data is waiting to become part of it.
+func (p *Parser) countSection(n int, data []byte) error {
+	held := p.sectionBytes + n
+	if n == 0 {
+		held += len(data)
+	} else {
+		p.sectionBytes = held
+	}
+	if p.maxHeaderBytes > 0 && held > p.maxHeaderBytes {
+		return ErrHeaderTooLarge
+	}
+	return nil
+}
+
+// countBody adds n announced body bytes and checks them against
+// maxBodyBytes.
+func (p *Parser) countBody(n int) error {
+	if p.maxBodyBytes <= 0 {
+		return nil
+	}
+	p.bodyBytes += n
+	if p.bodyBytes > p.maxBodyBytes {
+		return ErrBodyTooLarge
+	}
+	return nil
+}
+
+// determineFraming works out how the body is delimited once all headers are
+// in, following RFC 9112 section 6.3, and moves the parser to the next state.
+func (p *Parser) determineFraming() error {
+	te, hasTE := p.headers["transfer-encoding"]
+	cl, hasCL := p.headers["content-length"]
+
+	if hasTE {
+		if p.strict && hasCL {
+			return fmt.Errorf("%w: both Content-Length and Transfer-Encoding present", ErrBadFraming)
+		}
+		if p.strict && !p.requestLine.ProtoAtLeast(1, 1) {
+			return fmt.Errorf("%w: Transfer-Encoding in an HTTP/1.0 request", ErrBadFraming)
+		}
+		if !isChunkedLast(te, p.strict) {
+			return fmt.Errorf("%w: unsupported Transfer-Encoding %q", ErrBadFraming, te)
+		}
+		// Transfer-Encoding overrides Content-Length, and the latter must
+		// not leak to anyone looking at the headers afterwards.
+		delete(p.headers, "content-length")
+		p.state = requestStateParsingChunkSize
+		return nil
+	}
+
+	if hasCL {
+		contentLength, err := parseContentLength(cl, p.strict)
+		if err != nil {
+			return err
+		}
+		if err := p.countBody(contentLength); err != nil {
+			return err
+		}
+		if contentLength > 0 {
+			p.bodyRemaining = contentLength
+			p.state = requestStateParsingBody
+			return nil
+		}
+	}
+
+	p.state = requestStateDone
+	return nil
+}
+
+// isChunkedLast reports whether chunked is the final transfer coding, which
+// is the only way a request body with Transfer-Encoding can be delimited.
+// Strict mode only accepts a plain "chunked", so none of the usual
+// obfuscations ("xchunked", "chunked, identity", repeated headers) slip by.
+func isChunkedLast(te string, strict bool) bool {
+	if strict {
+		return strings.EqualFold(te, "chunked")
+	}
+	codings := strings.Split(te, ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
+
+// parseContentLength accepts 1*DIGIT. Outside strict mode a list of identical
+// values (which is what repeated headers turn into) is allowed as well.
+func parseContentLength(value string, strict bool) (int, error) {
+	values := []string{value}
+	if !strict {
+		values = strings.Split(value, ",")
+	}
+
+	contentLength := -1
+	for _, v := range values {
+		if !strict {
+			v = strings.TrimSpace(v)
+		}
+		if !isDigits(v) {
+			return 0, fmt.Errorf("%w: invalid Content-Length %q", ErrBadFraming, value)
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("%w: invalid Content-Length %q", ErrBadFraming, value)
+		}
+		if contentLength != -1 && contentLength != n {
+			return 0, fmt.Errorf("%w: conflicting Content-Length %q", ErrBadFraming, value)
+		}
+		contentLength = n
+	}
+	return contentLength, nil
+}
+
+// parseChunkSize parses chunk-size [ chunk-ext ] from a chunk size line.
+func parseChunkSize(line []byte, strict bool) (int, error) {
+	size := line
+	if idx := bytes.IndexByte(line, ';'); idx != -1 {
+		size = line[:idx]
+	}
+	if strict {
+		if bytes.ContainsAny(line, "\r\n") {
+			return 0, fmt.Errorf("%w: bare CR or LF in chunk size line", ErrBadFraming)
+		}
+	} else {
+		size = bytes.TrimSpace(size)
+	}
+
+	if len(size) == 0 || len(size) > maxChunkSizeDigits {
+		return 0, fmt.Errorf("%w: invalid chunk size %q", ErrBadFraming, size)
+	}
+	for i := 0; i < len(size); i++ {
+		if !isHex(size[i]) {
+			return 0, fmt.Errorf("%w: invalid chunk size %q", ErrBadFraming, size)
+		}
+	}
+	n := 0
+	for _, c := range size {
+		n = n<<4 | int(unhex(c))
+	}
+	return n, nil
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
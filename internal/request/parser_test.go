@@ -0,0 +1,159 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// feedAll pushes data through p in pieces of size at most step, re-feeding
+// whatever wasn't consumed, the same way a caller with a read loop would.
+func feedAll(p *Parser, data []byte, step int) ([]Event, error) {
+	var events []Event
+	pending := []byte{}
+	for pos := 0; pos < len(data) && !p.Done(); {
+		end := min(pos+step, len(data))
+		pending = append(pending, data[pos:end]...)
+		pos = end
+
+		consumed, evs, err := p.Feed(pending)
+		for _, ev := range evs {
+			// Data points into pending, which gets reused
+			ev.Data = append([]byte(nil), ev.Data...)
+			events = append(events, ev)
+		}
+		if err != nil {
+			return events, err
+		}
+		pending = append(pending[:0], pending[consumed:]...)
+	}
+	return events, nil
+}
+
+func TestParserEvents(t *testing.T) {
+	data := []byte("POST /submit HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"5\r\nhello\r\n" +
+		"0\r\n" +
+		"X-Checksum: abc\r\n" +
+		"\r\n")
+
+	// Test: Whole message at once
+	p := NewParser()
+	consumed, events, err := p.Feed(data)
+	require.NoError(t, err)
+	assert.Equal(t, len(data), consumed)
+	assert.True(t, p.Done())
+
+	types := []EventType{}
+	for _, ev := range events {
+		types = append(types, ev.Type)
+	}
+	assert.Equal(t, []EventType{
+		EventRequestLine,
+		EventHeader,
+		EventHeader,
+		EventHeadersComplete,
+		EventBodyChunk,
+		EventTrailer,
+		EventMessageComplete,
+	}, types)
+	assert.Equal(t, "POST", events[0].RequestLine.Method)
+	assert.Equal(t, "host", events[1].Name)
+	assert.Equal(t, "localhost:42069", events[1].Value)
+	assert.Equal(t, "chunked", events[3].Headers.Get("Transfer-Encoding"))
+	assert.Equal(t, "hello", string(events[4].Data))
+	assert.Equal(t, "x-checksum", events[5].Name)
+
+	// Test: Feeding after completion
+	_, _, err = p.Feed([]byte("GET / HTTP/1.1\r\n"))
+	require.Error(t, err)
+
+	// Test: Reset for the next message
+	p.Reset()
+	_, events, err = p.Feed([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, p.Done())
+	assert.Equal(t, EventMessageComplete, events[len(events)-1].Type)
+
+	// Test: Partial input consumes nothing it can't use
+	p = NewParser()
+	consumed, events, err = p.Feed([]byte("GET / HT"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, consumed)
+	assert.Empty(t, events)
+
+	// Test: Pipelined requests stop at the end of the first one
+	p = NewParser()
+	first := "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 2\r\n\r\nhi"
+	consumed, _, err = p.Feed([]byte(first + "GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, len(first), consumed)
+}
+
+func TestParserArbitrarySplits(t *testing.T) {
+	data := []byte("POST /submit HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"5\r\nhello\r\n" +
+		"7;ext=1\r\n world!\r\n" +
+		"0\r\n" +
+		"\r\n")
+
+	for step := 1; step <= len(data); step++ {
+		events, err := feedAll(NewParser(), data, step)
+		require.NoError(t, err, step)
+		body := ""
+		for _, ev := range events {
+			if ev.Type == EventBodyChunk {
+				body += string(ev.Data)
+			}
+		}
+		assert.Equal(t, "hello world!", body, step)
+		assert.Equal(t, EventMessageComplete, events[len(events)-1].Type, step)
+	}
+}
+
+func FuzzParser(f *testing.F) {
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"), 3)
+	f.Add([]byte("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello"), 1)
+	f.Add([]byte("POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\nA: b\r\n\r\n"), 7)
+	f.Add([]byte("POST / HTTP/1.1\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"), 2)
+
+	f.Fuzz(func(t *testing.T, data []byte, step int) {
+		if step <= 0 {
+			step = 1
+		}
+		whole, wholeErr := feedAll(NewStrictParser(), data, len(data)+1)
+		split, splitErr := feedAll(NewStrictParser(), data, step)
+
+		// however the bytes are split up, the outcome must be the same
+		if (wholeErr == nil) != (splitErr == nil) {
+			t.Fatalf("whole err = %v, split err = %v", wholeErr, splitErr)
+		}
+		if wholeErr != nil {
+			return
+		}
+		wholeBody, splitBody := "", ""
+		wholeDone, splitDone := false, false
+		for _, ev := range whole {
+			if ev.Type == EventBodyChunk {
+				wholeBody += string(ev.Data)
+			}
+			wholeDone = wholeDone || ev.Type == EventMessageComplete
+		}
+		for _, ev := range split {
+			if ev.Type == EventBodyChunk {
+				splitBody += string(ev.Data)
+			}
+			splitDone = splitDone || ev.Type == EventMessageComplete
+		}
+		if wholeBody != splitBody || wholeDone != splitDone {
+			t.Fatalf("whole body %q (done %v), split body %q (done %v)", wholeBody, wholeDone, splitBody, splitDone)
+		}
+	})
+}
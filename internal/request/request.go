@@ -1,70 +1,174 @@
 package request
 
 import (
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
-	"strconv"
-	"strings"
+	"sync"
 
 	"github.com/sankalpmukim/httpfromtcp/internal/headers"
 )
 
-type RequestState int
+// ErrBadFraming is returned when the message length can not be determined
+// unambiguously (RFC 9112 section 6.3). A server must answer these with 400
+// and close the connection, as any other reading risks request smuggling.
+var ErrBadFraming = errors.New("ambiguous or invalid message framing")
 
-const (
-	requestStateInitialized RequestState = iota
-	requestStateParsingHeaders
-	requestStateParsingBody
-	requestStateDone
-)
+// ErrVersionNotSupported is returned for a well formed request line whose
+// HTTP major version we don't speak. It should be answered with a 505.
+var ErrVersionNotSupported = errors.New("HTTP version not supported")
+
+// ErrHeaderTooLarge is returned when the request line and headers, or the
+// trailers, run past the limit set for them. A server should answer with
+// 431.
+var ErrHeaderTooLarge = errors.New("request header section too large")
+
+// ErrBodyTooLarge is returned when the body runs past the limit set for it.
+// A server should answer with 413.
+var ErrBodyTooLarge = errors.New("request body too large")
 
 type Request struct {
 	RequestLine RequestLine
 	Headers     headers.Headers
 	Body        []byte
-	state       RequestState // 0 -> initialized, 1 -> done
+	Trailers    headers.Headers
+
+	// BodyReader is set in place of Body when the body was left on the
+	// connection, see ReadOptions.StreamBody. Trailers are filled in once
+	// it has returned io.EOF.
+	BodyReader io.Reader
+
+	// filled in by ValidateHost
+	Host string
+	Port string
+
+	// RemoteAddr is the address of the peer that sent the request, as
+	// set by the server.
+	RemoteAddr string
+
+	// TLS is the state of the TLS connection the request came in on: the
+	// version, cipher suite, ALPN protocol, server name and the client's
+	// certificates. nil for plain connections.
+	TLS *tls.ConnectionState
+
+	// Identity is who the client is by the certificate it presented, set
+	// by the server when the certificate verified against its client CAs.
+	// nil for clients without one.
+	Identity *Identity
+
+	// header names in the order they arrived, so WriteTo can keep it
+	headerOrder []string
 }
 
 type RequestLine struct {
-	HttpVersion   string
+	HttpVersion   string // "1.1"
 	RequestTarget string
 	Method        string
+
+	HttpVersionMajor int
+	HttpVersionMinor int
+}
+
+// ProtoAtLeast reports whether the request was sent with HTTP version
+// major.minor or newer.
+func (rl RequestLine) ProtoAtLeast(major, minor int) bool {
+	return rl.HttpVersionMajor > major ||
+		rl.HttpVersionMajor == major && rl.HttpVersionMinor >= minor
 }
 
-const bufferSize = 8
+// reads start with a buffer big enough for the request line and headers of
+// nearly every real request, and buffers are recycled between requests.
+const bufferSize = 4096
 
-func parseRequestLine(data string) (int, RequestLine, error) {
-	// Find end of request line
-	idx := strings.Index(data, "\r\n")
-	if idx == -1 {
-		// Need more data
-		return 0, RequestLine{}, nil
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, bufferSize)
+		return &buf
+	},
+}
+
+// parsers are pooled too, mostly so their event slices get reused.
+var parserPool = sync.Pool{
+	New: func() any {
+		return NewParser()
+	},
+}
+
+// parseRequestLine parses a request line without its CRLF. Apart from the
+// target, the strings it returns are shared constants for the common cases.
+func parseRequestLine(line []byte, strict bool) (RequestLine, error) {
+	if strict && bytes.ContainsAny(line, "\r\n\t") {
+		return RequestLine{}, errors.New("invalid characters in request line")
 	}
 
-	line := data[:idx] // without \r\n
-	parts := strings.Split(line, " ")
-	if len(parts) != 3 {
-		return 0, RequestLine{}, errors.New("invalid request line format")
+	sp1 := bytes.IndexByte(line, ' ')
+	if sp1 == -1 {
+		return RequestLine{}, errors.New("invalid request line format")
+	}
+	sp2 := bytes.IndexByte(line[sp1+1:], ' ')
+	if sp2 == -1 {
+		return RequestLine{}, errors.New("invalid request line format")
+	}
+	sp2 += sp1 + 1
+	methodBytes := line[:sp1]
+	targetBytes := line[sp1+1 : sp2]
+	versionBytes := line[sp2+1:]
+	if len(targetBytes) == 0 || bytes.IndexByte(versionBytes, ' ') != -1 {
+		return RequestLine{}, errors.New("invalid request line format")
 	}
 
-	method := parts[0]
-	target := parts[1]
+	// method = token. whether we actually support it is up to the server.
+	method := internMethod(methodBytes)
+	if !headers.IsToken(method) {
+		return RequestLine{}, fmt.Errorf("invalid method %q", method)
+	}
+
+	major, minor, err := parseHttpVersion(versionBytes)
+	if err != nil {
+		return RequestLine{}, err
+	}
+
+	requestLine := RequestLine{
+		Method:           method,
+		RequestTarget:    string(targetBytes),
+		HttpVersion:      versionString(major, minor),
+		HttpVersionMajor: major,
+		HttpVersionMinor: minor,
+	}
+	if major != 1 {
+		return requestLine, fmt.Errorf("%w: HTTP/%s", ErrVersionNotSupported, requestLine.HttpVersion)
+	}
+	return requestLine, nil
+}
 
-	httpParts := strings.Split(parts[2], "/")
-	if len(httpParts) != 2 {
-		return 0, RequestLine{}, errors.New("invalid HTTP version")
+func internMethod(b []byte) string {
+	for _, method := range StandardMethods {
+		if string(b) == method {
+			return method
+		}
 	}
-	version := httpParts[1]
+	return string(b)
+}
 
-	// +2 to consume the "\r\n"
-	consumed := idx + 2
+func versionString(major, minor int) string {
+	switch {
+	case major == 1 && minor == 1:
+		return "1.1"
+	case major == 1 && minor == 0:
+		return "1.0"
+	}
+	return fmt.Sprintf("%d.%d", major, minor)
+}
 
-	return consumed, RequestLine{
-		Method:        method,
-		RequestTarget: target,
-		HttpVersion:   version,
-	}, nil
+// parseHttpVersion parses HTTP-version = "HTTP" "/" DIGIT "." DIGIT
+func parseHttpVersion(s []byte) (major, minor int, err error) {
+	if len(s) != len("HTTP/x.y") || !bytes.HasPrefix(s, []byte("HTTP/")) || s[6] != '.' ||
+		!isDigit(s[5]) || !isDigit(s[7]) {
+		return 0, 0, fmt.Errorf("invalid HTTP version %q", s)
+	}
+	return int(s[5] - '0'), int(s[7] - '0'), nil
 }
 
 // parseRequestLine re-implement
@@ -85,149 +189,258 @@ func parseRequestLine(data string) (int, RequestLine, error) {
 // this function is called once per request, with a reader that
 // can send information in chunks
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	buf := make([]byte, bufferSize)
-	readToIndex := 0
-	n := 0
-
-	req := &Request{
-		state:   requestStateInitialized,
-		Headers: headers.NewHeaders(),
-	}
+	req, _, err := readRequest(reader, ReadOptions{})
+	return req, err
+}
 
-	for req.state != requestStateDone {
+// RequestFromReaderStrict is RequestFromReader for servers that sit behind
+// another HTTP hop. Anything that two parsers could frame differently
+// (Content-Length together with Transfer-Encoding, repeated Content-Length,
+// obfuscated Transfer-Encoding, bare LF, obsolete line folding, ...) is
+// rejected instead of being interpreted.
+func RequestFromReaderStrict(reader io.Reader) (*Request, error) {
+	req, _, err := readRequest(reader, ReadOptions{Strict: true})
+	return req, err
+}
 
-		readToIndex += n
+// ReadOptions says how ReadRequest reads. The zero value is
+// RequestFromReader.
+type ReadOptions struct {
+	// Strict rejects ambiguous framing, see RequestFromReaderStrict.
+	Strict bool
+	// MaxHeaderBytes and MaxBodyBytes are the limits of Parser.SetLimits.
+	// Zero means none.
+	MaxHeaderBytes int
+	MaxBodyBytes   int
+	// StreamBody, if set, is asked about the request once its headers are
+	// in. When it says yes, ReadRequest returns right there and the body
+	// is left to be read from Request.BodyReader, instead of being
+	// gathered in Body. There is no rest then, the reader owns the bytes
+	// past the headers.
+	StreamBody func(req *Request) bool
+}
 
-		consumed, err := req.parse(buf[:readToIndex])
-		if err != nil {
-			return nil, err
-		}
+// ReadRequest is RequestFromReader for callers that keep using the
+// connection afterwards, and that may want limits on what they read. Reads
+// don't stop exactly at the end of the request, so whatever came in past it
+// (a pipelined request, the first bytes of an upgraded protocol) is handed
+// back in rest.
+func ReadRequest(reader io.Reader, opts ReadOptions) (req *Request, rest []byte, err error) {
+	return readRequest(reader, opts)
+}
 
-		if consumed > 0 {
-			// slide remaining bytes to front
-			copy(buf, buf[consumed:readToIndex])
-			readToIndex -= consumed
-		}
+func readRequest(reader io.Reader, opts ReadOptions) (*Request, []byte, error) {
+	pooled := bufferPool.Get().(*[]byte)
+	parser := parserPool.Get().(*Parser)
+	parser.strict = opts.Strict
+	parser.SetLimits(opts.MaxHeaderBytes, opts.MaxBodyBytes)
+	parser.Reset()
+	rr := requestReader{reader: reader, parser: parser, buf: *pooled}
 
-		for consumed > 0 && req.state != requestStateDone {
-			consumed, err = req.parse(buf[:readToIndex])
-			if err != nil {
-				return nil, err
-			}
+	req := &Request{
+		// the parser fills its headers in as they arrive, share them so a
+		// request that gets cut off still shows what was received
+		Headers:  parser.headers,
+		Trailers: headers.NewHeaders(),
+	}
 
-			if consumed > 0 {
-				// slide remaining bytes to front
-				copy(buf, buf[consumed:readToIndex])
-				readToIndex -= consumed
+	// set once StreamBody has asked for the body to be left to the handler,
+	// the rest of the events are the body's
+	var body *bodyReader
+	defer func() {
+		// a streamed body keeps reading with both
+		if body == nil {
+			bufferPool.Put(pooled)
+			parserPool.Put(parser)
+		}
+	}()
+	apply := req.apply
+	if opts.StreamBody != nil {
+		apply = func(events []Event) {
+			for i, ev := range events {
+				if body != nil {
+					body.apply(events[i:])
+					return
+				}
+				req.apply(events[i : i+1])
+				if ev.Type == EventHeadersComplete && opts.StreamBody(req) {
+					body = &bodyReader{req: req}
+				}
 			}
 		}
+	}
 
-		// Grow if full
-		if readToIndex == len(buf) {
-			newBuf := make([]byte, len(buf)*2)
-			copy(newBuf, buf)
-			buf = newBuf
+	for {
+		done, err := rr.feed(apply)
+		if err != nil {
+			return nil, nil, err
 		}
-
-		if req.state == requestStateDone {
+		if body != nil {
+			body.rr = rr
+			body.pending = body.data
+			req.BodyReader = body
+			return req, nil, nil
+		}
+		if done {
 			break
 		}
+		if err := rr.read(); err != nil {
+			if errors.Is(err, errCutOff) {
+				return req, nil, err
+			}
+			return nil, nil, err
+		}
+	}
 
-		n, err = reader.Read(buf[readToIndex:])
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-
-				// case where it EOF'd but *if* unparsed buffer exists
-				// so we still need to parse it.
-				if n != readToIndex || readToIndex != 0 {
-					_, err := req.parse(buf[:readToIndex])
-					if err != nil {
-						return nil, err
-					}
-				}
+	var rest []byte
+	if rr.n > 0 {
+		// buf goes back to the pool
+		rest = bytes.Clone(rr.buf[:rr.n])
+	}
+	return req, rest, nil
+}
 
-				if req.state == requestStateDone {
-					break
-				} else if req.state == requestStateParsingBody {
-					// case where req.state == body parsing, but headers suggest body not expected.
-					// i.e., expected the tcp connection to get closed.
-					contentLengthStr := req.Headers.Get("Content-Length")
-					if contentLengthStr == "" {
-						req.state = requestStateDone
-						continue
-					} else {
-						contentLength, err := strconv.Atoi(contentLengthStr)
-						if err != nil {
-							return nil, err
-						}
-						if contentLength == 0 {
-							req.state = requestStateDone
-							continue
-						}
-						return req, errors.New("Connection ended abruptly, before headers ended")
-					}
-				} else {
-					return req, errors.New("Connection ended abruptly, before headers ended")
-				}
-			}
-			return nil, err
+var errCutOff = errors.New("Connection ended abruptly, before the request was complete")
+
+// requestReader reads a request off reader into buf and through parser.
+type requestReader struct {
+	reader io.Reader
+	parser *Parser
+	buf    []byte
+	n      int // bytes at the front of buf the parser hasn't consumed
+	eof    bool
+}
+
+// feed hands what is buffered to the parser, and reports whether the
+// request is complete.
+func (rr *requestReader) feed(apply func([]Event)) (done bool, err error) {
+	consumed, events, err := rr.parser.Feed(rr.buf[:rr.n])
+	// body events point into buf, so they have to be applied before
+	// anything gets slid around
+	apply(events)
+	if err != nil {
+		return false, err
+	}
+
+	if consumed > 0 {
+		// slide remaining bytes to front
+		copy(rr.buf, rr.buf[consumed:rr.n])
+		rr.n -= consumed
+	}
+	return rr.parser.Done(), nil
+}
+
+// read reads more of the request into buf.
+func (rr *requestReader) read() error {
+	if rr.eof {
+		return errCutOff
+	}
+
+	// Grow if full. The grown buffer isn't pooled, requests that need
+	// it are rare and we don't want to keep huge buffers around. The
+	// parser's limits stop it from growing forever.
+	if rr.n == len(rr.buf) {
+		newBuf := make([]byte, len(rr.buf)*2)
+		copy(newBuf, rr.buf)
+		rr.buf = newBuf
+	}
+
+	n, err := rr.reader.Read(rr.buf[rr.n:])
+	rr.n += n
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			return err
 		}
+		// whatever came along with the EOF still needs parsing
+		rr.eof = true
 	}
+	return nil
+}
 
-	return req, nil
+// bodyReader is Request.BodyReader for a body left on the connection, see
+// ReadOptions.StreamBody.
+type bodyReader struct {
+	rr  requestReader
+	req *Request
+	// body decoded by the last feed, and what of it hasn't been read yet
+	data    []byte
+	pending []byte
+	err     error
 }
 
-func (r *Request) parse(data []byte) (int, error) {
-	switch r.state {
-	case requestStateInitialized:
-		bytesRead, requestLine, err := parseRequestLine(string(data))
-		if err != nil {
-			return 0, err
+func (b *bodyReader) apply(events []Event) {
+	for _, ev := range events {
+		switch ev.Type {
+		case EventBodyChunk:
+			b.data = append(b.data, ev.Data...)
+		case EventTrailer:
+			b.req.Trailers.Add(ev.Name, ev.Value)
 		}
-		if bytesRead == 0 {
-			return 0, nil // need more data
+	}
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	for len(b.pending) == 0 {
+		if b.err != nil {
+			return 0, b.err
 		}
-		r.RequestLine = requestLine
-		r.state = requestStateParsingHeaders
-		return bytesRead, nil
+		b.data = b.data[:0]
+		b.err = b.fill()
+		b.pending = b.data
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
 
-	case requestStateParsingHeaders:
-		bytesRead, headersDone, err := r.Headers.Parse(data)
-		if err != nil {
-			return 0, err
-		}
-		if headersDone {
-			r.state = requestStateParsingBody
-		}
-		return bytesRead, nil
-
-	case requestStateParsingBody:
-		contentLengthStr := r.Headers.Get("Content-Length")
-		if contentLengthStr == "" {
-			r.state = requestStateDone
-			return 0, nil
-		} else {
-			contentLength, err := strconv.Atoi(contentLengthStr)
-			if err != nil {
-				return 0, err
-			}
-			r.Body = append(r.Body, data...)
-			if contentLength < len(r.Body) {
-				return 0, fmt.Errorf("Received more body than Content-Length provided. Content-Length=%v, consumed body=%v", contentLength, len(r.Body))
-			}
-			// if contentLength > len(r.Body) {
-			// 	return 0, fmt.Errorf("Content-Length greater than consumed body length")
-			// }
-			if contentLength == len(r.Body) {
-				r.state = requestStateDone
+// fill reads until there is more of the body, or the request is done.
+func (b *bodyReader) fill() error {
+	for {
+		if b.rr.parser.Done() {
+			return io.EOF
+		}
+		if err := b.rr.read(); err != nil {
+			if errors.Is(err, errCutOff) {
+				return io.ErrUnexpectedEOF
 			}
-			return len(data), nil
+			return err
+		}
+		if _, err := b.rr.feed(b.apply); err != nil {
+			return err
+		}
+		if len(b.data) > 0 {
+			return nil
 		}
+	}
+}
 
-	case requestStateDone:
-		return 0, errors.New("error: trying to read data in a done state")
+func (r *Request) apply(events []Event) {
+	for _, ev := range events {
+		switch ev.Type {
+		case EventRequestLine:
+			r.RequestLine = ev.RequestLine
+		case EventHeader:
+			r.headerOrder = append(r.headerOrder, ev.Name)
+		case EventHeadersComplete:
+			// the parser may have dropped fields that lost out in framing
+			r.Headers = ev.Headers
+		case EventBodyChunk:
+			r.Body = append(r.Body, ev.Data...)
+		case EventTrailer:
+			r.Trailers.Add(ev.Name, ev.Value)
+		}
+	}
+}
 
-	default:
-		return 0, errors.New("error: unknown state")
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			return false
+		}
 	}
+	return len(s) > 0
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
 }
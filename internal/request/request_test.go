@@ -1,7 +1,12 @@
 package request
 
 import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"io"
+	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -34,6 +39,92 @@ func TestRequestLineParse(t *testing.T) {
 	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
 }
 
+func TestHttpVersionParsing(t *testing.T) {
+	// Test: HTTP/1.0
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.Equal(t, 1, r.RequestLine.HttpVersionMajor)
+	assert.Equal(t, 0, r.RequestLine.HttpVersionMinor)
+	assert.False(t, r.RequestLine.ProtoAtLeast(1, 1))
+
+	// Test: Newer minor versions are still HTTP/1
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.2\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.True(t, r.RequestLine.ProtoAtLeast(1, 1))
+
+	// Test: Unsupported major version
+	reader = &chunkReader{
+		data:            "GET / HTTP/9.9\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrVersionNotSupported)
+
+	// Test: Garbage version
+	for _, version := range []string{"FOO/bar", "HTTP/1", "HTTP/1.1.1", "HTTP/11", "http/1.1", "HTTP/a.b"} {
+		reader = &chunkReader{
+			data:            "GET / " + version + "\r\nHost: localhost:42069\r\n\r\n",
+			numBytesPerRead: 3,
+		}
+		_, err = RequestFromReader(reader)
+		require.Error(t, err, version)
+		assert.NotErrorIs(t, err, ErrVersionNotSupported, version)
+	}
+}
+
+func TestMethodParsing(t *testing.T) {
+	// Test: Unknown but well formed methods are left for the server to judge
+	reader := &chunkReader{
+		data:            "PROPFIND / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "PROPFIND", r.RequestLine.Method)
+
+	// Test: Method that isn't a token
+	reader = &chunkReader{
+		data:            "G(E)T / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Binary garbage as method
+	reader = &chunkReader{
+		data:            "\x16\x03\x01 / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Registry knows the standard methods and is case-sensitive
+	methods, err := NewMethodRegistry()
+	require.NoError(t, err)
+	assert.True(t, methods.Known("GET"))
+	assert.True(t, methods.Known("PATCH"))
+	assert.False(t, methods.Known("get"))
+	assert.False(t, methods.Known("PROPFIND"))
+
+	// Test: Registering WebDAV methods
+	require.NoError(t, methods.Register(WebDAVMethods...))
+	assert.True(t, methods.Known("PROPFIND"))
+	assert.Equal(t, len(StandardMethods)+len(WebDAVMethods), len(methods.List()))
+	assert.Equal(t, "GET", methods.List()[0])
+
+	// Test: Registering something that isn't a token
+	require.Error(t, methods.Register("BAD METHOD"))
+}
+
 func TestHeadersParsing(t *testing.T) {
 	// Test: Standard Headers
 	reader := &chunkReader{
@@ -100,6 +191,97 @@ func TestHeadersParsing(t *testing.T) {
 	require.NotNil(t, r)
 }
 
+func TestHostValidation(t *testing.T) {
+	// Test: Host with port
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: LocalHost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NoError(t, r.ValidateHost())
+	assert.Equal(t, "localhost", r.Host)
+	assert.Equal(t, "42069", r.Port)
+
+	// Test: IPv6 literal, trailing dot
+	for value, want := range map[string][2]string{
+		"[::1]:8080":   {"::1", "8080"},
+		"[::1]":        {"::1", ""},
+		"example.com.": {"example.com", ""},
+		"127.0.0.1:80": {"127.0.0.1", "80"},
+		"example.com:": {"example.com", ""},
+	} {
+		host, port, err := ParseHost(value)
+		require.NoError(t, err, value)
+		assert.Equal(t, want[0], host, value)
+		assert.Equal(t, want[1], port, value)
+	}
+
+	// Test: Invalid hosts
+	for _, value := range []string{"", "exa mple.com", "example.com:99999", "example.com:8o", "[::1", "[zz]:80", "a/b", "a@b"} {
+		_, _, err := ParseHost(value)
+		require.ErrorIs(t, err, ErrInvalidHost, value)
+	}
+
+	// Test: Missing Host in HTTP/1.1
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.ErrorIs(t, r.ValidateHost(), ErrInvalidHost)
+
+	// Test: Missing Host is fine in HTTP/1.0
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NoError(t, r.ValidateHost())
+
+	// Test: Duplicate Host
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nHost: example.com\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.ErrorIs(t, r.ValidateHost(), ErrInvalidHost)
+
+	// Test: An absolute-form target's authority wins over the Host header
+	reader = &chunkReader{
+		data:            "GET http://Static.LocalHost:8080/a?b HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NoError(t, r.ValidateHost())
+	assert.Equal(t, "static.localhost", r.Host)
+	assert.Equal(t, "8080", r.Port)
+
+	// Test: Handlers get the path and query of an absolute-form target
+	for target, want := range map[string]string{
+		"http://example.com/a?b#c": "/a?b",
+		"http://example.com":       "/",
+		"http://example.com?q":     "/?q",
+		"/a/http://b":              "/a/http://b",
+		"example.com:443":          "example.com:443",
+	} {
+		assert.Equal(t, want, OriginForm(target), target)
+	}
+
+	// Test: An absolute-form target with a bad authority
+	reader = &chunkReader{
+		data:            "GET http://user@example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.ErrorIs(t, r.ValidateHost(), ErrInvalidHost)
+}
+
 func TestBodyParsing(t *testing.T) {
 	// Test: Standard Body
 	reader := &chunkReader{
@@ -165,6 +347,318 @@ func TestBodyParsing(t *testing.T) {
 	require.NotNil(t, r)
 }
 
+func TestChunkedBodyParsing(t *testing.T) {
+	// Test: Chunked body with trailers
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"7;ext=1\r\n world!\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world!", string(r.Body))
+	assert.Equal(t, "abc", r.Trailers.Get("X-Checksum"))
+
+	// Test: Chunked body cut off in the middle
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"a\r\nhello",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Transfer-Encoding wins over Content-Length when not strict
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 3\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+	assert.Equal(t, "", r.Headers.Get("Content-Length"))
+}
+
+func TestStrictRejectsSmuggling(t *testing.T) {
+	vectors := []struct {
+		name string
+		data string
+	}{
+		{
+			// CL.TE: a front end honouring Content-Length forwards "0\r\n\r\nG"
+			// which a chunked back end reads as an empty body plus a "G..." request.
+			name: "CL.TE",
+			data: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nG",
+		},
+		{
+			name: "TE.CL",
+			data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n8\r\nSMUGGLED\r\n0\r\n\r\n",
+		},
+		{
+			name: "TE.TE space before colon",
+			data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding : chunked\r\n\r\n0\r\n\r\n",
+		},
+		{
+			name: "TE.TE tab before colon",
+			data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding\t: chunked\r\n\r\n0\r\n\r\n",
+		},
+		{
+			name: "TE.TE unknown coding",
+			data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: xchunked\r\n\r\n0\r\n\r\n",
+		},
+		{
+			name: "TE.TE duplicate header",
+			data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: identity\r\n\r\n0\r\n\r\n",
+		},
+		{
+			name: "TE.TE coding list",
+			data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: identity, chunked\r\n\r\n0\r\n\r\n",
+		},
+		{
+			name: "TE.TE obsolete line folding",
+			data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding:\r\n chunked\r\n\r\n0\r\n\r\n",
+		},
+		{
+			name: "TE.TE leading whitespace",
+			data: "POST / HTTP/1.1\r\nHost: a\r\n Transfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		},
+		{
+			name: "TE in HTTP/1.0",
+			data: "POST / HTTP/1.0\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		},
+		{
+			name: "duplicate Content-Length",
+			data: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 7\r\n\r\nhello",
+		},
+		{
+			name: "repeated identical Content-Length",
+			data: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello",
+		},
+		{
+			name: "signed Content-Length",
+			data: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +5\r\n\r\nhello",
+		},
+		{
+			name: "bare LF line endings",
+			data: "POST / HTTP/1.1\nHost: a\nContent-Length: 5\n\nhello",
+		},
+		{
+			name: "bare LF inside headers",
+			data: "POST / HTTP/1.1\r\nHost: a\nContent-Length: 5\r\n\r\nhello",
+		},
+		{
+			name: "bare CR inside a value",
+			data: "GET / HTTP/1.1\r\nHost: a\rX: b\r\n\r\n",
+		},
+		{
+			name: "chunk size with whitespace",
+			data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5 \r\nhello\r\n0\r\n\r\n",
+		},
+		{
+			name: "chunk size with 0x prefix",
+			data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0x5\r\nhello\r\n0\r\n\r\n",
+		},
+		{
+			name: "oversized chunk size",
+			data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\nfffffffffffffffff1\r\nhello\r\n0\r\n\r\n",
+		},
+		{
+			name: "chunk data without CRLF",
+			data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhelloXX0\r\n\r\n",
+		},
+		{
+			name: "Content-Length in trailers",
+			data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nContent-Length: 5\r\n\r\n",
+		},
+	}
+
+	for _, v := range vectors {
+		t.Run(v.name, func(t *testing.T) {
+			for _, numBytesPerRead := range []int{1, 3, len(v.data)} {
+				reader := &chunkReader{data: v.data, numBytesPerRead: numBytesPerRead}
+				_, err := RequestFromReaderStrict(reader)
+				require.Error(t, err)
+			}
+		})
+	}
+
+	// Test: a well formed chunked request still goes through in strict mode
+	reader := &chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReaderStrict(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+
+	// Test: and so does a Content-Length one
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReaderStrict(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+}
+
+func TestReadRequestLeftover(t *testing.T) {
+	// Test: Bytes past the end of the request are handed back
+	r, rest, err := ReadRequest(strings.NewReader("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhelloGET /next"), ReadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+	assert.Equal(t, "GET /next", string(rest))
+
+	// Test: Nothing left over
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: a\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, rest, err = ReadRequest(reader, ReadOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+}
+
+func TestReadRequestLimits(t *testing.T) {
+	limits := ReadOptions{MaxHeaderBytes: 1024, MaxBodyBytes: 64}
+
+	// Test: A header line that never ends stops the read at the limit
+	endless := bytes.NewReader(bytes.Repeat([]byte("a"), 1<<20))
+	_, _, err := ReadRequest(io.MultiReader(strings.NewReader("GET / HTTP/1.1\r\nX-Long: "), endless), limits)
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+	assert.Greater(t, endless.Len(), 1<<19, "most of it was never read")
+
+	// Test: So do many short headers
+	raw := "GET / HTTP/1.1\r\nHost: a\r\n" + strings.Repeat("X-A: b\r\n", 200) + "\r\n"
+	_, _, err = ReadRequest(strings.NewReader(raw), limits)
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: Up to the limit is fine
+	raw = "GET / HTTP/1.1\r\nHost: a\r\n" + strings.Repeat("X-A: b\r\n", 100) + "\r\n"
+	_, _, err = ReadRequest(strings.NewReader(raw), limits)
+	require.NoError(t, err)
+
+	// Test: A Content-Length over the limit fails before the body arrives
+	_, _, err = ReadRequest(strings.NewReader("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 65\r\n\r\n"), limits)
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: A chunked body is counted chunk by chunk
+	raw = "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n20\r\n" + strings.Repeat("x", 32) + "\r\n21\r\n"
+	_, _, err = ReadRequest(strings.NewReader(raw), limits)
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Trailers get a header section's limit of their own
+	raw = "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n" + strings.Repeat("X-A: b\r\n", 200) + "\r\n"
+	_, _, err = ReadRequest(strings.NewReader(raw), limits)
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: A chunk size line that never ends is refused, limits or not
+	endless = bytes.NewReader(bytes.Repeat([]byte("a"), 1<<20))
+	_, _, err = ReadRequest(io.MultiReader(strings.NewReader("POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n1;ext="), endless), ReadOptions{})
+	require.ErrorIs(t, err, ErrBadFraming)
+}
+
+func TestReadRequestStreamBody(t *testing.T) {
+	stream := ReadOptions{StreamBody: func(req *Request) bool { return req.RequestLine.RequestTarget == "/upload" }}
+
+	// Test: The body is left on the reader for the caller
+	reader := &chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nHost: a\r\nContent-Length: 11\r\n\r\nhello world",
+		numBytesPerRead: 3,
+	}
+	r, rest, err := ReadRequest(reader, stream)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+	assert.Empty(t, r.Body)
+	assert.Less(t, reader.pos, len(reader.data), "not all of it was read yet")
+	body, err := io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+
+	// Test: Trailers are in once the body is done
+	reader = &chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\nX-Sum: 42\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	r, _, err = ReadRequest(reader, stream)
+	require.NoError(t, err)
+	assert.Empty(t, r.Trailers)
+	body, err = io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+	assert.Equal(t, "42", r.Trailers.Get("x-sum"))
+
+	// Test: Requests StreamBody turns down are read as usual
+	r, _, err = ReadRequest(strings.NewReader("POST /other HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello"), stream)
+	require.NoError(t, err)
+	assert.Nil(t, r.BodyReader)
+	assert.Equal(t, "hello", string(r.Body))
+
+	// Test: No body reads as empty
+	r, _, err = ReadRequest(strings.NewReader("GET /upload HTTP/1.1\r\nHost: a\r\n\r\n"), stream)
+	require.NoError(t, err)
+	body, err = io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Empty(t, body)
+
+	// Test: Limits and cut off bodies fail the read
+	limited := stream
+	limited.MaxBodyBytes = 8
+	reader = &chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n5\r\nworld\r\n0\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	r, _, err = ReadRequest(reader, limited)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.BodyReader)
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+	r, _, err = ReadRequest(strings.NewReader("POST /upload HTTP/1.1\r\nHost: a\r\nContent-Length: 11\r\n\r\nhello"), stream)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.BodyReader)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestIdentityFromCertificate(t *testing.T) {
+	spiffe, err := url.Parse("spiffe://example.com/invoicer")
+	require.NoError(t, err)
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "invoicer", Organization: []string{"Billing"}},
+		DNSNames:       []string{"invoicer.internal"},
+		EmailAddresses: []string{"billing@example.com"},
+		URIs:           []*url.URL{spiffe},
+	}
+
+	// Test: URI SANs come first
+	id := IdentityFromCertificate(cert)
+	assert.Equal(t, "spiffe://example.com/invoicer", id.Name)
+	assert.Equal(t, []string{"spiffe://example.com/invoicer"}, id.URIs)
+	assert.Equal(t, []string{"Billing"}, id.Subject.Organization)
+	assert.Same(t, cert, id.Certificate)
+
+	// Test: Then DNS names, email addresses and the common name
+	cert.URIs = nil
+	assert.Equal(t, "invoicer.internal", IdentityFromCertificate(cert).Name)
+	cert.DNSNames = nil
+	assert.Equal(t, "billing@example.com", IdentityFromCertificate(cert).Name)
+	cert.EmailAddresses = nil
+	assert.Equal(t, "invoicer", IdentityFromCertificate(cert).Name)
+}
+
 type chunkReader struct {
 	data            string
 	numBytesPerRead int
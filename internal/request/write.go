@@ -0,0 +1,191 @@
+package request
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/headers"
+)
+
+// WriteTo writes r to w in HTTP/1.1 wire format, which makes it usable for
+// proxying, recording and as a client request.
+//
+// Headers go out in the order they were received in, followed by any added
+// afterwards in sorted order. The body is framed with chunked encoding when
+// the request asks for it or has trailers to send, and with a Content-Length
+// matching len(r.Body) otherwise. r itself is left untouched.
+func (r *Request) WriteTo(w io.Writer) (int64, error) {
+	chunked := len(r.Trailers) > 0 || isChunkedLast(r.Headers.Get("Transfer-Encoding"), false)
+	return r.write(w, chunked, bytes.NewReader(r.Body))
+}
+
+// WriteStreaming is WriteTo for bodies that aren't in memory: r.Body is
+// ignored and body is sent with chunked encoding as it is read, each chunk
+// flushed to w right away. r.Trailers are only looked at once body is
+// exhausted, so they can be filled in while it is being read (a checksum,
+// say).
+func (r *Request) WriteStreaming(w io.Writer, body io.Reader) (int64, error) {
+	return r.write(w, true, body)
+}
+
+// the most we put into a single chunk when streaming a body
+const maxChunkSize = 32 * 1024
+
+func (r *Request) write(w io.Writer, chunked bool, body io.Reader) (int64, error) {
+	if !headers.IsToken(r.RequestLine.Method) {
+		return 0, fmt.Errorf("invalid method %q", r.RequestLine.Method)
+	}
+	target := r.RequestLine.RequestTarget
+	if target == "" || strings.ContainsFunc(target, func(c rune) bool { return c <= ' ' || c == 0x7f }) {
+		return 0, fmt.Errorf("invalid request target %q", target)
+	}
+
+	version := r.RequestLine.HttpVersion
+	if version == "" {
+		version = "1.1"
+	}
+	if chunked && version == "1.0" {
+		return 0, fmt.Errorf("%w: HTTP/1.0 requests can't be chunked", ErrBadFraming)
+	}
+	if err := validateFields(r.Headers); err != nil {
+		return 0, err
+	}
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	fmt.Fprintf(bw, "%s %s HTTP/%s\r\n", r.RequestLine.Method, target, version)
+	hasTransferEncoding := false
+	for _, name := range r.orderedHeaderNames() {
+		switch strings.ToLower(name) {
+		case "content-length":
+			// written below, from the body we actually have
+			continue
+		case "transfer-encoding":
+			if !chunked {
+				continue
+			}
+			// chunked has to come last, or the body couldn't be framed
+			value := r.Headers[name]
+			if !isChunkedLast(value, false) {
+				if strings.TrimSpace(value) != "" {
+					value += ", "
+				}
+				value += "chunked"
+			}
+			writeField(bw, name, value)
+			hasTransferEncoding = true
+			continue
+		}
+		writeField(bw, name, r.Headers[name])
+	}
+	if chunked {
+		if !hasTransferEncoding {
+			writeField(bw, "transfer-encoding", "chunked")
+		}
+	} else if len(r.Body) > 0 || r.Headers.Get("Content-Length") != "" {
+		writeField(bw, "content-length", strconv.Itoa(len(r.Body)))
+	}
+	bw.WriteString("\r\n")
+
+	if !chunked {
+		bw.Write(r.Body)
+		err := bw.Flush()
+		return cw.n, err
+	}
+
+	buf := make([]byte, maxChunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(bw, "%X\r\n", n)
+			bw.Write(buf[:n])
+			bw.WriteString("\r\n")
+			if flushErr := bw.Flush(); flushErr != nil {
+				return cw.n, flushErr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return cw.n, err
+		}
+	}
+
+	if err := validateFields(r.Trailers); err != nil {
+		return cw.n, err
+	}
+	bw.WriteString("0\r\n")
+	for _, name := range sortedNames(r.Trailers) {
+		writeField(bw, name, r.Trailers[name])
+	}
+	bw.WriteString("\r\n")
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// orderedHeaderNames lists the header names in arrival order, then whatever
+// was added by hand.
+func (r *Request) orderedHeaderNames() []string {
+	names := make([]string, 0, len(r.Headers))
+	seen := make(map[string]bool, len(r.Headers))
+	for _, name := range r.headerOrder {
+		if _, ok := r.Headers[name]; ok && !seen[name] {
+			names = append(names, name)
+			seen[name] = true
+		}
+	}
+	var rest []string
+	for name := range r.Headers {
+		if !seen[strings.ToLower(name)] {
+			rest = append(rest, name)
+		}
+	}
+	slices.Sort(rest)
+	return append(names, rest...)
+}
+
+// validateFields makes sure nothing we were handed can break out of its
+// field line, the lenient parser lets a bare LF through for instance.
+func validateFields(h headers.Headers) error {
+	for name, value := range h {
+		if !headers.IsToken(name) || !headers.IsFieldValue(value) {
+			return fmt.Errorf("invalid field %q: %q", name, value)
+		}
+	}
+	return nil
+}
+
+func sortedNames(h headers.Headers) []string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func writeField(w *bufio.Writer, name, value string) {
+	w.WriteString(name)
+	w.WriteString(": ")
+	w.WriteString(value)
+	w.WriteString("\r\n")
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,174 @@
+package request
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteTo(t *testing.T) {
+	// Test: Headers keep their order, Content-Length follows the body
+	reader := &chunkReader{
+		data: "POST /coffee HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"User-Agent: curl/7.81.0\r\n" +
+			"Content-Length: 5\r\n" +
+			"Accept: */*\r\n" +
+			"\r\n" +
+			"hello",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	r.Body = []byte("hello world")
+	r.Headers["x-added"] = "1"
+
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	assert.Equal(t, "POST /coffee HTTP/1.1\r\n"+
+		"host: localhost:42069\r\n"+
+		"user-agent: curl/7.81.0\r\n"+
+		"accept: */*\r\n"+
+		"x-added: 1\r\n"+
+		"content-length: 11\r\n"+
+		"\r\n"+
+		"hello world", buf.String())
+
+	// Test: Trailers switch to chunked encoding
+	r = &Request{
+		RequestLine: RequestLine{Method: "PUT", RequestTarget: "/upload"},
+		Headers:     headers.Headers{"host": "example.com"},
+		Body:        []byte("hello"),
+		Trailers:    headers.Headers{"x-checksum": "abc"},
+	}
+	buf.Reset()
+	_, err = r.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "PUT /upload HTTP/1.1\r\n"+
+		"host: example.com\r\n"+
+		"transfer-encoding: chunked\r\n"+
+		"\r\n"+
+		"5\r\nhello\r\n"+
+		"0\r\n"+
+		"x-checksum: abc\r\n"+
+		"\r\n", buf.String())
+
+	// Test: chunked goes after the codings already there
+	r.Headers["transfer-encoding"] = "gzip"
+	buf.Reset()
+	_, err = r.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), "transfer-encoding: gzip, chunked\r\n")
+	assert.Equal(t, 1, strings.Count(buf.String(), "transfer-encoding"))
+	r.Headers["transfer-encoding"] = "gzip, chunked"
+	buf.Reset()
+	_, err = r.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), "transfer-encoding: gzip, chunked\r\n")
+
+	// Test: No body, no Content-Length
+	r = &Request{
+		RequestLine: RequestLine{Method: "GET", RequestTarget: "/"},
+		Headers:     headers.Headers{"host": "example.com"},
+	}
+	buf.Reset()
+	_, err = r.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "GET / HTTP/1.1\r\nhost: example.com\r\n\r\n", buf.String())
+
+	// Test: Header injection is refused
+	r.Headers["x-evil"] = "a\nTransfer-Encoding: chunked"
+	_, err = r.WriteTo(&buf)
+	require.Error(t, err)
+
+	// Test: Target with a space is refused
+	r = &Request{RequestLine: RequestLine{Method: "GET", RequestTarget: "/ HTTP/1.1"}}
+	_, err = r.WriteTo(&buf)
+	require.Error(t, err)
+}
+
+// randomRequest builds a request out of pieces the parser has to be able to
+// take back in unchanged.
+func randomRequest(rng *rand.Rand) *Request {
+	const tchars = "abcdefghijklmnopqrstuvwxyz0123456789-_.!#$%&'*+^`|~"
+	randString := func(alphabet string, minLen, maxLen int) string {
+		var b strings.Builder
+		for range minLen + rng.IntN(maxLen-minLen+1) {
+			b.WriteByte(alphabet[rng.IntN(len(alphabet))])
+		}
+		return b.String()
+	}
+
+	r := &Request{
+		RequestLine: RequestLine{
+			Method:        StandardMethods[rng.IntN(len(StandardMethods))],
+			RequestTarget: "/" + randString("abcdefghijklmnopqrstuvwxyz0123456789/-._~%?=&", 0, 40),
+			HttpVersion:   "1.1",
+		},
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+	}
+	r.Headers["host"] = "localhost:42069"
+	for range rng.IntN(10) {
+		name := "x-" + randString(tchars, 1, 12)
+		// values don't start or end with whitespace, the parser trims that
+		value := strings.TrimSpace(randString("abc xyz\t019:;,/\"\x80\xff", 0, 30))
+		r.Headers[name] = value
+	}
+
+	if rng.IntN(3) > 0 {
+		r.Body = make([]byte, rng.IntN(3000))
+		for i := range r.Body {
+			r.Body[i] = byte(rng.IntN(256))
+		}
+	}
+	switch rng.IntN(3) {
+	case 1:
+		r.Headers["transfer-encoding"] = "chunked"
+	case 2:
+		r.Headers["transfer-encoding"] = "chunked"
+		for range 1 + rng.IntN(3) {
+			r.Trailers["x-trailer-"+randString(tchars, 1, 8)] = randString("abcdef0123456789", 1, 64)
+		}
+	}
+	return r
+}
+
+func TestWriteToRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewPCG(42, 1024))
+	for i := range 500 {
+		original := randomRequest(rng)
+
+		var buf bytes.Buffer
+		_, err := original.WriteTo(&buf)
+		require.NoError(t, err)
+
+		reader := &chunkReader{data: buf.String(), numBytesPerRead: 1 + rng.IntN(64)}
+		parsed, err := RequestFromReaderStrict(reader)
+		require.NoError(t, err, "request %d:\n%s", i, buf.String())
+
+		msg := fmt.Sprintf("request %d, %d bytes per read", i, reader.numBytesPerRead)
+		assert.Equal(t, original.RequestLine.Method, parsed.RequestLine.Method, msg)
+		assert.Equal(t, original.RequestLine.RequestTarget, parsed.RequestLine.RequestTarget, msg)
+		assert.Equal(t, len(original.Body), len(parsed.Body), msg)
+		assert.True(t, bytes.Equal(original.Body, parsed.Body), msg)
+		assert.Equal(t, original.Trailers, parsed.Trailers, msg)
+		for name, value := range original.Headers {
+			assert.Equal(t, value, parsed.Headers[name], msg)
+		}
+
+		// and writing the parsed request again gives the exact same bytes
+		var again bytes.Buffer
+		_, err = parsed.WriteTo(&again)
+		require.NoError(t, err)
+		assert.Equal(t, buf.String(), again.String(), msg)
+	}
+}
@@ -0,0 +1,390 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/headers"
+)
+
+// the most we'll read of a status line plus headers (and of trailers)
+// before giving up on a response.
+const maxHeaderBytes = 1 << 20
+
+var ErrMalformedResponse = errors.New("malformed response")
+
+type Response struct {
+	StatusLine StatusLine
+	Headers    headers.Headers
+	Body       []byte
+	// only filled in once the whole body has been read
+	Trailers headers.Headers
+
+	// BodyReader streams the decoded body. It is set by ReadResponse,
+	// ResponseFromReader reads it to the end into Body.
+	BodyReader io.Reader
+
+	// set when the body runs until the connection closes, so the
+	// connection can't carry another response afterwards
+	closeDelimited bool
+	// set for a 101 and for a 2xx to CONNECT: what follows on the
+	// connection isn't HTTP/1 any more
+	switched bool
+}
+
+// ConnectionReusable reports whether the connection can carry another
+// exchange once this response's body has been read to the end: the body has
+// to have a length of its own, and neither HTTP/1.0 defaults nor a
+// "Connection: close" may be asking for the connection to go away. A
+// connection that switched protocols or became a tunnel is never reusable.
+func (r *Response) ConnectionReusable() bool {
+	if r.closeDelimited || r.switched {
+		return false
+	}
+	connection := strings.ToLower(r.Headers.Get("Connection"))
+	if hasToken(connection, "close") {
+		return false
+	}
+	if r.StatusLine.HttpVersionMajor == 1 && r.StatusLine.HttpVersionMinor == 0 {
+		return hasToken(connection, "keep-alive")
+	}
+	return true
+}
+
+// hasToken reports whether a comma separated list contains token.
+func hasToken(list, token string) bool {
+	for item := range strings.SplitSeq(list, ",") {
+		if strings.TrimSpace(item) == token {
+			return true
+		}
+	}
+	return false
+}
+
+type StatusLine struct {
+	HttpVersion  string // "1.1"
+	StatusCode   StatusCode
+	ReasonPhrase string
+
+	HttpVersionMajor int
+	HttpVersionMinor int
+}
+
+// ResponseFromReader reads a complete response to a reqMethod request from
+// r, body included. Interim 1xx responses (other than 101 Switching
+// Protocols) are skipped over, so what comes back is the final response.
+func ResponseFromReader(r io.Reader, reqMethod string) (*Response, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	for {
+		resp, err := ReadResponse(br, reqMethod)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(resp.BodyReader)
+		if err != nil {
+			return resp, err
+		}
+		resp.Body = body
+		if isInterim(resp.StatusLine.StatusCode) {
+			continue
+		}
+		return resp, nil
+	}
+}
+
+func isInterim(code StatusCode) bool {
+	return code >= 100 && code < 200 && code != SwitchingProtocols
+}
+
+// ReadResponse reads the status line and headers of the next response on br
+// and leaves the body to be streamed from BodyReader, which never reads past
+// the end of the response. That includes interim 1xx responses, which have
+// no body.
+func ReadResponse(br *bufio.Reader, reqMethod string) (*Response, error) {
+	budget := maxHeaderBytes
+	line, err := readLine(br, &budget)
+	if err != nil {
+		return nil, err
+	}
+	statusLine, err := parseStatusLine(line)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &Response{
+		StatusLine: statusLine,
+		Headers:    headers.NewHeaders(),
+		Trailers:   headers.NewHeaders(),
+	}
+	if err := readFields(br, resp.Headers, &budget); err != nil {
+		return nil, err
+	}
+	if err := resp.setupBody(br, reqMethod); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// parseStatusLine parses status-line = HTTP-version SP status-code SP
+// [ reason-phrase ], also taking a missing SP after the code.
+func parseStatusLine(line []byte) (StatusLine, error) {
+	version, rest, ok := bytes.Cut(line, []byte(" "))
+	if !ok {
+		return StatusLine{}, fmt.Errorf("%w: status line %q", ErrMalformedResponse, line)
+	}
+	if len(version) != len("HTTP/x.y") || !bytes.HasPrefix(version, []byte("HTTP/")) || version[6] != '.' ||
+		!isDigit(version[5]) || !isDigit(version[7]) {
+		return StatusLine{}, fmt.Errorf("%w: version %q", ErrMalformedResponse, version)
+	}
+	code, reason, _ := bytes.Cut(rest, []byte(" "))
+	if len(code) != 3 || !isDigit(code[0]) || !isDigit(code[1]) || !isDigit(code[2]) {
+		return StatusLine{}, fmt.Errorf("%w: status code %q", ErrMalformedResponse, code)
+	}
+	statusCode, _ := strconv.Atoi(string(code))
+
+	return StatusLine{
+		HttpVersion:      string(version[5:]),
+		StatusCode:       StatusCode(statusCode),
+		ReasonPhrase:     string(reason),
+		HttpVersionMajor: int(version[5] - '0'),
+		HttpVersionMinor: int(version[7] - '0'),
+	}, nil
+}
+
+// setupBody picks the body framing following RFC 9112 section 6.3.
+func (resp *Response) setupBody(br *bufio.Reader, reqMethod string) error {
+	code := resp.StatusLine.StatusCode
+	resp.switched = code == SwitchingProtocols || reqMethod == "CONNECT" && code >= 200 && code < 300
+	switch {
+	case reqMethod == "HEAD",
+		code >= 100 && code < 200,
+		code == NoContent,
+		code == NotModified,
+		reqMethod == "CONNECT" && code >= 200 && code < 300:
+		resp.BodyReader = eofReader{}
+		return nil
+	}
+
+	if te, ok := resp.Headers["transfer-encoding"]; ok {
+		codings := strings.Split(te, ",")
+		if strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			resp.BodyReader = &chunkedReader{br: br, trailers: resp.Trailers}
+		} else {
+			resp.BodyReader = br
+			resp.closeDelimited = true
+		}
+		return nil
+	}
+
+	if cl, ok := resp.Headers["content-length"]; ok {
+		n, err := parseContentLength(cl)
+		if err != nil {
+			return err
+		}
+		resp.BodyReader = &lengthReader{r: br, remaining: n}
+		return nil
+	}
+
+	resp.BodyReader = br
+	resp.closeDelimited = true
+	return nil
+}
+
+// parseContentLength takes 1*DIGIT, or a list of the same value repeated.
+func parseContentLength(value string) (int64, error) {
+	var contentLength int64 = -1
+	for v := range strings.SplitSeq(value, ",") {
+		v = strings.TrimSpace(v)
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || v == "" || !isDigit(v[0]) {
+			return 0, fmt.Errorf("%w: Content-Length %q", ErrMalformedResponse, value)
+		}
+		if contentLength != -1 && contentLength != n {
+			return 0, fmt.Errorf("%w: conflicting Content-Length %q", ErrMalformedResponse, value)
+		}
+		contentLength = n
+	}
+	return contentLength, nil
+}
+
+// readLine reads a line, accepting a bare LF as well as CRLF, and returns
+// it without the line ending. budget is how many more bytes we're willing
+// to read.
+func readLine(br *bufio.Reader, budget *int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := br.ReadSlice('\n')
+		*budget -= len(chunk)
+		if *budget < 0 {
+			return nil, fmt.Errorf("%w: headers too large", ErrMalformedResponse)
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			line = append(line, chunk...)
+			continue
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) && (len(line) > 0 || len(chunk) > 0) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if line != nil {
+			chunk = append(line, chunk...)
+		}
+		chunk = chunk[:len(chunk)-1]
+		return bytes.TrimSuffix(chunk, []byte("\r")), nil
+	}
+}
+
+// readFields reads field lines into h up to and including the empty line
+// that ends them.
+func readFields(br *bufio.Reader, h headers.Headers, budget *int) error {
+	for {
+		line, err := readLine(br, budget)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		name, value, done, err := headers.ParseFieldLine(line, false)
+		if err != nil {
+			return fmt.Errorf("%w: field line %q", ErrMalformedResponse, line)
+		}
+		if done {
+			return nil
+		}
+		h.Add(name, value)
+	}
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+// lengthReader reads a Content-Length delimited body.
+type lengthReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *lengthReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if errors.Is(err, io.EOF) && l.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// chunkedReader decodes a chunked body, collecting trailers at the end.
+type chunkedReader struct {
+	br        *bufio.Reader
+	remaining int64
+	trailers  headers.Headers
+	done      bool
+	err       error
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.remaining == 0 {
+		if err := c.nextChunk(); err != nil {
+			c.err = err
+			return 0, err
+		}
+		if c.done {
+			return 0, io.EOF
+		}
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	c.remaining -= int64(n)
+	if c.remaining == 0 && err == nil {
+		err = c.chunkEnd()
+	}
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	c.err = err
+	return n, err
+}
+
+// nextChunk reads a chunk size line, or the last chunk and trailers.
+func (c *chunkedReader) nextChunk() error {
+	budget := maxHeaderBytes
+	line, err := readLine(c.br, &budget)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	size, _, _ := bytes.Cut(line, []byte(";"))
+	size = bytes.TrimSpace(size)
+	// ParseInt takes a sign as well, which two parsers could read
+	// differently
+	n, err := strconv.ParseInt(string(size), 16, 64)
+	if err != nil || len(size) == 0 || !isHexDigits(size) {
+		return fmt.Errorf("%w: chunk size %q", ErrMalformedResponse, line)
+	}
+	if n == 0 {
+		if err := readFields(c.br, c.trailers, &budget); err != nil {
+			return err
+		}
+		c.done = true
+		return nil
+	}
+	c.remaining = n
+	return nil
+}
+
+// chunkEnd consumes the CRLF after a chunk's data.
+func (c *chunkedReader) chunkEnd() error {
+	b, err := c.br.ReadByte()
+	if err == nil && b == '\r' {
+		b, err = c.br.ReadByte()
+	}
+	if err != nil {
+		return err
+	}
+	if b != '\n' {
+		return fmt.Errorf("%w: chunk data not followed by CRLF", ErrMalformedResponse)
+	}
+	return nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigits(b []byte) bool {
+	for _, c := range b {
+		if !isDigit(c) && (c|0x20 < 'a' || c|0x20 > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -1,11 +1,15 @@
 package response
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/sankalpmukim/httpfromtcp/internal/headers"
 )
@@ -13,21 +17,90 @@ import (
 type StatusCode int
 
 const (
-	OK                  StatusCode = 200
-	BadRequest          StatusCode = 400
-	NotFound            StatusCode = 404
+	SwitchingProtocols StatusCode = 101
+	OK                 StatusCode = 200
+	NoContent          StatusCode = 204
+	PartialContent     StatusCode = 206
+	MovedPermanently   StatusCode = 301
+	NotModified        StatusCode = 304
+	BadRequest         StatusCode = 400
+	Forbidden          StatusCode = 403
+	NotFound           StatusCode = 404
+	MethodNotAllowed   StatusCode = 405
+
+	ProxyAuthenticationRequired StatusCode = 407
+	PreconditionFailed          StatusCode = 412
+	ContentTooLarge             StatusCode = 413
+	RangeNotSatisfiable         StatusCode = 416
+	UpgradeRequired             StatusCode = 426
+	RequestHeaderFieldsTooLarge StatusCode = 431
+
 	InternalServerError StatusCode = 500
+	NotImplemented      StatusCode = 501
+	BadGateway          StatusCode = 502
+	ServiceUnavailable  StatusCode = 503
+	GatewayTimeout      StatusCode = 504
+
+	HTTPVersionNotSupported StatusCode = 505
+)
+
+// the newest protocol version we speak. responses never claim more than this.
+const (
+	protoMajor = 1
+	protoMinor = 1
 )
 
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
-	statusLine := fmt.Sprintf("HTTP/1.1 %v ", statusCode)
+	return writeStatusLine(w, protoMajor, protoMinor, statusCode)
+}
+
+func writeStatusLine(w io.Writer, major, minor int, statusCode StatusCode) error {
+	statusLine := fmt.Sprintf("HTTP/%d.%d %v ", major, minor, statusCode)
 	switch statusCode {
+	case SwitchingProtocols:
+		statusLine += "Switching Protocols"
 	case OK:
 		statusLine += "OK"
+	case NoContent:
+		statusLine += "No Content"
+	case PartialContent:
+		statusLine += "Partial Content"
+	case MovedPermanently:
+		statusLine += "Moved Permanently"
+	case NotModified:
+		statusLine += "Not Modified"
 	case BadRequest:
 		statusLine += "Bad Request"
+	case Forbidden:
+		statusLine += "Forbidden"
+	case NotFound:
+		statusLine += "Not Found"
+	case MethodNotAllowed:
+		statusLine += "Method Not Allowed"
+	case ProxyAuthenticationRequired:
+		statusLine += "Proxy Authentication Required"
+	case PreconditionFailed:
+		statusLine += "Precondition Failed"
+	case ContentTooLarge:
+		statusLine += "Content Too Large"
+	case RangeNotSatisfiable:
+		statusLine += "Range Not Satisfiable"
+	case UpgradeRequired:
+		statusLine += "Upgrade Required"
+	case RequestHeaderFieldsTooLarge:
+		statusLine += "Request Header Fields Too Large"
 	case InternalServerError:
 		statusLine += "Internal Server Error"
+	case NotImplemented:
+		statusLine += "Not Implemented"
+	case BadGateway:
+		statusLine += "Bad Gateway"
+	case ServiceUnavailable:
+		statusLine += "Service Unavailable"
+	case GatewayTimeout:
+		statusLine += "Gateway Timeout"
+	case HTTPVersionNotSupported:
+		statusLine += "HTTP Version Not Supported"
 	default:
 		statusLine += ""
 	}
@@ -64,30 +137,176 @@ const (
 type Writer struct {
 	io.Writer
 	toWriteNext writerState
+
+	protoMajor int
+	protoMinor int
+	// set when talking to an HTTP/1.0 client: chunked writes go out as
+	// plain bytes and the end of the body is marked by closing the connection.
+	unchunked bool
+
+	// set by NewConnResponseWriter, for Hijack
+	conn     net.Conn
+	buffered []byte
+	hijacked bool
+	// closed by the watcher ClientGone starts
+	gone chan struct{}
+	// set by NewStreamResponseWriter, returned by ClientGone as it is
+	streamGone <-chan struct{}
 }
 
+// ErrNotHijackable is returned by Hijack when the writer doesn't sit on a
+// connection, the connection has been taken over already, or ClientGone is
+// watching it.
+var ErrNotHijackable = errors.New("connection can't be hijacked")
+
+// ErrHijacked is returned by writes through a Writer whose connection has
+// been hijacked.
+var ErrHijacked = errors.New("connection has been hijacked")
+
 func NewResponseWriter(w io.Writer) Writer {
-	return Writer{Writer: w, toWriteNext: statusLineNext}
+	return Writer{Writer: w, toWriteNext: statusLineNext, protoMajor: protoMajor, protoMinor: protoMinor}
+}
+
+// NewConnResponseWriter is NewResponseWriter for a writer on a connection
+// that the handler may take over with Hijack. buffered is what was read off
+// conn past the end of the request, it is handed over along with conn.
+func NewConnResponseWriter(conn net.Conn, buffered []byte) Writer {
+	w := NewResponseWriter(conn)
+	w.conn = conn
+	w.buffered = buffered
+	return w
+}
+
+// NewStreamResponseWriter is NewResponseWriter for a writer whose transport
+// knows by itself when the client has gone, an HTTP/2 stream for instance.
+// gone is closed once it has, and is what ClientGone returns.
+func NewStreamResponseWriter(w io.Writer, gone <-chan struct{}) Writer {
+	rw := NewResponseWriter(w)
+	rw.streamGone = gone
+	return rw
+}
+
+// SetProtocolVersion tells the writer which version the request came in
+// with, so the status line echoes it and HTTP/1.0 clients never see a
+// chunked body. Versions newer than ours are answered as ours.
+// It has to be called before WriteStatusLine.
+func (w *Writer) SetProtocolVersion(major, minor int) {
+	if major > protoMajor || major == protoMajor && minor > protoMinor {
+		major, minor = protoMajor, protoMinor
+	}
+	w.protoMajor = major
+	w.protoMinor = minor
+}
+
+// Hijack hands the connection under the writer over to the caller, for
+// protocol upgrades, tunnels and the like. The caller is responsible for
+// closing it, the server leaves hijacked connections alone once the handler
+// returns.
+//
+// Bytes that were read off the connection past the request, if any, are
+// buffered in rw.Reader, so the connection should be read through it.
+// Whatever was written with w before the hijack has gone out already, and
+// later writes through w fail with ErrHijacked.
+func (w *Writer) Hijack() (conn net.Conn, rw *bufio.ReadWriter, err error) {
+	if !w.CanHijack() {
+		return nil, nil, ErrNotHijackable
+	}
+	w.hijacked = true
+	w.Writer = hijackedWriter{}
+
+	r := bufio.NewReaderSize(io.MultiReader(bytes.NewReader(w.buffered), w.conn), max(len(w.buffered), 4096))
+	if len(w.buffered) > 0 {
+		// pull the leftovers into the bufio.Reader so Buffered reports
+		// them. The bytes.Reader has them all, so the connection isn't read.
+		r.Peek(len(w.buffered))
+	}
+	w.buffered = nil
+	return w.conn, bufio.NewReadWriter(r, bufio.NewWriter(w.conn)), nil
+}
+
+// CanHijack reports whether Hijack would succeed, so handlers can find out
+// before they answer. It is false for HTTP/2 streams, for one.
+func (w *Writer) CanHijack() bool {
+	return w.conn != nil && !w.hijacked && w.gone == nil
+}
+
+// Hijacked reports whether Hijack has been called successfully.
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
+
+type hijackedWriter struct{}
+
+func (hijackedWriter) Write([]byte) (int, error) { return 0, ErrHijacked }
+
+// ClientGone returns a channel that is closed once the client hangs up, so
+// handlers streaming a long response know when to stop. The request has
+// been read in full by then, so the connection is watched by reading and
+// dropping whatever else comes in until it fails; a writer being watched
+// can't be hijacked. Writers from NewStreamResponseWriter return the channel
+// they were made with. For other writers that aren't on a connection the
+// channel is nil, which never fires.
+func (w *Writer) ClientGone() <-chan struct{} {
+	if w.streamGone != nil {
+		return w.streamGone
+	}
+	if w.conn == nil || w.hijacked {
+		return nil
+	}
+	if w.gone == nil {
+		w.gone = make(chan struct{})
+		go func(conn net.Conn, gone chan struct{}) {
+			io.Copy(io.Discard, conn)
+			close(gone)
+		}(w.conn, w.gone)
+	}
+	return w.gone
+}
+
+func (w *Writer) isHTTP10() bool {
+	return w.protoMajor == 1 && w.protoMinor == 0
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
 	if w.toWriteNext == statusLineNext {
 		w.toWriteNext = headersNext
-		return WriteStatusLine(w, statusCode)
+		return writeStatusLine(w, w.protoMajor, w.protoMinor, statusCode)
 	} else {
 		return errors.ErrUnsupported
 	}
 }
 
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
+func (w *Writer) WriteHeaders(h headers.Headers) error {
 	if w.toWriteNext == headersNext {
 		w.toWriteNext = bodyNext
-		return WriteHeaders(w, headers)
+		if w.isHTTP10() {
+			h = w.downgradeHeaders(h)
+		}
+		return WriteHeaders(w, h)
 	} else {
 		return errors.ErrUnsupported
 	}
 }
 
+// downgradeHeaders strips chunked framing that an HTTP/1.0 client can't
+// understand. The caller's map is left alone.
+func (w *Writer) downgradeHeaders(h headers.Headers) headers.Headers {
+	out := headers.NewHeaders()
+	for k, v := range h {
+		switch strings.ToLower(k) {
+		case "transfer-encoding":
+			w.unchunked = true
+		case "trailer", "connection":
+		default:
+			out[k] = v
+		}
+	}
+	// HTTP/1.0 has no persistent connections unless asked for, and we
+	// close after every response anyway
+	out["connection"] = "close"
+	return out
+}
+
 func (w *Writer) WriteBody(p []byte) (int, error) {
 	if w.toWriteNext == bodyNext {
 		return w.Write(p)
@@ -96,7 +315,35 @@ func (w *Writer) WriteBody(p []byte) (int, error) {
 	}
 }
 
+// ReadFrom writes what r has as the body, like WriteBody, without holding
+// it all in memory. It makes io.Copy into a Writer stream: straight from
+// the kernel with sendfile or splice when the writer sits on a plain TCP
+// connection and r is a file, through a reused buffer otherwise, over TLS
+// for instance. Like WriteBody it doesn't frame what it writes, so it is
+// for bodies with a Content-Length.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if w.toWriteNext != bodyNext {
+		return 0, errors.ErrUnsupported
+	}
+	if tcpConn, ok := w.Writer.(*net.TCPConn); ok {
+		return tcpConn.ReadFrom(r)
+	}
+	buf := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(buf)
+	// the wrapper hides any ReadFrom of the writer under us, which
+	// io.CopyBuffer would use instead of the buffer
+	return io.CopyBuffer(struct{ io.Writer }{w.Writer}, r, *buf)
+}
+
+var copyBufPool = sync.Pool{New: func() any {
+	buf := make([]byte, 32*1024)
+	return &buf
+}}
+
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if w.unchunked {
+		return w.Write(p)
+	}
 	buf := make([]byte, 0, len(p)+32) // small extra for header + CRLF
 
 	buf = fmt.Appendf(buf, "%X\r\n", len(p))
@@ -107,10 +354,17 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 }
 
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if w.unchunked {
+		return 0, nil
+	}
 	return w.Write([]byte("0\r\n\r\n"))
 }
 
 func (w *Writer) WriteTrailers(h headers.Headers) error {
+	if w.unchunked {
+		// no trailers without chunked encoding
+		return nil
+	}
 	_, err := w.Write([]byte("0\r\n"))
 	if err != nil {
 		return err
@@ -0,0 +1,260 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterProtocolVersion(t *testing.T) {
+	// Test: HTTP/1.1 by default
+	var buf bytes.Buffer
+	w := NewResponseWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+
+	// Test: Echo HTTP/1.0
+	buf.Reset()
+	w = NewResponseWriter(&buf)
+	w.SetProtocolVersion(1, 0)
+	require.NoError(t, w.WriteStatusLine(NotFound))
+	assert.Equal(t, "HTTP/1.0 404 Not Found\r\n", buf.String())
+
+	// Test: Never claim more than HTTP/1.1
+	buf.Reset()
+	w = NewResponseWriter(&buf)
+	w.SetProtocolVersion(1, 5)
+	require.NoError(t, w.WriteStatusLine(OK))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+}
+
+func TestWriterChunkedForHTTP10(t *testing.T) {
+	// Test: HTTP/1.1 gets chunked framing and trailers
+	var buf bytes.Buffer
+	w := NewResponseWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h := headers.NewHeaders()
+	h["transfer-encoding"] = "chunked"
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers["x-sum"] = "1"
+	require.NoError(t, w.WriteTrailers(trailers))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ntransfer-encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\nx-sum: 1\r\n\r\n", buf.String())
+
+	// Test: HTTP/1.0 gets the raw body, delimited by connection close
+	buf.Reset()
+	w = NewResponseWriter(&buf)
+	w.SetProtocolVersion(1, 0)
+	require.NoError(t, w.WriteStatusLine(OK))
+	h = headers.NewHeaders()
+	h["transfer-encoding"] = "chunked"
+	h["trailer"] = "x-sum"
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(trailers))
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nconnection: close\r\n\r\nhello", buf.String())
+	// the caller's headers are untouched
+	assert.Equal(t, "chunked", h["transfer-encoding"])
+}
+
+func TestWriterReadFrom(t *testing.T) {
+	body := strings.Repeat("0123456789", 10000)
+
+	// Test: Nothing is copied before the headers
+	var buf bytes.Buffer
+	w := NewResponseWriter(&buf)
+	_, err := w.ReadFrom(strings.NewReader(body))
+	assert.ErrorIs(t, err, errors.ErrUnsupported)
+	assert.Empty(t, buf.String())
+
+	// Test: Other writers get a buffered copy
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(len(body))))
+	n, err := io.Copy(&w, iotest.HalfReader(strings.NewReader(body)))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(body)), n)
+	resp, err := ResponseFromReader(&buf, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, body, string(resp.Body))
+
+	// Test: Files go straight to TCP connections
+	name := filepath.Join(t.TempDir(), "body")
+	require.NoError(t, os.WriteFile(name, []byte(body), 0o600))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		file, err := os.Open(name)
+		if err != nil {
+			return
+		}
+		defer file.Close()
+		w := NewConnResponseWriter(conn, nil)
+		w.WriteStatusLine(OK)
+		w.WriteHeaders(GetDefaultHeaders(len(body)))
+		io.CopyN(&w, file, int64(len(body)))
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	resp, err = ResponseFromReader(conn, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, body, string(resp.Body))
+}
+
+func TestResponseFromReader(t *testing.T) {
+	// Test: Content-Length body
+	data := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Length: 13\r\n" +
+		"\r\n" +
+		"hello world!\n"
+	resp, err := ResponseFromReader(iotest.OneByteReader(strings.NewReader(data)), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, OK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "OK", resp.StatusLine.ReasonPhrase)
+	assert.Equal(t, "1.1", resp.StatusLine.HttpVersion)
+	assert.Equal(t, "text/plain", resp.Headers.Get("Content-Type"))
+	assert.Equal(t, "hello world!\n", string(resp.Body))
+
+	// Test: Chunked body with trailers
+	data = "HTTP/1.1 200 OK\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"Trailer: X-Content-SHA256\r\n" +
+		"\r\n" +
+		"5\r\nhello\r\n" +
+		"7;ext=1\r\n world!\r\n" +
+		"0\r\n" +
+		"X-Content-SHA256: abc\r\n" +
+		"\r\n"
+	resp, err = ResponseFromReader(iotest.OneByteReader(strings.NewReader(data)), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!", string(resp.Body))
+	assert.Equal(t, "abc", resp.Trailers.Get("X-Content-SHA256"))
+
+	// Test: Body delimited by connection close
+	data = "HTTP/1.0 200 OK\r\n" +
+		"\r\n" +
+		"until the end"
+	resp, err = ResponseFromReader(strings.NewReader(data), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, 0, resp.StatusLine.HttpVersionMinor)
+	assert.Equal(t, "until the end", string(resp.Body))
+
+	// Test: HEAD responses have no body whatever the headers say
+	data = "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n"
+	resp, err = ResponseFromReader(strings.NewReader(data), "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, "100", resp.Headers.Get("Content-Length"))
+	assert.Empty(t, resp.Body)
+
+	// Test: Neither do 204 and 304, and what follows them is the next response
+	for _, code := range []string{"204 No Content", "304 Not Modified"} {
+		data = "HTTP/1.1 " + code + "\r\nContent-Length: 5\r\n\r\nHTTP/1.1 200 OK\r\n\r\n"
+		br := bufio.NewReader(strings.NewReader(data))
+		resp, err = ResponseFromReader(br, "GET")
+		require.NoError(t, err)
+		assert.Empty(t, resp.Body)
+		resp, err = ResponseFromReader(br, "GET")
+		require.NoError(t, err, code)
+		assert.Equal(t, OK, resp.StatusLine.StatusCode)
+	}
+
+	// Test: Interim responses are skipped
+	data = "HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n" +
+		"HTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok"
+	resp, err = ResponseFromReader(strings.NewReader(data), "POST")
+	require.NoError(t, err)
+	assert.Equal(t, StatusCode(201), resp.StatusLine.StatusCode)
+	assert.Equal(t, "Created", resp.StatusLine.ReasonPhrase)
+	assert.Equal(t, "ok", string(resp.Body))
+
+	// Test: but 101 is final
+	data = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n"
+	resp, err = ResponseFromReader(strings.NewReader(data), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, SwitchingProtocols, resp.StatusLine.StatusCode)
+
+	// Test: Missing reason phrase
+	data = "HTTP/1.1 200\r\nContent-Length: 0\r\n\r\n"
+	resp, err = ResponseFromReader(strings.NewReader(data), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "", resp.StatusLine.ReasonPhrase)
+
+	// Test: Body shorter than Content-Length
+	data = "HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\npartial"
+	_, err = ResponseFromReader(strings.NewReader(data), "GET")
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Chunked body cut off
+	data = "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\na\r\nhello"
+	_, err = ResponseFromReader(strings.NewReader(data), "GET")
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Chunk sizes are hex digits only, no sign or prefix
+	for _, size := range []string{"+5", "-5", "0x5", "5_0", "g"} {
+		data = "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" + size + "\r\nhello\r\n0\r\n\r\n"
+		_, err = ResponseFromReader(strings.NewReader(data), "GET")
+		require.ErrorIs(t, err, ErrMalformedResponse, size)
+	}
+	data = "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nA\r\nhello, you\r\n0\r\n\r\n"
+	resp, err = ResponseFromReader(strings.NewReader(data), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "hello, you", string(resp.Body))
+
+	// Test: Malformed status lines
+	for _, line := range []string{"HTTP/1.1\r\n", "FOO/1.1 200 OK\r\n", "HTTP/1.1 20 OK\r\n", "HTTP/1.1 abc OK\r\n"} {
+		_, err = ResponseFromReader(strings.NewReader(line+"\r\n"), "GET")
+		require.ErrorIs(t, err, ErrMalformedResponse, line)
+	}
+
+	// Test: Conflicting Content-Length
+	data = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Length: 3\r\n\r\nabc"
+	_, err = ResponseFromReader(strings.NewReader(data), "GET")
+	require.ErrorIs(t, err, ErrMalformedResponse)
+}
+
+func TestConnectionReusable(t *testing.T) {
+	for data, reusable := range map[string]bool{
+		"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok":                           true,
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n":           true,
+		"HTTP/1.1 204 No Content\r\n\r\n":                                          true,
+		"HTTP/1.1 200 OK\r\n\r\nuntil close":                                       false,
+		"HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 2\r\n\r\nok":      false,
+		"HTTP/1.1 200 OK\r\nConnection: foo, Close\r\nContent-Length: 2\r\n\r\nok": false,
+		"HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\nok":                           false,
+		"HTTP/1.0 200 OK\r\nConnection: keep-alive\r\nContent-Length: 2\r\n\r\nok": true,
+		"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n":           false,
+	} {
+		resp, err := ResponseFromReader(strings.NewReader(data), "GET")
+		require.NoError(t, err, data)
+		assert.Equal(t, reusable, resp.ConnectionReusable(), data)
+	}
+
+	// Test: A tunnel opened by CONNECT isn't HTTP any more
+	resp, err := ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\n\r\n"), "CONNECT")
+	require.NoError(t, err)
+	assert.False(t, resp.ConnectionReusable())
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+)
+
+// identify sets req.Identity when the client presented a certificate that
+// verified against TLSOptions.ClientCAFile.
+func (s *Server) identify(req *request.Request) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || s.options.TLS == nil {
+		return
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	req.Identity = request.IdentityFromCertificate(cert)
+	if s.options.TLS.ClientIdentity != nil {
+		req.Identity.Name = s.options.TLS.ClientIdentity(cert)
+	}
+}
+
+// ClientCertPolicy says what a route makes of client certificates.
+type ClientCertPolicy int
+
+const (
+	// ClientCertNone ignores client certificates, the handler never sees
+	// an Identity.
+	ClientCertNone ClientCertPolicy = iota
+	// ClientCertOptional lets every client through, with the Identity of
+	// those that presented a certificate.
+	ClientCertOptional
+	// ClientCertRequire answers 403 to clients without a verified
+	// certificate.
+	ClientCertRequire
+)
+
+// ClientAuth is the client certificate policy of a route.
+type ClientAuth struct {
+	Policy ClientCertPolicy
+
+	// Allow, when not empty, lists the identity names let through, and
+	// clients with any other identity get a 403. Clients without one are
+	// still up to Policy.
+	Allow []string
+}
+
+// check returns why req is turned away, or nil.
+func (a ClientAuth) check(req *request.Request) *HandleError {
+	if a.Policy == ClientCertNone {
+		req.Identity = nil
+		return nil
+	}
+	if req.Identity == nil {
+		if a.Policy == ClientCertRequire {
+			return &HandleError{StatusCode: response.Forbidden, Message: "a client certificate is required"}
+		}
+		return nil
+	}
+	if len(a.Allow) > 0 && !slices.Contains(a.Allow, req.Identity.Name) {
+		return &HandleError{
+			StatusCode: response.Forbidden,
+			Message:    fmt.Sprintf("client %q is not allowed", req.Identity.Name),
+		}
+	}
+	return nil
+}
+
+// ClientAuthRoutes applies client certificate policies by path, for servers
+// where some routes are for other services only.
+//
+//	routes := server.NewClientAuthRoutes()
+//	routes.Add("/internal/", server.ClientAuth{Policy: server.ClientCertRequire})
+//	routes.Add("/internal/billing", server.ClientAuth{
+//		Policy: server.ClientCertRequire,
+//		Allow:  []string{"spiffe://example.com/invoicer"},
+//	})
+//	server.ServeWithOptions(port, options, routes.Wrap(handler))
+//
+// A prefix matches its own path and the paths below it, and the longest
+// matching prefix wins. Requests matching nothing go by Default, which
+// lets everyone through. Paths are compared percent-decoded and cleaned,
+// so "/a/../internal/x" and "/%69nternal/x" don't slip past "/internal/".
+type ClientAuthRoutes struct {
+	mu     sync.RWMutex
+	routes map[string]ClientAuth
+
+	Default ClientAuth
+}
+
+func NewClientAuthRoutes() *ClientAuthRoutes {
+	return &ClientAuthRoutes{
+		routes:  make(map[string]ClientAuth),
+		Default: ClientAuth{Policy: ClientCertOptional},
+	}
+}
+
+// Add sets the policy of the routes under prefix, a path such as
+// "/internal" or "/internal/".
+func (r *ClientAuthRoutes) Add(prefix string, auth ClientAuth) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[path.Clean("/"+prefix)] = auth
+}
+
+// Wrap returns a Handler putting requests through their route's policy
+// before handing them to handler.
+func (r *ClientAuthRoutes) Wrap(handler Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		auth, err := r.lookup(req.RequestLine.RequestTarget)
+		if err != nil {
+			WriteError(w, HandleError{StatusCode: response.BadRequest, Message: err.Error()})
+			return
+		}
+		if herr := auth.check(req); herr != nil {
+			WriteError(w, *herr)
+			return
+		}
+		handler(w, req)
+	}
+}
+
+func (r *ClientAuthRoutes) lookup(target string) (ClientAuth, error) {
+	// proxy requests and "OPTIONS *" aren't for any of our routes
+	if !strings.HasPrefix(target, "/") {
+		return r.Default, nil
+	}
+	u, err := url.ParseRequestURI(target)
+	if err != nil {
+		return ClientAuth{}, fmt.Errorf("invalid request target %q", target)
+	}
+	p := path.Clean(u.Path)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	best, bestLen := r.Default, -1
+	for prefix, auth := range r.routes {
+		if len(prefix) > bestLen && (p == prefix || strings.HasPrefix(p, strings.TrimSuffix(prefix, "/")+"/")) {
+			best, bestLen = auth, len(prefix)
+		}
+	}
+	return best, nil
+}
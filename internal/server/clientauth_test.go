@@ -0,0 +1,210 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA signs client certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+// writeBundle writes the CAs to a PEM file, and returns its name.
+func writeBundle(t *testing.T, name string, cas ...*testCA) string {
+	t.Helper()
+	var bundle []byte
+	for _, ca := range cas {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+	}
+	require.NoError(t, os.WriteFile(name, bundle, 0o600))
+	return name
+}
+
+// issue makes a client certificate named commonName, with uri as its SAN
+// when not empty.
+func (ca *testCA) issue(t *testing.T, commonName, uri string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if uri != "" {
+		u, err := url.Parse(uri)
+		require.NoError(t, err)
+		template.URIs = []*url.URL{u}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// identityHandler answers with who the client is.
+func identityHandler(w *response.Writer, req *request.Request) {
+	body := "anonymous"
+	if req.Identity != nil {
+		body = req.Identity.Name
+	}
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+// getAs requests target presenting cert, if any, and returns the status
+// and body of the response.
+func getAs(addr, target string, cert *tls.Certificate) (response.StatusCode, string, error) {
+	config := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return 0, "", err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: localhost\r\n\r\n", target); err != nil {
+		return 0, "", err
+	}
+	resp, err := response.ResponseFromReader(conn, "GET")
+	if err != nil {
+		return 0, "", err
+	}
+	return resp.StatusLine.StatusCode, string(resp.Body), nil
+}
+
+func TestClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	bundle := writeBundle(t, filepath.Join(dir, "ca.pem"), ca)
+	invoicer := ca.issue(t, "invoicer", "spiffe://test/invoicer")
+	reporter := ca.issue(t, "reporter", "spiffe://test/reporter")
+	stranger := newTestCA(t).issue(t, "stranger", "spiffe://test/invoicer")
+
+	routes := NewClientAuthRoutes()
+	routes.Add("/internal/", ClientAuth{Policy: ClientCertRequire})
+	routes.Add("/internal/billing", ClientAuth{Policy: ClientCertRequire, Allow: []string{"spiffe://test/invoicer"}})
+	routes.Add("/public", ClientAuth{Policy: ClientCertNone})
+	srv, err := ServeWithOptions(0, Options{TLS: &TLSOptions{SelfSigned: true, ClientCAFile: bundle}}, routes.Wrap(identityHandler))
+	require.NoError(t, err)
+	defer srv.Close()
+	addr := srv.Addr().String()
+
+	// Test: Required routes turn away clients without a certificate, and
+	// identify those with one
+	status, _, err := getAs(addr, "/internal/jobs", nil)
+	require.NoError(t, err)
+	assert.Equal(t, response.Forbidden, status)
+	status, body, err := getAs(addr, "/internal/jobs", &invoicer)
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, status)
+	assert.Equal(t, "spiffe://test/invoicer", body)
+
+	// Test: Allow lists narrow a route down to some clients
+	status, _, err = getAs(addr, "/internal/billing/invoices", &reporter)
+	require.NoError(t, err)
+	assert.Equal(t, response.Forbidden, status)
+	status, _, err = getAs(addr, "/internal/billing/invoices", &invoicer)
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, status)
+
+	// Test: Other routes are optional by default, and none hides the
+	// identity
+	for target, want := range map[string]string{"/": "spiffe://test/reporter", "/public/x": "anonymous", "/internalx": "spiffe://test/reporter"} {
+		status, body, err := getAs(addr, target, &reporter)
+		require.NoError(t, err)
+		assert.Equal(t, response.OK, status, target)
+		assert.Equal(t, want, body, target)
+	}
+	_, body, err = getAs(addr, "/", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "anonymous", body)
+
+	// Test: Paths are matched decoded and cleaned
+	for _, target := range []string{"/%69nternal/jobs", "/public/../internal/jobs", "//internal/jobs", "/internal/jobs?x=1"} {
+		status, _, err := getAs(addr, target, nil)
+		require.NoError(t, err)
+		assert.Equal(t, response.Forbidden, status, target)
+	}
+
+	// Test: Certificates from other CAs fail the handshake
+	_, _, err = getAs(addr, "/", &stranger)
+	assert.Error(t, err)
+
+	// Test: Reloading swaps the client CAs
+	other := newTestCA(t)
+	writeBundle(t, bundle, other)
+	require.NoError(t, srv.ReloadCertificates())
+	_, _, err = getAs(addr, "/", &invoicer)
+	assert.Error(t, err)
+	newcomer := other.issue(t, "newcomer", "")
+	_, body, err = getAs(addr, "/", &newcomer)
+	require.NoError(t, err)
+	assert.Equal(t, "newcomer", body)
+
+	// Test: A bundle without certificates doesn't load
+	require.NoError(t, os.WriteFile(bundle, []byte("garbage"), 0o600))
+	assert.Error(t, srv.ReloadCertificates())
+}
+
+func TestClientIdentityMapping(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	options := &TLSOptions{
+		SelfSigned:     true,
+		ClientCAFile:   writeBundle(t, filepath.Join(dir, "ca.pem"), ca),
+		ClientIdentity: func(cert *x509.Certificate) string { return "cn:" + cert.Subject.CommonName },
+	}
+	srv, err := ServeWithOptions(0, Options{TLS: options}, identityHandler)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: The server's mapping names the identity
+	cert := ca.issue(t, "invoicer", "spiffe://test/invoicer")
+	_, body, err := getAs(srv.Addr().String(), "/", &cert)
+	require.NoError(t, err)
+	assert.Equal(t, "cn:invoicer", body)
+}
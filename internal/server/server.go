@@ -1,10 +1,15 @@
 package server
 
 import (
+	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/sankalpmukim/httpfromtcp/internal/request"
 	"github.com/sankalpmukim/httpfromtcp/internal/response"
@@ -13,19 +18,112 @@ import (
 type Server struct {
 	listener net.Listener
 	handler  Handler
+	options  Options
+	// what is served when TLS is on
+	certs *certificates
+}
+
+// Options tweaks how the server treats incoming connections. The zero value
+// is what Serve uses.
+type Options struct {
+	// Strict rejects every request whose framing is ambiguous under
+	// RFC 9112 with a 400, see request.RequestFromReaderStrict. Turn this on
+	// whenever the server sits behind a proxy or load balancer.
+	Strict bool
+
+	// Methods lists the methods handed to the handler, everything else is
+	// answered with 501 Not Implemented. nil means request.StandardMethods.
+	Methods *request.MethodRegistry
+
+	// HTTP2, when set, takes over connections that speak HTTP/2: those
+	// opening with the client preface (h2c with prior knowledge), requests
+	// asking for "Upgrade: h2c", and TLS connections that negotiated "h2".
+	// Use an *http2.Server.
+	HTTP2 HTTP2Server
+
+	// TLS, when set, makes the server speak HTTPS only.
+	TLS *TLSOptions
+
+	// MaxHeaderBytes limits the request line and headers of HTTP/1
+	// requests, and their trailers, which get a 431 past it. Zero means
+	// 1 MiB.
+	MaxHeaderBytes int
+
+	// MaxBodyBytes limits the body of HTTP/1 requests, which is held in
+	// memory until the handler runs. Larger ones get a 413. Zero means
+	// 10 MiB.
+	MaxBodyBytes int64
+
+	// StreamBody, if set, is asked about every HTTP/1 request once its
+	// headers are in. For those it says yes to, the handler runs right
+	// away and reads the body from req.BodyReader, so it can pass it on
+	// without holding all of it. MaxBodyBytes applies all the same, the
+	// reader fails past it.
+	StreamBody func(req *request.Request) bool
+}
+
+const (
+	defaultMaxHeaderBytes = 1 << 20
+	defaultMaxBodyBytes   = 10 << 20
+)
+
+// HTTP2Server serves a connection that has switched to HTTP/2, handing its
+// streams to handler, until the connection is done. upgrade is the request
+// that asked for "Upgrade: h2c", answered with 101 already, or nil.
+type HTTP2Server interface {
+	ServeConn(conn net.Conn, handler Handler, upgrade *request.Request)
 }
 
 func Serve(port int, handler Handler) (*Server, error) {
+	return ServeWithOptions(port, Options{}, handler)
+}
+
+func ServeWithOptions(port int, options Options, handler Handler) (*Server, error) {
+	if options.Methods == nil {
+		methods, err := request.NewMethodRegistry()
+		if err != nil {
+			return nil, err
+		}
+		options.Methods = methods
+	}
+	if options.MaxHeaderBytes == 0 {
+		options.MaxHeaderBytes = defaultMaxHeaderBytes
+	}
+	if options.MaxBodyBytes == 0 {
+		options.MaxBodyBytes = defaultMaxBodyBytes
+	}
+
+	var certs *certificates
+	if options.TLS != nil {
+		certs = &certificates{
+			files:        options.TLS.Certificates,
+			selfSigned:   options.TLS.SelfSigned,
+			clientCAFile: options.TLS.ClientCAFile,
+		}
+		if err := certs.load(); err != nil {
+			return nil, err
+		}
+	}
+
 	netListener, err := net.Listen("tcp", ":"+fmt.Sprint(port))
 	if err != nil {
 		return nil, err
 	}
-	serverInstance := Server{listener: netListener, handler: handler}
+	if certs != nil {
+		netListener = tls.NewListener(netListener, newTLSConfig(options.TLS, certs, options.HTTP2 != nil))
+	}
+	serverInstance := Server{listener: netListener, handler: handler, options: options, certs: certs}
 	go serverInstance.listen()
 
 	return &serverInstance, nil
 }
 
+// Addr is the address the server listens on, handy when it was started on
+// port 0.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
 func (s *Server) Close() error {
 	fmt.Println("Server Close() called")
 	return s.listener.Close()
@@ -50,17 +148,226 @@ func (s *Server) listen() error {
 }
 
 func (s *Server) handle(conn net.Conn) {
-	request, err := request.RequestFromReader(conn)
+	hijacked := false
+	defer func() {
+		// a handler that hijacked the connection owns it now
+		if !hijacked {
+			conn.Close()
+		}
+	}()
+
+	var reader io.Reader = conn
+	if s.options.HTTP2 != nil {
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+				s.options.HTTP2.ServeConn(conn, s.checkedHandler, nil)
+				return
+			}
+		}
+
+		// h2c with prior knowledge starts with the preface where a
+		// request line would be
+		peeked, isPreface, err := sniffPreface(conn)
+		reader = io.MultiReader(bytes.NewReader(peeked), conn)
+		if isPreface {
+			s.options.HTTP2.ServeConn(&prefixedConn{Conn: conn, r: reader}, s.checkedHandler, nil)
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	// rest is whatever the client sent after the request, it goes to the
+	// handler should it hijack the connection
+	req, rest, err := request.ReadRequest(reader, request.ReadOptions{
+		Strict:         s.options.Strict,
+		MaxHeaderBytes: s.options.MaxHeaderBytes,
+		MaxBodyBytes:   int(s.options.MaxBodyBytes),
+		StreamBody:     s.options.StreamBody,
+	})
+	if status, ok := readErrorStatus(err); ok {
+		HandleWritingError(conn, HandleError{StatusCode: status, Message: err.Error()})
+		lingerClose(conn)
+		return
+	}
 	if err != nil {
 		fmt.Println("Error in RequestFromReader", err)
+		// the framing can't be trusted, so nothing after this point on the
+		// connection is either. answer and hang up.
+		HandleWritingError(conn, HandleError{StatusCode: response.BadRequest, Message: err.Error()})
+		lingerClose(conn)
+		return
+	}
+
+	req.RemoteAddr = conn.RemoteAddr().String()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+	s.identify(req)
+
+	if herr := s.check(req); herr != nil {
+		HandleWritingError(conn, *herr)
+		lingerClose(conn)
+		return
+	}
+
+	// the response to an "Upgrade: h2c" request goes out over HTTP/2, as
+	// stream 1. h2c is cleartext only, over TLS it takes ALPN to get h2,
+	// and a body left on the connection would be in the way.
+	if s.options.HTTP2 != nil && req.TLS == nil && req.BodyReader == nil && isH2CUpgrade(req) {
+		response.WriteStatusLine(conn, response.SwitchingProtocols)
+		response.WriteHeaders(conn, map[string]string{"connection": "Upgrade", "upgrade": "h2c"})
+		s.options.HTTP2.ServeConn(&prefixedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(rest), conn)}, s.checkedHandler, req)
+		return
+	}
+
+	responseWriter := response.NewConnResponseWriter(conn, rest)
+	responseWriter.SetProtocolVersion(req.RequestLine.HttpVersionMajor, req.RequestLine.HttpVersionMinor)
+	if req.RequestLine.Method == request.MethodOptions && req.RequestLine.RequestTarget == "*" {
+		s.writeServerOptions(&responseWriter)
+		return
+	}
+	s.handler(&responseWriter, req)
+	hijacked = responseWriter.Hijacked()
+	if !hijacked && req.BodyReader != nil {
+		// the handler may have left some of the body unread
+		lingerClose(conn)
+	}
+}
+
+// readErrorStatus picks the answer for the errors of reading a request
+// that say more than 400 Bad Request.
+func readErrorStatus(err error) (response.StatusCode, bool) {
+	switch {
+	case errors.Is(err, request.ErrVersionNotSupported):
+		return response.HTTPVersionNotSupported, true
+	case errors.Is(err, request.ErrHeaderTooLarge):
+		return response.RequestHeaderFieldsTooLarge, true
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return response.ContentTooLarge, true
+	}
+	return 0, false
+}
+
+// check puts a request through what every request has to pass before it
+// reaches the handler.
+func (s *Server) check(req *request.Request) *HandleError {
+	if !s.options.Methods.Known(req.RequestLine.Method) {
+		return &HandleError{
+			StatusCode: response.NotImplemented,
+			Message:    fmt.Sprintf("method %s is not implemented", req.RequestLine.Method),
+		}
+	}
+	if err := req.ValidateHost(); err != nil {
+		return &HandleError{StatusCode: response.BadRequest, Message: err.Error()}
+	}
+	return nil
+}
+
+// checkedHandler is the handler HTTP/2 streams go to, with the checks and
+// the "OPTIONS *" answer HTTP/1 requests get in handle.
+func (s *Server) checkedHandler(w *response.Writer, req *request.Request) {
+	s.identify(req)
+	if herr := s.check(req); herr != nil {
+		WriteError(w, *herr)
+		return
+	}
+	if req.RequestLine.Method == request.MethodOptions && req.RequestLine.RequestTarget == "*" {
+		s.writeServerOptions(w)
+		return
+	}
+	s.handler(w, req)
+}
+
+// the HTTP/2 client preface, RFC 9113 section 3.4
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// sniffPreface reads from conn for as long as what came in could still be
+// the HTTP/2 client preface. Anything else is an HTTP/1 request, to be
+// read from peeked and then the connection.
+func sniffPreface(conn net.Conn) (peeked []byte, isPreface bool, err error) {
+	buf := make([]byte, 0, len(http2Preface))
+	for len(buf) < len(http2Preface) {
+		n, err := conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if !strings.HasPrefix(http2Preface, string(buf)) {
+			return buf, false, nil
+		}
+		if err != nil {
+			return buf, false, err
+		}
+	}
+	return buf, true, nil
+}
+
+// isH2CUpgrade reports whether an HTTP/1.1 request asks to switch to
+// HTTP/2, RFC 7540 section 3.2. That takes "Upgrade: h2c" along with
+// exactly one HTTP2-Settings, both named in Connection.
+func isH2CUpgrade(req *request.Request) bool {
+	if !req.RequestLine.ProtoAtLeast(1, 1) || req.RequestLine.HttpVersionMajor != 1 {
+		return false
+	}
+	settings, ok := req.Headers["http2-settings"]
+	if !ok || strings.Contains(settings, ",") {
+		return false
 	}
+	return hasToken(req.Headers.Get("upgrade"), "h2c") &&
+		hasToken(req.Headers.Get("connection"), "upgrade") &&
+		hasToken(req.Headers.Get("connection"), "http2-settings")
+}
+
+func hasToken(list, token string) bool {
+	for item := range strings.SplitSeq(list, ",") {
+		if strings.EqualFold(strings.TrimSpace(item), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixedConn is a connection whose first bytes were read already, and
+// are read again from r before the rest.
+type prefixedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
 
-	responseWriter := response.NewResponseWriter(conn)
-	s.handler(&responseWriter, request)
+// writeServerOptions answers "OPTIONS *", which asks about the server as a
+// whole rather than any resource, so it never reaches the handler.
+func (s *Server) writeServerOptions(w *response.Writer) {
+	h := response.GetDefaultHeaders(0)
+	h["allow"] = strings.Join(s.options.Methods.List(), ", ")
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(h)
+}
 
-	conn.Close()
+// closing a socket with unread input makes the kernel send a RST, which can
+// make the client drop the error response we just wrote. so stop writing,
+// drain whatever is still coming for a moment, then close.
+func lingerClose(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(lingerTimeout))
+	io.CopyN(io.Discard, conn, lingerMaxBytes)
 }
 
+const (
+	lingerTimeout  = 500 * time.Millisecond
+	lingerMaxBytes = 256 * 1024
+)
+
+// HandleWritingError writes err straight to w. It is for raw connections,
+// before there is a response.Writer; handlers use WriteError.
 func HandleWritingError(w io.Writer, err HandleError) error {
 	response.WriteStatusLine(w, err.StatusCode)
 	outgoingMessage := fmt.Sprintf("An error occurred: %s", err.Message)
@@ -70,6 +377,20 @@ func HandleWritingError(w io.Writer, err HandleError) error {
 	return erro
 }
 
+// WriteError is HandleWritingError for handlers: it goes through w, so the
+// writer keeps track of what was sent and answers HTTP/1.0 clients as such.
+func WriteError(w *response.Writer, herr HandleError) error {
+	outgoingMessage := fmt.Sprintf("An error occurred: %s", herr.Message)
+	if err := w.WriteStatusLine(herr.StatusCode); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(response.GetDefaultHeaders(len(outgoingMessage))); err != nil {
+		return err
+	}
+	_, err := w.WriteBody([]byte(outgoingMessage))
+	return err
+}
+
 type HandleError struct {
 	StatusCode response.StatusCode
 	Message    string
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// roundTrip sends raw to the server on a new connection and reads back the
+// response.
+func roundTrip(t *testing.T, srv *Server, raw, method string) *response.Response {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, raw)
+	require.NoError(t, err)
+	resp, err := response.ResponseFromReader(conn, method)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestMethods(t *testing.T) {
+	methods, err := request.NewMethodRegistry(request.WebDAVMethods...)
+	require.NoError(t, err)
+	handled := make(chan string, 1)
+	srv, err := ServeWithOptions(0, Options{Methods: methods}, func(w *response.Writer, req *request.Request) {
+		handled <- req.RequestLine.Method
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: Methods nobody registered are a 501, without the handler
+	resp := roundTrip(t, srv, "BREW /pot HTTP/1.1\r\nHost: localhost\r\n\r\n", "BREW")
+	assert.Equal(t, response.NotImplemented, resp.StatusLine.StatusCode)
+	assert.Contains(t, string(resp.Body), "BREW")
+	assert.Empty(t, handled)
+
+	// Test: Registered ones reach the handler
+	resp = roundTrip(t, srv, "PROPFIND /file HTTP/1.1\r\nHost: localhost\r\n\r\n", "PROPFIND")
+	assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "PROPFIND", <-handled)
+
+	// Test: "OPTIONS *" is answered by the server, with every method it takes
+	resp = roundTrip(t, srv, "OPTIONS * HTTP/1.1\r\nHost: localhost\r\n\r\n", "OPTIONS")
+	assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+	assert.Equal(t, strings.Join(methods.List(), ", "), resp.Headers.Get("allow"))
+	assert.Contains(t, resp.Headers.Get("allow"), "PROPFIND")
+	assert.Empty(t, handled)
+
+	// Test: OPTIONS for a path is the handler's business
+	roundTrip(t, srv, "OPTIONS /file HTTP/1.1\r\nHost: localhost\r\n\r\n", "OPTIONS")
+	assert.Equal(t, "OPTIONS", <-handled)
+}
+
+func TestRequestLimits(t *testing.T) {
+	handled := make(chan string, 1)
+	srv, err := ServeWithOptions(0, Options{MaxHeaderBytes: 256, MaxBodyBytes: 16}, func(w *response.Writer, req *request.Request) {
+		handled <- string(req.Body)
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: Oversized headers are a 431, without the handler
+	resp := roundTrip(t, srv, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Big: "+strings.Repeat("a", 300)+"\r\n\r\n", "GET")
+	assert.Equal(t, response.RequestHeaderFieldsTooLarge, resp.StatusLine.StatusCode)
+
+	// Test: Oversized bodies are a 413
+	resp = roundTrip(t, srv, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 17\r\n\r\n"+strings.Repeat("a", 17), "POST")
+	assert.Equal(t, response.ContentTooLarge, resp.StatusLine.StatusCode)
+	assert.Empty(t, handled)
+
+	// Test: Within the limits the handler gets the request
+	resp = roundTrip(t, srv, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 16\r\n\r\n"+strings.Repeat("a", 16), "POST")
+	assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+	assert.Equal(t, strings.Repeat("a", 16), <-handled)
+}
+
+func TestStreamBody(t *testing.T) {
+	firstPart := make(chan string, 1)
+	srv, err := ServeWithOptions(0, Options{
+		MaxBodyBytes: 32,
+		StreamBody:   func(req *request.Request) bool { return req.RequestLine.RequestTarget == "/stream" },
+	}, func(w *response.Writer, req *request.Request) {
+		buf := make([]byte, 6)
+		_, err := io.ReadFull(req.BodyReader, buf)
+		if err != nil {
+			WriteError(w, HandleError{StatusCode: response.BadRequest, Message: err.Error()})
+			return
+		}
+		firstPart <- string(buf)
+		rest, err := io.ReadAll(req.BodyReader)
+		if err != nil {
+			WriteError(w, HandleError{StatusCode: response.ContentTooLarge, Message: err.Error()})
+			return
+		}
+		body := string(buf) + string(rest)
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: The handler reads the body as it comes in
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "POST /stream HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n6\r\nhello \r\n")
+	require.NoError(t, err)
+	select {
+	case got := <-firstPart:
+		assert.Equal(t, "hello ", got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler didn't get the start of the body")
+	}
+	_, err = io.WriteString(conn, "5\r\nworld\r\n0\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := response.ResponseFromReader(conn, "POST")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(resp.Body))
+
+	// Test: MaxBodyBytes still applies
+	resp = roundTrip(t, srv, "POST /stream HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n6\r\nhello \r\n40\r\n"+strings.Repeat("a", 64)+"\r\n0\r\n\r\n", "POST")
+	assert.Equal(t, response.ContentTooLarge, resp.StatusLine.StatusCode)
+}
+
+func TestHijack(t *testing.T) {
+	handlerErrors := make(chan error, 2)
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.SwitchingProtocols)
+		w.WriteHeaders(map[string]string{"upgrade": "echo", "connection": "upgrade"})
+		conn, rw, err := w.Hijack()
+		if err != nil {
+			handlerErrors <- err
+			return
+		}
+		_, err = w.WriteBody([]byte("too late"))
+		handlerErrors <- err
+		_, _, err = w.Hijack()
+		handlerErrors <- err
+
+		// keep going after the handler has returned, the server must not
+		// close the connection under us
+		go func() {
+			defer conn.Close()
+			for {
+				line, err := rw.ReadString('\n')
+				if err != nil {
+					return
+				}
+				rw.WriteString("echo: " + line)
+				rw.Flush()
+			}
+		}()
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: Bytes sent right behind the request reach the hijacker
+	_, err = io.WriteString(conn, "GET /echo HTTP/1.1\r\nHost: localhost\r\nUpgrade: echo\r\nConnection: upgrade\r\n\r\nearly bird\n")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := response.ReadResponse(br, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, response.SwitchingProtocols, resp.StatusLine.StatusCode)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "echo: early bird\n", line)
+
+	// Test: The writer is done with once hijacked
+	assert.ErrorIs(t, <-handlerErrors, response.ErrHijacked)
+	assert.ErrorIs(t, <-handlerErrors, response.ErrNotHijackable)
+
+	// Test: The connection outlives the handler
+	time.Sleep(50 * time.Millisecond)
+	_, err = io.WriteString(conn, "still there?\n")
+	require.NoError(t, err)
+	line, err = br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "echo: still there?\n", line)
+}
+
+func TestClientGone(t *testing.T) {
+	result := make(chan error, 1)
+	srv, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		gone := w.ClientGone()
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(map[string]string{"transfer-encoding": "chunked"})
+		w.WriteChunkedBody([]byte("waiting"))
+		select {
+		case <-gone:
+			_, _, err := w.Hijack()
+			result <- err
+		case <-time.After(5 * time.Second):
+			result <- nil
+		}
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: The handler hears about the client hanging up
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := response.ReadResponse(bufio.NewReader(conn), "GET")
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+	conn.Close()
+
+	// Test: and can't hijack a watched connection
+	assert.ErrorIs(t, <-result, response.ErrNotHijackable)
+}
+
+// fakeHTTP2 reports the connections handed to it, and what they start with.
+type fakeHTTP2 struct {
+	got chan string
+}
+
+func (f *fakeHTTP2) ServeConn(conn net.Conn, handler Handler, upgrade *request.Request) {
+	defer conn.Close()
+	buf := make([]byte, len(http2Preface))
+	n, _ := io.ReadFull(conn, buf)
+	f.got <- string(buf[:n])
+}
+
+func TestHTTP2Dispatch(t *testing.T) {
+	h2 := &fakeHTTP2{got: make(chan string, 1)}
+	srv, err := ServeWithOptions(0, Options{HTTP2: h2}, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: A connection opening with the preface goes to HTTP2, which
+	// reads it again, however it was split up
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, http2Preface[:3])
+	time.Sleep(10 * time.Millisecond)
+	io.WriteString(conn, http2Preface[3:])
+	select {
+	case got := <-h2.got:
+		assert.Equal(t, http2Preface, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't handed over")
+	}
+
+	// Test: HTTP/1.1 requests, even ones starting like the preface, don't
+	conn, err = net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := response.ResponseFromReader(conn, "POST")
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+}
+
+func TestALPN(t *testing.T) {
+	h2 := &fakeHTTP2{got: make(chan string, 1)}
+	s := &Server{handler: func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}, options: Options{HTTP2: h2}}
+	s.options.Methods, _ = request.NewMethodRegistry()
+	cert, err := SelfSignedCertificate("localhost")
+	require.NoError(t, err)
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	for _, proto := range []string{"h2", "http/1.1"} {
+		go func() {
+			if conn, err := ln.Accept(); err == nil {
+				s.handle(tls.Server(conn, config))
+			}
+		}()
+		client, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{proto}})
+		require.NoError(t, err)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+
+		if proto == "h2" {
+			// Test: Connections that negotiated h2 go to HTTP2 right away
+			_, err = io.WriteString(client, http2Preface)
+			require.NoError(t, err)
+			assert.Equal(t, http2Preface, <-h2.got)
+		} else {
+			// Test: The rest are served as HTTP/1.1, h2c upgrades are
+			// cleartext only
+			_, err = io.WriteString(client, "GET / HTTP/1.1\r\nHost: localhost\r\n"+
+				"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n")
+			require.NoError(t, err)
+			resp, err := response.ResponseFromReader(client, "GET")
+			require.NoError(t, err)
+			assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSOptions turns on HTTPS. Certificates are loaded when the server starts
+// and again on ReloadCertificates, so they can be renewed without a
+// restart.
+type TLSOptions struct {
+	// Certificates are the certificate and key files served, PEM encoded.
+	// Clients get the first one that fits the name they ask for with SNI,
+	// or the first one if none does.
+	Certificates []CertificateFiles
+
+	// SelfSigned makes up a certificate for localhost at startup, for
+	// development, when no Certificates are given. Browsers and curl
+	// don't trust it unless told to (curl -k).
+	SelfSigned bool
+
+	// MinVersion is the oldest TLS version accepted, tls.VersionTLS12 if
+	// zero.
+	MinVersion uint16
+
+	// CipherSuites limits the cipher suites of TLS 1.2 and older, nil
+	// means Go's defaults. Those of TLS 1.3 can't be configured.
+	CipherSuites []uint16
+
+	// ClientCAFile is a PEM bundle of the CAs client certificates are
+	// verified against, for mutual TLS. Setting it makes the server ask
+	// clients for a certificate, and fail handshakes presenting one that
+	// doesn't verify. Whether a route needs one at all is up to
+	// ClientAuthRoutes. Reloaded along with the Certificates.
+	ClientCAFile string
+
+	// ClientIdentity maps a verified client certificate to the Name of
+	// request.Identity, nil means request.IdentityFromCertificate's.
+	ClientIdentity func(cert *x509.Certificate) string
+}
+
+// CertificateFiles names a PEM encoded certificate chain and its key.
+type CertificateFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+// certificates holds what is being served, swapped whole on reload.
+type certificates struct {
+	files        []CertificateFiles
+	selfSigned   bool
+	clientCAFile string
+
+	mu        sync.RWMutex
+	certs     []tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func (c *certificates) load() error {
+	var certs []tls.Certificate
+	for _, f := range c.files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return fmt.Errorf("loading %s: %w", f.CertFile, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		if !c.selfSigned {
+			return errors.New("TLS needs certificates, or SelfSigned")
+		}
+		cert, err := SelfSignedCertificate("localhost", "127.0.0.1", "::1")
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	var clientCAs *x509.CertPool
+	if c.clientCAFile != "" {
+		bundle, err := os.ReadFile(c.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("loading client CAs: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(bundle) {
+			return fmt.Errorf("loading client CAs: no certificates in %s", c.clientCAFile)
+		}
+	}
+
+	c.mu.Lock()
+	c.certs = certs
+	c.clientCAs = clientCAs
+	c.mu.Unlock()
+	return nil
+}
+
+// getCertificate picks a certificate by SNI, the way crypto/tls does from
+// tls.Config.Certificates, which can't be changed once serving.
+func (c *certificates) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for i := range c.certs {
+		if hello.SupportsCertificate(&c.certs[i]) == nil {
+			return &c.certs[i], nil
+		}
+	}
+	return &c.certs[0], nil
+}
+
+// configForClient hands every handshake the client CAs loaded last, which
+// tls.Config.ClientCAs can't be swapped for once serving either.
+func (c *certificates) configForClient(config *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		clone := config.Clone()
+		clone.ClientCAs = c.clientCAs
+		return clone, nil
+	}
+}
+
+// newTLSConfig builds the config the listener serves with. h2 is offered
+// over ALPN when the server speaks HTTP/2.
+func newTLSConfig(options *TLSOptions, certs *certificates, http2 bool) *tls.Config {
+	config := &tls.Config{
+		GetCertificate: certs.getCertificate,
+		MinVersion:     options.MinVersion,
+		CipherSuites:   options.CipherSuites,
+		NextProtos:     []string{"http/1.1"},
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	if http2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	if options.ClientCAFile != "" {
+		// routes not needing a certificate take clients without one
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		config.GetConfigForClient = certs.configForClient(config.Clone())
+	}
+	return config
+}
+
+// ReloadCertificates reads the certificate files and the client CA bundle
+// again, for renewed certificates to take effect without a restart. New
+// connections get the new ones, and if any file fails to load the old ones
+// stay.
+func (s *Server) ReloadCertificates() error {
+	if s.certs == nil {
+		return errors.New("server isn't serving TLS")
+	}
+	return s.certs.load()
+}
+
+// SelfSignedCertificate makes a certificate for hosts, names or IP
+// addresses, signed by its own key. It is valid for a year, and only good
+// for development and tests.
+func SelfSignedCertificate(hosts ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"httpfromtcp development"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
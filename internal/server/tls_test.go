@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCertificate writes a self-signed certificate for hosts to PEM files
+// in dir, named after the first host.
+func writeCertificate(t *testing.T, dir string, hosts ...string) CertificateFiles {
+	t.Helper()
+	cert, err := SelfSignedCertificate(hosts...)
+	require.NoError(t, err)
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	files := CertificateFiles{CertFile: filepath.Join(dir, hosts[0]+".crt"), KeyFile: filepath.Join(dir, hosts[0]+".key")}
+	require.NoError(t, os.WriteFile(files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600))
+	require.NoError(t, os.WriteFile(files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600))
+	return files
+}
+
+// tlsStateHandler answers with what the request knows of its connection.
+func tlsStateHandler(w *response.Writer, req *request.Request) {
+	body := "plain"
+	if req.TLS != nil {
+		body = fmt.Sprintf("%s %s %s", tls.VersionName(req.TLS.Version), req.TLS.ServerName, req.TLS.NegotiatedProtocol)
+	}
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+// get makes a request over a new TLS connection, and returns the body and
+// the certificate the server presented.
+func get(t *testing.T, addr string, config *tls.Config) (string, *x509.Certificate) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, config)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", config.ServerName)
+	require.NoError(t, err)
+	resp, err := response.ResponseFromReader(conn, "GET")
+	require.NoError(t, err)
+	return string(resp.Body), conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	a := writeCertificate(t, dir, "a.test")
+	b := writeCertificate(t, dir, "b.test", "*.b.test")
+	srv, err := ServeWithOptions(0, Options{TLS: &TLSOptions{Certificates: []CertificateFiles{a, b}}}, tlsStateHandler)
+	require.NoError(t, err)
+	defer srv.Close()
+	addr := srv.Addr().String()
+
+	// Test: The handler sees the TLS state
+	body, cert := get(t, addr, &tls.Config{ServerName: "a.test", InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	assert.Equal(t, "TLS 1.3 a.test http/1.1", body)
+	assert.Equal(t, []string{"a.test"}, cert.DNSNames)
+
+	// Test: The certificate is picked by SNI, wildcards included, with
+	// the first one for names nobody has
+	for name, want := range map[string]string{"b.test": "b.test", "www.b.test": "b.test", "c.test": "a.test", "": "a.test"} {
+		_, cert := get(t, addr, &tls.Config{ServerName: name, InsecureSkipVerify: true})
+		assert.Equal(t, want, cert.DNSNames[0], name)
+	}
+
+	// Test: Reloading picks up renewed certificates
+	_, before := get(t, addr, &tls.Config{ServerName: "a.test", InsecureSkipVerify: true})
+	writeCertificate(t, dir, "a.test")
+	require.NoError(t, srv.ReloadCertificates())
+	_, after := get(t, addr, &tls.Config{ServerName: "a.test", InsecureSkipVerify: true})
+	assert.NotEqual(t, before.SerialNumber, after.SerialNumber)
+
+	// Test: A reload that fails keeps what was served
+	require.NoError(t, os.WriteFile(a.KeyFile, []byte("garbage"), 0o600))
+	assert.Error(t, srv.ReloadCertificates())
+	_, still := get(t, addr, &tls.Config{ServerName: "a.test", InsecureSkipVerify: true})
+	assert.Equal(t, after.SerialNumber, still.SerialNumber)
+}
+
+func TestTLSVersions(t *testing.T) {
+	srv, err := ServeWithOptions(0, Options{TLS: &TLSOptions{SelfSigned: true, MinVersion: tls.VersionTLS13}}, tlsStateHandler)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: Versions under the minimum are turned away
+	_, err = tls.Dial("tcp", srv.Addr().String(), &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	assert.Error(t, err)
+
+	// Test: TLS 1.2 by default, with the cipher suites asked for
+	suite := tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	srv, err = ServeWithOptions(0, Options{TLS: &TLSOptions{SelfSigned: true, CipherSuites: []uint16{suite}}}, tlsStateHandler)
+	require.NoError(t, err)
+	defer srv.Close()
+	conn, err := tls.Dial("tcp", srv.Addr().String(), &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	require.NoError(t, err)
+	assert.Equal(t, suite, conn.ConnectionState().CipherSuite)
+	conn.Close()
+	_, err = tls.Dial("tcp", srv.Addr().String(), &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11})
+	assert.Error(t, err)
+}
+
+func TestSelfSigned(t *testing.T) {
+	srv, err := ServeWithOptions(0, Options{TLS: &TLSOptions{SelfSigned: true}}, tlsStateHandler)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: Dev mode serves a certificate made up for localhost
+	_, cert := get(t, srv.Addr().String(), &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+	assert.Equal(t, []string{"localhost"}, cert.DNSNames)
+	assert.Len(t, cert.IPAddresses, 2)
+
+	// Test: TLS without any certificate doesn't start
+	_, err = ServeWithOptions(0, Options{TLS: &TLSOptions{}}, tlsStateHandler)
+	assert.Error(t, err)
+
+	// Test: Plain servers have nothing to reload
+	plain, err := Serve(0, tlsStateHandler)
+	require.NoError(t, err)
+	defer plain.Close()
+	assert.Error(t, plain.ReloadCertificates())
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+)
+
+// VirtualHosts dispatches requests to different handlers based on the
+// hostname in the Host header, so several sites can share one listener.
+//
+//	vhosts := server.NewVirtualHosts()
+//	vhosts.Add("example.com", siteHandler)
+//	vhosts.Add("*.example.com", tenantHandler)
+//	server.Serve(port, vhosts.Handle)
+//
+// Exact names win over wildcards, and among wildcards the longest suffix
+// wins. Requests matching nothing go to Default, or get a 404.
+type VirtualHosts struct {
+	mu        sync.RWMutex
+	exact     map[string]Handler
+	wildcards map[string]Handler // keyed by suffix, including the leading dot
+
+	Default Handler
+}
+
+func NewVirtualHosts() *VirtualHosts {
+	return &VirtualHosts{
+		exact:     make(map[string]Handler),
+		wildcards: make(map[string]Handler),
+	}
+}
+
+// Add registers handler for pattern, which is either a hostname or
+// "*.<hostname>" to match every subdomain (at any depth) of hostname.
+func (v *VirtualHosts) Add(pattern string, handler Handler) error {
+	wildcard := false
+	if after, ok := strings.CutPrefix(pattern, "*."); ok {
+		wildcard = true
+		pattern = after
+	}
+	host, port, err := request.ParseHost(pattern)
+	if err != nil {
+		return err
+	}
+	if port != "" {
+		return fmt.Errorf("virtual host %q must not have a port", pattern)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if wildcard {
+		v.wildcards["."+host] = handler
+	} else {
+		v.exact[host] = handler
+	}
+	return nil
+}
+
+// Handle is a Handler that passes the request on to the matching site.
+// It relies on the server having run request.ValidateHost already.
+func (v *VirtualHosts) Handle(w *response.Writer, req *request.Request) {
+	handler := v.lookup(req.Host)
+	if handler == nil {
+		WriteError(w, HandleError{
+			StatusCode: response.NotFound,
+			Message:    fmt.Sprintf("no site configured for host %q", req.Host),
+		})
+		return
+	}
+	handler(w, req)
+}
+
+func (v *VirtualHosts) lookup(host string) Handler {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	if handler, ok := v.exact[host]; ok {
+		return handler
+	}
+	var best Handler
+	bestLen := 0
+	for suffix, handler := range v.wildcards {
+		if strings.HasSuffix(host, suffix) && len(suffix) > bestLen {
+			best = handler
+			bestLen = len(suffix)
+		}
+	}
+	if best != nil {
+		return best
+	}
+	return v.Default
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVirtualHosts(t *testing.T) {
+	served := ""
+	site := func(name string) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			served = name
+		}
+	}
+
+	vhosts := NewVirtualHosts()
+	require.NoError(t, vhosts.Add("example.com", site("apex")))
+	require.NoError(t, vhosts.Add("*.example.com", site("wildcard")))
+	require.NoError(t, vhosts.Add("*.api.example.com", site("api")))
+	require.NoError(t, vhosts.Add("Other.Test", site("other")))
+	require.Error(t, vhosts.Add("example.com:80", site("port")))
+	require.Error(t, vhosts.Add("bad host", site("bad")))
+
+	for host, want := range map[string]string{
+		"example.com":          "apex",
+		"www.example.com":      "wildcard",
+		"a.b.example.com":      "wildcard",
+		"v1.api.example.com":   "api",
+		"other.test":           "other",
+		"notexample.com":       "",
+		"example.com.evil.net": "",
+	} {
+		served = ""
+		var buf bytes.Buffer
+		w := response.NewResponseWriter(&buf)
+		vhosts.Handle(&w, &request.Request{Host: host})
+		assert.Equal(t, want, served, host)
+		if want == "" {
+			assert.Contains(t, buf.String(), "404", host)
+		}
+	}
+
+	// Test: The 404 goes through the writer, answering HTTP/1.0 as such
+	var buf10 bytes.Buffer
+	w10 := response.NewResponseWriter(&buf10)
+	w10.SetProtocolVersion(1, 0)
+	vhosts.Handle(&w10, &request.Request{Host: "unknown.test"})
+	assert.True(t, strings.HasPrefix(buf10.String(), "HTTP/1.0 404 Not Found\r\n"), buf10.String())
+	assert.Error(t, w10.WriteStatusLine(response.OK), "the status line is out already")
+
+	// Test: Default catches everything else
+	vhosts.Default = site("default")
+	var buf bytes.Buffer
+	w := response.NewResponseWriter(&buf)
+	vhosts.Handle(&w, &request.Request{Host: "unknown.test"})
+	assert.Equal(t, "default", served)
+}
+
+func TestVirtualHostsAbsoluteForm(t *testing.T) {
+	vhosts := NewVirtualHosts()
+	site := func(name string) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			w.WriteStatusLine(response.OK)
+			w.WriteHeaders(response.GetDefaultHeaders(len(name)))
+			w.WriteBody([]byte(name))
+		}
+	}
+	require.NoError(t, vhosts.Add("static.localhost", site("static")))
+	vhosts.Default = site("default")
+	srv, err := Serve(0, vhosts.Handle)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: What curl -x sends, the site comes from the target
+	resp := roundTrip(t, srv, "GET http://static.localhost/ HTTP/1.1\r\nHost: localhost\r\n\r\n", "GET")
+	assert.Equal(t, response.OK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "static", string(resp.Body))
+}
@@ -0,0 +1,144 @@
+package sse
+
+import (
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+)
+
+// Broker fans events out to every client connected to its handler, and
+// keeps the latest ones so a client that reconnects with Last-Event-ID gets
+// the events it missed in between.
+//
+// The zero value is ready to use.
+type Broker struct {
+	// ReplaySize is how many events are kept for replay. Zero means 100.
+	ReplaySize int
+	// Options for every client's stream.
+	Options Options
+	// ErrorLog gets the errors met while starting streams. nil means the
+	// log package's standard logger.
+	ErrorLog *log.Logger
+
+	mu          sync.Mutex
+	nextID      uint64
+	history     []Event
+	subscribers map[chan Event]struct{}
+}
+
+// events a subscriber can fall behind by before it is dropped. It then
+// reconnects and catches up from the replay buffer.
+const subscriberBuffer = 64
+
+func (b *Broker) replaySize() int {
+	if b.ReplaySize > 0 {
+		return b.ReplaySize
+	}
+	return 100
+}
+
+// Publish sends e to every connected client. Events get increasing IDs,
+// set by Publish; an ID already in e is overwritten.
+func (b *Broker) Publish(e Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	e.ID = strconv.FormatUint(b.nextID, 10)
+	b.history = append(b.history, e)
+	if over := len(b.history) - b.replaySize(); over > 0 {
+		b.history = append(b.history[:0], b.history[over:]...)
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// too slow, let it catch up by reconnecting
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+	return e
+}
+
+// subscribe registers a new client, and returns the events after
+// lastEventID that it missed. When lastEventID is too old to be in the
+// history, that's all of it.
+func (b *Broker) subscribe(lastEventID string) (chan Event, []Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan Event, subscriberBuffer)
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan Event]struct{})
+	}
+	b.subscribers[ch] = struct{}{}
+
+	if lastEventID == "" {
+		return ch, nil
+	}
+	last, err := strconv.ParseUint(lastEventID, 10, 64)
+	if err != nil {
+		return ch, nil
+	}
+	var missed []Event
+	for _, e := range b.history {
+		if id, _ := strconv.ParseUint(e.ID, 10, 64); id > last {
+			missed = append(missed, e)
+		}
+	}
+	return ch, missed
+}
+
+func (b *Broker) unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Clients is the number of clients connected.
+func (b *Broker) Clients() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers)
+}
+
+// Handle is a server.Handler streaming the broker's events to the client
+// until it goes away.
+func (b *Broker) Handle(w *response.Writer, req *request.Request) {
+	ch, missed := b.subscribe(req.Headers.Get("last-event-id"))
+	defer b.unsubscribe(ch)
+
+	stream, err := NewStream(w, req, b.Options)
+	if err != nil {
+		errorLog := b.ErrorLog
+		if errorLog == nil {
+			errorLog = log.Default()
+		}
+		errorLog.Printf("Error starting event stream: %v", err)
+		return
+	}
+	for _, e := range missed {
+		if err := stream.Send(e); err != nil {
+			return
+		}
+	}
+	for {
+		select {
+		case <-stream.Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				stream.Close()
+				return
+			}
+			if err := stream.Send(e); err != nil {
+				return
+			}
+		}
+	}
+}
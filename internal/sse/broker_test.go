@@ -0,0 +1,91 @@
+package sse
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitForClients waits until n clients are subscribed to b.
+func waitForClients(t *testing.T, b *Broker, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool { return b.Clients() == n }, 2*time.Second, 5*time.Millisecond)
+}
+
+func TestBroker(t *testing.T) {
+	b := &Broker{ReplaySize: 3, Options: Options{Heartbeat: -1}}
+	url := startServer(t, b.Handle)
+
+	// Test: Events go to every client, with IDs
+	resp1, r1 := subscribe(t, url, "")
+	_, r2 := subscribe(t, url, "")
+	waitForClients(t, b, 2)
+	b.Publish(Event{Event: "tick", Data: "one"})
+	assert.Equal(t, "event: tick\nid: 1\ndata: one\n\n", readEvent(t, r1))
+	assert.Equal(t, "event: tick\nid: 1\ndata: one\n\n", readEvent(t, r2))
+
+	// Test: Clients that hang up are unsubscribed
+	resp1.Close()
+	waitForClients(t, b, 1)
+
+	// Test: Reconnecting with Last-Event-ID replays what was missed
+	for i := 2; i <= 4; i++ {
+		b.Publish(Event{Data: fmt.Sprint(i)})
+	}
+	_, r := subscribe(t, url, "2")
+	assert.Equal(t, "id: 3\ndata: 3\n\n", readEvent(t, r))
+	assert.Equal(t, "id: 4\ndata: 4\n\n", readEvent(t, r))
+	waitForClients(t, b, 2)
+	b.Publish(Event{Data: "5"})
+	assert.Equal(t, "id: 5\ndata: 5\n\n", readEvent(t, r))
+
+	// Test: Only ReplaySize events are kept
+	_, r = subscribe(t, url, "1")
+	for _, id := range []int{3, 4, 5} {
+		assert.Equal(t, fmt.Sprintf("id: %d\ndata: %d\n\n", id, id), readEvent(t, r))
+	}
+
+	// Test: Nothing to replay for an unknown or current ID
+	_, r = subscribe(t, url, "5")
+	waitForClients(t, b, 4)
+	b.Publish(Event{Data: "6"})
+	assert.Equal(t, "id: 6\ndata: 6\n\n", readEvent(t, r))
+}
+
+func TestBrokerSlowClient(t *testing.T) {
+	b := &Broker{}
+	ch, _ := b.subscribe("")
+
+	// Test: A client that falls too far behind is dropped, not waited for
+	for i := range subscriberBuffer + 1 {
+		b.Publish(Event{Data: fmt.Sprint(i)})
+	}
+	assert.Equal(t, 0, b.Clients())
+	received := 0
+	for range ch {
+		received++
+	}
+	assert.Equal(t, subscriberBuffer, received)
+}
+
+func TestBrokerErrorLog(t *testing.T) {
+	// Test: A stream that can't start is reported to ErrorLog
+	var errorLog bytes.Buffer
+	b := &Broker{ErrorLog: log.New(&errorLog, "", 0)}
+	req, err := request.RequestFromReader(strings.NewReader("GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := response.NewResponseWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(response.OK))
+	b.Handle(&w, req)
+	assert.Contains(t, errorLog.String(), "Error starting event stream: ")
+	assert.Equal(t, 0, b.Clients())
+}
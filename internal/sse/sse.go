@@ -0,0 +1,226 @@
+// Package sse streams Server-Sent Events, the text/event-stream format that
+// browsers read with EventSource, over a chunked response.
+package sse
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/headers"
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+)
+
+// ErrClosed is returned by Send once the stream has been closed, or the
+// client has gone away.
+var ErrClosed = errors.New("sse: stream closed")
+
+// ErrInvalidField is returned by Send for an event whose ID or name
+// contains a line break, which would end the field early.
+var ErrInvalidField = errors.New("sse: event id and name can't contain line breaks")
+
+// Event is one event of a stream. Fields left empty are left out.
+type Event struct {
+	// ID is what the client sends back in Last-Event-ID when it
+	// reconnects.
+	ID string
+	// Event is the event's name, "message" for the client when empty.
+	Event string
+	// Data can be several lines, each is sent as a data field of its own.
+	Data string
+	// Retry tells the client how long to wait before reconnecting.
+	Retry time.Duration
+}
+
+// appendEvent encodes e in the text/event-stream format.
+func appendEvent(b []byte, e Event) ([]byte, error) {
+	if strings.ContainsAny(e.ID, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return b, ErrInvalidField
+	}
+	if e.Event != "" {
+		b = append(b, "event: "...)
+		b = append(b, e.Event...)
+		b = append(b, '\n')
+	}
+	if e.ID != "" {
+		b = append(b, "id: "...)
+		b = append(b, e.ID...)
+		b = append(b, '\n')
+	}
+	if e.Retry > 0 {
+		b = append(b, "retry: "...)
+		b = strconv.AppendInt(b, e.Retry.Milliseconds(), 10)
+		b = append(b, '\n')
+	}
+	if e.Data != "" {
+		// the client splits data on any of CRLF, CR and LF
+		data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+		data = strings.ReplaceAll(data, "\r", "\n")
+		for line := range strings.SplitSeq(data, "\n") {
+			b = append(b, "data: "...)
+			b = append(b, line...)
+			b = append(b, '\n')
+		}
+	}
+	// a blank line dispatches the event
+	return append(b, '\n'), nil
+}
+
+// Options configures a Stream.
+type Options struct {
+	// Heartbeat is how often a comment line is sent while there are no
+	// events, so proxies don't time the connection out and a client that
+	// went away is noticed. Zero means 15 seconds, negative means no
+	// heartbeats.
+	Heartbeat time.Duration
+	// Retry, if set, is sent first, telling the client how long to wait
+	// before reconnecting.
+	Retry time.Duration
+}
+
+// Stream is an open event stream to one client. Send can be called from
+// any goroutine.
+type Stream struct {
+	w           *response.Writer
+	lastEventID string
+
+	mu     sync.Mutex
+	buf    []byte
+	closed bool
+	done   chan struct{}
+}
+
+// NewStream answers req with the headers of an event stream, and returns
+// the stream to send events on. It stays open until Close is called or the
+// client goes away, whichever comes first, and Done is closed then. The
+// handler has to wait for that before returning, the server closes the
+// connection once it does.
+func NewStream(w *response.Writer, req *request.Request, opts Options) (*Stream, error) {
+	h := headers.NewHeaders()
+	h["content-type"] = "text/event-stream"
+	h["cache-control"] = "no-cache"
+	h["transfer-encoding"] = "chunked"
+	h["connection"] = "close"
+	if err := w.WriteStatusLine(response.OK); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+
+	s := &Stream{
+		w:           w,
+		lastEventID: req.Headers.Get("last-event-id"),
+		done:        make(chan struct{}),
+	}
+	if opts.Retry > 0 {
+		if err := s.Send(Event{Retry: opts.Retry}); err != nil {
+			return nil, err
+		}
+	}
+	heartbeat := opts.Heartbeat
+	if heartbeat == 0 {
+		heartbeat = 15 * time.Second
+	}
+	go s.watch(w.ClientGone(), heartbeat)
+	return s, nil
+}
+
+// watch sends heartbeats and closes the stream when the client goes away.
+func (s *Stream) watch(gone <-chan struct{}, heartbeat time.Duration) {
+	var tick <-chan time.Time
+	if heartbeat > 0 {
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-gone:
+			s.abort()
+			return
+		case <-tick:
+			s.write([]byte(": heartbeat\n\n"))
+		}
+	}
+}
+
+// LastEventID is the ID of the last event the client saw before it
+// reconnected, from the Last-Event-ID header. It is empty on a first
+// connection.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed when the stream is over, because Close was called or the
+// client went away. Producers should stop sending then.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Send writes e to the client.
+func (s *Stream) Send(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	s.buf, err = appendEvent(s.buf[:0], e)
+	if err != nil {
+		return err
+	}
+	return s.writeLocked(s.buf)
+}
+
+// Comment writes a comment line, which the client ignores.
+func (s *Stream) Comment(text string) error {
+	return s.write([]byte(": " + strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(text) + "\n\n"))
+}
+
+func (s *Stream) write(p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeLocked(p)
+}
+
+func (s *Stream) writeLocked(p []byte) error {
+	if s.closed {
+		return ErrClosed
+	}
+	if _, err := s.w.WriteChunkedBody(p); err != nil {
+		// the client is gone
+		s.closed = true
+		close(s.done)
+		return err
+	}
+	return nil
+}
+
+// abort closes the stream without ending the body, there's nobody to read
+// it.
+func (s *Stream) abort() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+}
+
+// Close ends the stream. The client will reconnect after its retry
+// interval unless it is told otherwise, by an event it understands or a
+// 204 on the next connection.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	_, err := s.w.WriteChunkedBodyDone()
+	return err
+}
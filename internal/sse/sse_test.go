@@ -0,0 +1,138 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/client"
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/sankalpmukim/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, handler server.Handler) string {
+	t.Helper()
+	srv, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return "http://" + srv.Addr().String()
+}
+
+// subscribe opens an event stream and returns a reader of its body.
+func subscribe(t *testing.T, url, lastEventID string) (*client.Response, *bufio.Reader) {
+	t.Helper()
+	req, err := client.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	if lastEventID != "" {
+		req.Headers["last-event-id"] = lastEventID
+	}
+	resp, err := (&client.Client{DisableKeepAlives: true}).Do(context.Background(), req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Close() })
+	require.Equal(t, response.OK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Headers.Get("content-type"))
+	assert.Equal(t, "no-cache", resp.Headers.Get("cache-control"))
+	return resp, bufio.NewReader(resp.BodyReader)
+}
+
+// readEvent reads up to and including the blank line ending an event.
+func readEvent(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	var event strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		event.WriteString(line)
+		if line == "\n" {
+			return event.String()
+		}
+	}
+}
+
+func TestAppendEvent(t *testing.T) {
+	for want, e := range map[string]Event{
+		"data: hello\n\n":                        {Data: "hello"},
+		"event: update\nid: 7\ndata: {}\n\n":     {ID: "7", Event: "update", Data: "{}"},
+		"retry: 2500\n\n":                        {Retry: 2500 * time.Millisecond},
+		"data: one\ndata: two\ndata: three\n\n":  {Data: "one\ntwo\r\nthree"},
+		"data: cr\ndata: only\n\n":               {Data: "cr\ronly"},
+		"data: \ndata: blank lines\ndata: \n\n":  {Data: "\nblank lines\n"},
+		"data: : not a comment\ndata: id: 3\n\n": {Data: ": not a comment\nid: 3"},
+		"\n":                                     {},
+	} {
+		got, err := appendEvent(nil, e)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(got))
+	}
+
+	// Test: IDs and names can't break out of their line
+	for _, e := range []Event{{ID: "1\n"}, {ID: "1\x00"}, {Event: "a\rb"}} {
+		_, err := appendEvent(nil, e)
+		assert.ErrorIs(t, err, ErrInvalidField)
+	}
+}
+
+func TestStream(t *testing.T) {
+	handlerDone := make(chan error, 1)
+	url := startServer(t, func(w *response.Writer, req *request.Request) {
+		stream, err := NewStream(w, req, Options{Heartbeat: 50 * time.Millisecond, Retry: time.Second})
+		require.NoError(t, err)
+		assert.Equal(t, "41", stream.LastEventID())
+		stream.Send(Event{ID: "42", Event: "greeting", Data: "hello\nworld"})
+		stream.Comment("multi\nline")
+
+		// the producer runs until the client goes away
+		ticks := time.NewTicker(10 * time.Millisecond)
+		defer ticks.Stop()
+		for {
+			select {
+			case <-stream.Done():
+				handlerDone <- stream.Send(Event{Data: "too late"})
+				return
+			case <-ticks.C:
+			}
+		}
+	})
+
+	// Test: Retry, events and comments
+	resp, r := subscribe(t, url, "41")
+	assert.Equal(t, "retry: 1000\n\n", readEvent(t, r))
+	assert.Equal(t, "event: greeting\nid: 42\ndata: hello\ndata: world\n\n", readEvent(t, r))
+	assert.Equal(t, ": multi line\n\n", readEvent(t, r))
+
+	// Test: Heartbeats while nothing happens
+	assert.Equal(t, ": heartbeat\n\n", readEvent(t, r))
+	assert.Equal(t, ": heartbeat\n\n", readEvent(t, r))
+
+	// Test: Hanging up stops the producer
+	resp.Close()
+	select {
+	case err := <-handlerDone:
+		assert.ErrorIs(t, err, ErrClosed)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the stream didn't notice the client going away")
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	url := startServer(t, func(w *response.Writer, req *request.Request) {
+		stream, err := NewStream(w, req, Options{Heartbeat: -1})
+		require.NoError(t, err)
+		stream.Send(Event{Data: "last one"})
+		require.NoError(t, stream.Close())
+		assert.ErrorIs(t, stream.Send(Event{Data: "after close"}), ErrClosed)
+		<-stream.Done()
+	})
+
+	// Test: Close ends the body
+	_, r := subscribe(t, url, "")
+	assert.Equal(t, "data: last one\n\n", readEvent(t, r))
+	_, err := r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,166 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// permessage-deflate, RFC 7692.
+//
+// We always compress without context takeover, so every message we send is
+// a deflate stream of its own and needs no memory of the ones before it.
+// Clients usually keep their context, which costs us a 32 KiB window of what
+// they sent per connection.
+
+// deflate streams ended with a sync flush finish with these bytes, which are
+// left off on the wire (RFC 7692 section 7.2.1)
+const deflateTail = "\x00\x00\xff\xff"
+
+// deflateWindow is the largest LZ77 window, 2^15 bytes.
+const deflateWindow = 1 << 15
+
+type extensionOffer struct {
+	name   string
+	params []extensionParam
+}
+
+type extensionParam struct {
+	name, value string
+}
+
+// parseExtensions splits a Sec-WebSocket-Extensions value into its offers,
+// as in "permessage-deflate; client_max_window_bits, x-other".
+func parseExtensions(value string) []extensionOffer {
+	var offers []extensionOffer
+	for item := range strings.SplitSeq(value, ",") {
+		parts := strings.Split(item, ";")
+		offer := extensionOffer{name: strings.ToLower(strings.TrimSpace(parts[0]))}
+		if offer.name == "" {
+			continue
+		}
+		for _, part := range parts[1:] {
+			name, value, _ := strings.Cut(part, "=")
+			offer.params = append(offer.params, extensionParam{
+				name:  strings.ToLower(strings.TrimSpace(name)),
+				value: strings.Trim(strings.TrimSpace(value), `"`),
+			})
+		}
+		offers = append(offers, offer)
+	}
+	return offers
+}
+
+// deflateParams is what was agreed on for permessage-deflate.
+type deflateParams struct {
+	// the client starts every message with an empty window
+	clientNoContextTakeover bool
+}
+
+// negotiateDeflate picks the first permessage-deflate offer we can accept,
+// and returns it together with the Sec-WebSocket-Extensions answer to it.
+func negotiateDeflate(offers []extensionOffer) (params deflateParams, answer string, ok bool) {
+next:
+	for _, offer := range offers {
+		if offer.name != "permessage-deflate" {
+			continue
+		}
+		params = deflateParams{}
+		answer = "permessage-deflate; server_no_context_takeover"
+		seen := make(map[string]bool)
+		for _, p := range offer.params {
+			if seen[p.name] {
+				continue next
+			}
+			seen[p.name] = true
+			switch p.name {
+			case "server_no_context_takeover":
+				if p.value != "" {
+					continue next
+				}
+			case "client_no_context_takeover":
+				if p.value != "" {
+					continue next
+				}
+				params.clientNoContextTakeover = true
+				answer += "; client_no_context_takeover"
+			case "server_max_window_bits":
+				// compress/flate always uses the full window, so we can't
+				// do with less
+				if bits, err := strconv.Atoi(p.value); err != nil || bits != 15 {
+					continue next
+				}
+				answer += "; server_max_window_bits=15"
+			case "client_max_window_bits":
+				// any window the client picks fits in ours, there's no need
+				// to limit it
+				if p.value != "" {
+					if bits, err := strconv.Atoi(p.value); err != nil || bits < 8 || bits > 15 {
+						continue next
+					}
+				}
+			default:
+				continue next
+			}
+		}
+		return params, answer, true
+	}
+	return deflateParams{}, "", false
+}
+
+// compressor deflates the messages we send.
+type compressor struct {
+	w *flate.Writer
+}
+
+// reset starts a message whose deflated bytes go to dst.
+func (c *compressor) reset(dst io.Writer) {
+	if c.w == nil {
+		// flate.NewWriter only fails for an invalid level
+		c.w, _ = flate.NewWriter(dst, flate.BestSpeed)
+		return
+	}
+	c.w.Reset(dst)
+}
+
+// decompressor inflates the messages the client sends.
+type decompressor struct {
+	r io.ReadCloser
+	// the last deflateWindow bytes inflated, when the client keeps its
+	// context from one message to the next
+	window       []byte
+	keepsContext bool
+	src          bytes.Reader
+}
+
+// inflate decompresses a message, failing with ErrMessageTooBig when it
+// inflates to more than limit bytes.
+func (d *decompressor) inflate(data []byte, limit int64) ([]byte, error) {
+	// put back the tail the sender took off, followed by an empty final
+	// block so the reader ends at the end of the message
+	d.src.Reset(append(data, deflateTail+"\x01\x00\x00\xff\xff"...))
+	if d.r == nil {
+		d.r = flate.NewReaderDict(&d.src, d.window)
+	} else if err := d.r.(flate.Resetter).Reset(&d.src, d.window); err != nil {
+		return nil, err
+	}
+
+	out, err := io.ReadAll(io.LimitReader(d.r, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad deflate data: %v", ErrInvalidData, err)
+	}
+	if int64(len(out)) > limit {
+		return nil, ErrMessageTooBig
+	}
+
+	if d.keepsContext {
+		d.window = append(d.window, out...)
+		if len(d.window) > deflateWindow {
+			d.window = append(d.window[:0], d.window[len(d.window)-deflateWindow:]...)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,131 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateDeflate(t *testing.T) {
+	// Test: Offers we accept, and our answer
+	for offer, want := range map[string]string{
+		"permessage-deflate":                                                "permessage-deflate; server_no_context_takeover",
+		"permessage-deflate; client_max_window_bits":                        "permessage-deflate; server_no_context_takeover",
+		"permessage-deflate; client_max_window_bits=10":                     "permessage-deflate; server_no_context_takeover",
+		"permessage-deflate; client_no_context_takeover":                    "permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+		"permessage-deflate; server_no_context_takeover":                    "permessage-deflate; server_no_context_takeover",
+		`permessage-deflate; server_max_window_bits="15"`:                   "permessage-deflate; server_no_context_takeover; server_max_window_bits=15",
+		"x-webkit-deflate-frame, permessage-deflate":                        "permessage-deflate; server_no_context_takeover",
+		"permessage-deflate; server_max_window_bits=10, permessage-deflate": "permessage-deflate; server_no_context_takeover",
+	} {
+		_, answer, ok := negotiateDeflate(parseExtensions(offer))
+		assert.True(t, ok, offer)
+		assert.Equal(t, want, answer, offer)
+	}
+
+	// Test: Offers we decline
+	for _, offer := range []string{
+		"",
+		"x-webkit-deflate-frame",
+		"permessage-deflate; server_max_window_bits=10",
+		"permessage-deflate; client_max_window_bits=16",
+		"permessage-deflate; client_no_context_takeover=1",
+		"permessage-deflate; unknown_param",
+		"permessage-deflate; client_no_context_takeover; client_no_context_takeover",
+	} {
+		_, _, ok := negotiateDeflate(parseExtensions(offer))
+		assert.False(t, ok, offer)
+	}
+}
+
+// deflater compresses messages the way a browser does, keeping its
+// context from one message to the next.
+type deflater struct {
+	buf bytes.Buffer
+	w   *flate.Writer
+}
+
+func newDeflater() *deflater {
+	d := &deflater{}
+	d.w, _ = flate.NewWriter(&d.buf, flate.DefaultCompression)
+	return d
+}
+
+func (d *deflater) compress(msg []byte) []byte {
+	d.buf.Reset()
+	d.w.Write(msg)
+	d.w.Flush()
+	return bytes.TrimSuffix(bytes.Clone(d.buf.Bytes()), []byte(deflateTail))
+}
+
+func inflate(t *testing.T, data []byte) []byte {
+	t.Helper()
+	r := flate.NewReader(io.MultiReader(bytes.NewReader(data), strings.NewReader(deflateTail+"\x01\x00\x00\xff\xff")))
+	out, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return out
+}
+
+func TestCompression(t *testing.T) {
+	addr := startEchoServer(t, &Upgrader{EnableCompression: true, MaxMessageSize: 64 * 1024})
+
+	// Test: Without EnableCompression the offer is ignored
+	_, resp := dial(t, startEchoServer(t, &Upgrader{}), "Sec-WebSocket-Extensions: permessage-deflate\r\n")
+	assert.Equal(t, response.SwitchingProtocols, resp.StatusLine.StatusCode)
+	assert.Equal(t, "", resp.Headers.Get("Sec-WebSocket-Extensions"))
+
+	// Test: Case 12.1, compressed messages both ways, with the client
+	// keeping its context
+	c, resp := dial(t, addr, "Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n")
+	require.Equal(t, response.SwitchingProtocols, resp.StatusLine.StatusCode)
+	assert.Equal(t, "permessage-deflate; server_no_context_takeover", resp.Headers.Get("Sec-WebSocket-Extensions"))
+	d := newDeflater()
+	for _, msg := range []string{"", "hello", "hello hello hello", strings.Repeat("compress me ", 5000), "hello"} {
+		c.send(frame(true, 4, opText, d.compress([]byte(msg))))
+		h, payload := c.readFrame()
+		assert.True(t, h.rsv1, "server messages are compressed")
+		assert.Equal(t, byte(opText), h.opcode)
+		for !h.fin {
+			var more []byte
+			h, more = c.readFrame()
+			assert.False(t, h.rsv1, "only the first frame has RSV1")
+			payload = append(payload, more...)
+		}
+		assert.Equal(t, msg, string(inflate(t, payload)))
+	}
+
+	// Test: Case 13.x, compressed messages fragmented, uncompressed ones
+	// in between
+	compressed := newDeflater().compress([]byte("fragmented and compressed"))
+	c.send(frame(true, 0, opBinary, []byte("plain")))
+	h, payload := c.readFrame()
+	assert.Equal(t, "plain", string(inflate(t, payload)))
+	assert.True(t, h.rsv1)
+	c, _ = dial(t, addr, "Sec-WebSocket-Extensions: permessage-deflate; client_no_context_takeover\r\n")
+	c.send(frame(false, 4, opText, compressed[:5]), frame(true, 0, opContinuation, compressed[5:]))
+	_, payload = c.readFrame()
+	assert.Equal(t, "fragmented and compressed", string(inflate(t, payload)))
+
+	// Test: RSV1 on a continuation frame is a protocol error
+	c, _ = dial(t, addr, "Sec-WebSocket-Extensions: permessage-deflate\r\n")
+	c.send(frame(false, 4, opText, compressed[:5]), frame(true, 4, opContinuation, compressed[5:]))
+	c.expectClose(CloseProtocolError)
+
+	// Test: Data that doesn't inflate closes with 1007
+	c, _ = dial(t, addr, "Sec-WebSocket-Extensions: permessage-deflate\r\n")
+	c.send(frame(true, 4, opBinary, []byte{0xff, 0xff, 0xff}))
+	c.expectClose(CloseInvalidPayloadData)
+
+	// Test: The size limit applies to the inflated message
+	c, _ = dial(t, addr, "Sec-WebSocket-Extensions: permessage-deflate\r\n")
+	bomb := newDeflater().compress(make([]byte, 65*1024))
+	require.Less(t, len(bomb), 1024)
+	c.send(frame(true, 4, opBinary, bomb))
+	c.expectClose(CloseMessageTooBig)
+}
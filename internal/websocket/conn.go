@@ -0,0 +1,511 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MessageType says what a message's payload is.
+type MessageType int
+
+const (
+	// TextMessage payloads are UTF-8 text.
+	TextMessage MessageType = opText
+	// BinaryMessage payloads are anything at all.
+	BinaryMessage MessageType = opBinary
+)
+
+// Close codes, RFC 6455 section 7.4.1.
+const (
+	CloseNormalClosure      = 1000
+	CloseGoingAway          = 1001
+	CloseProtocolError      = 1002
+	CloseUnsupportedData    = 1003
+	CloseNoStatusReceived   = 1005 // never sent, reported when a close frame had no code
+	CloseAbnormalClosure    = 1006 // never sent, reported when there was no close frame
+	CloseInvalidPayloadData = 1007
+	ClosePolicyViolation    = 1008
+	CloseMessageTooBig      = 1009
+	CloseMandatoryExtension = 1010
+	CloseInternalServerErr  = 1011
+)
+
+var (
+	// ErrProtocol is what reading fails with when the client breaks the
+	// protocol. The connection is closed with CloseProtocolError.
+	ErrProtocol = errors.New("websocket: protocol error")
+	// ErrInvalidData is what reading fails with for a text message that
+	// isn't UTF-8, or a compressed one that doesn't inflate. The connection
+	// is closed with CloseInvalidPayloadData.
+	ErrInvalidData = errors.New("websocket: invalid message data")
+	// ErrMessageTooBig is what reading fails with for a message over the
+	// size limit. The connection is closed with CloseMessageTooBig.
+	ErrMessageTooBig = errors.New("websocket: message too big")
+	// ErrCloseSent is returned by writes after the close frame went out.
+	ErrCloseSent = errors.New("websocket: close sent")
+)
+
+// CloseError is what ReadMessage returns once the client has closed the
+// connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed with %d %s", e.Code, e.Reason)
+}
+
+// how long Close waits for the client to answer with a close frame of its
+// own
+const closeTimeout = 5 * time.Second
+
+// messages we send are cut into frames of this size
+const fragmentSize = 16 * 1024
+
+// Conn is a server side WebSocket connection, as returned by
+// Upgrader.Upgrade.
+//
+// One goroutine may read while others write: writes, pings and Close can be
+// called concurrently, and control frames go out between the frames of a
+// message that is being written.
+type Conn struct {
+	conn        net.Conn
+	subprotocol string
+	maxSize     int64
+
+	// reading, one ReadMessage at a time
+	readMu       sync.Mutex
+	br           *bufio.Reader
+	readErr      error
+	decompressor *decompressor // nil without permessage-deflate
+	pongHandler  func(data []byte)
+
+	// messageMu is held for a whole message, writeMu for each frame
+	messageMu  sync.Mutex
+	writeMu    sync.Mutex
+	bw         *bufio.Writer
+	header     []byte
+	closeSent  bool
+	compressor *compressor // nil without permessage-deflate
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, maxSize int64, deflate *deflateParams) *Conn {
+	c := &Conn{conn: conn, br: br, bw: bufio.NewWriterSize(conn, fragmentSize+14), maxSize: maxSize}
+	if deflate != nil {
+		c.compressor = &compressor{}
+		c.decompressor = &decompressor{keepsContext: !deflate.clientNoContextTakeover}
+	}
+	return c
+}
+
+// Subprotocol is the subprotocol agreed on in the handshake, if any.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// RemoteAddr is the address of the client.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetReadDeadline sets a deadline on reading from the connection, see
+// net.Conn. A ReadMessage that hits it fails, and so do all after it.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets a deadline on writing to the connection, see
+// net.Conn.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// SetPongHandler sets a function called with the payload of every pong
+// that comes in, from the goroutine calling ReadMessage. Pings are answered
+// with pongs automatically.
+func (c *Conn) SetPongHandler(h func(data []byte)) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	c.pongHandler = h
+}
+
+// ReadMessage returns the next message from the client, put together from
+// its fragments and decompressed. Control frames arriving in between are
+// dealt with along the way.
+//
+// Once the client closes the connection, ReadMessage returns a *CloseError.
+// When the client breaks the protocol, the connection is closed with the
+// matching close code and ReadMessage returns an error wrapping ErrProtocol,
+// ErrInvalidData or ErrMessageTooBig. Either way the connection is done for
+// and every later call returns the same error.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	typ, msg, err := c.readMessage()
+	if err != nil {
+		c.readErr = err
+		c.fail(err)
+	}
+	return typ, msg, err
+}
+
+func (c *Conn) readMessage() (MessageType, []byte, error) {
+	var (
+		typ        MessageType
+		msg        []byte
+		started    bool
+		compressed bool
+	)
+	for {
+		h, err := readFrameHeader(c.br)
+		if err != nil {
+			return 0, nil, err
+		}
+		if err := c.checkFrame(h, started); err != nil {
+			return 0, nil, err
+		}
+
+		if isControl(h.opcode) {
+			payload := make([]byte, h.length)
+			if _, err := io.ReadFull(c.br, payload); err != nil {
+				return 0, nil, unexpectedEOF(err)
+			}
+			maskBytes(h.mask, 0, payload)
+			if err := c.handleControl(h.opcode, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		if h.opcode != opContinuation {
+			started = true
+			typ = MessageType(h.opcode)
+			compressed = h.rsv1
+		}
+		if int64(len(msg))+h.length > c.maxSize {
+			return 0, nil, ErrMessageTooBig
+		}
+		start := len(msg)
+		msg = append(msg, make([]byte, h.length)...)
+		if _, err := io.ReadFull(c.br, msg[start:]); err != nil {
+			return 0, nil, unexpectedEOF(err)
+		}
+		maskBytes(h.mask, 0, msg[start:])
+		if h.fin {
+			break
+		}
+	}
+
+	if compressed {
+		var err error
+		if msg, err = c.decompressor.inflate(msg, c.maxSize); err != nil {
+			return 0, nil, err
+		}
+	}
+	if typ == TextMessage && !utf8.Valid(msg) {
+		return 0, nil, fmt.Errorf("%w: text message isn't valid UTF-8", ErrInvalidData)
+	}
+	return typ, msg, nil
+}
+
+// checkFrame validates a frame header against what came before it.
+func (c *Conn) checkFrame(h frameHeader, inMessage bool) error {
+	switch {
+	case !h.masked:
+		return fmt.Errorf("%w: frames from the client must be masked", ErrProtocol)
+	case h.rsv2 || h.rsv3:
+		return fmt.Errorf("%w: reserved bits set", ErrProtocol)
+	case h.rsv1 && (c.decompressor == nil || isControl(h.opcode) || h.opcode == opContinuation):
+		// RSV1 is permessage-deflate's, and only on a message's first frame
+		return fmt.Errorf("%w: reserved bits set", ErrProtocol)
+	}
+
+	switch h.opcode {
+	case opClose, opPing, opPong:
+		if !h.fin {
+			return fmt.Errorf("%w: fragmented control frame", ErrProtocol)
+		}
+		if h.length > maxControlPayload {
+			return fmt.Errorf("%w: control frame payload over %d bytes", ErrProtocol, maxControlPayload)
+		}
+	case opContinuation:
+		if !inMessage {
+			return fmt.Errorf("%w: continuation frame outside a message", ErrProtocol)
+		}
+	case opText, opBinary:
+		if inMessage {
+			return fmt.Errorf("%w: new message before the last one was finished", ErrProtocol)
+		}
+	default:
+		return fmt.Errorf("%w: reserved opcode %#x", ErrProtocol, h.opcode)
+	}
+	return nil
+}
+
+func (c *Conn) handleControl(opcode byte, payload []byte) error {
+	switch opcode {
+	case opPing:
+		err := c.writeFrame(opPong, payload)
+		if errors.Is(err, ErrCloseSent) {
+			// we're closing, the client will hear from us soon enough
+			return nil
+		}
+		return err
+	case opPong:
+		if c.pongHandler != nil {
+			c.pongHandler(payload)
+		}
+		return nil
+	}
+
+	closeErr := &CloseError{Code: CloseNoStatusReceived}
+	switch {
+	case len(payload) == 1:
+		return fmt.Errorf("%w: close frame payload of 1 byte", ErrProtocol)
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return fmt.Errorf("%w: close code %d", ErrProtocol, closeErr.Code)
+		}
+		if !utf8.ValidString(closeErr.Reason) {
+			return fmt.Errorf("%w: close reason isn't valid UTF-8", ErrInvalidData)
+		}
+	}
+
+	// echo the code back, unless we started the closing handshake
+	var reply []byte
+	if len(payload) >= 2 {
+		reply = payload[:2]
+	}
+	c.writeFrame(opClose, reply)
+	c.conn.Close()
+	return closeErr
+}
+
+// validCloseCode reports whether code may be sent in a close frame.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		// registered with IANA, or private
+		return true
+	}
+	return false
+}
+
+// fail ends the connection after reading failed with err.
+func (c *Conn) fail(err error) {
+	var closeErr *CloseError
+	if errors.As(err, &closeErr) {
+		// handleControl finished the closing handshake
+		return
+	}
+
+	code := 0
+	switch {
+	case errors.Is(err, ErrProtocol):
+		code = CloseProtocolError
+	case errors.Is(err, ErrInvalidData):
+		code = CloseInvalidPayloadData
+	case errors.Is(err, ErrMessageTooBig):
+		code = CloseMessageTooBig
+	}
+	if code == 0 {
+		// the connection itself failed, there's nobody to tell
+		c.conn.Close()
+		return
+	}
+
+	c.writeFrame(opClose, closePayload(code, ""))
+	// the client may still be sending, and closing with unread data
+	// resets the connection, which can throw away our close frame. so stop
+	// writing and drain for a moment before closing.
+	go func() {
+		if tcpConn, ok := c.conn.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+		c.conn.SetReadDeadline(time.Now().Add(time.Second))
+		io.Copy(io.Discard, c.br)
+		c.conn.Close()
+	}()
+}
+
+func closePayload(code int, reason string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return append(payload, reason...)
+}
+
+// writeFrame sends a frame of its own, a control frame or a whole message
+// in one.
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	return c.writeFrameHeader(frameHeader{fin: true, opcode: opcode, length: int64(len(payload))}, payload)
+}
+
+func (c *Conn) writeFrameHeader(h frameHeader, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if h.opcode == opClose {
+		c.closeSent = true
+	}
+	c.header = appendFrameHeader(c.header[:0], h)
+	c.bw.Write(c.header)
+	c.bw.Write(payload)
+	return c.bw.Flush()
+}
+
+// WriteMessage sends data as a single message, compressed if
+// permessage-deflate was agreed on.
+func (c *Conn) WriteMessage(typ MessageType, data []byte) error {
+	w, err := c.NextWriter(typ)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// NextWriter starts a message, for sending one too big to have in memory
+// at once. What is written goes out in fragments, and the message ends with
+// Close. Other messages wait until then.
+func (c *Conn) NextWriter(typ MessageType) (io.WriteCloser, error) {
+	if typ != TextMessage && typ != BinaryMessage {
+		return nil, fmt.Errorf("websocket: invalid message type %d", typ)
+	}
+	c.messageMu.Lock()
+	w := &messageWriter{c: c, opcode: byte(typ)}
+	if c.compressor != nil {
+		w.compressed = true
+		c.compressor.reset(deflateSink{w})
+	}
+	return w, nil
+}
+
+type messageWriter struct {
+	c          *Conn
+	opcode     byte // continuation after the first frame
+	compressed bool
+	buf        []byte // payload not sent yet
+	err        error
+	done       bool
+}
+
+// deflateSink collects what the compressor produces.
+type deflateSink struct{ w *messageWriter }
+
+func (s deflateSink) Write(p []byte) (int, error) {
+	s.w.buf = append(s.w.buf, p...)
+	return len(p), nil
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, errors.New("websocket: write after Close")
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.compressed {
+		w.c.compressor.w.Write(p)
+	} else {
+		w.buf = append(w.buf, p...)
+	}
+	// keep back what could be the deflate tail, it's cut off at the end
+	keep := 0
+	if w.compressed {
+		keep = len(deflateTail)
+	}
+	for len(w.buf) > fragmentSize+keep && w.err == nil {
+		w.err = w.flushFrame(w.buf[:fragmentSize], false)
+		w.buf = w.buf[:copy(w.buf, w.buf[fragmentSize:])]
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	return len(p), nil
+}
+
+func (w *messageWriter) flushFrame(payload []byte, fin bool) error {
+	h := frameHeader{fin: fin, opcode: w.opcode, rsv1: w.compressed && w.opcode != opContinuation, length: int64(len(payload))}
+	w.opcode = opContinuation
+	return w.c.writeFrameHeader(h, payload)
+}
+
+// Close sends what is left of the message, and lets the next one go.
+func (w *messageWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	defer w.c.messageMu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	if w.compressed {
+		w.c.compressor.w.Flush()
+		w.buf = bytes.TrimSuffix(w.buf, []byte(deflateTail))
+	}
+	return w.flushFrame(w.buf, true)
+}
+
+// Ping sends a ping, the client answers with a pong carrying the same data,
+// which the pong handler gets to see. data is at most 125 bytes.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return fmt.Errorf("websocket: ping payload over %d bytes", maxControlPayload)
+	}
+	return c.writeFrame(opPing, data)
+}
+
+// Close starts the closing handshake with code and reason, and closes the
+// connection once the client has answered, or after a few seconds.
+//
+// If a ReadMessage is running it sees the client's answer and returns a
+// *CloseError, otherwise Close reads and drops messages until the answer
+// comes.
+func (c *Conn) Close(code int, reason string) error {
+	if len(reason) > maxControlPayload-2 {
+		return fmt.Errorf("websocket: close reason over %d bytes", maxControlPayload-2)
+	}
+	if err := c.writeFrame(opClose, closePayload(code, reason)); err != nil {
+		c.conn.Close()
+		if errors.Is(err, ErrCloseSent) {
+			return nil
+		}
+		return err
+	}
+
+	if !c.readMu.TryLock() {
+		// the reader closes the connection when the answer comes
+		time.AfterFunc(closeTimeout, func() { c.conn.Close() })
+		return nil
+	}
+	defer c.readMu.Unlock()
+	if c.readErr == nil {
+		c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+		for c.readErr == nil {
+			_, _, c.readErr = c.readMessage()
+		}
+	}
+	c.conn.Close()
+	return nil
+}
@@ -0,0 +1,132 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// frame opcodes, RFC 6455 section 5.2
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// control frames carry at most this much payload and can't be fragmented
+const maxControlPayload = 125
+
+func isControl(opcode byte) bool {
+	return opcode&0x8 != 0
+}
+
+type frameHeader struct {
+	fin    bool
+	rsv1   bool // set on the first frame of a compressed message
+	rsv2   bool
+	rsv3   bool
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length int64
+}
+
+func readFrameHeader(r *bufio.Reader) (frameHeader, error) {
+	var h frameHeader
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return h, err
+	}
+	h.fin = b[0]&0x80 != 0
+	h.rsv1 = b[0]&0x40 != 0
+	h.rsv2 = b[0]&0x20 != 0
+	h.rsv3 = b[0]&0x10 != 0
+	h.opcode = b[0] & 0x0F
+	h.masked = b[1]&0x80 != 0
+
+	switch length := b[1] & 0x7F; length {
+	case 126:
+		if _, err := io.ReadFull(r, b[:2]); err != nil {
+			return h, unexpectedEOF(err)
+		}
+		h.length = int64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err := io.ReadFull(r, b[:8]); err != nil {
+			return h, unexpectedEOF(err)
+		}
+		n := binary.BigEndian.Uint64(b[:8])
+		if n>>63 != 0 {
+			return h, fmt.Errorf("%w: frame length has its most significant bit set", ErrProtocol)
+		}
+		h.length = int64(n)
+	default:
+		h.length = int64(length)
+	}
+
+	if h.masked {
+		if _, err := io.ReadFull(r, h.mask[:]); err != nil {
+			return h, unexpectedEOF(err)
+		}
+	}
+	return h, nil
+}
+
+// unexpectedEOF turns an EOF in the middle of a frame into
+// io.ErrUnexpectedEOF, a clean EOF is only possible between frames.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// appendFrameHeader encodes h with the shortest length encoding.
+func appendFrameHeader(b []byte, h frameHeader) []byte {
+	first := h.opcode
+	if h.fin {
+		first |= 0x80
+	}
+	if h.rsv1 {
+		first |= 0x40
+	}
+	if h.rsv2 {
+		first |= 0x20
+	}
+	if h.rsv3 {
+		first |= 0x10
+	}
+	b = append(b, first)
+
+	var maskBit byte
+	if h.masked {
+		maskBit = 0x80
+	}
+	switch {
+	case h.length <= 125:
+		b = append(b, maskBit|byte(h.length))
+	case h.length <= 0xFFFF:
+		b = append(b, maskBit|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(h.length))
+	default:
+		b = append(b, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(h.length))
+	}
+
+	if h.masked {
+		b = append(b, h.mask[:]...)
+	}
+	return b
+}
+
+// maskBytes XORs b with mask, starting pos bytes into the frame payload, and
+// returns the position after b. Masking and unmasking are the same thing.
+func maskBytes(mask [4]byte, pos int, b []byte) int {
+	for i := range b {
+		b[i] ^= mask[(pos+i)&3]
+	}
+	return pos + len(b)
+}
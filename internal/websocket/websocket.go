@@ -0,0 +1,192 @@
+// Package websocket implements the server side of the WebSocket protocol,
+// RFC 6455, with the permessage-deflate extension of RFC 7692.
+//
+// A server.Handler turns its request into a connection with
+// Upgrader.Upgrade, then exchanges messages over the Conn it gets back:
+//
+//	conn, err := upgrader.Upgrade(w, req)
+//	if err != nil {
+//		return // the client got an error response already
+//	}
+//	defer conn.Close(websocket.CloseNormalClosure, "")
+//	for {
+//		typ, msg, err := conn.ReadMessage()
+//		if err != nil {
+//			return
+//		}
+//		conn.WriteMessage(typ, msg)
+//	}
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/headers"
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/sankalpmukim/httpfromtcp/internal/server"
+)
+
+// ErrBadHandshake is returned by Upgrade for requests that aren't a valid
+// WebSocket handshake. They have been answered with an error already.
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+// the GUID that Sec-WebSocket-Accept is derived with, RFC 6455 section 1.3
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Upgrader turns WebSocket handshake requests into connections. The zero
+// value accepts same-origin requests with no subprotocol and no
+// compression.
+type Upgrader struct {
+	// Subprotocols are the subprotocols the server speaks, in order of
+	// preference. The first one the client offers is picked; if the client
+	// offers some but none of these, the connection goes ahead without one.
+	Subprotocols []string
+
+	// CheckOrigin decides whether a request with the given Origin is let in.
+	// nil lets in requests without an Origin, and those whose Origin has the
+	// same host as the request, which keeps other sites' pages out.
+	CheckOrigin func(req *request.Request) bool
+
+	// EnableCompression agrees to permessage-deflate when the client offers
+	// it.
+	EnableCompression bool
+
+	// MaxMessageSize is the largest message read, after decompression.
+	// Bigger ones close the connection with CloseMessageTooBig. Zero means
+	// 16 MiB.
+	MaxMessageSize int64
+}
+
+// IsUpgrade reports whether req asks for a WebSocket connection, which is
+// handy for routing.
+func IsUpgrade(req *request.Request) bool {
+	return hasToken(req.Headers.Get("connection"), "upgrade") && hasToken(req.Headers.Get("upgrade"), "websocket")
+}
+
+// Upgrade completes the handshake for req and takes over the connection.
+// When req isn't a valid handshake it answers with 400, 403 or 426, and
+// returns an error wrapping ErrBadHandshake.
+func (u *Upgrader) Upgrade(w *response.Writer, req *request.Request) (*Conn, error) {
+	fail := func(status response.StatusCode, msg string) (*Conn, error) {
+		if status == response.UpgradeRequired {
+			w.WriteStatusLine(status)
+			h := response.GetDefaultHeaders(len(msg))
+			h["sec-websocket-version"] = "13"
+			h["upgrade"] = "websocket"
+			w.WriteHeaders(h)
+			w.WriteBody([]byte(msg))
+		} else {
+			server.WriteError(w, server.HandleError{StatusCode: status, Message: msg})
+		}
+		return nil, fmt.Errorf("%w: %s", ErrBadHandshake, msg)
+	}
+
+	line := req.RequestLine
+	if line.Method != request.MethodGet {
+		return fail(response.BadRequest, "handshake must be a GET request")
+	}
+	if line.HttpVersionMajor < 1 || (line.HttpVersionMajor == 1 && line.HttpVersionMinor < 1) {
+		return fail(response.BadRequest, "handshake needs HTTP/1.1")
+	}
+	if !IsUpgrade(req) {
+		return fail(response.UpgradeRequired, "expected Connection: Upgrade and Upgrade: websocket")
+	}
+	if req.Headers.Get("sec-websocket-version") != "13" {
+		return fail(response.UpgradeRequired, "unsupported Sec-WebSocket-Version, only 13 is")
+	}
+	key := strings.TrimSpace(req.Headers.Get("sec-websocket-key"))
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return fail(response.BadRequest, "invalid Sec-WebSocket-Key")
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(req) {
+		return fail(response.Forbidden, "origin not allowed")
+	}
+
+	h := headers.NewHeaders()
+	h["upgrade"] = "websocket"
+	h["connection"] = "Upgrade"
+	h["sec-websocket-accept"] = acceptKey(key)
+	subprotocol := u.selectSubprotocol(req)
+	if subprotocol != "" {
+		h["sec-websocket-protocol"] = subprotocol
+	}
+	var deflate *deflateParams
+	if u.EnableCompression {
+		if params, answer, ok := negotiateDeflate(parseExtensions(req.Headers.Get("sec-websocket-extensions"))); ok {
+			deflate = &params
+			h["sec-websocket-extensions"] = answer
+		}
+	}
+
+	if err := w.WriteStatusLine(response.SwitchingProtocols); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+	netConn, rw, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	maxSize := u.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = 16 << 20
+	}
+	c := newConn(netConn, rw.Reader, maxSize, deflate)
+	c.subprotocol = subprotocol
+	return c, nil
+}
+
+// acceptKey is the Sec-WebSocket-Accept answer to a Sec-WebSocket-Key.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (u *Upgrader) selectSubprotocol(req *request.Request) string {
+	var offered []string
+	for p := range strings.SplitSeq(req.Headers.Get("sec-websocket-protocol"), ",") {
+		offered = append(offered, strings.TrimSpace(p))
+	}
+	for _, p := range u.Subprotocols {
+		if slices.Contains(offered, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+func sameOrigin(req *request.Request) bool {
+	origin := req.Headers.Get("origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Headers.Get("host"))
+}
+
+// hasToken reports whether a comma separated list contains token, ignoring
+// case.
+func hasToken(list, token string) bool {
+	for item := range strings.SplitSeq(list, ",") {
+		if strings.EqualFold(strings.TrimSpace(item), token) {
+			return true
+		}
+	}
+	return false
+}
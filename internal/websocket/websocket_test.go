@@ -0,0 +1,481 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sankalpmukim/httpfromtcp/internal/request"
+	"github.com/sankalpmukim/httpfromtcp/internal/response"
+	"github.com/sankalpmukim/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startEchoServer serves a WebSocket echo endpoint, which is what the
+// Autobahn test suite expects to talk to.
+func startEchoServer(t *testing.T, u *Upgrader) string {
+	t.Helper()
+	srv, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		conn, err := u.Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		go func() {
+			for {
+				typ, msg, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if err := conn.WriteMessage(typ, msg); err != nil {
+					return
+				}
+			}
+		}()
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return srv.Addr().String()
+}
+
+// testClient speaks raw frames, so tests can send what a well behaved
+// client never would.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+const handshake = "GET /chat HTTP/1.1\r\n" +
+	"Host: localhost\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n"
+
+// dial sends the handshake with extra header lines, and returns the
+// response to it.
+func dial(t *testing.T, addr, extra string) (*testClient, *response.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, handshake+extra+"\r\n")
+	require.NoError(t, err)
+	c := &testClient{t: t, conn: conn, br: bufio.NewReader(conn)}
+	resp, err := response.ReadResponse(c.br, "GET")
+	require.NoError(t, err)
+	return c, resp
+}
+
+// connect is dial for a handshake that has to succeed.
+func connect(t *testing.T, addr, extra string) *testClient {
+	t.Helper()
+	c, resp := dial(t, addr, extra)
+	require.Equal(t, response.SwitchingProtocols, resp.StatusLine.StatusCode)
+	return c
+}
+
+// frame is a masked frame from the client.
+func frame(fin bool, rsv byte, opcode byte, payload []byte) []byte {
+	first := rsv<<4 | opcode
+	if fin {
+		first |= 0x80
+	}
+	b := []byte{first}
+	switch {
+	case len(payload) <= 125:
+		b = append(b, 0x80|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		b = append(b, 0x80|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	default:
+		b = append(b, 0x80|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(len(payload)))
+	}
+	var mask [4]byte
+	rand.Read(mask[:])
+	b = append(b, mask[:]...)
+	start := len(b)
+	b = append(b, payload...)
+	maskBytes(mask, 0, b[start:])
+	return b
+}
+
+func (c *testClient) send(frames ...[]byte) {
+	c.t.Helper()
+	for _, f := range frames {
+		_, err := c.conn.Write(f)
+		require.NoError(c.t, err)
+	}
+}
+
+// readFrame reads one frame from the server.
+func (c *testClient) readFrame() (frameHeader, []byte) {
+	c.t.Helper()
+	h, err := readFrameHeader(c.br)
+	require.NoError(c.t, err)
+	assert.False(c.t, h.masked, "server frames are never masked")
+	payload := make([]byte, h.length)
+	_, err = io.ReadFull(c.br, payload)
+	require.NoError(c.t, err)
+	return h, payload
+}
+
+// expectMessage reads a whole message from the server.
+func (c *testClient) expectMessage(opcode byte, payload []byte) {
+	c.t.Helper()
+	h, got := c.readFrame()
+	assert.Equal(c.t, opcode, h.opcode)
+	for !h.fin {
+		var more []byte
+		h, more = c.readFrame()
+		assert.Equal(c.t, byte(opContinuation), h.opcode)
+		got = append(got, more...)
+	}
+	assert.Equal(c.t, payload, got)
+}
+
+// expectClose reads the server's close frame, expecting code, then the end
+// of the connection. Zero code means an empty close frame.
+func (c *testClient) expectClose(code int) {
+	c.t.Helper()
+	h, payload := c.readFrame()
+	require.Equal(c.t, byte(opClose), h.opcode, "payload %q", payload)
+	if code == 0 {
+		assert.Empty(c.t, payload)
+	} else {
+		require.GreaterOrEqual(c.t, len(payload), 2)
+		assert.Equal(c.t, code, int(binary.BigEndian.Uint16(payload)))
+	}
+	// the server hangs up after its close frame
+	rest, _ := io.ReadAll(c.br)
+	assert.Empty(c.t, rest)
+}
+
+func closeFrame(code int, reason string) []byte {
+	return frame(true, 0, opClose, closePayload(code, reason))
+}
+
+func TestHandshake(t *testing.T) {
+	addr := startEchoServer(t, &Upgrader{Subprotocols: []string{"v2.chat", "v1.chat"}})
+
+	// Test: The example handshake of RFC 6455 section 1.3
+	c, resp := dial(t, addr, "Origin: http://localhost\r\n")
+	require.Equal(t, response.SwitchingProtocols, resp.StatusLine.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Headers.Get("Sec-WebSocket-Accept"))
+	assert.Equal(t, "websocket", resp.Headers.Get("Upgrade"))
+	assert.Equal(t, "", resp.Headers.Get("Sec-WebSocket-Protocol"))
+	assert.Equal(t, "", resp.Headers.Get("Sec-WebSocket-Extensions"))
+	c.send(frame(true, 0, opText, []byte("hello")))
+	c.expectMessage(opText, []byte("hello"))
+
+	// Test: Subprotocols are picked in the server's order of preference
+	_, resp = dial(t, addr, "Sec-WebSocket-Protocol: v1.chat, v2.chat\r\n")
+	assert.Equal(t, "v2.chat", resp.Headers.Get("Sec-WebSocket-Protocol"))
+	_, resp = dial(t, addr, "Sec-WebSocket-Protocol: v3.chat\r\n")
+	assert.Equal(t, response.SwitchingProtocols, resp.StatusLine.StatusCode)
+	assert.Equal(t, "", resp.Headers.Get("Sec-WebSocket-Protocol"))
+
+	// Test: Frames sent right behind the handshake aren't lost
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write(append([]byte(handshake+"\r\n"), frame(true, 0, opBinary, []byte("eager"))...))
+	require.NoError(t, err)
+	c = &testClient{t: t, conn: conn, br: bufio.NewReader(conn)}
+	resp, err = response.ReadResponse(c.br, "GET")
+	require.NoError(t, err)
+	require.Equal(t, response.SwitchingProtocols, resp.StatusLine.StatusCode)
+	c.expectMessage(opBinary, []byte("eager"))
+
+	// Test: Bad handshakes
+	for name, tc := range map[string]struct {
+		raw  string
+		code response.StatusCode
+	}{
+		"post":           {strings.Replace(handshake, "GET", "POST", 1), response.BadRequest},
+		"http/1.0":       {strings.Replace(handshake, "HTTP/1.1", "HTTP/1.0", 1), response.BadRequest},
+		"no upgrade":     {strings.Replace(handshake, "Upgrade: websocket\r\n", "", 1), response.UpgradeRequired},
+		"no connection":  {strings.Replace(handshake, "Connection: Upgrade", "Connection: keep-alive", 1), response.UpgradeRequired},
+		"old version":    {strings.Replace(handshake, "Version: 13", "Version: 8", 1), response.UpgradeRequired},
+		"short key":      {strings.Replace(handshake, "dGhlIHNhbXBsZSBub25jZQ==", "c2hvcnQ=", 1), response.BadRequest},
+		"no key":         {strings.Replace(handshake, "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n", "", 1), response.BadRequest},
+		"foreign origin": {handshake + "Origin: https://evil.example\r\n", response.Forbidden},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.WriteString(conn, tc.raw+"\r\n")
+		require.NoError(t, err)
+		resp, err := response.ReadResponse(bufio.NewReader(conn), "GET")
+		require.NoError(t, err)
+		assert.Equal(t, tc.code, resp.StatusLine.StatusCode, name)
+		if tc.code == response.UpgradeRequired {
+			assert.Equal(t, "13", resp.Headers.Get("Sec-WebSocket-Version"), name)
+		}
+	}
+
+	// Test: CheckOrigin replaces the same-origin check
+	addr = startEchoServer(t, &Upgrader{CheckOrigin: func(req *request.Request) bool {
+		return req.Headers.Get("origin") == "https://app.example"
+	}})
+	_, resp = dial(t, addr, "Origin: https://app.example\r\n")
+	assert.Equal(t, response.SwitchingProtocols, resp.StatusLine.StatusCode)
+	_, resp = dial(t, addr, "Origin: http://localhost\r\n")
+	assert.Equal(t, response.Forbidden, resp.StatusLine.StatusCode)
+}
+
+func TestIsUpgrade(t *testing.T) {
+	req, err := request.RequestFromReader(strings.NewReader(handshake + "\r\n"))
+	require.NoError(t, err)
+	assert.True(t, IsUpgrade(req))
+	req, err = request.RequestFromReader(strings.NewReader(
+		"GET / HTTP/1.1\r\nHost: x\r\nConnection: keep-alive, Upgrade\r\nUpgrade: WebSocket\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, IsUpgrade(req))
+	req, err = request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\nUpgrade: h2c\r\nConnection: Upgrade\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, IsUpgrade(req))
+}
+
+// Autobahn's test cases run against an echo server, which cmd/httpserver
+// serves at /ws/echo. These are their local, scripted equivalents.
+
+func TestFraming(t *testing.T) {
+	addr := startEchoServer(t, &Upgrader{})
+
+	// Test: Case 1.1 and 1.2, echo across the payload length encodings
+	c := connect(t, addr, "")
+	for _, n := range []int{0, 1, 125, 126, 127, 65535, 65536, 100000} {
+		payload := []byte(strings.Repeat("*", n))
+		c.send(frame(true, 0, opText, payload))
+		c.expectMessage(opText, payload)
+		binary := make([]byte, n)
+		rand.Read(binary)
+		c.send(frame(true, 0, opBinary, binary))
+		c.expectMessage(opBinary, binary)
+	}
+
+	// Test: Case 2.2 and 2.4, pings are answered with their payload
+	for _, n := range []int{0, 10, 125} {
+		payload := []byte(strings.Repeat("p", n))
+		c.send(frame(true, 0, opPing, payload))
+		c.expectMessage(opPong, payload)
+	}
+
+	// Test: Case 2.8, unsolicited pongs are ignored
+	c.send(frame(true, 0, opPong, []byte("unsolicited")), frame(true, 0, opText, []byte("after")))
+	c.expectMessage(opText, []byte("after"))
+
+	// Test: Case 2.10, every ping gets its own pong
+	for i := range 10 {
+		c.send(frame(true, 0, opPing, []byte(fmt.Sprint(i))))
+	}
+	for i := range 10 {
+		c.expectMessage(opPong, []byte(fmt.Sprint(i)))
+	}
+	c.send(closeFrame(CloseNormalClosure, ""))
+	c.expectClose(CloseNormalClosure)
+
+	// Test: Protocol violations close the connection with 1002
+	for name, bad := range map[string][]byte{
+		"2.5 ping over 125 bytes":   frame(true, 0, opPing, make([]byte, 126)),
+		"3.1 rsv1 without deflate":  frame(true, 4, opText, []byte("x")),
+		"3.2 rsv2":                  frame(true, 2, opText, []byte("x")),
+		"3.4 rsv3 on a ping":        frame(true, 1, opPing, nil),
+		"4.1.1 reserved opcode 3":   frame(true, 0, 3, nil),
+		"4.2.1 reserved opcode 0xB": frame(true, 0, 0xB, nil),
+		"unmasked frame":            {0x81, 0x01, 'x'},
+		"huge length":               {0x82, 0xFF, 0x80, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := connect(t, addr, "")
+			c.send(bad)
+			c.expectClose(CloseProtocolError)
+		})
+	}
+}
+
+func TestFragmentation(t *testing.T) {
+	addr := startEchoServer(t, &Upgrader{})
+	c := connect(t, addr, "")
+
+	// Test: Case 5.3, fragments make up one message
+	c.send(
+		frame(false, 0, opText, []byte("frag")),
+		frame(false, 0, opContinuation, []byte("men")),
+		frame(true, 0, opContinuation, []byte("ted")),
+	)
+	c.expectMessage(opText, []byte("fragmented"))
+
+	// Test: Case 5.6, control frames in between fragments
+	c.send(
+		frame(false, 0, opBinary, []byte{1, 2}),
+		frame(true, 0, opPing, []byte("in between")),
+		frame(true, 0, opContinuation, []byte{3}),
+	)
+	c.expectMessage(opPong, []byte("in between"))
+	c.expectMessage(opBinary, []byte{1, 2, 3})
+
+	// Test: Case 6.2, UTF-8 characters split across fragments
+	text := []byte("κόσμε, 世界")
+	c.send(frame(false, 0, opText, text[:1]), frame(false, 0, opContinuation, text[1:8]), frame(true, 0, opContinuation, text[8:]))
+	c.expectMessage(opText, text)
+
+	// Test: Messages from the server are fragmented too
+	big := []byte(strings.Repeat("0123456789", 4000))
+	c.send(frame(true, 0, opBinary, big))
+	h, payload := c.readFrame()
+	assert.False(t, h.fin)
+	assert.Equal(t, byte(opBinary), h.opcode)
+	assert.Len(t, payload, fragmentSize)
+	h, more := c.readFrame()
+	assert.False(t, h.fin)
+	assert.Equal(t, byte(opContinuation), h.opcode)
+	payload = append(payload, more...)
+	h, more = c.readFrame()
+	assert.True(t, h.fin)
+	assert.Equal(t, byte(opContinuation), h.opcode)
+	assert.Equal(t, big, append(payload, more...))
+
+	// Test: Broken fragmentation closes with 1002
+	for name, bad := range map[string][][]byte{
+		"5.1 fragmented ping":            {frame(false, 0, opPing, []byte("a")), frame(true, 0, opContinuation, []byte("b"))},
+		"5.9 continuation with no start": {frame(true, 0, opContinuation, []byte("x"))},
+		"5.18 text inside a text":        {frame(false, 0, opText, []byte("a")), frame(true, 0, opText, []byte("b"))},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := connect(t, addr, "")
+			c.send(bad...)
+			c.expectClose(CloseProtocolError)
+		})
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	addr := startEchoServer(t, &Upgrader{})
+
+	// Test: Case 6.3, text that isn't UTF-8 closes with 1007
+	for name, frames := range map[string][][]byte{
+		"single frame":          {frame(true, 0, opText, []byte("\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xed\xa0\x80edited"))},
+		"fragmented":            {frame(false, 0, opText, []byte("ok so far")), frame(true, 0, opContinuation, []byte{0xff})},
+		"truncated at the end":  {frame(true, 0, opText, []byte("\xe2\x82"))},
+		"overlong encoding":     {frame(true, 0, opText, []byte{0xc0, 0xaf})},
+		"7.5.1 in close reason": {closeFrame(CloseNormalClosure, "\xff\xfe")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := connect(t, addr, "")
+			c.send(frames...)
+			c.expectClose(CloseInvalidPayloadData)
+		})
+	}
+
+	// Test: Binary messages aren't checked
+	c := connect(t, addr, "")
+	c.send(frame(true, 0, opBinary, []byte{0xff, 0xfe}))
+	c.expectMessage(opBinary, []byte{0xff, 0xfe})
+}
+
+func TestClose(t *testing.T) {
+	addr := startEchoServer(t, &Upgrader{})
+
+	// Test: Case 7.1.1, the close code is echoed and the server hangs up
+	c := connect(t, addr, "")
+	c.send(frame(true, 0, opText, []byte("bye")))
+	c.expectMessage(opText, []byte("bye"))
+	c.send(closeFrame(CloseGoingAway, "see you"))
+	c.expectClose(CloseGoingAway)
+
+	// Test: Case 7.3.1, an empty close is answered with an empty close
+	c = connect(t, addr, "")
+	c.send(frame(true, 0, opClose, nil))
+	c.expectClose(0)
+
+	// Test: Case 7.1.3, nothing after the close frame is looked at
+	c = connect(t, addr, "")
+	c.send(closeFrame(CloseNormalClosure, ""), frame(true, 0, opText, []byte("too late")), frame(true, 0, opPing, nil))
+	c.expectClose(CloseNormalClosure)
+
+	// Test: Case 7.7, valid close codes
+	for _, code := range []int{1000, 1001, 1002, 1003, 1007, 1008, 1009, 1010, 1011, 3000, 3999, 4000, 4999} {
+		c := connect(t, addr, "")
+		c.send(closeFrame(code, ""))
+		c.expectClose(code)
+	}
+
+	// Test: Case 7.3.2 and 7.9, bad close frames get 1002
+	for _, bad := range [][]byte{
+		frame(true, 0, opClose, []byte{0x03}),
+		closeFrame(0, ""),
+		closeFrame(999, ""),
+		closeFrame(1004, ""),
+		closeFrame(1005, ""),
+		closeFrame(1006, ""),
+		closeFrame(1016, ""),
+		closeFrame(2999, ""),
+		closeFrame(5000, ""),
+		closeFrame(CloseNormalClosure, strings.Repeat("x", 124)),
+	} {
+		c := connect(t, addr, "")
+		c.send(bad)
+		c.expectClose(CloseProtocolError)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	closeErrors := make(chan error, 1)
+	srv, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		conn, err := (&Upgrader{}).Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(TextMessage, []byte("closing now"))
+		closeErrors <- conn.Close(CloseGoingAway, "restarting")
+		closeErrors <- conn.WriteMessage(TextMessage, []byte("no"))
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// Test: Close waits for the client's close frame, dropping messages
+	c := connect(t, srv.Addr().String(), "")
+	c.expectMessage(opText, []byte("closing now"))
+	h, payload := c.readFrame()
+	assert.Equal(t, byte(opClose), h.opcode)
+	assert.Equal(t, closePayload(CloseGoingAway, "restarting"), payload)
+	c.send(frame(true, 0, opText, []byte("ignored")), frame(true, 0, opPing, nil), closeFrame(CloseGoingAway, ""))
+	rest, _ := io.ReadAll(c.br)
+	assert.Empty(t, rest)
+	assert.NoError(t, <-closeErrors)
+	assert.ErrorIs(t, <-closeErrors, ErrCloseSent)
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	addr := startEchoServer(t, &Upgrader{MaxMessageSize: 1000})
+
+	// Test: Case 9 style limits, at the limit is fine
+	c := connect(t, addr, "")
+	c.send(frame(true, 0, opBinary, make([]byte, 1000)))
+	c.expectMessage(opBinary, make([]byte, 1000))
+
+	// Test: Over it closes with 1009, in one frame or several
+	c.send(frame(true, 0, opBinary, make([]byte, 1001)))
+	c.expectClose(CloseMessageTooBig)
+	c = connect(t, addr, "")
+	c.send(frame(false, 0, opBinary, make([]byte, 600)), frame(true, 0, opContinuation, make([]byte, 600)))
+	c.expectClose(CloseMessageTooBig)
+
+	// Test: A length over the limit is refused before its payload arrives
+	c = connect(t, addr, "")
+	c.send([]byte{0x82, 0xFF, 0, 0, 0, 1, 0, 0, 0, 0, 1, 2, 3, 4})
+	c.expectClose(CloseMessageTooBig)
+}